@@ -0,0 +1,277 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"go.mau.fi/mautrix-imessage/database"
+	"go.mau.fi/mautrix-imessage/imessage"
+	"go.mau.fi/mautrix-imessage/ipc"
+)
+
+const (
+	backfillQueuePollInterval = 1 * time.Minute
+	backfillRetryBaseDelay    = 30 * time.Second
+	backfillRetryMaxDelay     = 30 * time.Minute
+
+	backfillPriorityPrivateChat = 1000
+	// Media uploads always go after message backfills
+	backfillPriorityMediaPenalty = 10000
+	backfillMaxMemberPenalty     = 500
+	backfillMaxAgePenalty        = 365
+)
+
+// backfillPriority returns the queue priority of the portal. DMs come first,
+// then chats are ordered by how recently they were active and how big they are.
+func (portal *Portal) backfillPriority() int {
+	var priority int
+	if portal.IsPrivateChat() {
+		priority += backfillPriorityPrivateChat
+	} else if len(portal.MXID) > 0 {
+		members, err := portal.bridge.StateStore.GetRoomJoinedOrInvitedMembers(portal.MXID)
+		if err != nil {
+			portal.log.Warnfln("Failed to get member count for backfill priority: %v", err)
+		}
+		if len(members) > backfillMaxMemberPenalty {
+			priority -= backfillMaxMemberPenalty
+		} else {
+			priority -= len(members)
+		}
+	}
+	ageDays := backfillMaxAgePenalty
+	if lastMessage := portal.bridge.DB.Message.GetLastInChat(portal.GUID, portal.Receiver); lastMessage != nil {
+		ageDays = int(time.Since(lastMessage.Time()) / (24 * time.Hour))
+		if ageDays > backfillMaxAgePenalty {
+			ageDays = backfillMaxAgePenalty
+		}
+	}
+	return priority - ageDays
+}
+
+func (portal *Portal) enqueueBackfill(jobType database.BackfillJobType, maxMessages int) {
+	job := portal.bridge.DB.BackfillQueue.New()
+	job.PortalGUID = portal.GUID
+	job.Receiver = portal.Receiver
+	job.Type = jobType
+	job.Priority = portal.backfillPriority()
+	if jobType == database.BackfillJobMedia {
+		job.Priority -= backfillPriorityMediaPenalty
+	}
+	job.MaxMessages = maxMessages
+	if job.Insert() {
+		portal.log.Debugfln("Queued %s backfill job #%d with priority %d", jobType, job.ID, job.Priority)
+		portal.user.wakeBackfillQueue()
+	}
+}
+
+func (user *User) wakeBackfillQueue() {
+	select {
+	case user.backfillQueueWake <- struct{}{}:
+	default:
+	}
+}
+
+// startBackfillQueue starts the background backfill worker of the user if it isn't running yet.
+func (user *User) startBackfillQueue() {
+	if !user.bridge.Config.Bridge.Backfill.Enable {
+		return
+	}
+	user.backfillQueueOnce.Do(func() {
+		go user.runBackfillQueue()
+	})
+}
+
+func (user *User) runBackfillQueue() {
+	// Jobs are processed one at a time and the delay limits how often each connector is queried.
+	// With additional connectors, jobs of one connector don't have to wait for the delay of another.
+	delay := time.Duration(user.bridge.Config.Bridge.Backfill.Queue.Delay) * time.Second
+	throttledUntil := make(map[*imessage.PlatformConfig]time.Time)
+	user.log.Debugln("Starting backfill queue")
+	for !user.bridge.stopping {
+		job, wait := user.getNextBackfillJob(throttledUntil)
+		if job == nil {
+			user.waitForBackfillJob(wait)
+			continue
+		}
+		connector := user.GetConnectorConfig().ForChat(job.PortalGUID)
+		user.processBackfillJob(job)
+		throttledUntil[connector] = time.Now().Add(delay)
+	}
+}
+
+// getNextBackfillJob returns the highest priority job that is ready to run on a connector that isn't throttled.
+// If there's no such job, it returns how long to wait until one becomes ready.
+func (user *User) getNextBackfillJob(throttledUntil map[*imessage.PlatformConfig]time.Time) (*database.BackfillJob, time.Duration) {
+	now := time.Now()
+	wait := backfillQueuePollInterval
+	for _, job := range user.bridge.DB.BackfillQueue.GetAll(user.Receiver) {
+		readyAt := job.NextAttempt
+		if until := throttledUntil[user.GetConnectorConfig().ForChat(job.PortalGUID)]; until.After(readyAt) {
+			readyAt = until
+		}
+		if !readyAt.After(now) {
+			return job, 0
+		} else if untilReady := readyAt.Sub(now); untilReady < wait {
+			wait = untilReady
+		}
+	}
+	return nil, wait
+}
+
+func (user *User) waitForBackfillJob(wait time.Duration) {
+	if wait < time.Second {
+		wait = time.Second
+	}
+	select {
+	case <-user.backfillQueueWake:
+	case <-time.After(wait):
+	}
+}
+
+func (user *User) processBackfillJob(job *database.BackfillJob) {
+	portal := user.GetPortalByGUIDIfExists(job.PortalGUID)
+	if portal == nil || len(portal.MXID) == 0 {
+		user.log.Debugfln("Dropping %s backfill job #%d for %s: portal doesn't have a room", job.Type, job.ID, job.PortalGUID)
+		job.Delete()
+		return
+	}
+	portal.log.Debugfln("Running %s backfill job #%d (attempt %d)", job.Type, job.ID, job.Attempts+1)
+	var done bool
+	var err error
+	switch job.Type {
+	case database.BackfillJobForward:
+		err = portal.runForwardBackfillJob()
+		done = err == nil
+	case database.BackfillJobBackward:
+		done, err = portal.runBackwardBackfillJob(job)
+	case database.BackfillJobMedia:
+		done, err = portal.runLazyMediaJob()
+	default:
+		err = fmt.Errorf("unknown job type %q", job.Type)
+	}
+	if err != nil {
+		user.handleBackfillJobError(portal, job, err)
+	} else if done {
+		portal.log.Debugfln("Finished %s backfill job #%d", job.Type, job.ID)
+		job.Delete()
+	} else {
+		job.Attempts = 0
+		job.LastError = ""
+		job.Update()
+	}
+}
+
+// runForwardBackfillJob bridges missed messages in chunks of the queue batch size. The backfill lock is only held
+// while sending each chunk, so that live messages don't have to wait behind the whole backlog.
+func (portal *Portal) runForwardBackfillJob() (err error) {
+	defer func() {
+		if panicErr := recover(); panicErr != nil {
+			portal.log.Errorfln("Panic in forward backfill job: %v\n%s", panicErr, debug.Stack())
+			err = fmt.Errorf("backfill panicked: %v", panicErr)
+		}
+	}()
+	messages, backfillID, remaining, err := portal.fetchForwardBackfill()
+	if err != nil {
+		return err
+	}
+	sendChunk := func(chunk []*imessage.Message, remaining int) error {
+		portal.log.Debugln("Locking backfill (queue)")
+		portal.lockBackfill()
+		defer func() {
+			portal.log.Debugln("Unlocking backfill (queue)")
+			portal.unlockBackfill()
+		}()
+		return portal.sendForwardBackfill(backfillID, portal.skipBridgedMessages(chunk), remaining)
+	}
+	limit := portal.bridge.Config.Bridge.Backfill.Queue.BatchSize
+	for len(messages) > limit {
+		err = sendChunk(messages[:limit], 0)
+		if err != nil {
+			return err
+		}
+		messages = messages[limit:]
+	}
+	return sendChunk(messages, remaining)
+}
+
+// skipBridgedMessages removes messages that were bridged while the backfill lock wasn't held.
+func (portal *Portal) skipBridgedMessages(messages []*imessage.Message) []*imessage.Message {
+	filtered := messages[:0:0]
+	for _, msg := range messages {
+		if portal.bridge.DB.Message.GetByGUID(msg.ChatGUID, portal.Receiver, msg.GUID, 0) == nil {
+			filtered = append(filtered, msg)
+		}
+	}
+	return filtered
+}
+
+func (portal *Portal) runBackwardBackfillJob(job *database.BackfillJob) (done bool, err error) {
+	defer func() {
+		if panicErr := recover(); panicErr != nil {
+			portal.log.Errorfln("Panic in backward backfill job: %v\n%s", panicErr, debug.Stack())
+			err = fmt.Errorf("backfill panicked: %v", panicErr)
+		}
+	}()
+	limit := portal.bridge.Config.Bridge.Backfill.Queue.BatchSize
+	if job.MaxMessages > 0 && job.MaxMessages < limit {
+		limit = job.MaxMessages
+	}
+	fetched, bridged, err := portal.backwardBackfill(limit)
+	if err != nil {
+		return false, err
+	}
+	job.MaxMessages -= bridged
+	// A short batch means there's no more history on the connector side. If nothing new was bridged,
+	// the oldest message didn't change and fetching again would return the same batch.
+	return fetched < limit || bridged == 0 || job.MaxMessages <= 0, nil
+}
+
+// isRetryableBackfillError returns true if the error is temporary, such as the connector not responding in time.
+func isRetryableBackfillError(err error) bool {
+	return errors.Is(err, ipc.ErrIPCTimeout) || errors.Is(err, errLazyMediaUploadFailed)
+}
+
+// backfillRetryDelay returns how long to wait before retrying a job that has already failed the given number of times.
+// The delay is doubled after every attempt, up to the maximum delay.
+func backfillRetryDelay(attempts int) time.Duration {
+	delay := backfillRetryBaseDelay
+	for i := 0; i < attempts && delay < backfillRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > backfillRetryMaxDelay {
+		delay = backfillRetryMaxDelay
+	}
+	return delay
+}
+
+func (user *User) handleBackfillJobError(portal *Portal, job *database.BackfillJob, err error) {
+	if !isRetryableBackfillError(err) || job.Attempts >= user.bridge.Config.Bridge.Backfill.Queue.MaxRetries {
+		portal.log.Errorfln("Dropping %s backfill job #%d after %d attempts: %v", job.Type, job.ID, job.Attempts+1, err)
+		job.Delete()
+		return
+	}
+	retryDelay := backfillRetryDelay(job.Attempts)
+	job.Attempts++
+	job.LastError = err.Error()
+	job.NextAttempt = time.Now().Add(retryDelay)
+	job.Update()
+	portal.log.Warnfln("%s backfill job #%d failed, retrying in %s: %v", job.Type, job.ID, retryDelay, err)
+}
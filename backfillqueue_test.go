@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.mau.fi/mautrix-imessage/ipc"
+)
+
+func TestBackfillRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{0, 30 * time.Second},
+		{1, 1 * time.Minute},
+		{2, 2 * time.Minute},
+		{5, 16 * time.Minute},
+		{6, 30 * time.Minute},
+		{100, 30 * time.Minute},
+	}
+	for _, test := range tests {
+		if delay := backfillRetryDelay(test.attempts); delay != test.expected {
+			t.Errorf("backfillRetryDelay(%d) returned %s, expected %s", test.attempts, delay, test.expected)
+		}
+	}
+}
+
+func TestIsRetryableBackfillError(t *testing.T) {
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{ipc.ErrIPCTimeout, true},
+		{fmt.Errorf("failed to fetch messages: %w", ipc.ErrIPCTimeout), true},
+		{fmt.Errorf("%w abc in def: server error", errLazyMediaUploadFailed), true},
+		{errors.New("failed to send messages to Matrix"), false},
+		{ipc.ErrNotFound, false},
+	}
+	for _, test := range tests {
+		if retryable := isRetryableBackfillError(test.err); retryable != test.retryable {
+			t.Errorf("isRetryableBackfillError(%v) returned %t, expected %t", test.err, retryable, test.retryable)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const defaultBackwardBackfillLimit = 100
+
+var (
+	errBackwardBackfillNeedsMSC2716 = errors.New("backfilling older messages requires MSC2716 to be enabled")
+	errBackwardBackfillNoBatchID    = errors.New("the room doesn't have a known point to insert older messages at")
+	errBackwardBackfillNoMessages   = errors.New("no messages have been bridged to the room yet")
+)
+
+// BackwardBackfill fetches up to limit messages older than the oldest bridged message in the portal
+// and inserts them at the start of the room with MSC2716 batch sending. It returns the number of
+// messages that were bridged.
+func (portal *Portal) BackwardBackfill(limit int) (int, error) {
+	_, bridged, err := portal.backwardBackfill(limit)
+	return bridged, err
+}
+
+// backwardBackfill is BackwardBackfill, but it also returns the number of messages fetched from the connector,
+// which includes messages that were skipped because they had already been bridged.
+func (portal *Portal) backwardBackfill(limit int) (fetched, bridged int, err error) {
+	if !portal.bridge.Config.Bridge.Backfill.MSC2716 {
+		return 0, 0, errBackwardBackfillNeedsMSC2716
+	} else if len(portal.MXID) == 0 {
+		return 0, 0, errors.New("portal doesn't have a Matrix room")
+	}
+	if limit <= 0 {
+		limit = defaultBackwardBackfillLimit
+	}
+	// Older messages are inserted at the start of the room, so new messages don't need to wait for them.
+	portal.backwardBackfillLock.Lock()
+	defer portal.backwardBackfillLock.Unlock()
+	if len(portal.NextBatchID) == 0 {
+		return 0, 0, errBackwardBackfillNoBatchID
+	}
+	oldest := portal.bridge.DB.Message.GetFirstInChat(portal.GUID, portal.Receiver)
+	if oldest == nil {
+		return 0, 0, errBackwardBackfillNoMessages
+	}
+
+	backfillID := fmt.Sprintf("bridge-backward-%s::%s::%d", portal.Identifier.LocalID, oldest.GUID, time.Now().UnixMilli())
+	portal.log.Debugfln("Fetching up to %d messages before %s (%s) for backward backfill", limit, oldest.GUID, oldest.Time())
+	messages, err := portal.user.IM.GetMessagesBefore(portal.GUID, oldest.GUID, oldest.Time(), limit, backfillID)
+	if err != nil {
+		go portal.user.IM.SendBackfillResult(portal.GUID, backfillID, false, nil)
+		return 0, 0, fmt.Errorf("failed to fetch older messages: %w", err)
+	}
+	filtered := messages[:0]
+	for _, msg := range messages {
+		if portal.bridge.DB.Message.GetLastByGUID(portal.GUID, portal.Receiver, msg.GUID) != nil {
+			portal.log.Debugfln("Skipping already bridged message %s in backward backfill", msg.GUID)
+			continue
+		}
+		filtered = append(filtered, msg)
+	}
+	if len(filtered) == 0 {
+		portal.log.Debugln("No older messages to backfill")
+		go portal.user.IM.SendBackfillResult(portal.GUID, backfillID, true, nil)
+		return len(messages), 0, nil
+	}
+	if !portal.sendBackfill(backfillID, filtered, false) {
+		return len(messages), 0, errors.New("failed to send older messages to Matrix")
+	}
+	return len(messages), len(filtered), nil
+}
@@ -29,9 +29,10 @@ const bridgeInfoService = "fi.mau.imessage.service"
 type CustomBridgeInfoSection struct {
 	event.BridgeInfoSection
 
-	GUID    string `json:"fi.mau.imessage.guid,omitempty"`
-	Service string `json:"fi.mau.imessage.service,omitempty"`
-	IsGroup bool   `json:"fi.mau.imessage.is_group,omitempty"`
+	GUID     string `json:"fi.mau.imessage.guid,omitempty"`
+	Receiver string `json:"fi.mau.imessage.receiver,omitempty"`
+	Service  string `json:"fi.mau.imessage.service,omitempty"`
+	IsGroup  bool   `json:"fi.mau.imessage.is_group,omitempty"`
 
 	SendStatusStart int64  `json:"com.beeper.send_status_start,omitempty"`
 	TimeoutSeconds  int    `json:"com.beeper.timeout_seconds,omitempty"`
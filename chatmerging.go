@@ -9,22 +9,63 @@ import (
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 
+	"go.mau.fi/mautrix-imessage/database"
 	"go.mau.fi/mautrix-imessage/imessage"
 )
 
-func (br *IMBridge) UpdateMerges(contacts []*imessage.Contact) {
-	br.Log.Infofln("Updating chat merges with %d contacts", len(contacts))
+// MergePlanPortal is an existing portal that would be merged into the target portal.
+type MergePlanPortal struct {
+	GUID         string    `json:"guid"`
+	MXID         id.RoomID `json:"mxid,omitempty"`
+	MessageCount int64     `json:"message_count"`
+}
+
+// MergePlan describes the merge that UpdateMerges does for a single contact.
+type MergePlan struct {
+	Contact string `json:"contact"`
+	Target  string `json:"target"`
+	// Existing portals that will be merged into the target portal
+	Sources []MergePlanPortal `json:"sources,omitempty"`
+	// Chat GUIDs that don't have portals yet, which will only be marked as merged in the database
+	WithoutPortal []string `json:"without_portal,omitempty"`
+	// The total number of messages that will be moved to the target portal
+	MessageCount int64 `json:"message_count"`
+
+	targetPortal  *Portal
+	sourcePortals []*Portal
+}
+
+// UpdateMerges merges the portals of all the identifiers of each contact. If dryRun is true,
+// the merges are only planned and returned without changing anything.
+func (user *User) UpdateMerges(contacts []*imessage.Contact, dryRun bool) []*MergePlan {
+	user.log.Infofln("Updating chat merges with %d contacts (dry run: %t)", len(contacts), dryRun)
+	plans := user.planMerges(contacts)
+	if dryRun {
+		return plans
+	}
+	for _, plan := range plans {
+		user.executeMergePlan(plan)
+	}
+	user.log.Infoln("Finished merging with contact list")
+	return plans
+}
 
+func (user *User) planMerges(contacts []*imessage.Contact) []*MergePlan {
+	optedOut := user.bridge.DB.MergeOptOut.GetAll(user.Receiver)
 	alreadyHandledGUIDs := make(map[string]struct{}, len(contacts)*2)
-	portals := make([]*Portal, 0, 16)
-	noPortals := make([]string, 0, 16)
-	collect := func(localID string) {
-		guid := imessage.Identifier{Service: "iMessage", LocalID: localID}.String()
+	var plans []*MergePlan
+	var portals []*Portal
+	var noPortals []string
+	// When SMS chats are handled by a separate connector, they have their own portals,
+	// which should be merged with the iMessage portals of the same contact.
+	mergeSMS := len(user.GetConnectorConfig().AdditionalConnectors) > 0
+	collect := func(service, localID string) {
+		guid := imessage.Identifier{Service: service, LocalID: localID}.String()
 		if _, alreadyHandled := alreadyHandledGUIDs[guid]; alreadyHandled {
 			return
 		}
 		alreadyHandledGUIDs[guid] = struct{}{}
-		portal := br.GetPortalByGUIDIfExists(guid)
+		portal := user.GetPortalByGUIDIfExists(guid)
 		if portal == nil {
 			noPortals = append(noPortals, guid)
 		} else if portal.GUID == guid {
@@ -32,21 +73,39 @@ func (br *IMBridge) UpdateMerges(contacts []*imessage.Contact) {
 		} // else: the ID has already been merged into something else, so ignore it for now
 	}
 
+Contacts:
 	for _, contact := range contacts {
-		portals = portals[:0]
-		noPortals = noPortals[:0]
+		portals = nil
+		noPortals = nil
 
-		// Find all the portals from the contact (except ones that have already been merged into another GUID)
+		phones := make([]string, 0, len(contact.Phones))
 		for _, phone := range contact.Phones {
+			phone = user.bridge.NormalizeLocalID(phone)
 			if !strings.HasPrefix(phone, "+") {
+				// Not a valid phone number even after normalization
 				continue
 			}
-			collect(phone)
+			phones = append(phones, phone)
+		}
+		for _, identifier := range append(phones, contact.Emails...) {
+			if _, isOptedOut := optedOut[user.bridge.normalizeOptOutIdentifier(identifier)]; isOptedOut {
+				user.log.Debugfln("Not merging chats of %s, as %s has opted out of merging", contact.Name(), identifier)
+				continue Contacts
+			}
+		}
+
+		// Find all the portals from the contact (except ones that have already been merged into another GUID)
+		for _, phone := range phones {
+			collect("iMessage", phone)
+			if mergeSMS {
+				collect("SMS", phone)
+			}
 		}
 		for _, email := range contact.Emails {
-			collect(email)
+			collect("iMessage", email)
 		}
 
+		plan := &MergePlan{Contact: contact.Name()}
 		// If we found more than one existing portal, merge them into the best one
 		if len(portals) > 1 {
 			bestPortal := portals[0]
@@ -62,24 +121,52 @@ func (br *IMBridge) UpdateMerges(contacts []*imessage.Contact) {
 				}
 			}
 			portals[bestPortalIndex], portals[0] = portals[0], portals[bestPortalIndex]
-			bestPortal.Merge(portals[1:])
+			plan.targetPortal = portals[0]
+			plan.sourcePortals = portals[1:]
+			for _, portal := range plan.sourcePortals {
+				count := user.bridge.DB.Message.CountInChat(portal.GUID, portal.Receiver)
+				plan.Sources = append(plan.Sources, MergePlanPortal{GUID: portal.GUID, MXID: portal.MXID, MessageCount: count})
+				plan.MessageCount += count
+			}
 		}
 		// If we found any identifiers without a portal, just mark them as merged in the database.
 		if len(noPortals) > 1 || (len(noPortals) == 1 && len(portals) > 0) {
-			var targetPortal *Portal
-			mergeList := noPortals
 			if len(portals) == 0 {
-				targetPortal = br.GetPortalByGUID(noPortals[0])
-				mergeList = noPortals[1:]
+				plan.Target = noPortals[0]
+				plan.WithoutPortal = noPortals[1:]
 			} else {
-				targetPortal = portals[0]
+				plan.targetPortal = portals[0]
+				plan.WithoutPortal = noPortals
 			}
-			br.Log.Debugfln("Merging %v (with no portals created) into portal %s", mergeList, targetPortal.GUID)
-			br.DB.MergedChat.Set(nil, targetPortal.GUID, mergeList...)
-			targetPortal.addSecondaryGUIDs(mergeList)
 		}
+		if plan.targetPortal != nil {
+			plan.Target = plan.targetPortal.GUID
+		}
+		if len(plan.Sources) > 0 || len(plan.WithoutPortal) > 0 {
+			plans = append(plans, plan)
+		}
+	}
+	return plans
+}
+
+func (user *User) executeMergePlan(plan *MergePlan) {
+	if len(plan.sourcePortals) > 0 {
+		plan.targetPortal.Merge(plan.sourcePortals)
+	}
+	if len(plan.WithoutPortal) > 0 {
+		targetPortal := plan.targetPortal
+		if targetPortal == nil {
+			targetPortal = user.GetPortalByGUID(plan.Target)
+		}
+		user.log.Debugfln("Merging %v (with no portals created) into portal %s", plan.WithoutPortal, targetPortal.GUID)
+		before := layoutOf(targetPortal)
+		for _, guid := range plan.WithoutPortal {
+			before[guid] = []string{guid}
+		}
+		user.bridge.DB.MergedChat.Set(nil, targetPortal.GUID, targetPortal.Receiver, plan.WithoutPortal...)
+		targetPortal.addSecondaryGUIDs(plan.WithoutPortal)
+		user.recordMergeHistory(database.MergeActionMerge, before, layoutOf(targetPortal))
 	}
-	br.Log.Infoln("Finished merging with contact list")
 }
 
 func (portal *Portal) Merge(others []*Portal) {
@@ -108,6 +195,7 @@ func (portal *Portal) Merge(others []*Portal) {
 	if portal.MXID != "" {
 		roomIDs = append(roomIDs, portal.MXID)
 	}
+	before := layoutOf(append([]*Portal{portal}, others...)...)
 	var newRoomID id.RoomID
 	var req *mautrix.ReqBeeperMergeRoom
 	portal.log.Debugfln("Merging room with %v (%v)", guids, roomIDs)
@@ -134,6 +222,12 @@ func (portal *Portal) Merge(others []*Portal) {
 		portal.log.Debugfln("Using old room ID as new one")
 		newRoomID = roomIDs[0]
 	}
+	for _, other := range others {
+		if other != portal {
+			// The space rows of the other portals are deleted along with the portals
+			other.removeFromSpaces()
+		}
+	}
 	portal.bridge.portalsLock.Lock()
 	defer portal.bridge.portalsLock.Unlock()
 
@@ -143,11 +237,11 @@ func (portal *Portal) Merge(others []*Portal) {
 		return
 	}
 	portal.log.Debugln("Updating portal GUIDs in message table")
-	portal.bridge.DB.Message.MergePortalGUID(txn, portal.GUID, guids...)
+	portal.bridge.DB.Message.MergePortalGUID(txn, portal.GUID, portal.Receiver, guids...)
 	portal.log.Debugln("Updating merged chat table")
-	portal.bridge.DB.MergedChat.Set(txn, portal.GUID, guids...)
+	portal.bridge.DB.MergedChat.Set(txn, portal.GUID, portal.Receiver, guids...)
 	for _, guid := range guids {
-		portal.bridge.portalsByGUID[guid] = portal
+		portal.bridge.portalsByGUID[portalKey{guid, portal.Receiver}] = portal
 	}
 	portal.addSecondaryGUIDs(guids)
 	if newRoomID != "" {
@@ -166,9 +260,10 @@ func (portal *Portal) Merge(others []*Portal) {
 		portal.log.Errorln("Failed to commit room merge transaction:", err)
 	} else {
 		portal.log.Infofln("Finished merging %v -> %s / %v -> %s", guids, portal.GUID, roomIDs, newRoomID)
+		portal.user.recordMergeHistory(database.MergeActionMerge, before, layoutOf(portal))
 		if newRoomID != "" {
-			portal.addToSpace(portal.bridge.user)
-			portal.bridge.user.UpdateDirectChats(map[id.UserID][]id.RoomID{portal.GetDMPuppet().MXID: {portal.MXID}})
+			portal.addToSpace(portal.user)
+			portal.user.UpdateDirectChats(map[id.UserID][]id.RoomID{portal.GetDMPuppet().MXID: {portal.MXID}})
 			for _, user := range req.NewRoom.Invite {
 				portal.bridge.StateStore.SetMembership(portal.MXID, user, event.MembershipJoin)
 			}
@@ -182,6 +277,7 @@ func (portal *Portal) Split(splitParts map[string][]string) {
 	reqParts := make([]mautrix.BeeperSplitRoomPart, len(splitParts))
 	portals := make(map[string]*Portal, len(splitParts))
 	portalReq := make(map[string]*mautrix.BeeperSplitRoomPart, len(splitParts))
+	before := layoutOf(portal)
 	br.portalsLock.Lock()
 	defer br.portalsLock.Unlock()
 	txn, err := br.DB.Begin()
@@ -189,6 +285,7 @@ func (portal *Portal) Split(splitParts map[string][]string) {
 		log.Errorln("Failed to begin transaction to split rooms:", err)
 		return
 	}
+	var movedGUIDs []string
 	i := -1
 	for primaryGUID, guids := range splitParts {
 		guids = append(guids, primaryGUID)
@@ -205,9 +302,9 @@ func (portal *Portal) Split(splitParts map[string][]string) {
 		}
 		log.Debugfln("Updating merged chat mapping with %v -> %s", guids, primaryGUID)
 		for _, guid := range guids {
-			delete(br.portalsByGUID, guid)
+			delete(br.portalsByGUID, portalKey{guid, portal.Receiver})
 		}
-		partPortal := br.loadDBPortal(txn, nil, primaryGUID)
+		partPortal := portal.user.loadDBPortal(txn, nil, primaryGUID)
 		partPortal.addSecondaryGUIDs(guids)
 		partPortal.LastSeenHandle = primaryGUID
 		partPortal.preCreateDMSync(nil)
@@ -216,13 +313,15 @@ func (portal *Portal) Split(splitParts map[string][]string) {
 		reqParts[i].UserID = partPortal.MainIntent().UserID
 		reqParts[i].NewRoom = *partPortal.getRoomCreateContent()
 		reqParts[i].Values = guids
+		movedGUIDs = append(movedGUIDs, guids...)
 		for _, guid := range guids {
-			br.portalsByGUID[guid] = partPortal
-			res := br.DB.Message.SplitPortalGUID(txn, guid, portal.GUID, primaryGUID)
+			br.portalsByGUID[portalKey{guid, portal.Receiver}] = partPortal
+			res := br.DB.Message.SplitPortalGUID(txn, guid, portal.GUID, portal.Receiver, primaryGUID)
 			log.Debugfln("Moved %d messages with handle %s in portal %s to portal %s", res, guid, portal.GUID, partPortal.GUID)
 		}
-		br.DB.MergedChat.Set(txn, primaryGUID, guids...)
+		br.DB.MergedChat.Set(txn, primaryGUID, portal.Receiver, guids...)
 	}
+	portal.removeSecondaryGUIDs(movedGUIDs)
 	wasSplit := false
 	if portal.bridge.Config.Homeserver.Software == bridgeconfig.SoftwareHungry {
 		var resp *mautrix.RespBeeperSplitRoom
@@ -257,10 +356,19 @@ func (portal *Portal) Split(splitParts map[string][]string) {
 		log.Errorln("Failed to commit room split transaction:", err)
 	}
 	log.Debugfln("Finished splitting room into %+v", splitParts)
+	partPortals := make([]*Portal, 0, len(portals)+1)
+	if _, ok := portals[portal.GUID]; !ok {
+		// The source portal wasn't one of the parts, but it still exists with the remaining GUIDs
+		partPortals = append(partPortals, portal)
+	}
+	for _, partPortal := range portals {
+		partPortals = append(partPortals, partPortal)
+	}
+	portal.user.recordMergeHistory(database.MergeActionSplit, before, layoutOf(partPortals...))
 	for guid, partPortal := range portals {
 		if partPortal.MXID != "" {
-			partPortal.addToSpace(br.user)
-			br.user.UpdateDirectChats(map[id.UserID][]id.RoomID{partPortal.GetDMPuppet().MXID: {partPortal.MXID}})
+			partPortal.addToSpace(portal.user)
+			portal.user.UpdateDirectChats(map[id.UserID][]id.RoomID{partPortal.GetDMPuppet().MXID: {partPortal.MXID}})
 			if wasSplit {
 				for _, user := range portalReq[guid].NewRoom.Invite {
 					br.StateStore.SetMembership(partPortal.MXID, user, event.MembershipJoin)
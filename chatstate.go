@@ -0,0 +1,155 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/pushrules"
+
+	"go.mau.fi/mautrix-imessage/imessage"
+)
+
+// UpdateChatState applies the mute and archive state of the iMessage chat to the user's Matrix account
+// using the double puppet intent.
+func (portal *Portal) UpdateChatState(state imessage.ChatState) {
+	intent := portal.user.DoublePuppetIntent
+	if len(portal.MXID) == 0 || intent == nil {
+		return
+	}
+	changed := false
+	if state.Muted != nil && portal.bridge.Config.Bridge.MuteBridging && *state.Muted != portal.Muted {
+		err := portal.setMuted(intent, *state.Muted)
+		if err != nil {
+			portal.log.Warnfln("Failed to set muted=%t for %s: %v", *state.Muted, portal.user.MXID, err)
+		} else {
+			portal.log.Debugfln("Set muted=%t for %s", *state.Muted, portal.user.MXID)
+			portal.Muted = *state.Muted
+			changed = true
+		}
+	}
+	if state.Archived != nil && len(portal.bridge.Config.Bridge.ArchiveTag) > 0 && *state.Archived != portal.Archived {
+		err := portal.setArchived(intent, *state.Archived)
+		if err != nil {
+			portal.log.Warnfln("Failed to set archived=%t for %s: %v", *state.Archived, portal.user.MXID, err)
+		} else {
+			portal.log.Debugfln("Set archived=%t for %s", *state.Archived, portal.user.MXID)
+			portal.Archived = *state.Archived
+			changed = true
+		}
+	}
+	if changed {
+		portal.Update(nil)
+	}
+}
+
+func (portal *Portal) setMuted(intent *appservice.IntentAPI, muted bool) error {
+	if muted {
+		return intent.PutPushRule("global", pushrules.RoomRule, string(portal.MXID), &mautrix.ReqPutPushRule{
+			Actions: []pushrules.PushActionType{pushrules.ActionDontNotify},
+		})
+	}
+	err := intent.DeletePushRule("global", pushrules.RoomRule, string(portal.MXID))
+	if errors.Is(err, mautrix.MNotFound) {
+		err = nil
+	}
+	return err
+}
+
+func (portal *Portal) setArchived(intent *appservice.IntentAPI, archived bool) error {
+	tag := portal.bridge.Config.Bridge.ArchiveTag
+	if archived {
+		return intent.AddTagWithCustomData(portal.MXID, tag, map[string]interface{}{
+			appservice.DoublePuppetKey: portal.bridge.Name,
+		})
+	}
+	return intent.RemoveTag(portal.MXID, tag)
+}
+
+// HandleMatrixChatState stores mute and archive changes made on Matrix and sends them to the connector.
+// Fields that match the already known state are ignored, which also filters out echoes of UpdateChatState.
+func (portal *Portal) HandleMatrixChatState(state imessage.ChatState) {
+	changed := false
+	if state.Muted != nil && *state.Muted != portal.Muted {
+		portal.Muted = *state.Muted
+		changed = true
+	} else {
+		state.Muted = nil
+	}
+	if state.Archived != nil && *state.Archived != portal.Archived {
+		portal.Archived = *state.Archived
+		changed = true
+	} else {
+		state.Archived = nil
+	}
+	if !changed {
+		return
+	}
+	portal.Update(nil)
+	if !portal.capabilities().ChatStateSync {
+		portal.log.Debugln("Not sending chat state change to connector: not supported")
+		return
+	}
+	portal.log.Debugfln("Sending chat state change from Matrix to connector (muted: %v, archived: %v)", boolPtrString(state.Muted), boolPtrString(state.Archived))
+	err := portal.user.IM.SetChatState(portal.GUID, state)
+	if err != nil {
+		portal.log.Warnfln("Failed to send chat state change to connector: %v", err)
+	}
+}
+
+func boolPtrString(val *bool) string {
+	if val == nil {
+		return "unchanged"
+	} else if *val {
+		return "true"
+	}
+	return "false"
+}
+
+func (user *User) handleTagEvent(portal *Portal, evt *event.Event) {
+	_, archived := evt.Content.AsTag().Tags[user.bridge.Config.Bridge.ArchiveTag]
+	portal.HandleMatrixChatState(imessage.ChatState{Archived: &archived})
+}
+
+func (user *User) handlePushRulesEvent(evt *event.Event) {
+	ruleset, err := pushrules.EventToPushRules(evt)
+	if err != nil {
+		user.log.Warnfln("Failed to parse push rules: %v", err)
+		return
+	} else if ruleset == nil {
+		return
+	}
+	for _, portal := range user.GetAllPortals() {
+		muted := isMutingRule(ruleset.Room.Map[string(portal.MXID)])
+		portal.HandleMatrixChatState(imessage.ChatState{Muted: &muted})
+	}
+}
+
+func isMutingRule(rule *pushrules.PushRule) bool {
+	if rule == nil || !rule.Enabled {
+		return false
+	}
+	for _, action := range rule.Actions {
+		if action.Action == pushrules.ActionNotify {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,649 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-imessage/database"
+)
+
+// checkPortalOwner makes sure that the portal of the command belongs to the user running it,
+// so that users can't change the chats of other bridge users. Admins can manage all portals.
+func checkPortalOwner(ce *commands.Event) bool {
+	portal := ce.Portal.(*Portal)
+	if portal.user != ce.User.(*User) && ce.User.GetPermissionLevel() < bridgeconfig.PermissionLevelAdmin {
+		ce.Reply("This chat belongs to another bridge user")
+		return false
+	}
+	return true
+}
+
+var cmdLogin = &commands.FullHandler{
+	Func: fnLogin,
+	Name: "login",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAuth,
+		Description: "Start your iMessage connector after logging out.",
+	},
+}
+
+func fnLogin(ce *commands.Event) {
+	user := ce.User.(*User)
+	if user.connectorConfig == nil {
+		ce.Reply("You don't have an iMessage connector configured")
+		return
+	} else if user.IsConnected() {
+		ce.Reply("You're already logged in")
+		return
+	}
+	err := user.initConnector()
+	if err != nil {
+		user.log.Errorln("Failed to initialize iMessage connector:", err)
+		ce.Reply("Failed to initialize iMessage connector: %v", err)
+		return
+	}
+	user.LoggedOut = false
+	user.Update()
+	ce.Reply("Connecting to iMessage...")
+	go func() {
+		err = user.Connect(func() {
+			ce.Reply("Successfully connected to iMessage")
+			go user.StartupSync()
+		})
+		if err != nil {
+			user.log.Errorln("Error in iMessage connection:", err)
+			ce.Reply("Error in iMessage connection: %v", err)
+		}
+	}()
+}
+
+var cmdLogout = &commands.FullHandler{
+	Func: fnLogout,
+	Name: "logout",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAuth,
+		Description: "Stop your iMessage connector. Other bridge users are not affected.",
+	},
+}
+
+func fnLogout(ce *commands.Event) {
+	user := ce.User.(*User)
+	if user.connectorConfig == nil {
+		ce.Reply("You don't have an iMessage connector configured")
+		return
+	} else if user.LoggedOut {
+		ce.Reply("You're not logged in")
+		return
+	} else if platform := user.connectorConfig.Platform; platform == "ios" || platform == "android" {
+		ce.Reply("The %s connector is controlled by the app and can't be stopped from Matrix", platform)
+		return
+	}
+	user.Disconnect()
+	user.LoggedOut = true
+	user.Update()
+	ce.Reply("Stopped your iMessage connector. Use `login` to start it again.")
+}
+
+var cmdSetSendPolicy = &commands.FullHandler{
+	Func: fnSetSendPolicy,
+	Name: "set-send-policy",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "Choose whether messages in this private chat are sent as iMessage, SMS, or iMessage with SMS fallback.",
+		Args:        "<auto|imessage|sms|sms_fallback|default>",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnSetSendPolicy(ce *commands.Event) {
+	if !checkPortalOwner(ce) {
+		return
+	}
+	portal := ce.Portal.(*Portal)
+	if len(ce.Args) == 0 {
+		policy := portal.SendPolicy
+		if policy == "" {
+			policy = fmt.Sprintf("default (%s)", portal.bridge.Config.Bridge.SendPolicy.Default)
+		}
+		ce.Reply("The send policy of this chat is %s. Usage: `set-send-policy <%s|default>`", policy, strings.Join(sendPolicies, "|"))
+		return
+	} else if !portal.IsPrivateChat() {
+		ce.Reply("Send policies can only be changed in private chats")
+		return
+	}
+	newPolicy := strings.ToLower(ce.Args[0])
+	if newPolicy == "default" {
+		newPolicy = ""
+	} else if !isValidSendPolicy(newPolicy) {
+		ce.Reply("Unknown send policy %q. Usage: `set-send-policy <%s|default>`", newPolicy, strings.Join(sendPolicies, "|"))
+		return
+	}
+	portal.SendPolicy = newPolicy
+	portal.Update(nil)
+	if newPolicy == "" {
+		ce.Reply("This chat will now use the default send policy (%s)", portal.bridge.Config.Bridge.SendPolicy.Default)
+	} else {
+		ce.Reply("Changed the send policy of this chat to %s", newPolicy)
+	}
+}
+
+var cmdEditGhost = &commands.FullHandler{
+	Func: fnEditGhost,
+	Name: "edit-ghost",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "Override the name or avatar of the other user in this private chat, or hide their phone number or email from the name and contact info (it's still visible in the Matrix user ID).",
+		Args:        "<name [new name]|avatar [mxc or https URL]|hide-identifier <on|off>|reset>",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+const editGhostUsage = "Usage: `edit-ghost <name [new name]|avatar [mxc or https URL]|hide-identifier <on|off>|reset>`"
+
+func fnEditGhost(ce *commands.Event) {
+	if !checkPortalOwner(ce) {
+		return
+	}
+	portal := ce.Portal.(*Portal)
+	if !portal.IsPrivateChat() {
+		ce.Reply("Ghosts can only be edited in private chats")
+		return
+	}
+	puppet := portal.GetDMPuppet()
+	if puppet == nil {
+		ce.Reply("This private chat doesn't have a ghost")
+		return
+	}
+	if len(ce.Args) == 0 {
+		override := puppet.Override
+		if override.IsEmpty() {
+			ce.Reply("%s doesn't have any overrides. %s", puppet.Displayname, editGhostUsage)
+		} else {
+			ce.Reply("Overrides for %s:\n\n* Name: %q\n* Avatar: %s\n* Hide identifier: %t\n\n%s",
+				puppet.ID, override.Displayname, override.AvatarURL, override.HideIdentifier, editGhostUsage)
+		}
+		return
+	}
+	switch strings.ToLower(ce.Args[0]) {
+	case "name":
+		name := strings.TrimSpace(strings.Join(ce.Args[1:], " "))
+		puppet.EditOverride(func(override *database.PuppetOverride) {
+			override.Displayname = name
+		})
+		if len(name) == 0 {
+			ce.Reply("Removed name override, the name is now %s", puppet.Displayname)
+		} else {
+			ce.Reply("Changed name to %s", puppet.Displayname)
+		}
+	case "avatar":
+		var avatarURL id.ContentURI
+		if len(ce.Args) > 1 {
+			var err error
+			avatarURL, err = puppet.ResolveAvatarURL(ce.Args[1])
+			if err != nil {
+				ce.Reply("Failed to get avatar: %v", err)
+				return
+			}
+		}
+		puppet.EditOverride(func(override *database.PuppetOverride) {
+			override.AvatarURL = avatarURL
+		})
+		if avatarURL.IsEmpty() {
+			ce.Reply("Removed avatar override")
+		} else {
+			ce.Reply("Changed avatar to %s", avatarURL)
+		}
+	case "hide-identifier":
+		if len(ce.Args) < 2 {
+			ce.Reply(editGhostUsage)
+			return
+		}
+		var hide bool
+		switch strings.ToLower(ce.Args[1]) {
+		case "on", "true", "yes":
+			hide = true
+		case "off", "false", "no":
+			hide = false
+		default:
+			ce.Reply(editGhostUsage)
+			return
+		}
+		puppet.EditOverride(func(override *database.PuppetOverride) {
+			override.HideIdentifier = hide
+		})
+		ce.Reply("Changed identifier hiding to %t, the name is now %s", hide, puppet.Displayname)
+	case "reset":
+		puppet.ResetOverride()
+		ce.Reply("Removed all overrides, the name is now %s", puppet.Displayname)
+	default:
+		ce.Reply(editGhostUsage)
+	}
+}
+
+var cmdMergeHistory = &commands.FullHandler{
+	Func: fnMergeHistory,
+	Name: "merge-history",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "List recent chat merges and splits.",
+		Args:        "[limit]",
+	},
+	RequiresLogin: true,
+}
+
+func fnMergeHistory(ce *commands.Event) {
+	user := ce.User.(*User)
+	limit := 10
+	if len(ce.Args) > 0 {
+		var err error
+		limit, err = strconv.Atoi(ce.Args[0])
+		if err != nil || limit <= 0 {
+			ce.Reply("Usage: `merge-history [limit]`")
+			return
+		}
+	}
+	entries := user.bridge.DB.MergeHistory.GetRecent(user.Receiver, limit)
+	if len(entries) == 0 {
+		ce.Reply("No chats have been merged or split")
+		return
+	}
+	lines := make([]string, len(entries))
+	for i, entry := range entries {
+		undone := ""
+		if entry.Undone {
+			undone = " (undone)"
+		}
+		lines[i] = fmt.Sprintf("* #%d %s %s%s: %s → %s", entry.ID, entry.Timestamp.Format("2006-01-02 15:04:05"), entry.Action, undone,
+			formatPortalLayout(entry.Before), formatPortalLayout(entry.After))
+	}
+	ce.Reply("%s\n\nUse `undo-merge <id>` to restore the chats from before a merge or split.", strings.Join(lines, "\n"))
+}
+
+var cmdUndoMerge = &commands.FullHandler{
+	Func: fnUndoMerge,
+	Name: "undo-merge",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "Undo a chat merge or split from the merge history.",
+		Args:        "<id>",
+	},
+	RequiresLogin: true,
+}
+
+func fnUndoMerge(ce *commands.Event) {
+	user := ce.User.(*User)
+	if len(ce.Args) == 0 {
+		ce.Reply("Usage: `undo-merge <id>`")
+		return
+	}
+	entryID, err := strconv.ParseInt(strings.TrimPrefix(ce.Args[0], "#"), 10, 64)
+	if err != nil {
+		ce.Reply("Usage: `undo-merge <id>`")
+		return
+	}
+	err = user.UndoMerge(entryID)
+	if err != nil {
+		ce.Reply("Failed to undo #%d: %v", entryID, err)
+	} else {
+		ce.Reply("Successfully undid #%d", entryID)
+	}
+}
+
+var cmdAutoMerge = &commands.FullHandler{
+	Func: fnAutoMerge,
+	Name: "auto-merge",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "Merge the chats of each contact in your contact list. Use `preview` to only list the planned merges.",
+		Args:        "[preview]",
+	},
+	RequiresLogin: true,
+}
+
+func fnAutoMerge(ce *commands.Event) {
+	user := ce.User.(*User)
+	dryRun := len(ce.Args) > 0 && strings.ToLower(ce.Args[0]) == "preview"
+	contactList, err := user.Contacts.GetContactList()
+	if err != nil {
+		ce.Reply("Failed to get contact list: %v", err)
+		return
+	}
+	plans := user.UpdateMerges(contactList, dryRun)
+	if len(plans) == 0 {
+		ce.Reply("There are no chats to merge")
+		return
+	}
+	lines := make([]string, len(plans))
+	for i, plan := range plans {
+		sources := make([]string, 0, len(plan.Sources)+len(plan.WithoutPortal))
+		for _, source := range plan.Sources {
+			if source.MXID == "" {
+				sources = append(sources, fmt.Sprintf("%s (no room, %d messages)", source.GUID, source.MessageCount))
+			} else {
+				sources = append(sources, fmt.Sprintf("%s (%d messages)", source.GUID, source.MessageCount))
+			}
+		}
+		for _, guid := range plan.WithoutPortal {
+			sources = append(sources, fmt.Sprintf("%s (no portal)", guid))
+		}
+		lines[i] = fmt.Sprintf("* %s: %s → %s", plan.Contact, strings.Join(sources, ", "), plan.Target)
+	}
+	if dryRun {
+		ce.Reply("Planned merges:\n\n%s\n\nUse `merge-opt-out <phone or email>` to exclude contacts, then `auto-merge` to merge.", strings.Join(lines, "\n"))
+	} else {
+		ce.Reply("Merged chats:\n\n%s\n\nUse `merge-history` and `undo-merge` to undo merges.", strings.Join(lines, "\n"))
+	}
+}
+
+var cmdMergeOptOut = &commands.FullHandler{
+	Func: fnMergeOptOut,
+	Name: "merge-opt-out",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "Stop automatically merging the chats of the contact with the given phone number or email, or list opted out identifiers.",
+		Args:        "[phone or email]",
+	},
+	RequiresLogin: true,
+}
+
+func fnMergeOptOut(ce *commands.Event) {
+	user := ce.User.(*User)
+	if len(ce.Args) == 0 {
+		optedOut := user.bridge.DB.MergeOptOut.GetAll(user.Receiver)
+		if len(optedOut) == 0 {
+			ce.Reply("No contacts are opted out of automatic merging")
+			return
+		}
+		identifiers := make([]string, 0, len(optedOut))
+		for identifier := range optedOut {
+			identifiers = append(identifiers, identifier)
+		}
+		sort.Strings(identifiers)
+		ce.Reply("Contacts with these identifiers are not merged automatically:\n\n* %s", strings.Join(identifiers, "\n* "))
+		return
+	}
+	identifier := user.bridge.normalizeOptOutIdentifier(strings.Join(ce.Args, " "))
+	user.bridge.DB.MergeOptOut.Add(user.Receiver, identifier)
+	ce.Reply("Chats of the contact with %s will no longer be merged automatically. Use `merge-history` and `undo-merge` to split already merged chats.", identifier)
+}
+
+var cmdMergeOptIn = &commands.FullHandler{
+	Func: fnMergeOptIn,
+	Name: "merge-opt-in",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "Allow automatically merging the chats of the contact with the given phone number or email again.",
+		Args:        "<phone or email>",
+	},
+	RequiresLogin: true,
+}
+
+func fnMergeOptIn(ce *commands.Event) {
+	user := ce.User.(*User)
+	if len(ce.Args) == 0 {
+		ce.Reply("Usage: `merge-opt-in <phone or email>`")
+		return
+	}
+	identifier := user.bridge.normalizeOptOutIdentifier(strings.Join(ce.Args, " "))
+	if user.bridge.DB.MergeOptOut.Remove(user.Receiver, identifier) {
+		ce.Reply("Chats of the contact with %s will be merged automatically again", identifier)
+	} else {
+		ce.Reply("%s wasn't opted out of automatic merging", identifier)
+	}
+}
+
+var cmdMoveToSpace = &commands.FullHandler{
+	Func: fnMoveToSpace,
+	Name: "move-to-space",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "Move this chat to a custom sub-space of your personal filtering space, or remove it from its custom sub-space.",
+		Args:        "<name|none>",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnMoveToSpace(ce *commands.Event) {
+	if !checkPortalOwner(ce) {
+		return
+	}
+	portal := ce.Portal.(*Portal)
+	if len(ce.Args) == 0 {
+		if len(portal.SpaceTag) == 0 {
+			ce.Reply("This chat isn't in a custom sub-space. Usage: `move-to-space <name|none>`")
+		} else {
+			ce.Reply("This chat is in the %s sub-space. Usage: `move-to-space <name|none>`", portal.SpaceTag)
+		}
+		return
+	}
+	tag := strings.TrimSpace(strings.Join(ce.Args, " "))
+	if strings.ToLower(tag) == "none" {
+		tag = ""
+	}
+	err := portal.MoveToSpace(tag)
+	if err != nil {
+		ce.Reply("Failed to move chat: %v", err)
+	} else if len(tag) == 0 {
+		ce.Reply("Removed this chat from its custom sub-space")
+	} else {
+		ce.Reply("Moved this chat to the %s sub-space", tag)
+	}
+}
+
+var cmdMessageStatus = &commands.FullHandler{
+	Func: fnMessageStatus,
+	Name: "message-status",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "Show when a message was sent, delivered and read. Reply to the message or pass its event ID.",
+		Args:        "[event ID]",
+	},
+	RequiresLogin: true,
+}
+
+func fnMessageStatus(ce *commands.Event) {
+	user := ce.User.(*User)
+	eventID := ce.ReplyTo
+	if len(ce.Args) > 0 {
+		eventID = id.EventID(ce.Args[0])
+	}
+	if len(eventID) == 0 {
+		ce.Reply("Usage: `message-status <event ID>`, or reply to a message with `message-status`")
+		return
+	}
+	msg := user.bridge.DB.Message.GetByMXID(eventID)
+	if msg == nil || msg.PortalReceiver != user.Receiver {
+		ce.Reply("That event isn't a bridged message")
+		return
+	}
+	formatTime := func(ts time.Time) string {
+		if ts.IsZero() {
+			return "unknown"
+		}
+		return ts.Format("2006-01-02 15:04:05")
+	}
+	ce.Reply("Status of %s (`%s`):\n\n"+
+		"* Timestamp: %s\n"+
+		"* Sent: %s\n"+
+		"* Delivered: %s\n"+
+		"* Read: %s",
+		eventID, msg.GUID, formatTime(msg.Time()), formatTime(msg.SentTime()), formatTime(msg.DeliveredTime()), formatTime(msg.ReadTime()))
+}
+
+var cmdBackfillOlder = &commands.FullHandler{
+	Func: fnBackfillOlder,
+	Name: "backfill-older",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "Load messages from before the oldest bridged message in this chat.",
+		Args:        "[limit]",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnBackfillOlder(ce *commands.Event) {
+	portal := ce.Portal.(*Portal)
+	limit := defaultBackwardBackfillLimit
+	if len(ce.Args) > 0 {
+		var err error
+		limit, err = strconv.Atoi(ce.Args[0])
+		if err != nil || limit <= 0 {
+			ce.Reply("Usage: `backfill-older [limit]`")
+			return
+		}
+	}
+	count, err := portal.BackwardBackfill(limit)
+	if err != nil {
+		ce.Reply("Failed to backfill older messages: %v", err)
+	} else if count == 0 {
+		ce.Reply("No older messages found")
+	} else {
+		ce.Reply("Backfilled %d older messages", count)
+	}
+}
+
+var cmdBackfillQueue = &commands.FullHandler{
+	Func: fnBackfillQueue,
+	Name: "backfill-queue",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "List the chats that are waiting to be backfilled in the background.",
+	},
+	RequiresLogin: true,
+}
+
+func fnBackfillQueue(ce *commands.Event) {
+	user := ce.User.(*User)
+	jobs := user.bridge.DB.BackfillQueue.GetAll(user.Receiver)
+	if len(jobs) == 0 {
+		ce.Reply("The backfill queue is empty")
+		return
+	}
+	lines := make([]string, len(jobs))
+	for i, job := range jobs {
+		name := job.PortalGUID
+		if portal := user.GetPortalByGUIDIfExists(job.PortalGUID); portal != nil && len(portal.Name) > 0 {
+			name = fmt.Sprintf("%s (`%s`)", portal.Name, job.PortalGUID)
+		}
+		line := fmt.Sprintf("%d. %s: %s backfill, priority %d", job.ID, name, job.Type, job.Priority)
+		if job.MaxMessages > 0 {
+			line += fmt.Sprintf(", %d messages left", job.MaxMessages)
+		}
+		if job.Attempts > 0 {
+			line += fmt.Sprintf(", failed %d times (last error: %s), next attempt at %s",
+				job.Attempts, job.LastError, job.NextAttempt.Format("2006-01-02 15:04:05"))
+		}
+		lines[i] = line
+	}
+	ce.Reply("%d chats in the backfill queue:\n\n%s", len(jobs), strings.Join(lines, "\n"))
+}
+
+var cmdPortalSettings = &commands.FullHandler{
+	Func: fnPortalSettings,
+	Name: "portal-settings",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "View or change bridge settings for this chat. Use `default` as the value to go back to the global config.",
+		Args:        "[<setting> <value|default>]",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnPortalSettings(ce *commands.Event) {
+	if !checkPortalOwner(ce) {
+		return
+	}
+	portal := ce.Portal.(*Portal)
+	if len(ce.Args) == 0 {
+		ce.Reply("Settings of this chat:\n\n%s", formatPortalSettings(portal))
+		return
+	} else if len(ce.Args) < 2 {
+		ce.Reply("Usage: `portal-settings <setting> <value|default>`")
+		return
+	}
+	key := strings.ToLower(ce.Args[0])
+	value := strings.Join(ce.Args[1:], " ")
+	if value == "default" {
+		value = ""
+	}
+	err := setPortalSetting(&portal.Settings, key, value)
+	if err != nil {
+		ce.Reply("Failed to change setting: %v", err)
+		return
+	}
+	portal.savePortalSettings()
+	ce.Reply("Updated settings of this chat:\n\n%s", formatPortalSettings(portal))
+}
+
+var cmdPortalPermissions = &commands.FullHandler{
+	Func: fnPortalPermissions,
+	Name: "portal-permissions",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "View or change who can send messages, react, rename the group or change members in this chat. Rules are `owner`, `relay` (anyone in the relay whitelist) or Matrix user IDs.",
+		Args:        "[<send|react|rename|members> <rules...|nobody|default>]",
+	},
+	RequiresPortal: true,
+	RequiresAdmin:  true,
+}
+
+func fnPortalPermissions(ce *commands.Event) {
+	portal := ce.Portal.(*Portal)
+	if len(ce.Args) == 0 {
+		ce.Reply("Permissions in this chat:\n\n%s", formatPortalPermissions(portal))
+		return
+	} else if len(ce.Args) < 2 {
+		ce.Reply("Usage: `portal-permissions <%s> <rules...|nobody|default>`", strings.Join(portalActions, "|"))
+		return
+	}
+	action := strings.ToLower(ce.Args[0])
+	rules := ce.Args[1:]
+	if len(rules) == 1 && rules[0] == "nobody" {
+		rules = []string{}
+	}
+	if len(rules) == 1 && rules[0] == "default" {
+		if _, ok := portalActionDescriptions[action]; !ok {
+			ce.Reply("Unknown action %q. Usage: `portal-permissions <%s> <rules...|nobody|default>`", action, strings.Join(portalActions, "|"))
+			return
+		}
+		delete(portal.Settings.Permissions, action)
+	} else if err := validatePermissionRules(action, rules); err != nil {
+		ce.Reply("Failed to change permissions: %v", err)
+		return
+	} else {
+		if portal.Settings.Permissions == nil {
+			portal.Settings.Permissions = make(map[string][]string)
+		}
+		portal.Settings.Permissions[action] = rules
+	}
+	portal.savePortalSettings()
+	ce.Reply("Updated permissions in this chat:\n\n%s", formatPortalPermissions(portal))
+}
@@ -18,22 +18,32 @@ package config
 
 import (
 	"bytes"
+	"fmt"
+	"regexp"
 	"strconv"
 	"strings"
 	"text/template"
 
+	"github.com/nyaruka/phonenumbers"
 	"maunium.net/go/mautrix/bridge/bridgeconfig"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-imessage/imessage"
 )
 
 type BridgeConfig struct {
-	User id.UserID `yaml:"user"`
+	User       id.UserID         `yaml:"user"`
+	ExtraUsers []ExtraUserConfig `yaml:"extra_users"`
 
 	UsernameTemplate    string `yaml:"username_template"`
 	DisplaynameTemplate string `yaml:"displayname_template"`
 
 	PersonalFilteringSpaces bool `yaml:"personal_filtering_spaces"`
+	SubSpaces               struct {
+		ChatType bool `yaml:"chat_type"`
+		Service  bool `yaml:"service"`
+	} `yaml:"sub_spaces"`
 
 	DeliveryReceipts    bool `yaml:"delivery_receipts"`
 	MessageStatusEvents bool `yaml:"message_status_events"`
@@ -44,18 +54,30 @@ type BridgeConfig struct {
 
 	SyncWithCustomPuppets bool   `yaml:"sync_with_custom_puppets"`
 	SyncDirectChatList    bool   `yaml:"sync_direct_chat_list"`
+	MuteBridging          bool   `yaml:"mute_bridging"`
+	ArchiveTag            string `yaml:"archive_tag"`
 	LoginSharedSecret     string `yaml:"login_shared_secret"`
 	DoublePuppetServerURL string `yaml:"double_puppet_server_url"`
 	Backfill              struct {
 		Enable               bool    `yaml:"enable"`
 		InitialLimit         int     `yaml:"initial_limit"`
+		ImmediateLimit       int     `yaml:"immediate_limit"`
 		InitialSyncMaxAge    float64 `yaml:"initial_sync_max_age"`
 		UnreadHoursThreshold int     `yaml:"unread_hours_threshold"`
 		MSC2716              bool    `yaml:"msc2716"`
+		LazyMedia            bool    `yaml:"lazy_media"`
+		Queue                struct {
+			BatchSize  int `yaml:"batch_size"`
+			Delay      int `yaml:"delay"`
+			MaxRetries int `yaml:"max_retries"`
+		} `yaml:"queue"`
 	} `yaml:"backfill"`
-	PeriodicSync       bool `yaml:"periodic_sync"`
-	FindPortalsIfEmpty bool `yaml:"find_portals_if_db_empty"`
-	MediaViewer        struct {
+	PeriodicSync           bool `yaml:"periodic_sync"`
+	PeriodicSyncInterval   int  `yaml:"periodic_sync_interval"`
+	PeriodicSyncJitter     int  `yaml:"periodic_sync_jitter"`
+	StartupSyncConcurrency int  `yaml:"startup_sync_concurrency"`
+	FindPortalsIfEmpty     bool `yaml:"find_portals_if_db_empty"`
+	MediaViewer            struct {
 		URL        string `yaml:"url"`
 		Homeserver string `yaml:"homeserver"`
 		SMSMinSize int    `yaml:"sms_min_size"`
@@ -77,6 +99,13 @@ type BridgeConfig struct {
 	FederateRooms          bool   `yaml:"federate_rooms"`
 	CaptionInMessage       bool   `yaml:"caption_in_message"`
 	PrivateChatPortalMeta  string `yaml:"private_chat_portal_meta"`
+	TapbackFallback        string `yaml:"tapback_fallback"`
+	SendPolicy             struct {
+		Default         string `yaml:"default"`
+		FallbackTimeout int    `yaml:"fallback_timeout"`
+	} `yaml:"send_policy"`
+	ContactSources ContactSourcesConfig `yaml:"contact_sources"`
+	PhoneRegion    string               `yaml:"phone_number_region"`
 
 	Encryption bridgeconfig.EncryptionConfig `yaml:"encryption"`
 
@@ -100,7 +129,48 @@ func (bc BridgeConfig) GetManagementRoomTexts() bridgeconfig.ManagementRoomTexts
 	}
 }
 
+// ContactSourcesConfig contains the external contact sources whose contacts are merged with the connector's contacts.
+type ContactSourcesConfig struct {
+	RefreshInterval int `yaml:"refresh_interval"`
+	CardDAV         struct {
+		URL      string `yaml:"url"`
+		Username string `yaml:"username"`
+		Password string `yaml:"password"`
+	} `yaml:"carddav"`
+	VCFDirectory string `yaml:"vcf_directory"`
+}
+
+var extraUserIDRegex = regexp.MustCompile("^[a-z0-9]+$")
+
 func (bc BridgeConfig) Validate() error {
+	switch bc.SendPolicy.Default {
+	case "auto", "imessage", "sms", "sms_fallback":
+	default:
+		return fmt.Errorf("invalid default send policy %q", bc.SendPolicy.Default)
+	}
+	if bc.Backfill.Queue.BatchSize <= 0 {
+		return fmt.Errorf("backfill queue batch size must be positive")
+	}
+	if len(bc.PhoneRegion) > 0 && !phonenumbers.GetSupportedRegions()[bc.PhoneRegion] {
+		return fmt.Errorf("unsupported phone number region %q", bc.PhoneRegion)
+	}
+	receivers := make(map[string]struct{}, len(bc.ExtraUsers))
+	userIDs := map[id.UserID]struct{}{bc.User: {}}
+	for _, extraUser := range bc.ExtraUsers {
+		if !extraUserIDRegex.MatchString(extraUser.ID) {
+			return fmt.Errorf("invalid extra user ID %q: must only contain lowercase letters and numbers", extraUser.ID)
+		} else if _, alreadyExists := receivers[extraUser.ID]; alreadyExists {
+			return fmt.Errorf("duplicate extra user ID %q", extraUser.ID)
+		} else if _, alreadyExists := userIDs[extraUser.User]; alreadyExists {
+			return fmt.Errorf("user %s is configured more than once", extraUser.User)
+		} else if extraUser.IMessage.HasPlatform("ios") {
+			return fmt.Errorf("extra user %s can't use the ios platform, as it requires the stdio IPC", extraUser.ID)
+		} else if extraUser.IMessage.HasPlatform("android") {
+			return fmt.Errorf("extra user %s can't use the android platform, as it requires the stdio IPC", extraUser.ID)
+		}
+		receivers[extraUser.ID] = struct{}{}
+		userIDs[extraUser.User] = struct{}{}
+	}
 	return nil
 }
 
@@ -138,6 +208,8 @@ func (bc *BridgeConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return err
 	}
 
+	bc.PhoneRegion = strings.ToUpper(bc.PhoneRegion)
+
 	return nil
 }
 
@@ -152,6 +224,12 @@ func (bc BridgeConfig) FormatDisplayname(name string) string {
 }
 
 func (bc BridgeConfig) FormatUsername(username string) string {
+	return bc.FormatReceiverUsername("", username)
+}
+
+// FormatReceiverUsername formats the ghost username of the given iMessage user ID
+// for the bridge user with the given receiver ID.
+func (bc BridgeConfig) FormatReceiverUsername(receiver, username string) string {
 	if strings.HasPrefix(username, "+") {
 		if _, err := strconv.Atoi(username[1:]); err == nil {
 			username = username[1:]
@@ -159,11 +237,22 @@ func (bc BridgeConfig) FormatUsername(username string) string {
 	} else {
 		username = id.EncodeUserLocalpart(username)
 	}
+	if len(receiver) > 0 {
+		username = receiver + "/" + username
+	}
 	var buf bytes.Buffer
 	bc.usernameTemplate.Execute(&buf, username)
 	return buf.String()
 }
 
+// ExtraUserConfig contains the config for a bridge user in addition to the primary user.
+// The ID is used to separate the portals and ghosts of the user from other users.
+type ExtraUserConfig struct {
+	ID       string                  `yaml:"id"`
+	User     id.UserID               `yaml:"user"`
+	IMessage imessage.PlatformConfig `yaml:"imessage"`
+}
+
 type RelayConfig struct {
 	Enabled        bool                         `yaml:"enabled"`
 	Whitelist      []string                     `yaml:"whitelist"`
@@ -228,11 +317,27 @@ type formatData struct {
 }
 
 func (rc *RelayConfig) FormatMessage(content *event.MessageEventContent, sender id.UserID, member event.MemberEventContent) (string, error) {
+	return rc.FormatMessageWithOverrides(nil, content, sender, member)
+}
+
+// FormatMessageWithOverrides formats the message like FormatMessage, but uses the format from overrides
+// instead of the config if there's one for the message type.
+func (rc *RelayConfig) FormatMessageWithOverrides(overrides map[event.MessageType]string, content *event.MessageEventContent, sender id.UserID, member event.MemberEventContent) (string, error) {
 	if len(member.Displayname) == 0 {
 		member.Displayname = sender.String()
 	}
+	tpl := rc.messageTemplates.Lookup(string(content.MsgType))
+	if override, ok := overrides[content.MsgType]; ok {
+		var err error
+		tpl, err = template.New(string(content.MsgType)).Parse(override)
+		if err != nil {
+			return "", err
+		}
+	} else if tpl == nil {
+		return "", fmt.Errorf("no relay format for %s", content.MsgType)
+	}
 	var formatted strings.Builder
-	err := rc.messageTemplates.ExecuteTemplate(&formatted, string(content.MsgType), formatData{
+	err := tpl.Execute(&formatted, formatData{
 		Sender: Sender{
 			UserID:             sender.String(),
 			MemberEventContent: member,
@@ -243,3 +348,9 @@ func (rc *RelayConfig) FormatMessage(content *event.MessageEventContent, sender
 	})
 	return formatted.String(), err
 }
+
+// ValidateRelayFormat checks that the given relay message format is a valid template.
+func ValidateRelayFormat(format string) error {
+	_, err := template.New("").Parse(format)
+	return err
+}
@@ -39,6 +39,7 @@ func DoUpgrade(helper *up.Helper) {
 	helper.Copy(up.Str, "imessage", "unix_socket")
 	helper.Copy(up.Int, "imessage", "ping_interval_seconds")
 	helper.Copy(up.Bool, "imessage", "delete_media_after_upload")
+	helper.Copy(up.List, "imessage", "additional_connectors")
 
 	helper.Copy(up.Str|up.Null, "segment", "key")
 	helper.Copy(up.Str|up.Null, "segment", "user_id")
@@ -51,9 +52,12 @@ func DoUpgrade(helper *up.Helper) {
 	helper.Copy(up.Int, "hacky_startup_test", "periodic_resolve")
 
 	helper.Copy(up.Str, "bridge", "user")
+	helper.Copy(up.List, "bridge", "extra_users")
 	helper.Copy(up.Str, "bridge", "username_template")
 	helper.Copy(up.Str, "bridge", "displayname_template")
 	helper.Copy(up.Bool, "bridge", "personal_filtering_spaces")
+	helper.Copy(up.Bool, "bridge", "sub_spaces", "chat_type")
+	helper.Copy(up.Bool, "bridge", "sub_spaces", "service")
 
 	helper.Copy(up.Bool, "bridge", "delivery_receipts")
 	if legacyStatusEvents, ok := helper.Get(up.Bool, "bridge", "send_message_send_status_events"); ok && legacyStatusEvents != "" {
@@ -66,6 +70,8 @@ func DoUpgrade(helper *up.Helper) {
 	helper.Copy(up.Str|up.Null, "bridge", "device_id")
 	helper.Copy(up.Bool, "bridge", "sync_with_custom_puppets")
 	helper.Copy(up.Bool, "bridge", "sync_direct_chat_list")
+	helper.Copy(up.Bool, "bridge", "mute_bridging")
+	helper.Copy(up.Str|up.Null, "bridge", "archive_tag")
 	helper.Copy(up.Str|up.Null, "bridge", "login_shared_secret")
 	helper.Copy(up.Str|up.Null, "bridge", "double_puppet_server_url")
 	if legacyBackfillLimit, ok := helper.Get(up.Int, "bridge", "initial_backfill_limit"); ok {
@@ -78,10 +84,18 @@ func DoUpgrade(helper *up.Helper) {
 	} else {
 		helper.Copy(up.Float|up.Int, "bridge", "backfill", "initial_sync_max_age")
 	}
+	helper.Copy(up.Int, "bridge", "backfill", "immediate_limit")
 	helper.Copy(up.Bool, "bridge", "backfill", "enable")
 	helper.Copy(up.Bool, "bridge", "backfill", "msc2716")
+	helper.Copy(up.Bool, "bridge", "backfill", "lazy_media")
 	helper.Copy(up.Int, "bridge", "backfill", "unread_hours_threshold")
+	helper.Copy(up.Int, "bridge", "backfill", "queue", "batch_size")
+	helper.Copy(up.Int, "bridge", "backfill", "queue", "delay")
+	helper.Copy(up.Int, "bridge", "backfill", "queue", "max_retries")
 	helper.Copy(up.Bool, "bridge", "periodic_sync")
+	helper.Copy(up.Int, "bridge", "periodic_sync_interval")
+	helper.Copy(up.Int, "bridge", "periodic_sync_jitter")
+	helper.Copy(up.Int, "bridge", "startup_sync_concurrency")
 	helper.Copy(up.Bool, "bridge", "find_portals_if_db_empty")
 	if legacyMediaViewerURL, ok := helper.Get(up.Str, "bridge", "media_viewer_url"); ok && legacyMediaViewerURL != "" {
 		helper.Set(up.Str, legacyMediaViewerURL, "bridge", "media_viewer", "url")
@@ -116,6 +130,15 @@ func DoUpgrade(helper *up.Helper) {
 	helper.Copy(up.Bool, "bridge", "federate_rooms")
 	helper.Copy(up.Bool, "bridge", "caption_in_message")
 	helper.Copy(up.Str, "bridge", "private_chat_portal_meta")
+	helper.Copy(up.Str, "bridge", "tapback_fallback")
+	helper.Copy(up.Str, "bridge", "send_policy", "default")
+	helper.Copy(up.Int, "bridge", "send_policy", "fallback_timeout")
+	helper.Copy(up.Int, "bridge", "contact_sources", "refresh_interval")
+	helper.Copy(up.Str|up.Null, "bridge", "contact_sources", "carddav", "url")
+	helper.Copy(up.Str|up.Null, "bridge", "contact_sources", "carddav", "username")
+	helper.Copy(up.Str|up.Null, "bridge", "contact_sources", "carddav", "password")
+	helper.Copy(up.Str|up.Null, "bridge", "contact_sources", "vcf_directory")
+	helper.Copy(up.Str|up.Null, "bridge", "phone_number_region")
 
 	helper.Copy(up.Bool, "bridge", "encryption", "allow")
 	helper.Copy(up.Bool, "bridge", "encryption", "default")
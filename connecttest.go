@@ -135,6 +135,8 @@ func (br *IMBridge) hackyTestLoop() {
 	}
 }
 
+// hackyStartupTests sends the startup test message. The test identifier is configured for
+// the primary user's account, so the test always runs on the primary user's connector.
 func (br *IMBridge) hackyStartupTests(sleep, forceSend bool) {
 	if sleep {
 		time.Sleep(time.Duration(rand.Intn(120)+60) * time.Second)
@@ -161,7 +163,7 @@ func (br *IMBridge) hackyStartupTests(sleep, forceSend bool) {
 	if !actuallyStart {
 		return
 	}
-	portal := br.GetPortalByGUID(resp.GUID)
+	portal := br.user.GetPortalByGUID(resp.GUID)
 
 	payload, err := encryptTestPayload(br.Config.HackyStartupTest.Key, map[string]any{
 		"segment_user_id": Segment.userID,
@@ -177,7 +179,7 @@ func (br *IMBridge) hackyStartupTests(sleep, forceSend bool) {
 		startupTestKey:   payload,
 		startupTestIDKey: randomID,
 	}
-	sendResp, err := br.IM.SendMessage(portal.getTargetGUID("text message", "startup test", ""), br.Config.HackyStartupTest.Message, "", 0, nil, metadata)
+	sendResp, err := br.user.IM.SendMessage(portal.getTargetGUID("text message", "startup test", ""), br.Config.HackyStartupTest.Message, "", 0, nil, metadata)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to send message")
 		trackStartupTestError("send message", randomID)
@@ -228,7 +230,7 @@ func (br *IMBridge) trackStartupTestPingStatus(msgStatus *imessage.SendMessageSt
 	Segment.Track(hackyTestSegmentEvent, meta)
 }
 
-func (br *IMBridge) receiveStartupTestPing(msg *imessage.Message) {
+func (br *IMBridge) receiveStartupTestPing(user *User, msg *imessage.Message) {
 	unencryptedID, ok := msg.Metadata[startupTestIDKey].(string)
 	if !ok {
 		return
@@ -279,7 +281,7 @@ func (br *IMBridge) receiveStartupTestPing(msg *imessage.Message) {
 		"msg_guid":  msg.GUID,
 	})
 	time.Sleep(2 * time.Second)
-	resp, err := br.IM.SendMessage(msg.ChatGUID, br.Config.HackyStartupTest.ResponseMessage, msg.GUID, 0, nil, map[string]any{
+	resp, err := user.IM.SendMessage(msg.ChatGUID, br.Config.HackyStartupTest.ResponseMessage, msg.GUID, 0, nil, map[string]any{
 		startupTestResponseKey: map[string]any{
 			"random_id": randomID,
 		},
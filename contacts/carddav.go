@@ -0,0 +1,111 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package contacts
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mau.fi/mautrix-imessage/imessage"
+)
+
+const addressBookQuery = `<?xml version="1.0" encoding="utf-8"?>
+<C:addressbook-query xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:carddav">
+	<D:prop>
+		<D:getetag/>
+		<C:address-data/>
+	</D:prop>
+</C:addressbook-query>`
+
+type davMultiStatus struct {
+	Responses []struct {
+		Href      string `xml:"DAV: href"`
+		PropStats []struct {
+			Status string `xml:"DAV: status"`
+			Prop   struct {
+				AddressData string `xml:"urn:ietf:params:xml:ns:carddav address-data"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// CardDAVSource fetches contacts from a CardDAV address book.
+// The URL must point at the address book collection, e.g. https://dav.example.com/user/contacts/
+type CardDAVSource struct {
+	URL      string
+	Username string
+	Password string
+
+	Client *http.Client
+}
+
+func NewCardDAVSource(url, username, password string) *CardDAVSource {
+	return &CardDAVSource{
+		URL:      url,
+		Username: username,
+		Password: password,
+		Client:   &http.Client{Timeout: 2 * time.Minute},
+	}
+}
+
+func (src *CardDAVSource) String() string {
+	return fmt.Sprintf("CardDAV address book %s", src.URL)
+}
+
+func (src *CardDAVSource) GetContactList() ([]*imessage.Contact, error) {
+	req, err := http.NewRequest("REPORT", src.URL, strings.NewReader(addressBookQuery))
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	req.Header.Set("Depth", "1")
+	if len(src.Username) > 0 {
+		req.SetBasicAuth(src.Username, src.Password)
+	}
+	resp, err := src.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, body)
+	}
+	var multiStatus davMultiStatus
+	err = xml.NewDecoder(resp.Body).Decode(&multiStatus)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	var contacts []*imessage.Contact
+	for _, response := range multiStatus.Responses {
+		for _, propStat := range response.PropStats {
+			if len(propStat.Prop.AddressData) == 0 || !strings.Contains(propStat.Status, " 200 ") {
+				continue
+			}
+			parsed, err := ParseVCards(strings.NewReader(propStat.Prop.AddressData))
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse vCard %s: %w", response.Href, err)
+			}
+			contacts = append(contacts, parsed...)
+		}
+	}
+	return contacts, nil
+}
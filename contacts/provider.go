@@ -0,0 +1,242 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package contacts
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"go.mau.fi/mautrix-imessage/imessage"
+)
+
+// Source is an external source of contacts, e.g. a CardDAV server or a directory of vCard files.
+type Source interface {
+	fmt.Stringer
+	GetContactList() ([]*imessage.Contact, error)
+}
+
+// NormalizePhone removes everything except digits and the leading plus sign from a phone number.
+func NormalizePhone(phone string) string {
+	var out strings.Builder
+	for i, char := range strings.TrimSpace(phone) {
+		if (char >= '0' && char <= '9') || (char == '+' && i == 0) {
+			out.WriteRune(char)
+		}
+	}
+	return out.String()
+}
+
+// NormalizeIdentifier normalizes a phone number or email so it can be used as a lookup key.
+func NormalizeIdentifier(identifier string) string {
+	if strings.ContainsRune(identifier, '@') {
+		return strings.ToLower(strings.TrimSpace(identifier))
+	}
+	return NormalizePhone(identifier)
+}
+
+func contactIdentifiers(contact *imessage.Contact) []string {
+	identifiers := make([]string, 0, len(contact.Phones)+len(contact.Emails))
+	for _, phone := range contact.Phones {
+		identifiers = append(identifiers, NormalizeIdentifier(phone))
+	}
+	for _, email := range contact.Emails {
+		identifiers = append(identifiers, NormalizeIdentifier(email))
+	}
+	return identifiers
+}
+
+func appendMissing(existing []string, values ...string) []string {
+	for _, value := range values {
+		found := false
+		for _, existingValue := range existing {
+			if NormalizeIdentifier(existingValue) == NormalizeIdentifier(value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			existing = append(existing, value)
+		}
+	}
+	return existing
+}
+
+// MergeContact returns a new contact with the fields of primary, where missing fields are filled from secondary.
+func MergeContact(primary, secondary *imessage.Contact) *imessage.Contact {
+	if primary == nil {
+		return secondary
+	} else if secondary == nil {
+		return primary
+	}
+	merged := *primary
+	if !merged.HasName() {
+		merged.FirstName = secondary.FirstName
+		merged.LastName = secondary.LastName
+		merged.Nickname = secondary.Nickname
+	}
+	if len(merged.Avatar) == 0 {
+		merged.Avatar = secondary.Avatar
+	}
+	merged.Phones = appendMissing(append([]string{}, merged.Phones...), secondary.Phones...)
+	merged.Emails = appendMissing(append([]string{}, merged.Emails...), secondary.Emails...)
+	return &merged
+}
+
+// Store caches the contacts fetched from external sources.
+type Store struct {
+	Sources []Source
+	log     log.Logger
+
+	lock         sync.RWMutex
+	contacts     []*imessage.Contact
+	byIdentifier map[string]*imessage.Contact
+	// bySource contains the last successfully fetched contacts of each source, in the same order as Sources.
+	bySource [][]*imessage.Contact
+}
+
+func NewStore(log log.Logger, sources ...Source) *Store {
+	return &Store{
+		Sources:      sources,
+		log:          log,
+		byIdentifier: make(map[string]*imessage.Contact),
+		bySource:     make([][]*imessage.Contact, len(sources)),
+	}
+}
+
+// Refresh fetches the contacts from all sources. If a source fails, the previously cached contacts of that
+// source are kept and the error is returned along with the contacts. Contacts that share an identifier are merged.
+func (store *Store) Refresh() ([]*imessage.Contact, error) {
+	var allContacts []*imessage.Contact
+	var errs []string
+	if len(store.bySource) != len(store.Sources) {
+		store.bySource = make([][]*imessage.Contact, len(store.Sources))
+	}
+	for i, source := range store.Sources {
+		contacts, err := source.GetContactList()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("failed to get contacts from %s: %v", source, err))
+			contacts = store.bySource[i]
+		} else {
+			store.log.Debugfln("Got %d contacts from %s", len(contacts), source)
+			store.bySource[i] = contacts
+		}
+		allContacts = append(allContacts, contacts...)
+	}
+	byIdentifier := make(map[string]*imessage.Contact, len(allContacts)*2)
+	deduplicated := make([]*imessage.Contact, 0, len(allContacts))
+	for _, contact := range allContacts {
+		var existing *imessage.Contact
+		identifiers := contactIdentifiers(contact)
+		for _, identifier := range identifiers {
+			if existing = byIdentifier[identifier]; existing != nil {
+				break
+			}
+		}
+		if existing != nil {
+			merged := MergeContact(existing, contact)
+			*existing = *merged
+			contact = existing
+		} else {
+			// Merging modifies the contact, so copy it to keep the cached source contacts unchanged
+			copied := *contact
+			contact = &copied
+			deduplicated = append(deduplicated, contact)
+		}
+		for _, identifier := range contactIdentifiers(contact) {
+			byIdentifier[identifier] = contact
+		}
+	}
+	store.lock.Lock()
+	store.contacts = deduplicated
+	store.byIdentifier = byIdentifier
+	store.lock.Unlock()
+	if len(errs) > 0 {
+		return deduplicated, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return deduplicated, nil
+}
+
+func (store *Store) Get(identifier string) *imessage.Contact {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	return store.byIdentifier[NormalizeIdentifier(identifier)]
+}
+
+func (store *Store) List() []*imessage.Contact {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	return store.contacts
+}
+
+// Provider merges the contacts from an iMessage connector with the contacts in a Store.
+// Contact info from the connector takes precedence, the store is used to fill in missing fields.
+type Provider struct {
+	Connector imessage.ContactAPI
+	Store     *Store
+}
+
+var _ imessage.ContactAPI = (*Provider)(nil)
+
+func (provider *Provider) GetContactInfo(identifier string) (*imessage.Contact, error) {
+	contact, err := provider.Connector.GetContactInfo(identifier)
+	if provider.Store == nil {
+		return contact, err
+	}
+	storeContact := provider.Store.Get(identifier)
+	if err != nil {
+		if storeContact != nil {
+			return storeContact, nil
+		}
+		return nil, err
+	}
+	return MergeContact(contact, storeContact), nil
+}
+
+func (provider *Provider) GetContactList() ([]*imessage.Contact, error) {
+	contacts, err := provider.Connector.GetContactList()
+	if provider.Store == nil {
+		return contacts, err
+	} else if err != nil {
+		provider.Store.log.Warnln("Failed to get contact list from connector, only using external contact sources:", err)
+		contacts = nil
+	}
+	byIdentifier := make(map[string]int, len(contacts)*2)
+	merged := make([]*imessage.Contact, len(contacts))
+	copy(merged, contacts)
+	for i, contact := range merged {
+		for _, identifier := range contactIdentifiers(contact) {
+			byIdentifier[identifier] = i
+		}
+	}
+	for _, storeContact := range provider.Store.List() {
+		found := false
+		for _, identifier := range contactIdentifiers(storeContact) {
+			if i, ok := byIdentifier[identifier]; ok {
+				merged[i] = MergeContact(merged[i], storeContact)
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, storeContact)
+		}
+	}
+	return merged, nil
+}
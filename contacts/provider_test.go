@@ -0,0 +1,67 @@
+package contacts_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"go.mau.fi/mautrix-imessage/contacts"
+	"go.mau.fi/mautrix-imessage/imessage"
+)
+
+type fakeSource struct {
+	name     string
+	contacts []*imessage.Contact
+	err      error
+}
+
+func (fs *fakeSource) String() string {
+	return fs.name
+}
+
+func (fs *fakeSource) GetContactList() ([]*imessage.Contact, error) {
+	return fs.contacts, fs.err
+}
+
+func TestStore_Refresh(t *testing.T) {
+	first := &fakeSource{name: "first", contacts: []*imessage.Contact{
+		{FirstName: "John", Phones: []string{"+1 (555) 123-4567"}},
+	}}
+	second := &fakeSource{name: "second", contacts: []*imessage.Contact{
+		{FirstName: "Jane", Emails: []string{"jane@example.com"}},
+	}}
+	third := &fakeSource{name: "third", contacts: []*imessage.Contact{
+		{Phones: []string{"+15551234567"}, Emails: []string{"John@Example.com"}},
+	}}
+	store := contacts.NewStore(log.Sub("Contacts"), first, second, third)
+	list, err := store.Refresh()
+	if err != nil {
+		t.Fatal("Unexpected error refreshing contacts:", err)
+	} else if len(list) != 2 {
+		t.Fatalf("Expected duplicate contacts to be merged into 2 contacts, got %d", len(list))
+	} else if john := store.Get("john@example.com"); john == nil || john.FirstName != "John" {
+		t.Errorf("Expected merged contact for john@example.com, got %+v", john)
+	}
+
+	first.err = errors.New("connection refused")
+	first.contacts = nil
+	second.contacts = []*imessage.Contact{{FirstName: "Jane", LastName: "Doe", Emails: []string{"jane@example.com"}}}
+	third.err = errors.New("timeout")
+	list, err = store.Refresh()
+	if err == nil {
+		t.Fatal("Expected an error when sources fail")
+	} else if !strings.Contains(err.Error(), "first") || !strings.Contains(err.Error(), "third") {
+		t.Errorf("Expected error to mention both failed sources, got %v", err)
+	}
+	if len(list) != 2 {
+		t.Errorf("Expected cached contacts of failed sources to be kept, got %d contacts", len(list))
+	}
+	if john := store.Get("+15551234567"); john == nil || john.FirstName != "John" {
+		t.Errorf("Expected cached contact from failed source, got %+v", john)
+	}
+	if jane := store.Get("jane@example.com"); jane == nil || jane.LastName != "Doe" {
+		t.Errorf("Expected contact from working source to be refreshed, got %+v", jane)
+	}
+}
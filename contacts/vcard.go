@@ -0,0 +1,168 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package contacts
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+
+	"go.mau.fi/mautrix-imessage/imessage"
+)
+
+type vCardLine struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+func parseVCardLine(line string) (parsed vCardLine, ok bool) {
+	sep := strings.IndexRune(line, ':')
+	if sep < 0 {
+		return
+	}
+	parsed.Value = line[sep+1:]
+	nameAndParams := strings.Split(line[:sep], ";")
+	parsed.Name = strings.ToUpper(nameAndParams[0])
+	if dot := strings.LastIndexByte(parsed.Name, '.'); dot >= 0 {
+		// Strip the group prefix (e.g. item1.TEL)
+		parsed.Name = parsed.Name[dot+1:]
+	}
+	parsed.Params = make(map[string]string, len(nameAndParams)-1)
+	for _, param := range nameAndParams[1:] {
+		key, value, _ := strings.Cut(param, "=")
+		parsed.Params[strings.ToUpper(key)] = strings.Trim(value, `"`)
+	}
+	return parsed, true
+}
+
+var vCardUnescaper = strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`)
+
+// splitVCardValue splits a structured vCard value by unescaped semicolons.
+func splitVCardValue(value string) []string {
+	var parts []string
+	var current strings.Builder
+	escaped := false
+	for _, char := range value {
+		if escaped {
+			current.WriteRune('\\')
+			current.WriteRune(char)
+			escaped = false
+		} else if char == '\\' {
+			escaped = true
+		} else if char == ';' {
+			parts = append(parts, vCardUnescaper.Replace(current.String()))
+			current.Reset()
+		} else {
+			current.WriteRune(char)
+		}
+	}
+	return append(parts, vCardUnescaper.Replace(current.String()))
+}
+
+func parseVCardPhoto(line vCardLine) []byte {
+	value := line.Value
+	if strings.HasPrefix(value, "data:") {
+		// vCard 4.0: data URI
+		_, data, ok := strings.Cut(value, ",")
+		if !ok || !strings.Contains(value[:len(value)-len(data)], ";base64") {
+			return nil
+		}
+		value = data
+	} else if enc := strings.ToLower(line.Params["ENCODING"]); enc != "b" && enc != "base64" {
+		// Photos by URL aren't supported
+		return nil
+	}
+	photo, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil
+	}
+	return photo
+}
+
+// ParseVCards parses all the vCards in the given reader into contacts.
+// Only the fields used by the bridge (names, phone numbers, emails and photos) are parsed.
+func ParseVCards(reader io.Reader) ([]*imessage.Contact, error) {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var lines []string
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			// Folded line, continue the previous line
+			lines[len(lines)-1] += line[1:]
+		} else if len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read vCard: %w", err)
+	}
+
+	var contacts []*imessage.Contact
+	var contact *imessage.Contact
+	var formattedName string
+	for _, rawLine := range lines {
+		line, ok := parseVCardLine(rawLine)
+		if !ok {
+			continue
+		}
+		if line.Name == "BEGIN" && strings.EqualFold(line.Value, "VCARD") {
+			contact = &imessage.Contact{}
+			formattedName = ""
+			continue
+		} else if contact == nil {
+			continue
+		}
+		switch line.Name {
+		case "END":
+			if !contact.HasName() && len(formattedName) > 0 {
+				contact.FirstName = formattedName
+			}
+			if len(contact.Phones) > 0 || len(contact.Emails) > 0 {
+				contacts = append(contacts, contact)
+			}
+			contact = nil
+		case "N":
+			parts := splitVCardValue(line.Value)
+			contact.LastName = strings.TrimSpace(parts[0])
+			if len(parts) > 1 {
+				contact.FirstName = strings.TrimSpace(parts[1])
+			}
+		case "FN":
+			formattedName = strings.TrimSpace(vCardUnescaper.Replace(line.Value))
+		case "NICKNAME":
+			nickname, _, _ := strings.Cut(vCardUnescaper.Replace(line.Value), ",")
+			contact.Nickname = strings.TrimSpace(nickname)
+		case "TEL":
+			phone := NormalizePhone(strings.TrimPrefix(line.Value, "tel:"))
+			if len(phone) > 0 {
+				contact.Phones = append(contact.Phones, phone)
+			}
+		case "EMAIL":
+			email := strings.TrimSpace(strings.TrimPrefix(line.Value, "mailto:"))
+			if len(email) > 0 {
+				contact.Emails = append(contact.Emails, email)
+			}
+		case "PHOTO":
+			contact.Avatar = parseVCardPhoto(line)
+		}
+	}
+	return contacts, nil
+}
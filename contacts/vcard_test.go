@@ -0,0 +1,96 @@
+package contacts_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.mau.fi/mautrix-imessage/contacts"
+)
+
+const testVCards = "BEGIN:VCARD\r\n" +
+	"VERSION:3.0\r\n" +
+	"N:Doe;John;;;\r\n" +
+	"FN:John Doe\r\n" +
+	"item1.TEL;type=CELL:+1 (555) 123-\r\n" +
+	" 4567\r\n" +
+	"EMAIL;type=INTERNET:john@example.com\r\n" +
+	"PHOTO;ENCODING=b;TYPE=JPEG:aGVsbG8=\r\n" +
+	"END:VCARD\r\n" +
+	"BEGIN:VCARD\r\n" +
+	"VERSION:4.0\r\n" +
+	"FN:Jane\\, the tester\r\n" +
+	"TEL;VALUE=uri:tel:+44-20-7946-0000\r\n" +
+	"PHOTO:data:image/png;base64,d29ybGQ=\r\n" +
+	"END:VCARD\r\n" +
+	"BEGIN:VCARD\r\n" +
+	"FN:Nobody\r\n" +
+	"END:VCARD\r\n"
+
+func TestParseVCards(t *testing.T) {
+	parsed, err := contacts.ParseVCards(strings.NewReader(testVCards))
+	if err != nil {
+		t.Fatal("Failed to parse vCards:", err)
+	} else if len(parsed) != 2 {
+		t.Fatalf("Expected 2 contacts, got %d", len(parsed))
+	}
+	john := parsed[0]
+	if john.FirstName != "John" || john.LastName != "Doe" {
+		t.Errorf("Unexpected name %q %q", john.FirstName, john.LastName)
+	}
+	if len(john.Phones) != 1 || john.Phones[0] != "+15551234567" {
+		t.Errorf("Unexpected phones %v", john.Phones)
+	}
+	if len(john.Emails) != 1 || john.Emails[0] != "john@example.com" {
+		t.Errorf("Unexpected emails %v", john.Emails)
+	}
+	if string(john.Avatar) != "hello" {
+		t.Errorf("Unexpected avatar %q", john.Avatar)
+	}
+	jane := parsed[1]
+	if jane.FirstName != "Jane, the tester" {
+		t.Errorf("Unexpected name %q", jane.FirstName)
+	}
+	if len(jane.Phones) != 1 || jane.Phones[0] != "+442079460000" {
+		t.Errorf("Unexpected phones %v", jane.Phones)
+	}
+	if string(jane.Avatar) != "world" {
+		t.Errorf("Unexpected avatar %q", jane.Avatar)
+	}
+}
+
+func TestCardDAVSource_GetContactList(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "REPORT" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		} else if user, pass, _ := r.BasicAuth(); user != "user" || pass != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusMultiStatus)
+		_, _ = w.Write([]byte(`<?xml version="1.0"?>
+<multistatus xmlns="DAV:" xmlns:CR="urn:ietf:params:xml:ns:carddav">
+	<response>
+		<href>/user/contacts/john.vcf</href>
+		<propstat>
+			<prop><CR:address-data>BEGIN:VCARD
+N:Doe;John;;;
+TEL:+15551234567
+END:VCARD
+</CR:address-data></prop>
+			<status>HTTP/1.1 200 OK</status>
+		</propstat>
+	</response>
+</multistatus>`))
+	}))
+	defer server.Close()
+
+	parsed, err := contacts.NewCardDAVSource(server.URL, "user", "pass").GetContactList()
+	if err != nil {
+		t.Fatal("Failed to get contacts:", err)
+	} else if len(parsed) != 1 || parsed[0].FirstName != "John" || parsed[0].Phones[0] != "+15551234567" {
+		t.Errorf("Unexpected contacts %+v", parsed)
+	}
+}
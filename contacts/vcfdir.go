@@ -0,0 +1,63 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package contacts
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.mau.fi/mautrix-imessage/imessage"
+)
+
+// VCFDirectorySource reads contacts from all .vcf files in a directory.
+type VCFDirectorySource struct {
+	Path string
+}
+
+func (src *VCFDirectorySource) String() string {
+	return fmt.Sprintf("vCard directory %s", src.Path)
+}
+
+func (src *VCFDirectorySource) readFile(path string) ([]*imessage.Contact, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseVCards(file)
+}
+
+func (src *VCFDirectorySource) GetContactList() ([]*imessage.Contact, error) {
+	entries, err := os.ReadDir(src.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory: %w", err)
+	}
+	var contacts []*imessage.Contact
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.EqualFold(filepath.Ext(entry.Name()), ".vcf") {
+			continue
+		}
+		parsed, err := src.readFile(filepath.Join(src.Path, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", entry.Name(), err)
+		}
+		contacts = append(contacts, parsed...)
+	}
+	return contacts, nil
+}
@@ -82,8 +82,8 @@ func (user *User) loginWithSharedSecret() error {
 	}
 	req := mautrix.ReqLogin{
 		Identifier:               mautrix.UserIdentifier{Type: mautrix.IdentifierTypeUser, User: string(user.MXID)},
-		DeviceID:                 id.DeviceID(user.bridge.Config.IMessage.BridgeName()),
-		InitialDeviceDisplayName: user.bridge.Config.IMessage.BridgeName(),
+		DeviceID:                 id.DeviceID(user.GetConnectorConfig().BridgeName()),
+		InitialDeviceDisplayName: user.GetConnectorConfig().BridgeName(),
 	}
 	if loginSecret == "appservice" {
 		client.AccessToken = user.bridge.AS.Registration.AppToken
@@ -152,7 +152,7 @@ func (user *User) startSyncing() {
 	if !user.bridge.Config.Bridge.SyncWithCustomPuppets {
 		return
 	}
-	if !user.bridge.IM.Capabilities().SendTypingNotifications && !user.bridge.IM.Capabilities().SendReadReceipts {
+	if !user.IM.Capabilities().SendTypingNotifications && !user.IM.Capabilities().SendReadReceipts {
 		user.log.Warnln("Syncing with double puppet is enabled in config, but configured platform doesn't support sending typing notifications nor read receipts")
 	}
 	go func() {
@@ -194,9 +194,14 @@ func (user *User) handleReceiptEvent(portal *Portal, evt *event.Event) {
 }
 
 func (user *User) ProcessResponse(resp *mautrix.RespSync, _ string) error {
+	for _, evt := range resp.AccountData.Events {
+		if evt.Type == event.AccountDataPushRules && user.bridge.Config.Bridge.MuteBridging {
+			go user.handlePushRulesEvent(evt)
+		}
+	}
 	for roomID, events := range resp.Rooms.Join {
 		portal := user.bridge.GetPortalByMXID(roomID)
-		if portal == nil {
+		if portal == nil || portal.user != user {
 			continue
 		}
 		for _, evt := range events.Ephemeral.Events {
@@ -213,6 +218,16 @@ func (user *User) ProcessResponse(resp *mautrix.RespSync, _ string) error {
 				}
 			}
 		}
+		for _, evt := range events.AccountData.Events {
+			if evt.Type != event.AccountDataRoomTags || len(user.bridge.Config.Bridge.ArchiveTag) == 0 {
+				continue
+			}
+			err := evt.Content.ParseRaw(evt.Type)
+			if err != nil {
+				return err
+			}
+			go user.handleTagEvent(portal, evt)
+		}
 	}
 
 	return nil
@@ -231,16 +246,24 @@ func (user *User) OnFailedSync(_ *mautrix.RespSync, err error) (time.Duration, e
 
 func (user *User) GetFilterJSON(_ id.UserID) *mautrix.Filter {
 	everything := []event.Type{{Type: "*"}}
+	accountData := mautrix.FilterPart{NotTypes: everything}
+	if user.bridge.Config.Bridge.MuteBridging {
+		accountData = mautrix.FilterPart{Types: []event.Type{event.AccountDataPushRules}}
+	}
+	roomAccountData := mautrix.FilterPart{NotTypes: everything}
+	if len(user.bridge.Config.Bridge.ArchiveTag) > 0 {
+		roomAccountData = mautrix.FilterPart{Types: []event.Type{event.AccountDataRoomTags}}
+	}
 	return &mautrix.Filter{
 		Presence: mautrix.FilterPart{
 			Senders: []id.UserID{user.MXID},
 			Types:   []event.Type{event.EphemeralEventPresence},
 		},
-		AccountData: mautrix.FilterPart{NotTypes: everything},
+		AccountData: accountData,
 		Room: mautrix.RoomFilter{
 			Ephemeral:    mautrix.FilterPart{Types: []event.Type{event.EphemeralEventTyping, event.EphemeralEventReceipt}},
 			IncludeLeave: false,
-			AccountData:  mautrix.FilterPart{NotTypes: everything},
+			AccountData:  roomAccountData,
 			State:        mautrix.FilterPart{NotTypes: everything},
 			Timeline:     mautrix.FilterPart{NotTypes: everything},
 		},
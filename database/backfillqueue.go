@@ -0,0 +1,139 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix/util/dbutil"
+)
+
+type BackfillJobType string
+
+const (
+	// BackfillJobForward fetches messages newer than the last bridged message.
+	BackfillJobForward BackfillJobType = "forward"
+	// BackfillJobBackward fetches messages older than the first bridged message using MSC2716.
+	BackfillJobBackward BackfillJobType = "backward"
+	// BackfillJobMedia uploads media of backfilled messages that was skipped with lazy media.
+	BackfillJobMedia BackfillJobType = "media"
+)
+
+type BackfillQueueQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+func (bqq *BackfillQueueQuery) New() *BackfillJob {
+	return &BackfillJob{
+		db:  bqq.db,
+		log: bqq.log,
+	}
+}
+
+const backfillJobColumns = "id, portal_guid, portal_receiver, job_type, priority, max_messages, attempts, next_attempt, last_error, created_at"
+
+// GetAll returns all queued jobs of the given receiver, highest priority first.
+func (bqq *BackfillQueueQuery) GetAll(receiver string) []*BackfillJob {
+	rows, err := bqq.db.Query("SELECT "+backfillJobColumns+" FROM backfill_queue WHERE portal_receiver=$1 ORDER BY priority DESC, id", receiver)
+	if err != nil {
+		bqq.log.Warnfln("Failed to get backfill queue: %v", err)
+		return nil
+	}
+	defer rows.Close()
+	var jobs []*BackfillJob
+	for rows.Next() {
+		job := bqq.New().Scan(rows)
+		if job != nil {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs
+}
+
+type BackfillJob struct {
+	db  *Database
+	log log.Logger
+
+	ID          int64
+	PortalGUID  string
+	Receiver    string
+	Type        BackfillJobType
+	Priority    int
+	MaxMessages int
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+	CreatedAt   time.Time
+}
+
+func (job *BackfillJob) Scan(row dbutil.Scannable) *BackfillJob {
+	var nextAttempt, createdAt int64
+	err := row.Scan(&job.ID, &job.PortalGUID, &job.Receiver, &job.Type, &job.Priority, &job.MaxMessages, &job.Attempts, &nextAttempt, &job.LastError, &createdAt)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			job.log.Errorln("Database scan failed:", err)
+		}
+		return nil
+	}
+	job.NextAttempt = time.UnixMilli(nextAttempt)
+	job.CreatedAt = time.UnixMilli(createdAt)
+	return job
+}
+
+// Insert adds the job to the queue. If the portal already has a job of the same type queued,
+// the existing job is kept and false is returned.
+func (job *BackfillJob) Insert() bool {
+	if job.CreatedAt.IsZero() {
+		job.CreatedAt = time.Now()
+	}
+	res, err := job.db.Exec(`
+		INSERT INTO backfill_queue (portal_guid, portal_receiver, job_type, priority, max_messages, attempts, next_attempt, last_error, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (portal_guid, portal_receiver, job_type) DO NOTHING
+	`, job.PortalGUID, job.Receiver, job.Type, job.Priority, job.MaxMessages, job.Attempts, job.NextAttempt.UnixMilli(), job.LastError, job.CreatedAt.UnixMilli())
+	if err != nil {
+		job.log.Warnfln("Failed to insert %s backfill job for %s: %v", job.Type, job.PortalGUID, err)
+		return false
+	}
+	affected, _ := res.RowsAffected()
+	if affected == 0 {
+		return false
+	}
+	job.ID, _ = res.LastInsertId()
+	return true
+}
+
+func (job *BackfillJob) Update() {
+	_, err := job.db.Exec(
+		"UPDATE backfill_queue SET priority=$1, max_messages=$2, attempts=$3, next_attempt=$4, last_error=$5 WHERE id=$6",
+		job.Priority, job.MaxMessages, job.Attempts, job.NextAttempt.UnixMilli(), job.LastError, job.ID,
+	)
+	if err != nil {
+		job.log.Warnfln("Failed to update backfill job #%d: %v", job.ID, err)
+	}
+}
+
+func (job *BackfillJob) Delete() {
+	_, err := job.db.Exec("DELETE FROM backfill_queue WHERE id=$1", job.ID)
+	if err != nil {
+		job.log.Warnfln("Failed to delete backfill job #%d: %v", job.ID, err)
+	}
+}
@@ -35,6 +35,13 @@ type Database struct {
 	Tapback    *TapbackQuery
 	KV         *KeyValueQuery
 	MergedChat *MergedChatQuery
+
+	PuppetOverride *PuppetOverrideQuery
+	MergeHistory   *MergeHistoryQuery
+	MergeOptOut    *MergeOptOutQuery
+	Space          *SpaceQuery
+	BackfillQueue  *BackfillQueueQuery
+	LazyMedia      *LazyMediaQuery
 }
 
 func New(parent *dbutil.Database, log maulogger.Logger) *Database {
@@ -71,5 +78,29 @@ func New(parent *dbutil.Database, log maulogger.Logger) *Database {
 		db:  db,
 		log: log.Sub("MergedChat"),
 	}
+	db.PuppetOverride = &PuppetOverrideQuery{
+		db:  db,
+		log: log.Sub("PuppetOverride"),
+	}
+	db.MergeHistory = &MergeHistoryQuery{
+		db:  db,
+		log: log.Sub("MergeHistory"),
+	}
+	db.MergeOptOut = &MergeOptOutQuery{
+		db:  db,
+		log: log.Sub("MergeOptOut"),
+	}
+	db.Space = &SpaceQuery{
+		db:  db,
+		log: log.Sub("Space"),
+	}
+	db.BackfillQueue = &BackfillQueueQuery{
+		db:  db,
+		log: log.Sub("BackfillQueue"),
+	}
+	db.LazyMedia = &LazyMediaQuery{
+		db:  db,
+		log: log.Sub("LazyMedia"),
+	}
 	return db
 }
@@ -33,6 +33,10 @@ const (
 	KVSendStatusStart    = "com.beeper.send_status_start"
 	KVBridgeWasConnected = "bridge_was_connected"
 	KVBridgeInfoVersion  = "bridge_info_version"
+	// KVPhoneNumbersNormalized is suffixed with the receiver and phone number region
+	KVPhoneNumbersNormalized = "phone_numbers_normalized"
+	// KVStartupSyncCheckpoint is suffixed with the receiver
+	KVStartupSyncCheckpoint = "startup_sync_checkpoint"
 
 	ExpectedBridgeInfoVersion = "1"
 )
@@ -0,0 +1,125 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/dbutil"
+
+	"go.mau.fi/mautrix-imessage/imessage"
+)
+
+type LazyMediaQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+func (lmq *LazyMediaQuery) New() *LazyMedia {
+	return &LazyMedia{
+		db:  lmq.db,
+		log: lmq.log,
+	}
+}
+
+const lazyMediaColumns = "mxc, portal_guid, portal_receiver, message_guid, uploader, upload_url, path, file_name, mime_type, is_audio, created_at"
+
+// GetPending returns media in the given portal that hasn't been uploaded yet, newest first.
+func (lmq *LazyMediaQuery) GetPending(portalGUID, receiver string, limit int) []*LazyMedia {
+	rows, err := lmq.db.Query(
+		"SELECT "+lazyMediaColumns+" FROM lazy_media WHERE portal_guid=$1 AND portal_receiver=$2 ORDER BY created_at DESC LIMIT $3",
+		portalGUID, receiver, limit,
+	)
+	if err != nil {
+		lmq.log.Warnfln("Failed to get pending media in %s: %v", portalGUID, err)
+		return nil
+	}
+	defer rows.Close()
+	var media []*LazyMedia
+	for rows.Next() {
+		lm := lmq.New().Scan(rows)
+		if lm != nil {
+			media = append(media, lm)
+		}
+	}
+	return media
+}
+
+func (lmq *LazyMediaQuery) HasPending(portalGUID, receiver string) (exists bool) {
+	err := lmq.db.QueryRow("SELECT EXISTS(SELECT 1 FROM lazy_media WHERE portal_guid=$1 AND portal_receiver=$2)", portalGUID, receiver).Scan(&exists)
+	if err != nil {
+		lmq.log.Warnfln("Failed to check pending media in %s: %v", portalGUID, err)
+	}
+	return
+}
+
+// LazyMedia is a backfilled attachment whose content URI has been reserved and sent to Matrix, but not uploaded yet.
+type LazyMedia struct {
+	db  *Database
+	log log.Logger
+
+	MXC         id.ContentURI
+	PortalGUID  string
+	Receiver    string
+	MessageGUID string
+	Uploader    id.UserID
+	UploadURL   string
+	Attachment  imessage.Attachment
+	IsAudio     bool
+	CreatedAt   time.Time
+}
+
+func (lm *LazyMedia) Scan(row dbutil.Scannable) *LazyMedia {
+	var mxc string
+	var createdAt int64
+	err := row.Scan(&mxc, &lm.PortalGUID, &lm.Receiver, &lm.MessageGUID, &lm.Uploader, &lm.UploadURL,
+		&lm.Attachment.PathOnDisk, &lm.Attachment.FileName, &lm.Attachment.MimeType, &lm.IsAudio, &createdAt)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			lm.log.Errorln("Database scan failed:", err)
+		}
+		return nil
+	}
+	lm.MXC, _ = id.ParseContentURI(mxc)
+	lm.CreatedAt = time.UnixMilli(createdAt)
+	return lm
+}
+
+func (lm *LazyMedia) Insert() {
+	if lm.CreatedAt.IsZero() {
+		lm.CreatedAt = time.Now()
+	}
+	_, err := lm.db.Exec(`
+		INSERT INTO lazy_media (mxc, portal_guid, portal_receiver, message_guid, uploader, upload_url, path, file_name, mime_type, is_audio, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+	`, lm.MXC.String(), lm.PortalGUID, lm.Receiver, lm.MessageGUID, lm.Uploader, lm.UploadURL,
+		lm.Attachment.PathOnDisk, lm.Attachment.FileName, lm.Attachment.MimeType, lm.IsAudio, lm.CreatedAt.UnixMilli())
+	if err != nil {
+		lm.log.Warnfln("Failed to insert pending media %s: %v", lm.MXC, err)
+	}
+}
+
+func (lm *LazyMedia) Delete() {
+	_, err := lm.db.Exec("DELETE FROM lazy_media WHERE mxc=$1", lm.MXC.String())
+	if err != nil {
+		lm.log.Warnfln("Failed to delete pending media %s: %v", lm.MXC, err)
+	}
+}
@@ -31,32 +31,33 @@ type MergedChatQuery struct {
 	log log.Logger
 }
 
-func (mcq *MergedChatQuery) Set(txn dbutil.Execable, target string, sources ...string) {
+func (mcq *MergedChatQuery) Set(txn dbutil.Execable, target, receiver string, sources ...string) {
 	if txn == nil {
 		txn = mcq.db
 	}
 	placeholders := make([]string, len(sources))
-	args := make([]any, len(sources)+1)
+	args := make([]any, len(sources)+2)
 	args[0] = target
+	args[1] = receiver
 	for i, source := range sources {
-		args[i+1] = source
-		placeholders[i] = fmt.Sprintf("(?1, ?%d)", i+2)
+		args[i+2] = source
+		placeholders[i] = fmt.Sprintf("(?1, ?2, ?%d)", i+3)
 	}
-	_, err := txn.Exec(fmt.Sprintf("INSERT OR REPLACE INTO merged_chat (target_guid, source_guid) VALUES %s", strings.Join(placeholders, ", ")), args...)
+	_, err := txn.Exec(fmt.Sprintf("INSERT OR REPLACE INTO merged_chat (target_guid, receiver, source_guid) VALUES %s", strings.Join(placeholders, ", ")), args...)
 	if err != nil {
 		mcq.log.Warnfln("Failed to insert %s->%s: %v", sources, target, err)
 	}
 }
 
-func (mcq *MergedChatQuery) Remove(guid string) {
-	_, err := mcq.db.Exec("DELETE FROM merged_chat WHERE source_guid=$1", guid)
+func (mcq *MergedChatQuery) Remove(guid, receiver string) {
+	_, err := mcq.db.Exec("DELETE FROM merged_chat WHERE source_guid=$1 AND receiver=$2", guid, receiver)
 	if err != nil {
 		mcq.log.Warnfln("Failed to remove %s: %v", guid, err)
 	}
 }
 
-func (mcq *MergedChatQuery) GetAllForTarget(guid string) (sources []string) {
-	rows, err := mcq.db.Query("SELECT source_guid FROM merged_chat WHERE target_guid=$1", guid)
+func (mcq *MergedChatQuery) GetAllForTarget(guid, receiver string) (sources []string) {
+	rows, err := mcq.db.Query("SELECT source_guid FROM merged_chat WHERE target_guid=$1 AND receiver=$2", guid, receiver)
 	if err != nil {
 		mcq.log.Errorfln("Failed to get merge sources for %s: %v", guid, err)
 		return
@@ -73,8 +74,8 @@ func (mcq *MergedChatQuery) GetAllForTarget(guid string) (sources []string) {
 	return
 }
 
-func (mcq *MergedChatQuery) Get(guid string) (target string) {
-	err := mcq.db.QueryRow("SELECT target_guid FROM merged_chat WHERE source_guid=$1", guid).Scan(&target)
+func (mcq *MergedChatQuery) Get(guid, receiver string) (target string) {
+	err := mcq.db.QueryRow("SELECT target_guid FROM merged_chat WHERE source_guid=$1 AND receiver=$2", guid, receiver).Scan(&target)
 	if err != nil && !errors.Is(err, sql.ErrNoRows) {
 		mcq.log.Errorfln("Failed to get merge target for %s: %v", guid, err)
 	}
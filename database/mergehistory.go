@@ -0,0 +1,130 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix/util/dbutil"
+)
+
+type MergeHistoryQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+func (mhq *MergeHistoryQuery) New() *MergeHistory {
+	return &MergeHistory{
+		db:  mhq.db,
+		log: mhq.log,
+	}
+}
+
+const mergeHistoryColumns = "id, receiver, action, layout_before, layout_after, timestamp, undone"
+
+func (mhq *MergeHistoryQuery) GetRecent(receiver string, limit int) (entries []*MergeHistory) {
+	rows, err := mhq.db.Query("SELECT "+mergeHistoryColumns+" FROM merge_history WHERE receiver=$1 ORDER BY id DESC LIMIT $2", receiver, limit)
+	if err != nil || rows == nil {
+		return nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		entry := mhq.New().Scan(rows)
+		if entry != nil {
+			entries = append(entries, entry)
+		}
+	}
+	return
+}
+
+func (mhq *MergeHistoryQuery) Get(id int64, receiver string) *MergeHistory {
+	row := mhq.db.QueryRow("SELECT "+mergeHistoryColumns+" FROM merge_history WHERE id=$1 AND receiver=$2", id, receiver)
+	if row == nil {
+		return nil
+	}
+	return mhq.New().Scan(row)
+}
+
+const (
+	MergeActionMerge = "merge"
+	MergeActionSplit = "split"
+)
+
+// PortalLayout maps the primary GUID of each portal to all the chat GUIDs that are merged into it.
+type PortalLayout map[string][]string
+
+// MergeHistory is an entry in the audit log of portal merges and splits.
+type MergeHistory struct {
+	db  *Database
+	log log.Logger
+
+	ID        int64
+	Receiver  string
+	Action    string
+	Before    PortalLayout
+	After     PortalLayout
+	Timestamp time.Time
+	Undone    bool
+}
+
+func (mh *MergeHistory) Scan(row dbutil.Scannable) *MergeHistory {
+	var before, after string
+	var ts int64
+	err := row.Scan(&mh.ID, &mh.Receiver, &mh.Action, &before, &after, &ts, &mh.Undone)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			mh.log.Errorln("Database scan failed:", err)
+		}
+		return nil
+	}
+	mh.Timestamp = time.UnixMilli(ts)
+	if err = json.Unmarshal([]byte(before), &mh.Before); err != nil {
+		mh.log.Warnfln("Failed to parse layout before merge history entry #%d: %v", mh.ID, err)
+	}
+	if err = json.Unmarshal([]byte(after), &mh.After); err != nil {
+		mh.log.Warnfln("Failed to parse layout after merge history entry #%d: %v", mh.ID, err)
+	}
+	return mh
+}
+
+func (mh *MergeHistory) Insert(txn dbutil.Execable) {
+	if txn == nil {
+		txn = mh.db
+	}
+	before, _ := json.Marshal(mh.Before)
+	after, _ := json.Marshal(mh.After)
+	res, err := txn.Exec("INSERT INTO merge_history (receiver, action, layout_before, layout_after, timestamp, undone) VALUES ($1, $2, $3, $4, $5, $6)",
+		mh.Receiver, mh.Action, string(before), string(after), mh.Timestamp.UnixMilli(), mh.Undone)
+	if err != nil {
+		mh.log.Warnfln("Failed to insert %s history entry: %v", mh.Action, err)
+		return
+	}
+	mh.ID, _ = res.LastInsertId()
+}
+
+func (mh *MergeHistory) MarkUndone() {
+	_, err := mh.db.Exec("UPDATE merge_history SET undone=true WHERE id=$1", mh.ID)
+	if err != nil {
+		mh.log.Warnfln("Failed to mark merge history entry #%d as undone: %v", mh.ID, err)
+	} else {
+		mh.Undone = true
+	}
+}
@@ -0,0 +1,64 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	log "maunium.net/go/maulogger/v2"
+)
+
+// MergeOptOutQuery stores the contact identifiers whose chats shouldn't be merged automatically.
+type MergeOptOutQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+func (mooq *MergeOptOutQuery) GetAll(receiver string) map[string]struct{} {
+	identifiers := make(map[string]struct{})
+	rows, err := mooq.db.Query("SELECT identifier FROM merge_opt_out WHERE receiver=$1", receiver)
+	if err != nil {
+		mooq.log.Errorfln("Failed to get merge opt-outs: %v", err)
+		return identifiers
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var identifier string
+		err = rows.Scan(&identifier)
+		if err != nil {
+			mooq.log.Errorfln("Failed to scan merge opt-out: %v", err)
+		} else {
+			identifiers[identifier] = struct{}{}
+		}
+	}
+	return identifiers
+}
+
+func (mooq *MergeOptOutQuery) Add(receiver, identifier string) {
+	_, err := mooq.db.Exec("INSERT INTO merge_opt_out (receiver, identifier) VALUES ($1, $2) ON CONFLICT (receiver, identifier) DO NOTHING", receiver, identifier)
+	if err != nil {
+		mooq.log.Warnfln("Failed to add merge opt-out for %s: %v", identifier, err)
+	}
+}
+
+func (mooq *MergeOptOutQuery) Remove(receiver, identifier string) bool {
+	res, err := mooq.db.Exec("DELETE FROM merge_opt_out WHERE receiver=$1 AND identifier=$2", receiver, identifier)
+	if err != nil {
+		mooq.log.Warnfln("Failed to remove merge opt-out for %s: %v", identifier, err)
+		return false
+	}
+	affected, _ := res.RowsAffected()
+	return affected > 0
+}
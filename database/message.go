@@ -29,6 +29,8 @@ import (
 	"maunium.net/go/mautrix/util/dbutil"
 )
 
+const messageColumns = "portal_guid, portal_receiver, guid, part, mxid, sender_guid, handle_guid, timestamp, thread_originator_guid, thread_originator_part, sent_at, delivered_at, read_at"
+
 type MessageQuery struct {
 	db  *Database
 	log log.Logger
@@ -41,8 +43,8 @@ func (mq *MessageQuery) New() *Message {
 	}
 }
 
-func (mq *MessageQuery) GetIDsSince(chat string, since time.Time) (messages []string) {
-	rows, err := mq.db.Query("SELECT guid FROM message WHERE portal_guid=$1 AND timestamp>=$2 AND part=0 ORDER BY timestamp ASC", chat, since.Unix()*1000)
+func (mq *MessageQuery) GetIDsSince(chat, receiver string, since time.Time) (messages []string) {
+	rows, err := mq.db.Query("SELECT guid FROM message WHERE portal_guid=$1 AND portal_receiver=$2 AND timestamp>=$3 AND part=0 ORDER BY timestamp ASC", chat, receiver, since.Unix()*1000)
 	if err != nil || rows == nil {
 		return nil
 	}
@@ -59,32 +61,45 @@ func (mq *MessageQuery) GetIDsSince(chat string, since time.Time) (messages []st
 	return
 }
 
-func (mq *MessageQuery) GetLastByGUID(chat string, guid string) *Message {
-	return mq.get("SELECT portal_guid, guid, part, mxid, sender_guid, handle_guid, timestamp "+
-		"FROM message WHERE portal_guid=$1 AND guid=$2 ORDER BY part DESC LIMIT 1", chat, guid)
+// GetUnreadUpTo returns the messages up to the given timestamp that haven't been marked as read
+// by the remote user, newest first.
+func (mq *MessageQuery) GetUnreadUpTo(chat, receiver string, timestamp int64, limit int) (messages []*Message) {
+	rows, err := mq.db.Query("SELECT "+messageColumns+" FROM message WHERE portal_guid=$1 AND portal_receiver=$2 AND read_at=0 AND timestamp>0 AND timestamp<=$3 "+
+		"ORDER BY timestamp DESC LIMIT $4", chat, receiver, timestamp, limit)
+	if err != nil || rows == nil {
+		return nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if msg := mq.New().Scan(rows); msg != nil {
+			messages = append(messages, msg)
+		}
+	}
+	return
+}
+
+func (mq *MessageQuery) GetLastByGUID(chat, receiver string, guid string) *Message {
+	return mq.get("SELECT "+messageColumns+" FROM message WHERE portal_guid=$1 AND portal_receiver=$2 AND guid=$3 ORDER BY part DESC LIMIT 1", chat, receiver, guid)
 }
 
-func (mq *MessageQuery) FindChatByGUID(guid string) (chatGUID string) {
-	err := mq.db.QueryRow("SELECT portal_guid FROM message WHERE guid=$1", guid).Scan(&chatGUID)
+func (mq *MessageQuery) FindChatByGUID(receiver, guid string) (chatGUID string) {
+	err := mq.db.QueryRow("SELECT portal_guid FROM message WHERE portal_receiver=$1 AND guid=$2", receiver, guid).Scan(&chatGUID)
 	if err != nil && !errors.Is(err, sql.ErrNoRows) {
 		mq.log.Errorfln("Failed to find chat by GUID: %v", err)
 	}
 	return
 }
 
-func (mq *MessageQuery) GetByGUID(chat string, guid string, part int) *Message {
-	return mq.get("SELECT portal_guid, guid, part, mxid, sender_guid, handle_guid, timestamp "+
-		"FROM message WHERE portal_guid=$1 AND guid=$2 AND part=$3", chat, guid, part)
+func (mq *MessageQuery) GetByGUID(chat, receiver string, guid string, part int) *Message {
+	return mq.get("SELECT "+messageColumns+" FROM message WHERE portal_guid=$1 AND portal_receiver=$2 AND guid=$3 AND part=$4", chat, receiver, guid, part)
 }
 
 func (mq *MessageQuery) GetByMXID(mxid id.EventID) *Message {
-	return mq.get("SELECT portal_guid, guid, part, mxid, sender_guid, handle_guid, timestamp "+
-		"FROM message WHERE mxid=$1", mxid)
+	return mq.get("SELECT "+messageColumns+" FROM message WHERE mxid=$1", mxid)
 }
 
-func (mq *MessageQuery) GetLastInChat(chat string) *Message {
-	msg := mq.get("SELECT portal_guid, guid, part, mxid, sender_guid, handle_guid, timestamp "+
-		"FROM message WHERE portal_guid=$1 ORDER BY timestamp DESC LIMIT 1", chat)
+func (mq *MessageQuery) GetLastInChat(chat, receiver string) *Message {
+	msg := mq.get("SELECT "+messageColumns+" FROM message WHERE portal_guid=$1 AND portal_receiver=$2 ORDER BY timestamp DESC LIMIT 1", chat, receiver)
 	if msg == nil || msg.Timestamp == 0 {
 		// Old db, we don't know what the last message is.
 		return nil
@@ -92,17 +107,37 @@ func (mq *MessageQuery) GetLastInChat(chat string) *Message {
 	return msg
 }
 
-func (mq *MessageQuery) MergePortalGUID(txn dbutil.Execable, to string, from ...string) int64 {
+// GetFirstInChat returns the oldest bridged message in the chat.
+func (mq *MessageQuery) GetFirstInChat(chat, receiver string) *Message {
+	return mq.get("SELECT "+messageColumns+" FROM message WHERE portal_guid=$1 AND portal_receiver=$2 AND timestamp>0 ORDER BY timestamp ASC, part ASC LIMIT 1", chat, receiver)
+}
+
+// GetLastInThread returns the latest message in the thread started by the given message.
+func (mq *MessageQuery) GetLastInThread(chat, receiver, originatorGUID string) *Message {
+	return mq.get("SELECT "+messageColumns+" FROM message WHERE portal_guid=$1 AND portal_receiver=$2 AND thread_originator_guid=$3 "+
+		"ORDER BY timestamp DESC, part DESC LIMIT 1", chat, receiver, originatorGUID)
+}
+
+func (mq *MessageQuery) CountInChat(chat, receiver string) (count int64) {
+	err := mq.db.QueryRow("SELECT COUNT(*) FROM message WHERE portal_guid=$1 AND portal_receiver=$2", chat, receiver).Scan(&count)
+	if err != nil {
+		mq.log.Warnfln("Failed to count messages in %s: %v", chat, err)
+	}
+	return
+}
+
+func (mq *MessageQuery) MergePortalGUID(txn dbutil.Execable, to, receiver string, from ...string) int64 {
 	if txn == nil {
 		txn = mq.db
 	}
-	args := make([]any, len(from)+1)
+	args := make([]any, len(from)+2)
 	args[0] = to
+	args[1] = receiver
 	for i, fr := range from {
-		args[i+1] = fr
+		args[i+2] = fr
 	}
 	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(from)), ",")
-	res, err := txn.Exec(fmt.Sprintf("UPDATE message SET portal_guid=? WHERE portal_guid IN (%s)", placeholders), args...)
+	res, err := txn.Exec(fmt.Sprintf("UPDATE message SET portal_guid=? WHERE portal_receiver=? AND portal_guid IN (%s)", placeholders), args...)
 	if err != nil {
 		mq.log.Errorfln("Failed to update portal GUID for messages (%v -> %s): %v", err, from, to)
 		return -1
@@ -115,11 +150,11 @@ func (mq *MessageQuery) MergePortalGUID(txn dbutil.Execable, to string, from ...
 	}
 }
 
-func (mq *MessageQuery) SplitPortalGUID(txn dbutil.Execable, fromHandle, fromPortal, to string) int64 {
+func (mq *MessageQuery) SplitPortalGUID(txn dbutil.Execable, fromHandle, fromPortal, receiver, to string) int64 {
 	if txn == nil {
 		txn = mq.db
 	}
-	res, err := txn.Exec("UPDATE message SET portal_guid=?1 WHERE portal_guid=?2 AND handle_guid=?3", to, fromPortal, fromHandle)
+	res, err := txn.Exec("UPDATE message SET portal_guid=?1 WHERE portal_guid=?2 AND portal_receiver=?3 AND handle_guid=?4", to, fromPortal, receiver, fromHandle)
 	if err != nil {
 		mq.log.Errorfln("Failed to split portal GUID for messages (%s in %s -> %s): %v", fromHandle, fromPortal, to, err)
 		return -1
@@ -144,21 +179,49 @@ type Message struct {
 	db  *Database
 	log log.Logger
 
-	PortalGUID string
-	GUID       string
-	Part       int
-	MXID       id.EventID
-	SenderGUID string
-	HandleGUID string
-	Timestamp  int64
+	PortalGUID     string
+	PortalReceiver string
+	GUID           string
+	Part           int
+	MXID           id.EventID
+	SenderGUID     string
+	HandleGUID     string
+	Timestamp      int64
+
+	ThreadOriginatorGUID string
+	ThreadOriginatorPart int
+
+	// Delivery state of outgoing messages as unix milliseconds, zero if unknown.
+	SentAt      int64
+	DeliveredAt int64
+	ReadAt      int64
 }
 
 func (msg *Message) Time() time.Time {
 	return time.UnixMilli(msg.Timestamp)
 }
 
+func unixMilliOrZero(ts int64) time.Time {
+	if ts == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ts)
+}
+
+func (msg *Message) SentTime() time.Time {
+	return unixMilliOrZero(msg.SentAt)
+}
+
+func (msg *Message) DeliveredTime() time.Time {
+	return unixMilliOrZero(msg.DeliveredAt)
+}
+
+func (msg *Message) ReadTime() time.Time {
+	return unixMilliOrZero(msg.ReadAt)
+}
+
 func (msg *Message) Scan(row dbutil.Scannable) *Message {
-	err := row.Scan(&msg.PortalGUID, &msg.GUID, &msg.Part, &msg.MXID, &msg.SenderGUID, &msg.HandleGUID, &msg.Timestamp)
+	err := row.Scan(&msg.PortalGUID, &msg.PortalReceiver, &msg.GUID, &msg.Part, &msg.MXID, &msg.SenderGUID, &msg.HandleGUID, &msg.Timestamp, &msg.ThreadOriginatorGUID, &msg.ThreadOriginatorPart, &msg.SentAt, &msg.DeliveredAt, &msg.ReadAt)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			msg.log.Errorln("Database scan failed:", err)
@@ -172,15 +235,25 @@ func (msg *Message) Insert(txn dbutil.Execable) {
 	if txn == nil {
 		txn = msg.db
 	}
-	_, err := txn.Exec("INSERT INTO message (portal_guid, guid, part, mxid, sender_guid, handle_guid, timestamp) VALUES ($1, $2, $3, $4, $5, $6, $7)",
-		msg.PortalGUID, msg.GUID, msg.Part, msg.MXID, msg.SenderGUID, msg.HandleGUID, msg.Timestamp)
+	_, err := txn.Exec("INSERT INTO message ("+messageColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)",
+		msg.PortalGUID, msg.PortalReceiver, msg.GUID, msg.Part, msg.MXID, msg.SenderGUID, msg.HandleGUID, msg.Timestamp,
+		msg.ThreadOriginatorGUID, msg.ThreadOriginatorPart, msg.SentAt, msg.DeliveredAt, msg.ReadAt)
 	if err != nil {
 		msg.log.Warnfln("Failed to insert %s.%d@%s: %v", msg.GUID, msg.Part, msg.PortalGUID, err)
 	}
 }
 
+// UpdateDeliveryState saves the delivery state of all parts of the message.
+func (msg *Message) UpdateDeliveryState() {
+	_, err := msg.db.Exec("UPDATE message SET sent_at=$1, delivered_at=$2, read_at=$3 WHERE portal_guid=$4 AND portal_receiver=$5 AND guid=$6",
+		msg.SentAt, msg.DeliveredAt, msg.ReadAt, msg.PortalGUID, msg.PortalReceiver, msg.GUID)
+	if err != nil {
+		msg.log.Warnfln("Failed to update delivery state of %s@%s: %v", msg.GUID, msg.PortalGUID, err)
+	}
+}
+
 func (msg *Message) Delete() {
-	_, err := msg.db.Exec("DELETE FROM message WHERE portal_guid=$1 AND guid=$2", msg.PortalGUID, msg.GUID)
+	_, err := msg.db.Exec("DELETE FROM message WHERE portal_guid=$1 AND portal_receiver=$2 AND guid=$3", msg.PortalGUID, msg.PortalReceiver, msg.GUID)
 	if err != nil {
 		msg.log.Warnfln("Failed to delete %s.%d@%s: %v", msg.GUID, msg.Part, msg.PortalGUID, err)
 	}
@@ -18,10 +18,12 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 
 	log "maunium.net/go/maulogger/v2"
 
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 	"maunium.net/go/mautrix/util/dbutil"
 
@@ -49,20 +51,20 @@ func (pq *PortalQuery) Count() (count int) {
 	return
 }
 
-const portalColumns = "guid, mxid, name, avatar_hash, avatar_url, encrypted, backfill_start_ts, in_space, thread_id, last_seen_handle, first_event_id, next_batch_id"
+const portalColumns = "guid, receiver, mxid, name, avatar_hash, avatar_url, encrypted, backfill_start_ts, in_space, thread_id, last_seen_handle, first_event_id, next_batch_id, send_policy, space_tag, muted, archived, info_hash, settings"
 const selectPortal = "SELECT " + portalColumns + " FROM portal"
-const selectMergedPortalByGUID = "SELECT " + portalColumns + " FROM merged_chat LEFT JOIN portal ON merged_chat.target_guid=portal.guid WHERE source_guid=$1"
+const selectMergedPortalByGUID = "SELECT " + portalColumns + " FROM merged_chat LEFT JOIN portal ON merged_chat.target_guid=portal.guid AND merged_chat.receiver=portal.receiver WHERE source_guid=$1 AND merged_chat.receiver=$2"
 
 func (pq *PortalQuery) GetAllWithMXID() []*Portal {
 	return pq.getAll(selectPortal + " WHERE mxid<>''")
 }
 
-func (pq *PortalQuery) GetByGUID(guid string) *Portal {
+func (pq *PortalQuery) GetByGUID(guid, receiver string) *Portal {
 	parsed := imessage.ParseIdentifier(guid)
 	if parsed.IsGroup {
-		return pq.get(selectPortal+" WHERE guid=$1", guid)
+		return pq.get(selectPortal+" WHERE guid=$1 AND receiver=$2", guid, receiver)
 	} else {
-		return pq.get(selectMergedPortalByGUID, guid)
+		return pq.get(selectMergedPortalByGUID, guid, receiver)
 	}
 }
 
@@ -70,8 +72,8 @@ func (pq *PortalQuery) GetByMXID(mxid id.RoomID) *Portal {
 	return pq.get(selectPortal+" WHERE mxid=$1", mxid)
 }
 
-func (pq *PortalQuery) FindPrivateChats() []*Portal {
-	return pq.getAll(selectPortal + " WHERE guid LIKE '%%;-;%%'")
+func (pq *PortalQuery) FindPrivateChats(receiver string) []*Portal {
+	return pq.getAll(selectPortal+" WHERE guid LIKE '%%;-;%%' AND receiver=$1", receiver)
 }
 
 func (pq *PortalQuery) getAll(query string, args ...interface{}) (portals []*Portal) {
@@ -98,8 +100,9 @@ type Portal struct {
 	db  *Database
 	log log.Logger
 
-	GUID string
-	MXID id.RoomID
+	GUID     string
+	Receiver string
+	MXID     id.RoomID
 
 	Name            string
 	AvatarHash      *[32]byte
@@ -112,6 +115,26 @@ type Portal struct {
 
 	FirstEventID id.EventID
 	NextBatchID  id.BatchID
+
+	SendPolicy string
+	SpaceTag   string
+	Muted      bool
+	Archived   bool
+	InfoHash   string
+	Settings   PortalSettings
+}
+
+// PortalSettings contains per-portal overrides for bridge config options. Nil fields use the global config.
+type PortalSettings struct {
+	CaptionInMessage      *bool                        `json:"caption_in_message,omitempty"`
+	PrivateChatPortalMeta *string                      `json:"private_chat_portal_meta,omitempty"`
+	ConvertHEIF           *bool                        `json:"convert_heif,omitempty"`
+	ConvertTIFF           *bool                        `json:"convert_tiff,omitempty"`
+	ConvertVideo          *bool                        `json:"convert_video,omitempty"`
+	LinkPreviews          *bool                        `json:"link_previews,omitempty"`
+	RelayFormats          map[event.MessageType]string `json:"relay_formats,omitempty"`
+	// Permissions maps actions to the list of users who may do them (see permissions.go in the main package).
+	Permissions map[string][]string `json:"permissions,omitempty"`
 }
 
 func (portal *Portal) avatarHashSlice() []byte {
@@ -124,7 +147,8 @@ func (portal *Portal) avatarHashSlice() []byte {
 func (portal *Portal) Scan(row dbutil.Scannable) *Portal {
 	var mxid, avatarURL sql.NullString
 	var avatarHashSlice []byte
-	err := row.Scan(&portal.GUID, &mxid, &portal.Name, &avatarHashSlice, &avatarURL, &portal.Encrypted, &portal.BackfillStartTS, &portal.InSpace, &portal.ThreadID, &portal.LastSeenHandle, &portal.FirstEventID, &portal.NextBatchID)
+	var settings string
+	err := row.Scan(&portal.GUID, &portal.Receiver, &mxid, &portal.Name, &avatarHashSlice, &avatarURL, &portal.Encrypted, &portal.BackfillStartTS, &portal.InSpace, &portal.ThreadID, &portal.LastSeenHandle, &portal.FirstEventID, &portal.NextBatchID, &portal.SendPolicy, &portal.SpaceTag, &portal.Muted, &portal.Archived, &portal.InfoHash, &settings)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			portal.log.Errorln("Database scan failed:", err)
@@ -132,6 +156,12 @@ func (portal *Portal) Scan(row dbutil.Scannable) *Portal {
 		return nil
 	}
 	portal.MXID = id.RoomID(mxid.String)
+	if len(settings) > 0 {
+		err = json.Unmarshal([]byte(settings), &portal.Settings)
+		if err != nil {
+			portal.log.Warnfln("Failed to parse settings of %s: %v", portal.GUID, err)
+		}
+	}
 	portal.AvatarURL, _ = id.ParseContentURI(avatarURL.String)
 	if avatarHashSlice != nil || len(avatarHashSlice) == 32 {
 		var avatarHash [32]byte
@@ -148,12 +178,21 @@ func (portal *Portal) mxidPtr() *id.RoomID {
 	return nil
 }
 
+func (portal *Portal) settingsJSON() string {
+	data, err := json.Marshal(&portal.Settings)
+	if err != nil {
+		portal.log.Warnfln("Failed to marshal settings of %s: %v", portal.GUID, err)
+		return "{}"
+	}
+	return string(data)
+}
+
 func (portal *Portal) Insert(txn dbutil.Execable) {
 	if txn == nil {
 		txn = portal.db
 	}
-	_, err := txn.Exec(fmt.Sprintf("INSERT INTO portal (%s) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)", portalColumns),
-		portal.GUID, portal.mxidPtr(), portal.Name, portal.avatarHashSlice(), portal.AvatarURL.String(), portal.Encrypted, portal.BackfillStartTS, portal.InSpace, portal.ThreadID, portal.LastSeenHandle, portal.FirstEventID, portal.NextBatchID)
+	_, err := txn.Exec(fmt.Sprintf("INSERT INTO portal (%s) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19)", portalColumns),
+		portal.GUID, portal.Receiver, portal.mxidPtr(), portal.Name, portal.avatarHashSlice(), portal.AvatarURL.String(), portal.Encrypted, portal.BackfillStartTS, portal.InSpace, portal.ThreadID, portal.LastSeenHandle, portal.FirstEventID, portal.NextBatchID, portal.SendPolicy, portal.SpaceTag, portal.Muted, portal.Archived, portal.InfoHash, portal.settingsJSON())
 	if err != nil {
 		portal.log.Warnfln("Failed to insert %s: %v", portal.GUID, err)
 	} else {
@@ -169,15 +208,15 @@ func (portal *Portal) Update(txn dbutil.Execable) {
 	if len(portal.MXID) > 0 {
 		mxid = &portal.MXID
 	}
-	_, err := txn.Exec("UPDATE portal SET mxid=$1, name=$2, avatar_hash=$3, avatar_url=$4, encrypted=$5, backfill_start_ts=$6, in_space=$7, thread_id=$8, last_seen_handle=$9, first_event_id=$10, next_batch_id=$11 WHERE guid=$12",
-		mxid, portal.Name, portal.avatarHashSlice(), portal.AvatarURL.String(), portal.Encrypted, portal.BackfillStartTS, portal.InSpace, portal.ThreadID, portal.LastSeenHandle, portal.FirstEventID, portal.NextBatchID, portal.GUID)
+	_, err := txn.Exec("UPDATE portal SET mxid=$1, name=$2, avatar_hash=$3, avatar_url=$4, encrypted=$5, backfill_start_ts=$6, in_space=$7, thread_id=$8, last_seen_handle=$9, first_event_id=$10, next_batch_id=$11, send_policy=$12, space_tag=$13, muted=$14, archived=$15, info_hash=$16, settings=$17 WHERE guid=$18 AND receiver=$19",
+		mxid, portal.Name, portal.avatarHashSlice(), portal.AvatarURL.String(), portal.Encrypted, portal.BackfillStartTS, portal.InSpace, portal.ThreadID, portal.LastSeenHandle, portal.FirstEventID, portal.NextBatchID, portal.SendPolicy, portal.SpaceTag, portal.Muted, portal.Archived, portal.InfoHash, portal.settingsJSON(), portal.GUID, portal.Receiver)
 	if err != nil {
 		portal.log.Warnfln("Failed to update %s: %v", portal.GUID, err)
 	}
 }
 
 func (portal *Portal) ReID(newGUID string) {
-	_, err := portal.db.Exec("UPDATE portal SET guid=$1 WHERE guid=$2", newGUID, portal.GUID)
+	_, err := portal.db.Exec("UPDATE portal SET guid=$1 WHERE guid=$2 AND receiver=$3", newGUID, portal.GUID, portal.Receiver)
 	if err != nil {
 		portal.log.Warnfln("Failed to re-id %s: %v", portal.GUID, err)
 	} else {
@@ -186,7 +225,7 @@ func (portal *Portal) ReID(newGUID string) {
 }
 
 func (portal *Portal) Delete() {
-	_, err := portal.db.Exec("DELETE FROM portal WHERE guid=$1", portal.GUID)
+	_, err := portal.db.Exec("DELETE FROM portal WHERE guid=$1 AND receiver=$2", portal.GUID, portal.Receiver)
 	if err != nil {
 		portal.log.Warnfln("Failed to delete %s: %v", portal.GUID, err)
 	}
@@ -38,10 +38,10 @@ func (pq *PuppetQuery) New() *Puppet {
 	}
 }
 
-const puppetColumns = "id, displayname, name_overridden, avatar_hash, avatar_url, contact_info_set"
+const puppetColumns = "id, receiver, displayname, name_overridden, avatar_hash, avatar_url, contact_info_set"
 
-func (pq *PuppetQuery) GetAll() (puppets []*Puppet) {
-	rows, err := pq.db.Query(fmt.Sprintf("SELECT %s FROM puppet", puppetColumns))
+func (pq *PuppetQuery) GetAll(receiver string) (puppets []*Puppet) {
+	rows, err := pq.db.Query(fmt.Sprintf("SELECT %s FROM puppet WHERE receiver=$1", puppetColumns), receiver)
 	if err != nil || rows == nil {
 		return nil
 	}
@@ -52,8 +52,8 @@ func (pq *PuppetQuery) GetAll() (puppets []*Puppet) {
 	return
 }
 
-func (pq *PuppetQuery) Get(id string) *Puppet {
-	row := pq.db.QueryRow(fmt.Sprintf("SELECT %s FROM puppet WHERE id=$1", puppetColumns), id)
+func (pq *PuppetQuery) Get(id, receiver string) *Puppet {
+	row := pq.db.QueryRow(fmt.Sprintf("SELECT %s FROM puppet WHERE id=$1 AND receiver=$2", puppetColumns), id, receiver)
 	if row == nil {
 		return nil
 	}
@@ -65,6 +65,7 @@ type Puppet struct {
 	log log.Logger
 
 	ID             string
+	Receiver       string
 	Displayname    string
 	NameOverridden bool
 	AvatarHash     *[32]byte
@@ -82,7 +83,7 @@ func (puppet *Puppet) avatarHashSlice() []byte {
 func (puppet *Puppet) Scan(row dbutil.Scannable) *Puppet {
 	var avatarURL sql.NullString
 	var avatarHashSlice []byte
-	err := row.Scan(&puppet.ID, &puppet.Displayname, &puppet.NameOverridden, &avatarHashSlice, &avatarURL, &puppet.ContactInfoSet)
+	err := row.Scan(&puppet.ID, &puppet.Receiver, &puppet.Displayname, &puppet.NameOverridden, &avatarHashSlice, &avatarURL, &puppet.ContactInfoSet)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			puppet.log.Errorln("Database scan failed:", err)
@@ -99,17 +100,42 @@ func (puppet *Puppet) Scan(row dbutil.Scannable) *Puppet {
 }
 
 func (puppet *Puppet) Insert() {
-	_, err := puppet.db.Exec("INSERT INTO puppet (id, displayname, name_overridden, avatar_hash, avatar_url, contact_info_set) VALUES ($1, $2, $3, $4, $5, $6)",
-		puppet.ID, puppet.Displayname, puppet.NameOverridden, puppet.avatarHashSlice(), puppet.AvatarURL.String(), puppet.ContactInfoSet)
+	_, err := puppet.db.Exec("INSERT INTO puppet (id, receiver, displayname, name_overridden, avatar_hash, avatar_url, contact_info_set) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		puppet.ID, puppet.Receiver, puppet.Displayname, puppet.NameOverridden, puppet.avatarHashSlice(), puppet.AvatarURL.String(), puppet.ContactInfoSet)
 	if err != nil {
 		puppet.log.Warnfln("Failed to insert %s: %v", puppet.ID, err)
 	}
 }
 
 func (puppet *Puppet) Update() {
-	_, err := puppet.db.Exec("UPDATE puppet SET displayname=$1, name_overridden=$2, avatar_hash=$3, avatar_url=$4, contact_info_set=$5 WHERE id=$6",
-		puppet.Displayname, puppet.NameOverridden, puppet.avatarHashSlice(), puppet.AvatarURL.String(), puppet.ContactInfoSet, puppet.ID)
+	_, err := puppet.db.Exec("UPDATE puppet SET displayname=$1, name_overridden=$2, avatar_hash=$3, avatar_url=$4, contact_info_set=$5 WHERE id=$6 AND receiver=$7",
+		puppet.Displayname, puppet.NameOverridden, puppet.avatarHashSlice(), puppet.AvatarURL.String(), puppet.ContactInfoSet, puppet.ID, puppet.Receiver)
 	if err != nil {
 		puppet.log.Warnfln("Failed to update %s: %v", puppet.ID, err)
 	}
 }
+
+func (puppet *Puppet) ReID(newID string) {
+	_, err := puppet.db.Exec("UPDATE puppet SET id=$1 WHERE id=$2 AND receiver=$3", newID, puppet.ID, puppet.Receiver)
+	if err != nil {
+		puppet.log.Warnfln("Failed to re-id %s: %v", puppet.ID, err)
+		return
+	}
+	_, err = puppet.db.Exec("UPDATE puppet_override SET puppet_id=$1 WHERE puppet_id=$2 AND receiver=$3", newID, puppet.ID, puppet.Receiver)
+	if err != nil {
+		puppet.log.Warnfln("Failed to re-id override of %s: %v", puppet.ID, err)
+	}
+	puppet.ID = newID
+}
+
+func (puppet *Puppet) Delete() {
+	_, err := puppet.db.Exec("DELETE FROM puppet WHERE id=$1 AND receiver=$2", puppet.ID, puppet.Receiver)
+	if err != nil {
+		puppet.log.Warnfln("Failed to delete %s: %v", puppet.ID, err)
+		return
+	}
+	_, err = puppet.db.Exec("DELETE FROM puppet_override WHERE puppet_id=$1 AND receiver=$2", puppet.ID, puppet.Receiver)
+	if err != nil {
+		puppet.log.Warnfln("Failed to delete override of %s: %v", puppet.ID, err)
+	}
+}
@@ -0,0 +1,93 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/dbutil"
+)
+
+type PuppetOverrideQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+func (poq *PuppetOverrideQuery) New() *PuppetOverride {
+	return &PuppetOverride{
+		db:  poq.db,
+		log: poq.log,
+	}
+}
+
+func (poq *PuppetOverrideQuery) Get(puppetID, receiver string) *PuppetOverride {
+	row := poq.db.QueryRow("SELECT puppet_id, receiver, displayname, avatar_url, hide_identifier FROM puppet_override WHERE puppet_id=$1 AND receiver=$2", puppetID, receiver)
+	if row == nil {
+		return nil
+	}
+	return poq.New().Scan(row)
+}
+
+// PuppetOverride contains local profile overrides for a ghost, which take precedence over contact info.
+type PuppetOverride struct {
+	db  *Database
+	log log.Logger
+
+	PuppetID       string
+	Receiver       string
+	Displayname    string
+	AvatarURL      id.ContentURI
+	HideIdentifier bool
+}
+
+func (po *PuppetOverride) IsEmpty() bool {
+	return po == nil || (len(po.Displayname) == 0 && po.AvatarURL.IsEmpty() && !po.HideIdentifier)
+}
+
+func (po *PuppetOverride) Scan(row dbutil.Scannable) *PuppetOverride {
+	var avatarURL string
+	err := row.Scan(&po.PuppetID, &po.Receiver, &po.Displayname, &avatarURL, &po.HideIdentifier)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			po.log.Errorln("Database scan failed:", err)
+		}
+		return nil
+	}
+	po.AvatarURL, _ = id.ParseContentURI(avatarURL)
+	return po
+}
+
+func (po *PuppetOverride) Upsert() {
+	_, err := po.db.Exec(`
+		INSERT INTO puppet_override (puppet_id, receiver, displayname, avatar_url, hide_identifier) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (puppet_id, receiver) DO UPDATE
+			SET displayname=excluded.displayname, avatar_url=excluded.avatar_url, hide_identifier=excluded.hide_identifier
+	`, po.PuppetID, po.Receiver, po.Displayname, po.AvatarURL.String(), po.HideIdentifier)
+	if err != nil {
+		po.log.Warnfln("Failed to upsert override for %s: %v", po.PuppetID, err)
+	}
+}
+
+func (po *PuppetOverride) Delete() {
+	_, err := po.db.Exec("DELETE FROM puppet_override WHERE puppet_id=$1 AND receiver=$2", po.PuppetID, po.Receiver)
+	if err != nil {
+		po.log.Warnfln("Failed to delete override for %s: %v", po.PuppetID, err)
+	}
+}
@@ -0,0 +1,86 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// SpaceQuery tracks the sub-spaces of users and which sub-spaces each portal has been added to.
+type SpaceQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+func (sq *SpaceQuery) getRoomMap(query string, args ...any) map[string]id.RoomID {
+	spaces := make(map[string]id.RoomID)
+	rows, err := sq.db.Query(query, args...)
+	if err != nil {
+		sq.log.Errorfln("Failed to query spaces: %v", err)
+		return spaces
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var roomID id.RoomID
+		err = rows.Scan(&key, &roomID)
+		if err != nil {
+			sq.log.Errorfln("Failed to scan space: %v", err)
+		} else {
+			spaces[key] = roomID
+		}
+	}
+	return spaces
+}
+
+func (sq *SpaceQuery) GetUserSpaces(userID id.UserID) map[string]id.RoomID {
+	return sq.getRoomMap("SELECT space_key, room_id FROM user_space WHERE user_mxid=$1", userID)
+}
+
+func (sq *SpaceQuery) SetUserSpace(userID id.UserID, key string, roomID id.RoomID) {
+	_, err := sq.db.Exec(`
+		INSERT INTO user_space (user_mxid, space_key, room_id) VALUES ($1, $2, $3)
+		ON CONFLICT (user_mxid, space_key) DO UPDATE SET room_id=excluded.room_id
+	`, userID, key, roomID)
+	if err != nil {
+		sq.log.Warnfln("Failed to save %s space of %s: %v", key, userID, err)
+	}
+}
+
+// GetPortalSpaces returns the sub-space keys of the portal mapped to the room ID that was added to each sub-space.
+func (sq *SpaceQuery) GetPortalSpaces(guid, receiver string) map[string]id.RoomID {
+	return sq.getRoomMap("SELECT space_key, room_id FROM portal_space WHERE portal_guid=$1 AND portal_receiver=$2", guid, receiver)
+}
+
+func (sq *SpaceQuery) AddPortalSpace(guid, receiver, key string, roomID id.RoomID) {
+	_, err := sq.db.Exec(`
+		INSERT INTO portal_space (portal_guid, portal_receiver, space_key, room_id) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (portal_guid, portal_receiver, space_key) DO UPDATE SET room_id=excluded.room_id
+	`, guid, receiver, key, roomID)
+	if err != nil {
+		sq.log.Warnfln("Failed to save %s space of %s: %v", key, guid, err)
+	}
+}
+
+func (sq *SpaceQuery) RemovePortalSpace(guid, receiver, key string) {
+	_, err := sq.db.Exec("DELETE FROM portal_space WHERE portal_guid=$1 AND portal_receiver=$2 AND space_key=$3", guid, receiver, key)
+	if err != nil {
+		sq.log.Warnfln("Failed to remove %s space of %s: %v", key, guid, err)
+	}
+}
@@ -27,6 +27,8 @@ import (
 	"go.mau.fi/mautrix-imessage/imessage"
 )
 
+const tapbackColumns = "portal_guid, portal_receiver, guid, message_guid, message_part, sender_guid, handle_guid, type, emoji, mxid"
+
 type TapbackQuery struct {
 	db  *Database
 	log log.Logger
@@ -39,21 +41,18 @@ func (mq *TapbackQuery) New() *Tapback {
 	}
 }
 
-func (mq *TapbackQuery) GetByGUID(chat, message string, part int, sender string) *Tapback {
-	return mq.get("SELECT portal_guid, guid, message_guid, message_part, sender_guid, handle_guid, type, mxid "+
-		"FROM tapback WHERE portal_guid=$1 AND message_guid=$2 AND message_part=$3 AND sender_guid=$4",
-		chat, message, part, sender)
+func (mq *TapbackQuery) GetByGUID(chat, receiver, message string, part int, sender string) *Tapback {
+	return mq.get("SELECT "+tapbackColumns+" FROM tapback WHERE portal_guid=$1 AND portal_receiver=$2 AND message_guid=$3 AND message_part=$4 AND sender_guid=$5",
+		chat, receiver, message, part, sender)
 }
 
-func (mq *TapbackQuery) GetByTapbackGUID(chat, tapback string) *Tapback {
-	return mq.get("SELECT portal_guid, guid, message_guid, message_part, sender_guid, handle_guid, type, mxid "+
-		"FROM tapback WHERE portal_guid=$1 AND guid=$2",
-		chat, tapback)
+func (mq *TapbackQuery) GetByTapbackGUID(chat, receiver, tapback string) *Tapback {
+	return mq.get("SELECT "+tapbackColumns+" FROM tapback WHERE portal_guid=$1 AND portal_receiver=$2 AND guid=$3",
+		chat, receiver, tapback)
 }
 
 func (mq *TapbackQuery) GetByMXID(mxid id.EventID) *Tapback {
-	return mq.get("SELECT portal_guid, guid, message_guid, message_part, sender_guid, handle_guid, type, mxid "+
-		"FROM tapback WHERE mxid=$1", mxid)
+	return mq.get("SELECT "+tapbackColumns+" FROM tapback WHERE mxid=$1", mxid)
 }
 
 func (mq *TapbackQuery) get(query string, args ...interface{}) *Tapback {
@@ -68,19 +67,21 @@ type Tapback struct {
 	db  *Database
 	log log.Logger
 
-	PortalGUID  string
-	GUID        string
-	MessageGUID string
-	MessagePart int
-	SenderGUID  string
-	HandleGUID  string
-	Type        imessage.TapbackType
-	MXID        id.EventID
+	PortalGUID     string
+	PortalReceiver string
+	GUID           string
+	MessageGUID    string
+	MessagePart    int
+	SenderGUID     string
+	HandleGUID     string
+	Type           imessage.TapbackType
+	Emoji          string
+	MXID           id.EventID
 }
 
 func (tapback *Tapback) Scan(row dbutil.Scannable) *Tapback {
 	var nullishGUID sql.NullString
-	err := row.Scan(&tapback.PortalGUID, &nullishGUID, &tapback.MessageGUID, &tapback.MessagePart, &tapback.SenderGUID, &tapback.HandleGUID, &tapback.Type, &tapback.MXID)
+	err := row.Scan(&tapback.PortalGUID, &tapback.PortalReceiver, &nullishGUID, &tapback.MessageGUID, &tapback.MessagePart, &tapback.SenderGUID, &tapback.HandleGUID, &tapback.Type, &tapback.Emoji, &tapback.MXID)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			tapback.log.Errorln("Database scan failed:", err)
@@ -95,23 +96,23 @@ func (tapback *Tapback) Insert(txn dbutil.Execable) {
 	if txn == nil {
 		txn = tapback.db
 	}
-	_, err := txn.Exec("INSERT INTO tapback (portal_guid, guid, message_guid, message_part, sender_guid, handle_guid, type, mxid) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
-		tapback.PortalGUID, tapback.GUID, tapback.MessageGUID, tapback.MessagePart, tapback.SenderGUID, tapback.HandleGUID, tapback.Type, tapback.MXID)
+	_, err := txn.Exec("INSERT INTO tapback ("+tapbackColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)",
+		tapback.PortalGUID, tapback.PortalReceiver, tapback.GUID, tapback.MessageGUID, tapback.MessagePart, tapback.SenderGUID, tapback.HandleGUID, tapback.Type, tapback.Emoji, tapback.MXID)
 	if err != nil {
 		tapback.log.Warnfln("Failed to insert tapback %s/%s.%d/%s: %v", tapback.PortalGUID, tapback.MessageGUID, tapback.MessagePart, tapback.SenderGUID, err)
 	}
 }
 
 func (tapback *Tapback) Update() {
-	_, err := tapback.db.Exec("UPDATE tapback SET guid=?5, type=?6, mxid=?7 WHERE portal_guid=?1 AND message_guid=?2 AND message_part=?3 AND sender_guid=?4",
-		tapback.PortalGUID, tapback.MessageGUID, tapback.MessagePart, tapback.SenderGUID, tapback.GUID, tapback.Type, tapback.MXID)
+	_, err := tapback.db.Exec("UPDATE tapback SET guid=?6, type=?7, emoji=?8, mxid=?9 WHERE portal_guid=?1 AND portal_receiver=?2 AND message_guid=?3 AND message_part=?4 AND sender_guid=?5",
+		tapback.PortalGUID, tapback.PortalReceiver, tapback.MessageGUID, tapback.MessagePart, tapback.SenderGUID, tapback.GUID, tapback.Type, tapback.Emoji, tapback.MXID)
 	if err != nil {
 		tapback.log.Warnfln("Failed to update tapback %s/%s.%d/%s: %v", tapback.PortalGUID, tapback.MessageGUID, tapback.MessagePart, tapback.SenderGUID, err)
 	}
 }
 
 func (tapback *Tapback) Delete() {
-	_, err := tapback.db.Exec("DELETE FROM tapback WHERE portal_guid=$1 AND message_guid=$2 AND message_part=$3 AND sender_guid=$4", tapback.PortalGUID, tapback.MessageGUID, tapback.MessagePart, tapback.SenderGUID)
+	_, err := tapback.db.Exec("DELETE FROM tapback WHERE portal_guid=$1 AND portal_receiver=$2 AND message_guid=$3 AND message_part=$4 AND sender_guid=$5", tapback.PortalGUID, tapback.PortalReceiver, tapback.MessageGUID, tapback.MessagePart, tapback.SenderGUID)
 	if err != nil {
 		tapback.log.Warnfln("Failed to delete tapback %s/%s.%d/%s: %v", tapback.PortalGUID, tapback.MessageGUID, tapback.MessagePart, tapback.SenderGUID, err)
 	}
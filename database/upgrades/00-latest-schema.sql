@@ -1,9 +1,10 @@
--- v0 -> v19: Latest schema
+-- v0 -> v33: Latest schema
 
 CREATE TABLE portal (
-	guid              TEXT    PRIMARY KEY,
-	mxid              TEXT    UNIQUE,
-	name              TEXT    NOT NULL,
+	guid              TEXT,
+	receiver          TEXT NOT NULL DEFAULT '',
+	mxid              TEXT UNIQUE,
+	name              TEXT NOT NULL,
 	avatar_hash       TEXT,
 	avatar_url        TEXT,
 	encrypted         BOOLEAN NOT NULL DEFAULT false,
@@ -12,16 +13,37 @@ CREATE TABLE portal (
 	thread_id         TEXT NOT NULL DEFAULT '',
 	last_seen_handle  TEXT NOT NULL DEFAULT '',
 	first_event_id    TEXT NOT NULL DEFAULT '',
-	next_batch_id     TEXT NOT NULL DEFAULT ''
+	next_batch_id     TEXT NOT NULL DEFAULT '',
+	send_policy       TEXT NOT NULL DEFAULT '',
+	space_tag         TEXT NOT NULL DEFAULT '',
+	muted             BOOLEAN NOT NULL DEFAULT false,
+	archived          BOOLEAN NOT NULL DEFAULT false,
+	info_hash         TEXT NOT NULL DEFAULT '',
+	settings          TEXT NOT NULL DEFAULT '{}',
+
+	PRIMARY KEY (guid, receiver)
 );
 
 CREATE TABLE puppet (
-	id               TEXT PRIMARY KEY,
+	id               TEXT,
+	receiver         TEXT NOT NULL DEFAULT '',
 	displayname      TEXT NOT NULL,
 	name_overridden  BOOLEAN,
 	avatar_hash      TEXT,
 	avatar_url       TEXT,
-	contact_info_set BOOLEAN NOT NULL DEFAULT false
+	contact_info_set BOOLEAN NOT NULL DEFAULT false,
+
+	PRIMARY KEY (id, receiver)
+);
+
+CREATE TABLE puppet_override (
+	puppet_id       TEXT,
+	receiver        TEXT NOT NULL DEFAULT '',
+	displayname     TEXT NOT NULL DEFAULT '',
+	avatar_url      TEXT NOT NULL DEFAULT '',
+	hide_identifier BOOLEAN NOT NULL DEFAULT false,
+
+	PRIMARY KEY (puppet_id, receiver)
 );
 
 CREATE TABLE "user" (
@@ -29,30 +51,46 @@ CREATE TABLE "user" (
 	access_token    TEXT NOT NULL,
 	next_batch      TEXT NOT NULL,
 	space_room      TEXT NOT NULL,
-	management_room TEXT NOT NULL
+	management_room TEXT NOT NULL,
+	logged_out      BOOLEAN NOT NULL DEFAULT false
 );
 
 CREATE TABLE message (
-	portal_guid   TEXT REFERENCES portal(guid) ON DELETE CASCADE ON UPDATE CASCADE,
-	guid          TEXT,
-	part          INTEGER,
-	mxid          TEXT NOT NULL UNIQUE,
-	sender_guid   TEXT NOT NULL,
-	handle_guid   TEXT NOT NULL DEFAULT '',
-	timestamp     BIGINT NOT NULL,
-	PRIMARY KEY (portal_guid, guid, part)
+	portal_guid     TEXT,
+	portal_receiver TEXT NOT NULL DEFAULT '',
+	guid            TEXT,
+	part            INTEGER,
+	mxid            TEXT NOT NULL UNIQUE,
+	sender_guid     TEXT NOT NULL,
+	handle_guid     TEXT NOT NULL DEFAULT '',
+	timestamp       BIGINT NOT NULL,
+
+	thread_originator_guid TEXT NOT NULL DEFAULT '',
+	thread_originator_part INTEGER NOT NULL DEFAULT 0,
+
+	sent_at      BIGINT NOT NULL DEFAULT 0,
+	delivered_at BIGINT NOT NULL DEFAULT 0,
+	read_at      BIGINT NOT NULL DEFAULT 0,
+
+	PRIMARY KEY (portal_guid, portal_receiver, guid, part),
+	FOREIGN KEY (portal_guid, portal_receiver) REFERENCES portal(guid, receiver) ON DELETE CASCADE ON UPDATE CASCADE
 );
 
 CREATE TABLE tapback (
-	portal_guid  TEXT,
-	message_guid TEXT,
-	message_part INTEGER,
-	sender_guid  TEXT,
-	handle_guid  TEXT NOT NULL DEFAULT '',
-	type         INTEGER NOT NULL,
-	mxid         TEXT NOT NULL UNIQUE, guid TEXT DEFAULT NULL,
-	PRIMARY KEY (portal_guid, message_guid, message_part, sender_guid),
-	FOREIGN KEY (portal_guid, message_guid, message_part) REFERENCES message(portal_guid, guid, part) ON DELETE CASCADE ON UPDATE CASCADE
+	portal_guid     TEXT,
+	portal_receiver TEXT NOT NULL DEFAULT '',
+	message_guid    TEXT,
+	message_part    INTEGER,
+	sender_guid     TEXT,
+	handle_guid     TEXT NOT NULL DEFAULT '',
+	type            INTEGER NOT NULL,
+	emoji           TEXT NOT NULL DEFAULT '',
+	mxid            TEXT NOT NULL UNIQUE,
+	guid            TEXT DEFAULT NULL,
+
+	PRIMARY KEY (portal_guid, portal_receiver, message_guid, message_part, sender_guid),
+	FOREIGN KEY (portal_guid, portal_receiver, message_guid, message_part)
+		REFERENCES message(portal_guid, portal_receiver, guid, part) ON DELETE CASCADE ON UPDATE CASCADE
 );
 
 CREATE TABLE kv_store (
@@ -61,17 +99,87 @@ CREATE TABLE kv_store (
 );
 
 CREATE TABLE merged_chat (
-	source_guid TEXT PRIMARY KEY,
+	source_guid TEXT,
+	receiver    TEXT NOT NULL DEFAULT '',
 	target_guid TEXT NOT NULL,
 
-	CONSTRAINT merged_chat_portal_fkey FOREIGN KEY (target_guid) REFERENCES portal(guid) ON DELETE CASCADE ON UPDATE CASCADE
+	PRIMARY KEY (source_guid, receiver),
+	CONSTRAINT merged_chat_portal_fkey FOREIGN KEY (target_guid, receiver) REFERENCES portal(guid, receiver) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE merge_history (
+	id            INTEGER PRIMARY KEY,
+	receiver      TEXT NOT NULL DEFAULT '',
+	action        TEXT NOT NULL,
+	layout_before TEXT NOT NULL,
+	layout_after  TEXT NOT NULL,
+	timestamp     BIGINT NOT NULL,
+	undone        BOOLEAN NOT NULL DEFAULT false
+);
+
+CREATE TABLE merge_opt_out (
+	receiver   TEXT NOT NULL DEFAULT '',
+	identifier TEXT,
+
+	PRIMARY KEY (receiver, identifier)
+);
+
+CREATE TABLE user_space (
+	user_mxid TEXT,
+	space_key TEXT,
+	room_id   TEXT NOT NULL,
+
+	PRIMARY KEY (user_mxid, space_key),
+	FOREIGN KEY (user_mxid) REFERENCES "user"(mxid) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE portal_space (
+	portal_guid     TEXT,
+	portal_receiver TEXT NOT NULL DEFAULT '',
+	space_key       TEXT,
+	room_id         TEXT NOT NULL,
+
+	PRIMARY KEY (portal_guid, portal_receiver, space_key),
+	FOREIGN KEY (portal_guid, portal_receiver) REFERENCES portal(guid, receiver) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE backfill_queue (
+	id              INTEGER PRIMARY KEY,
+	portal_guid     TEXT NOT NULL,
+	portal_receiver TEXT NOT NULL DEFAULT '',
+	job_type        TEXT NOT NULL,
+	priority        INTEGER NOT NULL,
+	max_messages    INTEGER NOT NULL DEFAULT 0,
+	attempts        INTEGER NOT NULL DEFAULT 0,
+	next_attempt    BIGINT NOT NULL DEFAULT 0,
+	last_error      TEXT NOT NULL DEFAULT '',
+	created_at      BIGINT NOT NULL,
+
+	UNIQUE (portal_guid, portal_receiver, job_type),
+	FOREIGN KEY (portal_guid, portal_receiver) REFERENCES portal(guid, receiver) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE lazy_media (
+	mxc             TEXT PRIMARY KEY,
+	portal_guid     TEXT NOT NULL,
+	portal_receiver TEXT NOT NULL DEFAULT '',
+	message_guid    TEXT NOT NULL,
+	uploader        TEXT NOT NULL,
+	upload_url      TEXT NOT NULL DEFAULT '',
+	path            TEXT NOT NULL,
+	file_name       TEXT NOT NULL,
+	mime_type       TEXT NOT NULL,
+	is_audio        BOOLEAN NOT NULL DEFAULT false,
+	created_at      BIGINT NOT NULL,
+
+	FOREIGN KEY (portal_guid, portal_receiver) REFERENCES portal(guid, receiver) ON DELETE CASCADE ON UPDATE CASCADE
 );
 
 CREATE TRIGGER on_portal_insert_add_merged_chat AFTER INSERT ON portal WHEN NEW.guid LIKE '%%;-;%%' BEGIN
-	INSERT INTO merged_chat (source_guid, target_guid) VALUES (NEW.guid, NEW.guid)
-	ON CONFLICT (source_guid) DO UPDATE SET target_guid=NEW.guid;
+	INSERT INTO merged_chat (source_guid, receiver, target_guid) VALUES (NEW.guid, NEW.receiver, NEW.guid)
+	ON CONFLICT (source_guid, receiver) DO UPDATE SET target_guid=NEW.guid;
 END;
 
 CREATE TRIGGER on_merge_delete_portal AFTER INSERT ON merged_chat WHEN NEW.source_guid<>NEW.target_guid BEGIN
-	DELETE FROM portal WHERE guid=NEW.source_guid;
+	DELETE FROM portal WHERE guid=NEW.source_guid AND receiver=NEW.receiver;
 END;
@@ -0,0 +1,4 @@
+-- v20: Store thread originator of messages
+
+ALTER TABLE message ADD COLUMN thread_originator_guid TEXT NOT NULL DEFAULT '';
+ALTER TABLE message ADD COLUMN thread_originator_part INTEGER NOT NULL DEFAULT 0;
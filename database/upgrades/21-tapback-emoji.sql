@@ -0,0 +1,3 @@
+-- v21: Store custom emoji of tapbacks
+
+ALTER TABLE tapback ADD COLUMN emoji TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,111 @@
+-- v22: Scope portals and puppets per user
+PRAGMA defer_foreign_keys = ON;
+
+DROP TRIGGER on_portal_insert_add_merged_chat;
+DROP TRIGGER on_merge_delete_portal;
+
+ALTER TABLE portal RENAME TO old_portal;
+ALTER TABLE puppet RENAME TO old_puppet;
+ALTER TABLE message RENAME TO old_message;
+ALTER TABLE tapback RENAME TO old_tapback;
+ALTER TABLE merged_chat RENAME TO old_merged_chat;
+
+CREATE TABLE portal (
+	guid              TEXT,
+	receiver          TEXT NOT NULL DEFAULT '',
+	mxid              TEXT UNIQUE,
+	name              TEXT NOT NULL,
+	avatar_hash       TEXT,
+	avatar_url        TEXT,
+	encrypted         BOOLEAN NOT NULL DEFAULT false,
+	backfill_start_ts BIGINT NOT NULL DEFAULT 0,
+	in_space          BOOLEAN NOT NULL DEFAULT false,
+	thread_id         TEXT NOT NULL DEFAULT '',
+	last_seen_handle  TEXT NOT NULL DEFAULT '',
+	first_event_id    TEXT NOT NULL DEFAULT '',
+	next_batch_id     TEXT NOT NULL DEFAULT '',
+
+	PRIMARY KEY (guid, receiver)
+);
+
+CREATE TABLE puppet (
+	id               TEXT,
+	receiver         TEXT NOT NULL DEFAULT '',
+	displayname      TEXT NOT NULL,
+	name_overridden  BOOLEAN,
+	avatar_hash      TEXT,
+	avatar_url       TEXT,
+	contact_info_set BOOLEAN NOT NULL DEFAULT false,
+
+	PRIMARY KEY (id, receiver)
+);
+
+CREATE TABLE message (
+	portal_guid     TEXT,
+	portal_receiver TEXT NOT NULL DEFAULT '',
+	guid            TEXT,
+	part            INTEGER,
+	mxid            TEXT NOT NULL UNIQUE,
+	sender_guid     TEXT NOT NULL,
+	handle_guid     TEXT NOT NULL DEFAULT '',
+	timestamp       BIGINT NOT NULL,
+
+	thread_originator_guid TEXT NOT NULL DEFAULT '',
+	thread_originator_part INTEGER NOT NULL DEFAULT 0,
+
+	PRIMARY KEY (portal_guid, portal_receiver, guid, part),
+	FOREIGN KEY (portal_guid, portal_receiver) REFERENCES portal(guid, receiver) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE tapback (
+	portal_guid     TEXT,
+	portal_receiver TEXT NOT NULL DEFAULT '',
+	message_guid    TEXT,
+	message_part    INTEGER,
+	sender_guid     TEXT,
+	handle_guid     TEXT NOT NULL DEFAULT '',
+	type            INTEGER NOT NULL,
+	emoji           TEXT NOT NULL DEFAULT '',
+	mxid            TEXT NOT NULL UNIQUE,
+	guid            TEXT DEFAULT NULL,
+
+	PRIMARY KEY (portal_guid, portal_receiver, message_guid, message_part, sender_guid),
+	FOREIGN KEY (portal_guid, portal_receiver, message_guid, message_part)
+		REFERENCES message(portal_guid, portal_receiver, guid, part) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE merged_chat (
+	source_guid TEXT,
+	receiver    TEXT NOT NULL DEFAULT '',
+	target_guid TEXT NOT NULL,
+
+	PRIMARY KEY (source_guid, receiver),
+	CONSTRAINT merged_chat_portal_fkey FOREIGN KEY (target_guid, receiver) REFERENCES portal(guid, receiver) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+INSERT INTO portal (guid, mxid, name, avatar_hash, avatar_url, encrypted, backfill_start_ts, in_space, thread_id, last_seen_handle, first_event_id, next_batch_id)
+SELECT guid, mxid, name, avatar_hash, avatar_url, encrypted, backfill_start_ts, in_space, thread_id, last_seen_handle, first_event_id, next_batch_id FROM old_portal;
+INSERT INTO puppet (id, displayname, name_overridden, avatar_hash, avatar_url, contact_info_set)
+SELECT id, displayname, name_overridden, avatar_hash, avatar_url, contact_info_set FROM old_puppet;
+INSERT INTO message (portal_guid, guid, part, mxid, sender_guid, handle_guid, timestamp, thread_originator_guid, thread_originator_part)
+SELECT portal_guid, guid, part, mxid, sender_guid, handle_guid, timestamp, thread_originator_guid, thread_originator_part FROM old_message;
+INSERT INTO tapback (portal_guid, message_guid, message_part, sender_guid, handle_guid, type, emoji, mxid, guid)
+SELECT portal_guid, message_guid, message_part, sender_guid, handle_guid, type, emoji, mxid, guid FROM old_tapback;
+INSERT INTO merged_chat (source_guid, target_guid) SELECT source_guid, target_guid FROM old_merged_chat;
+
+DROP TABLE old_tapback;
+DROP TABLE old_message;
+DROP TABLE old_merged_chat;
+DROP TABLE old_portal;
+DROP TABLE old_puppet;
+
+CREATE TRIGGER on_portal_insert_add_merged_chat AFTER INSERT ON portal WHEN NEW.guid LIKE '%%;-;%%' BEGIN
+	INSERT INTO merged_chat (source_guid, receiver, target_guid) VALUES (NEW.guid, NEW.receiver, NEW.guid)
+	ON CONFLICT (source_guid, receiver) DO UPDATE SET target_guid=NEW.guid;
+END;
+
+CREATE TRIGGER on_merge_delete_portal AFTER INSERT ON merged_chat WHEN NEW.source_guid<>NEW.target_guid BEGIN
+	DELETE FROM portal WHERE guid=NEW.source_guid AND receiver=NEW.receiver;
+END;
+
+ALTER TABLE "user" ADD COLUMN logged_out BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,3 @@
+-- v23: Store per-portal send policy
+
+ALTER TABLE portal ADD COLUMN send_policy TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,11 @@
+-- v24: Add local ghost profile overrides
+
+CREATE TABLE puppet_override (
+	puppet_id       TEXT,
+	receiver        TEXT NOT NULL DEFAULT '',
+	displayname     TEXT NOT NULL DEFAULT '',
+	avatar_url      TEXT NOT NULL DEFAULT '',
+	hide_identifier BOOLEAN NOT NULL DEFAULT false,
+
+	PRIMARY KEY (puppet_id, receiver)
+);
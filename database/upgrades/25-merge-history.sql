@@ -0,0 +1,11 @@
+-- v25: Add audit log for portal merges and splits
+
+CREATE TABLE merge_history (
+	id            INTEGER PRIMARY KEY,
+	receiver      TEXT NOT NULL DEFAULT '',
+	action        TEXT NOT NULL,
+	layout_before TEXT NOT NULL,
+	layout_after  TEXT NOT NULL,
+	timestamp     BIGINT NOT NULL,
+	undone        BOOLEAN NOT NULL DEFAULT false
+);
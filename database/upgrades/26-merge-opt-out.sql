@@ -0,0 +1,8 @@
+-- v26: Add per-contact opt-outs for automatic chat merging
+
+CREATE TABLE merge_opt_out (
+	receiver   TEXT NOT NULL DEFAULT '',
+	identifier TEXT,
+
+	PRIMARY KEY (receiver, identifier)
+);
@@ -0,0 +1,22 @@
+-- v27: Track portal membership in sub-spaces
+
+ALTER TABLE portal ADD COLUMN space_tag TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE user_space (
+	user_mxid TEXT,
+	space_key TEXT,
+	room_id   TEXT NOT NULL,
+
+	PRIMARY KEY (user_mxid, space_key),
+	FOREIGN KEY (user_mxid) REFERENCES "user"(mxid) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE portal_space (
+	portal_guid     TEXT,
+	portal_receiver TEXT NOT NULL DEFAULT '',
+	space_key       TEXT,
+	room_id         TEXT NOT NULL,
+
+	PRIMARY KEY (portal_guid, portal_receiver, space_key),
+	FOREIGN KEY (portal_guid, portal_receiver) REFERENCES portal(guid, receiver) ON DELETE CASCADE ON UPDATE CASCADE
+);
@@ -0,0 +1,4 @@
+-- v28: Store mute and archive state of portals
+
+ALTER TABLE portal ADD COLUMN muted BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE portal ADD COLUMN archived BOOLEAN NOT NULL DEFAULT false;
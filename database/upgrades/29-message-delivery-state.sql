@@ -0,0 +1,5 @@
+-- v29: Store delivery and read state of outgoing messages
+
+ALTER TABLE message ADD COLUMN sent_at BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE message ADD COLUMN delivered_at BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE message ADD COLUMN read_at BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,3 @@
+-- v30: Store hash of last synced chat info
+
+ALTER TABLE portal ADD COLUMN info_hash TEXT NOT NULL DEFAULT '';
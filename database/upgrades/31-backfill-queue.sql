@@ -0,0 +1,17 @@
+-- v31: Add persistent backfill queue
+
+CREATE TABLE backfill_queue (
+	id              INTEGER PRIMARY KEY,
+	portal_guid     TEXT NOT NULL,
+	portal_receiver TEXT NOT NULL DEFAULT '',
+	job_type        TEXT NOT NULL,
+	priority        INTEGER NOT NULL,
+	max_messages    INTEGER NOT NULL DEFAULT 0,
+	attempts        INTEGER NOT NULL DEFAULT 0,
+	next_attempt    BIGINT NOT NULL DEFAULT 0,
+	last_error      TEXT NOT NULL DEFAULT '',
+	created_at      BIGINT NOT NULL,
+
+	UNIQUE (portal_guid, portal_receiver, job_type),
+	FOREIGN KEY (portal_guid, portal_receiver) REFERENCES portal(guid, receiver) ON DELETE CASCADE ON UPDATE CASCADE
+);
@@ -0,0 +1,17 @@
+-- v32: Add table for lazily uploaded backfill media
+
+CREATE TABLE lazy_media (
+	mxc             TEXT PRIMARY KEY,
+	portal_guid     TEXT NOT NULL,
+	portal_receiver TEXT NOT NULL DEFAULT '',
+	message_guid    TEXT NOT NULL,
+	uploader        TEXT NOT NULL,
+	upload_url      TEXT NOT NULL DEFAULT '',
+	path            TEXT NOT NULL,
+	file_name       TEXT NOT NULL,
+	mime_type       TEXT NOT NULL,
+	is_audio        BOOLEAN NOT NULL DEFAULT false,
+	created_at      BIGINT NOT NULL,
+
+	FOREIGN KEY (portal_guid, portal_receiver) REFERENCES portal(guid, receiver) ON DELETE CASCADE ON UPDATE CASCADE
+);
@@ -0,0 +1,3 @@
+-- v33: Add per-portal settings
+
+ALTER TABLE portal ADD COLUMN settings TEXT NOT NULL DEFAULT '{}';
@@ -38,7 +38,7 @@ func (uq *UserQuery) New() *User {
 }
 
 func (uq *UserQuery) GetByMXID(userID id.UserID) *User {
-	row := uq.db.QueryRow(`SELECT mxid, access_token, next_batch, space_room, management_room FROM "user" WHERE mxid=$1`, userID)
+	row := uq.db.QueryRow(`SELECT mxid, access_token, next_batch, space_room, management_room, logged_out FROM "user" WHERE mxid=$1`, userID)
 	if row == nil {
 		return nil
 	}
@@ -54,10 +54,11 @@ type User struct {
 	NextBatch      string
 	SpaceRoom      id.RoomID
 	ManagementRoom id.RoomID
+	LoggedOut      bool
 }
 
 func (user *User) Scan(row dbutil.Scannable) *User {
-	err := row.Scan(&user.MXID, &user.AccessToken, &user.NextBatch, &user.SpaceRoom, &user.ManagementRoom)
+	err := row.Scan(&user.MXID, &user.AccessToken, &user.NextBatch, &user.SpaceRoom, &user.ManagementRoom, &user.LoggedOut)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			user.log.Errorln("Database scan failed:", err)
@@ -68,16 +69,16 @@ func (user *User) Scan(row dbutil.Scannable) *User {
 }
 
 func (user *User) Insert() {
-	_, err := user.db.Exec(`INSERT INTO "user" (mxid, access_token, next_batch, space_room, management_room) VALUES ($1, $2, $3, $4, $5)`,
-		user.MXID, user.AccessToken, user.NextBatch, user.SpaceRoom, user.ManagementRoom)
+	_, err := user.db.Exec(`INSERT INTO "user" (mxid, access_token, next_batch, space_room, management_room, logged_out) VALUES ($1, $2, $3, $4, $5, $6)`,
+		user.MXID, user.AccessToken, user.NextBatch, user.SpaceRoom, user.ManagementRoom, user.LoggedOut)
 	if err != nil {
 		user.log.Warnfln("Failed to insert %s: %v", user.MXID, err)
 	}
 }
 
 func (user *User) Update() {
-	_, err := user.db.Exec(`UPDATE "user" SET access_token=$1, next_batch=$2, space_room=$3, management_room=$4 WHERE mxid=$5`,
-		user.AccessToken, user.NextBatch, user.SpaceRoom, user.ManagementRoom, user.MXID)
+	_, err := user.db.Exec(`UPDATE "user" SET access_token=$1, next_batch=$2, space_room=$3, management_room=$4, logged_out=$5 WHERE mxid=$6`,
+		user.AccessToken, user.NextBatch, user.SpaceRoom, user.ManagementRoom, user.LoggedOut, user.MXID)
 	if err != nil {
 		user.log.Warnfln("Failed to update %s: %v", user.MXID, err)
 	}
@@ -0,0 +1,134 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-imessage/database"
+	"go.mau.fi/mautrix-imessage/imessage"
+)
+
+func (portal *Portal) markMessageSent(msg *database.Message, ts time.Time) {
+	if msg.SentAt != 0 {
+		return
+	}
+	msg.SentAt = ts.UnixMilli()
+	msg.UpdateDeliveryState()
+}
+
+func (portal *Portal) markMessageDelivered(msg *database.Message, ts time.Time) {
+	if msg.DeliveredAt != 0 {
+		return
+	}
+	msg.DeliveredAt = ts.UnixMilli()
+	msg.UpdateDeliveryState()
+	portal.log.Debugfln("Message %s (%s) was delivered at %s", msg.GUID, msg.MXID, ts)
+	if portal.IsPrivateChat() {
+		portal.sendDeliveredStatus(msg.MXID)
+	}
+}
+
+// markMessageReadByRemote stores the read time of an outgoing message. If sendReceipt is true,
+// a read receipt is also sent from the DM puppet.
+func (portal *Portal) markMessageReadByRemote(msg *database.Message, ts time.Time, sendReceipt bool) {
+	if msg.ReadAt != 0 {
+		return
+	}
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	if msg.DeliveredAt == 0 {
+		// Read messages have obviously been delivered too
+		msg.DeliveredAt = ts.UnixMilli()
+	}
+	msg.ReadAt = ts.UnixMilli()
+	msg.UpdateDeliveryState()
+	portal.log.Debugfln("Message %s (%s) was read at %s", msg.GUID, msg.MXID, ts)
+	if sendReceipt && portal.IsPrivateChat() {
+		err := portal.markRead(portal.MainIntent(), msg.MXID, ts)
+		if err != nil {
+			portal.log.Warnfln("Failed to send read receipt for %s: %v", msg.MXID, err)
+		}
+	}
+}
+
+// maxReadByRemoteMessages is the maximum number of older outgoing messages that are marked as read
+// when the remote user reads a private chat.
+const maxReadByRemoteMessages = 100
+
+// isFromMe checks whether a bridged message was sent by the user. Messages sent from Matrix have no sender,
+// while messages sent from other devices may have the user's own handle as the sender.
+func (portal *Portal) isFromMe(msg *database.Message) bool {
+	return msg.SenderGUID == "" || portal.user.isOwnHandle(imessage.ParseIdentifier(msg.SenderGUID).LocalID)
+}
+
+// markReadByRemoteUpTo marks all outgoing messages up to the given message as read by the remote user.
+// Receipts are cumulative, so the target message itself may also be an incoming message.
+func (portal *Portal) markReadByRemoteUpTo(msg *database.Message, ts time.Time) {
+	for _, unread := range portal.bridge.DB.Message.GetUnreadUpTo(portal.GUID, portal.Receiver, msg.Timestamp, maxReadByRemoteMessages) {
+		if portal.isFromMe(unread) {
+			portal.markMessageReadByRemote(unread, ts, false)
+		}
+	}
+}
+
+// updateOutgoingMessageState handles updated copies of outgoing messages that have already been bridged,
+// which the connector sends when the delivery or read state changes.
+func (portal *Portal) updateOutgoingMessageState(dbMessage *database.Message, msg *imessage.Message) {
+	if !msg.IsFromMe {
+		return
+	}
+	if msg.IsSent {
+		portal.markMessageSent(dbMessage, msg.Time)
+	}
+	if msg.IsRead || !msg.ReadAt.IsZero() {
+		portal.markMessageReadByRemote(dbMessage, msg.ReadAt, true)
+	} else if msg.IsDelivered {
+		portal.markMessageDelivered(dbMessage, time.Now())
+	}
+}
+
+func (portal *Portal) sendDeliveredStatus(eventID id.EventID) {
+	if !portal.bridge.Config.Bridge.MessageStatusEvents {
+		return
+	}
+	content := &event.Content{
+		Parsed: &event.BeeperMessageStatusEventContent{
+			Network: portal.getBridgeInfoStateKey(),
+			RelatesTo: event.RelatesTo{
+				Type:    event.RelReference,
+				EventID: eventID,
+			},
+			Status: event.MessageStatusSuccess,
+		},
+		Raw: map[string]any{
+			"delivered_to_users": []id.UserID{portal.MainIntent().UserID},
+		},
+	}
+	statusIntent := portal.bridge.Bot
+	if !portal.Encrypted {
+		statusIntent = portal.MainIntent()
+	}
+	_, err := statusIntent.SendMessageEvent(portal.MXID, event.BeeperMessageStatus, content)
+	if err != nil {
+		portal.log.Warnfln("Failed to send delivered status event for %s: %v", eventID, err)
+	}
+}
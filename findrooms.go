@@ -58,9 +58,11 @@ func (br *IMBridge) findPortal(roomID id.RoomID, state mautrix.RoomStateMap) boo
 		br.Log.Debugfln("Skipping %s: room is already a registered portal", roomID)
 	} else if bridgeInfo, err := br.findBridgeInfo(state); err != nil {
 		br.Log.Debugfln("Skipping %s: %s", roomID, err)
-	} else if err = br.checkMembers(state); err != nil {
+	} else if user, ok := br.usersByReceiver[bridgeInfo.Channel.Receiver]; !ok {
+		br.Log.Debugfln("Skipping %s (to %s): unknown receiver %q", roomID, bridgeInfo.Channel.GUID, bridgeInfo.Channel.Receiver)
+	} else if err = br.checkMembers(state, user); err != nil {
 		br.Log.Debugfln("Skipping %s (to %s): %s", roomID, bridgeInfo.Channel.GUID, err)
-	} else if portal := br.GetPortalByGUID(bridgeInfo.Channel.GUID); len(portal.MXID) > 0 {
+	} else if portal := user.GetPortalByGUID(bridgeInfo.Channel.GUID); len(portal.MXID) > 0 {
 		br.Log.Debugfln("Skipping %s (to %s): portal to chat already exists (%s)", roomID, portal.GUID, portal.MXID)
 	} else {
 		encryptionEvent, ok := state[event.StateEncryption][""]
@@ -83,7 +85,7 @@ func (br *IMBridge) findPortal(roomID id.RoomID, state mautrix.RoomStateMap) boo
 	return false
 }
 
-func (br *IMBridge) checkMembers(state mautrix.RoomStateMap) error {
+func (br *IMBridge) checkMembers(state mautrix.RoomStateMap, user *User) error {
 	members, ok := state[event.StateMember]
 	if !ok {
 		return errors.New("didn't find member list")
@@ -92,9 +94,9 @@ func (br *IMBridge) checkMembers(state mautrix.RoomStateMap) error {
 	if !ok || bridgeBotMember.Content.AsMember().Membership != event.MembershipJoin {
 		return fmt.Errorf("bridge bot %s is not joined", br.Bot.UserID)
 	}
-	userMember, ok := members[br.user.MXID.String()]
+	userMember, ok := members[user.MXID.String()]
 	if !ok || userMember.Content.AsMember().Membership != event.MembershipJoin {
-		return fmt.Errorf("user %s is not joined", br.user.MXID)
+		return fmt.Errorf("user %s is not joined", user.MXID)
 	}
 	return nil
 }
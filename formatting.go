@@ -0,0 +1,206 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-imessage/imessage"
+)
+
+const (
+	mentionStartMarker = "\x02"
+	mentionEndMarker   = "\x03"
+	mentionsReturnKey  = "fi.mau.imessage.mentions"
+)
+
+func (br *IMBridge) newMatrixHTMLParser() *format.HTMLParser {
+	return &format.HTMLParser{
+		TabsToSpaces:   4,
+		Newline:        "\n",
+		HorizontalLine: "\n---\n",
+		PillConverter: func(displayname, mxid, eventID string, ctx format.Context) string {
+			if len(mxid) == 0 || mxid[0] != '@' {
+				return format.DefaultPillConverter(displayname, mxid, eventID, ctx)
+			}
+			puppet := br.GetPuppetByMXID(id.UserID(mxid))
+			if puppet == nil {
+				return displayname
+			}
+			name := puppet.Displayname
+			if len(name) == 0 {
+				name = puppet.ID
+			}
+			mentions, _ := ctx.ReturnData[mentionsReturnKey].([]string)
+			ctx.ReturnData[mentionsReturnKey] = append(mentions, puppet.ID)
+			return mentionStartMarker + name + mentionEndMarker
+		},
+	}
+}
+
+// convertMatrixFormatting converts the HTML body of a Matrix message into iMessage plain text.
+// Links are kept in the text and user pills are replaced with the names of the mentioned users.
+// The returned ranges contain the positions of the mentioned names and the GUIDs of the mentioned users.
+// The mention GUIDs use the service of the chat the message is sent to, which may differ from the portal's own
+// service when falling back to SMS or sending to a merged chat.
+func (portal *Portal) convertMatrixFormatting(content *event.MessageEventContent, targetGUID string) (string, []imessage.TextFormatRange) {
+	if content.Format != event.FormatHTML || len(content.FormattedBody) == 0 {
+		return content.Body, nil
+	}
+	ctx := format.NewContext()
+	text := portal.bridge.newMatrixHTMLParser().Parse(content.FormattedBody, ctx)
+	mentionedIDs, _ := ctx.ReturnData[mentionsReturnKey].([]string)
+	return extractMentions(text, mentionedIDs, imessage.ParseIdentifier(targetGUID).Service)
+}
+
+// extractMentions removes the mention markers added by the pill converter and returns the UTF-16 ranges of the
+// mentioned names. The mentioned IDs must be in the same order as the mentions in the text.
+func extractMentions(text string, mentionedIDs []string, service string) (string, []imessage.TextFormatRange) {
+	var mentions []imessage.TextFormatRange
+	var out strings.Builder
+	var utf16Len int
+	for i := 0; ; i++ {
+		startIdx := strings.Index(text, mentionStartMarker)
+		endIdx := strings.Index(text, mentionEndMarker)
+		if startIdx < 0 || endIdx < startIdx || i >= len(mentionedIDs) {
+			break
+		}
+		out.WriteString(text[:startIdx])
+		utf16Len += len(utf16.Encode([]rune(text[:startIdx])))
+		name := text[startIdx+len(mentionStartMarker) : endIdx]
+		nameLen := len(utf16.Encode([]rune(name)))
+		mentions = append(mentions, imessage.TextFormatRange{
+			Start:   utf16Len,
+			Length:  nameLen,
+			Mention: imessage.Identifier{LocalID: mentionedIDs[i], Service: service}.String(),
+		})
+		out.WriteString(name)
+		utf16Len += nameLen
+		text = text[endIdx+len(mentionEndMarker):]
+	}
+	out.WriteString(text)
+	return strings.NewReplacer(mentionStartMarker, "", mentionEndMarker, "").Replace(out.String()), mentions
+}
+
+// moveFormatRanges shifts the ranges of the text to its position inside the body. If the body doesn't contain
+// the text as-is, like when a relay format template doesn't include the message text, the ranges are dropped.
+func moveFormatRanges(ranges []imessage.TextFormatRange, body, text string) []imessage.TextFormatRange {
+	if len(ranges) == 0 {
+		return ranges
+	}
+	index := strings.Index(body, text)
+	if index < 0 {
+		return nil
+	}
+	offset := len(utf16.Encode([]rune(body[:index])))
+	moved := make([]imessage.TextFormatRange, len(ranges))
+	for i, r := range ranges {
+		r.Start += offset
+		moved[i] = r
+	}
+	return moved
+}
+
+// isSafeLinkURL returns true if the link can be made clickable in Matrix.
+// Other schemes like javascript: and data: are bridged as plain text.
+func isSafeLinkURL(link string) bool {
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(parsed.Scheme) {
+	case "http", "https", "mailto", "tel":
+		return true
+	default:
+		return false
+	}
+}
+
+func utf16ToHTML(text []uint16) string {
+	return event.TextToHTML(strings.ReplaceAll(string(utf16.Decode(text)), "\ufffc", ""))
+}
+
+// convertIMFormatting converts the formatted ranges of an iMessage into Matrix HTML.
+// Mentions are converted into user pills and the mentioned puppets are returned separately.
+// Overlapping ranges are ignored.
+func (portal *Portal) convertIMFormatting(text string, ranges []imessage.TextFormatRange) (string, []id.UserID) {
+	if len(ranges) == 0 {
+		return "", nil
+	}
+	ranges = append([]imessage.TextFormatRange{}, ranges...)
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].Start < ranges[j].Start
+	})
+	encoded := utf16.Encode([]rune(text))
+	var out strings.Builder
+	var hasFormatting bool
+	var mentions []id.UserID
+	lastEnd := 0
+	for _, r := range ranges {
+		end := r.Start + r.Length
+		if r.Start < lastEnd || r.Length <= 0 || end > len(encoded) {
+			continue
+		}
+		out.WriteString(utf16ToHTML(encoded[lastEnd:r.Start]))
+		lastEnd = end
+		segment := utf16ToHTML(encoded[r.Start:end])
+		if len(r.Mention) > 0 && strings.Contains(r.Mention, ";") {
+			localID := imessage.ParseIdentifier(r.Mention).LocalID
+			var mxid id.UserID
+			if portal.user.isOwnHandle(localID) {
+				mxid = portal.user.MXID
+			} else {
+				// Only format the ghost MXID here, looking up the puppet would create a database row for it.
+				mxid = portal.bridge.FormatPuppetMXID(portal.bridge.NormalizeLocalID(localID), portal.user.Receiver)
+			}
+			segment = fmt.Sprintf(`<a href="%s">%s</a>`, mxid.URI().MatrixToURL(), segment)
+			mentions = append(mentions, mxid)
+			hasFormatting = true
+		} else if len(r.Link) > 0 && isSafeLinkURL(r.Link) {
+			segment = fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(r.Link), segment)
+			hasFormatting = true
+		}
+		if r.Bold {
+			segment = fmt.Sprintf("<strong>%s</strong>", segment)
+		}
+		if r.Italic {
+			segment = fmt.Sprintf("<em>%s</em>", segment)
+		}
+		if r.Underline {
+			segment = fmt.Sprintf("<u>%s</u>", segment)
+		}
+		if r.Strikethrough {
+			segment = fmt.Sprintf("<del>%s</del>", segment)
+		}
+		hasFormatting = hasFormatting || r.Bold || r.Italic || r.Underline || r.Strikethrough
+		out.WriteString(segment)
+	}
+	if !hasFormatting {
+		return "", nil
+	}
+	out.WriteString(utf16ToHTML(encoded[lastEnd:]))
+	return out.String(), mentions
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-imessage/imessage"
+)
+
+func TestExtractMentions(t *testing.T) {
+	text, mentions := extractMentions("hi \x02Jane 👋\x03 and \x02Bob\x03!", []string{"+12025550123", "bob@example.com"}, "SMS")
+	if text != "hi Jane 👋 and Bob!" {
+		t.Errorf("Unexpected text %q", text)
+	}
+	expected := []imessage.TextFormatRange{
+		{Start: 3, Length: 7, Mention: "SMS;-;+12025550123"},
+		{Start: 15, Length: 3, Mention: "SMS;-;bob@example.com"},
+	}
+	if !reflect.DeepEqual(mentions, expected) {
+		t.Errorf("Unexpected mentions %+v", mentions)
+	}
+
+	text, mentions = extractMentions("\x02Jane\x03 \x02Unknown\x03", []string{"jane@example.com"}, "iMessage")
+	if text != "Jane Unknown" {
+		t.Errorf("Unexpected text %q with missing mention ID", text)
+	} else if len(mentions) != 1 {
+		t.Errorf("Expected 1 mention, got %+v", mentions)
+	}
+}
+
+func TestIsSafeLinkURL(t *testing.T) {
+	tests := []struct {
+		link string
+		safe bool
+	}{
+		{"https://example.com", true},
+		{"HTTP://example.com/path?a=b", true},
+		{"mailto:user@example.com", true},
+		{"tel:+12025550123", true},
+		{"javascript:alert(1)", false},
+		{"JavaScript:alert(1)", false},
+		{"data:text/html;base64,PHNjcmlwdD4=", false},
+		{"example.com", false},
+		{"://broken", false},
+	}
+	for _, test := range tests {
+		if safe := isSafeLinkURL(test.link); safe != test.safe {
+			t.Errorf("isSafeLinkURL(%q) returned %t, expected %t", test.link, safe, test.safe)
+		}
+	}
+}
+
+func TestPortal_ConvertIMFormatting(t *testing.T) {
+	br := newTestBridge("US")
+	user := newTestUser(br, "@main:example.com", "", &br.Config.IMessage)
+	user.latestState = &imessage.BridgeStatus{RemoteID: "+12025550123"}
+	portal := newTestPortal("iMessage;+;chat123", "!room:example.com")
+	portal.bridge = br
+	portal.user = user
+
+	tests := []struct {
+		name     string
+		text     string
+		ranges   []imessage.TextFormatRange
+		expected string
+		mentions []id.UserID
+	}{
+		{"no ranges", "Hello", nil, "", nil},
+		{"bold", "Hello world", []imessage.TextFormatRange{{Start: 0, Length: 5, Bold: true}}, "<strong>Hello</strong> world", nil},
+		{"utf-16 offsets", "👋 hi there", []imessage.TextFormatRange{{Start: 3, Length: 2, Italic: true}}, "👋 <em>hi</em> there", nil},
+		{"unsorted", "abc def", []imessage.TextFormatRange{
+			{Start: 4, Length: 3, Strikethrough: true},
+			{Start: 0, Length: 3, Underline: true},
+		}, "<u>abc</u> <del>def</del>", nil},
+		{"overlapping", "abcdef", []imessage.TextFormatRange{
+			{Start: 0, Length: 4, Bold: true},
+			{Start: 2, Length: 3, Italic: true},
+		}, "<strong>abcd</strong>ef", nil},
+		{"out of bounds", "abc", []imessage.TextFormatRange{{Start: 2, Length: 5, Bold: true}}, "", nil},
+		{"link", "see docs & more", []imessage.TextFormatRange{{Start: 4, Length: 4, Link: "https://example.com/?a=1&b=2"}},
+			`see <a href="https://example.com/?a=1&amp;b=2">docs</a> &amp; more`, nil},
+		{"unsafe link", "click me", []imessage.TextFormatRange{{Start: 0, Length: 8, Link: "javascript:alert(1)"}}, "", nil},
+		{"unsafe link with bold", "click me", []imessage.TextFormatRange{{Start: 0, Length: 5, Link: "data:text/html,hi", Bold: true}},
+			"<strong>click</strong> me", nil},
+		{"own mention", "hi me", []imessage.TextFormatRange{{Start: 3, Length: 2, Mention: "iMessage;-;(202) 555-0123"}},
+			`hi <a href="https://matrix.to/#/@main:example.com">me</a>`, []id.UserID{"@main:example.com"}},
+	}
+	for _, test := range tests {
+		output, mentions := portal.convertIMFormatting(test.text, test.ranges)
+		if output != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, output)
+		}
+		if !reflect.DeepEqual(mentions, test.mentions) {
+			t.Errorf("%s: expected mentions %v, got %v", test.name, test.mentions, mentions)
+		}
+	}
+}
+
+func TestMoveFormatRanges(t *testing.T) {
+	ranges := []imessage.TextFormatRange{{Start: 3, Length: 4, Mention: "iMessage;-;+12025550123"}}
+	tests := []struct {
+		name     string
+		body     string
+		text     string
+		expected []imessage.TextFormatRange
+	}{
+		{"unchanged", "hi Jane", "hi Jane", ranges},
+		{"emote", "/me hi Jane", "hi Jane", []imessage.TextFormatRange{{Start: 7, Length: 4, Mention: ranges[0].Mention}}},
+		{"relay format", "👋 Bob: hi Jane", "hi Jane", []imessage.TextFormatRange{{Start: 11, Length: 4, Mention: ranges[0].Mention}}},
+		{"text not included", "Bob sent a message", "hi Jane", nil},
+	}
+	for _, test := range tests {
+		if moved := moveFormatRanges(ranges, test.body, test.text); !reflect.DeepEqual(moved, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.expected, moved)
+		}
+	}
+	if ranges[0].Start != 3 {
+		t.Error("moveFormatRanges modified the input ranges")
+	}
+}
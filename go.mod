@@ -6,6 +6,7 @@ require (
 	github.com/fsnotify/fsnotify v1.6.0
 	github.com/gabriel-vasile/mimetype v1.4.1
 	github.com/mattn/go-sqlite3 v1.14.16
+	github.com/nyaruka/phonenumbers v1.1.6
 	github.com/rs/zerolog v1.29.1
 	github.com/strukturag/libheif v1.14.2
 	github.com/tidwall/gjson v1.14.4
@@ -18,6 +19,7 @@ require (
 
 require (
 	github.com/coreos/go-systemd/v22 v22.5.0 // indirect
+	github.com/golang/protobuf v1.3.2 // indirect
 	github.com/gorilla/mux v1.8.0 // indirect
 	github.com/gorilla/websocket v1.5.0 // indirect
 	github.com/lib/pq v1.10.8 // indirect
@@ -30,6 +32,7 @@ require (
 	go.mau.fi/zeroconfig v0.1.2 // indirect
 	golang.org/x/net v0.9.0 // indirect
 	golang.org/x/sys v0.7.0 // indirect
+	golang.org/x/text v0.9.0 // indirect
 	gopkg.in/natefinch/lumberjack.v2 v2.2.1 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,181 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/gabriel-vasile/mimetype"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/bridge"
+	"maunium.net/go/mautrix/bridge/status"
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-imessage/imessage"
+)
+
+var _ bridge.MetaHandlingPortal = (*Portal)(nil)
+var _ bridge.MembershipHandlingPortal = (*Portal)(nil)
+
+var errGroupManagementNotSupported = errors.New("changing group info is not supported by the connector")
+
+func (portal *Portal) canManageGroup(sender bridge.User, action string) error {
+	if portal.IsPrivateChat() {
+		return errors.New("can't change members or info of private chats")
+	} else if !portal.capabilities().GroupManagement {
+		return errGroupManagementNotSupported
+	} else if !portal.isActionAllowed(sender.GetMXID(), action) {
+		return errActionNotAllowed(action)
+	}
+	return nil
+}
+
+func (portal *Portal) sendGroupManagementNotice(message string, args ...any) {
+	_, err := portal.sendMainIntentMessage(&event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    fmt.Sprintf(message, args...),
+	})
+	if err != nil {
+		portal.log.Warnfln("Failed to send group management error notice: %v", err)
+	}
+}
+
+func (portal *Portal) HandleMatrixMeta(sender bridge.User, evt *event.Event) {
+	if err := portal.canManageGroup(sender, portalActionRename); err != nil {
+		portal.log.Debugfln("Ignoring %s %s from %s: %v", evt.Type.Type, evt.ID, evt.Sender, err)
+		portal.sendErrorMessage(evt, err, err.Error(), true, status.MsgStatusUnsupported, "")
+		return
+	}
+	var err error
+	var humanReadableError string
+	switch content := evt.Content.Parsed.(type) {
+	case *event.RoomNameEventContent:
+		if content.Name == portal.Name {
+			return
+		}
+		err = portal.user.IM.SetGroupTitle(portal.GUID, content.Name)
+		if err != nil {
+			humanReadableError = "failed to change group name"
+		} else {
+			portal.log.Debugfln("Changed group name to %s from Matrix event %s", content.Name, evt.ID)
+			portal.Name = content.Name
+			portal.Update(nil)
+			portal.UpdateBridgeInfo()
+		}
+	case *event.RoomAvatarEventContent:
+		if content.URL == portal.AvatarURL {
+			return
+		}
+		humanReadableError, err = portal.setGroupAvatarFromMatrix(content)
+	default:
+		return
+	}
+	if err != nil {
+		portal.log.Errorfln("Failed to bridge %s %s: %v", evt.Type.Type, evt.ID, err)
+		portal.sendErrorMessage(evt, err, humanReadableError, true, status.MsgStatusPermFailure, "")
+	} else {
+		portal.bridge.SendMessageSuccessCheckpoint(evt, status.MsgStepRemote, 0)
+	}
+}
+
+func (portal *Portal) setGroupAvatarFromMatrix(content *event.RoomAvatarEventContent) (string, error) {
+	if content.URL.IsEmpty() {
+		err := portal.user.IM.SetGroupAvatar(portal.GUID, nil)
+		if err != nil {
+			return "failed to remove group photo", err
+		}
+		portal.AvatarHash = nil
+		portal.AvatarURL = content.URL
+		portal.Update(nil)
+		portal.UpdateBridgeInfo()
+		return "", nil
+	}
+	data, err := portal.MainIntent().DownloadBytes(content.URL)
+	if err != nil {
+		return "failed to download group photo", err
+	}
+	mime := mimetype.Detect(data)
+	dir, filePath, err := imessage.SendFilePrepare("avatar"+mime.Extension(), data)
+	if err != nil {
+		return "failed to prepare group photo", err
+	}
+	err = portal.user.IM.SetGroupAvatar(portal.GUID, &imessage.Attachment{
+		FileName:   "avatar" + mime.Extension(),
+		PathOnDisk: filePath,
+		MimeType:   mime.String(),
+	})
+	portal.user.IM.SendFileCleanup(dir)
+	if err != nil {
+		return "failed to change group photo", err
+	}
+	hash := sha256.Sum256(data)
+	portal.AvatarHash = &hash
+	portal.AvatarURL = content.URL
+	portal.Update(nil)
+	portal.UpdateBridgeInfo()
+	return "", nil
+}
+
+func (portal *Portal) HandleMatrixInvite(sender bridge.User, ghost bridge.Ghost) {
+	puppet := ghost.(*Puppet)
+	if err := portal.canManageGroup(sender, portalActionMembers); err != nil {
+		portal.log.Debugfln("Ignoring invite of %s: %v", puppet.ID, err)
+		portal.sendGroupManagementNotice("⚠ Failed to add %s to the chat: %v", puppet.ID, err)
+	} else if err = portal.user.IM.AddParticipants(portal.GUID, []string{puppet.ID}); err != nil {
+		portal.log.Errorfln("Failed to add %s to chat: %v", puppet.ID, err)
+		portal.sendGroupManagementNotice("⚠ Failed to add %s to the chat: %v", puppet.ID, err)
+	} else {
+		portal.log.Debugfln("Added %s to chat after Matrix invite", puppet.ID)
+		err = puppet.Intent.EnsureJoined(portal.MXID)
+		if err != nil {
+			portal.log.Warnfln("Failed to make puppet of %s join %s: %v", puppet.ID, portal.MXID, err)
+		}
+		return
+	}
+	_, err := portal.MainIntent().KickUser(portal.MXID, &mautrix.ReqKickUser{
+		Reason: "failed to add user to chat",
+		UserID: puppet.MXID,
+	})
+	if err != nil {
+		portal.log.Warnfln("Failed to revoke invite of %s: %v", puppet.MXID, err)
+	}
+}
+
+func (portal *Portal) HandleMatrixKick(sender bridge.User, ghost bridge.Ghost) {
+	puppet := ghost.(*Puppet)
+	if err := portal.canManageGroup(sender, portalActionMembers); err != nil {
+		portal.log.Debugfln("Ignoring kick of %s: %v", puppet.ID, err)
+		portal.sendGroupManagementNotice("⚠ Failed to remove %s from the chat: %v", puppet.ID, err)
+	} else if err = portal.user.IM.RemoveParticipants(portal.GUID, []string{puppet.ID}); err != nil {
+		portal.log.Errorfln("Failed to remove %s from chat: %v", puppet.ID, err)
+		portal.sendGroupManagementNotice("⚠ Failed to remove %s from the chat: %v", puppet.ID, err)
+	} else {
+		portal.log.Debugfln("Removed %s from chat after Matrix kick", puppet.ID)
+		return
+	}
+	err := puppet.Intent.EnsureJoined(portal.MXID)
+	if err != nil {
+		portal.log.Warnfln("Failed to re-add puppet of %s to %s: %v", puppet.ID, portal.MXID, err)
+	}
+}
+
+func (portal *Portal) HandleMatrixLeave(_ bridge.User) {
+	portal.log.Debugln("Bridge user left the room, not leaving the iMessage chat")
+}
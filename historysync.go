@@ -19,6 +19,7 @@ package main
 import (
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"runtime/debug"
 	"time"
@@ -32,6 +33,7 @@ import (
 
 	"go.mau.fi/mautrix-imessage/database"
 	"go.mau.fi/mautrix-imessage/imessage"
+	"go.mau.fi/mautrix-imessage/ipc"
 )
 
 var PortalCreationDummyEvent = event.Type{Type: "fi.mau.dummy.portal_created", Class: event.MessageEventType}
@@ -52,34 +54,57 @@ func (portal *Portal) unlockBackfill() {
 	portal.backfillLock.Unlock()
 }
 
-func (portal *Portal) forwardBackfill() {
+// forwardBackfill fetches and bridges messages newer than the last bridged message.
+// The caller must hold the backfill lock.
+func (portal *Portal) forwardBackfill() (err error) {
 	defer func() {
-		if err := recover(); err != nil {
-			portal.log.Errorfln("Panic while backfilling: %v\n%s", err, string(debug.Stack()))
+		if panicErr := recover(); panicErr != nil {
+			portal.log.Errorfln("Panic while backfilling: %v\n%s", panicErr, string(debug.Stack()))
+			err = fmt.Errorf("backfill panicked: %v", panicErr)
 		}
 	}()
+	messages, backfillID, remaining, err := portal.fetchForwardBackfill()
+	if err != nil {
+		return err
+	}
+	return portal.sendForwardBackfill(backfillID, messages, remaining)
+}
 
-	var messages []*imessage.Message
-	var err error
-	var backfillID string
-	lastMessage := portal.bridge.DB.Message.GetLastInChat(portal.GUID)
+// fetchForwardBackfill fetches the messages newer than the last bridged message. The returned remaining count
+// is the number of older messages to backfill in the background after an initial backfill.
+func (portal *Portal) fetchForwardBackfill() (messages []*imessage.Message, backfillID string, remaining int, err error) {
+	lastMessage := portal.bridge.DB.Message.GetLastInChat(portal.GUID, portal.Receiver)
 	if lastMessage == nil && portal.BackfillStartTS == 0 {
-		portal.log.Debugfln("Fetching up to %d messages for initial backfill", portal.bridge.Config.Bridge.Backfill.InitialLimit)
+		limit := portal.bridge.Config.Bridge.Backfill.InitialLimit
+		immediateLimit := portal.bridge.Config.Bridge.Backfill.ImmediateLimit
+		if portal.bridge.Config.Bridge.Backfill.MSC2716 && immediateLimit > 0 && immediateLimit < limit {
+			remaining = limit - immediateLimit
+			limit = immediateLimit
+		}
+		portal.log.Debugfln("Fetching up to %d messages for initial backfill", limit)
 		backfillID = fmt.Sprintf("bridge-initial-%s::%d", portal.Identifier.LocalID, time.Now().UnixMilli())
-		messages, err = portal.bridge.IM.GetMessagesWithLimit(portal.GUID, portal.bridge.Config.Bridge.Backfill.InitialLimit, backfillID)
+		messages, err = portal.user.IM.GetMessagesWithLimit(portal.GUID, limit, backfillID)
+		if len(messages) < limit {
+			remaining = 0
+		}
 	} else if lastMessage != nil {
 		portal.log.Debugfln("Fetching messages since %s for catchup backfill", lastMessage.Time().String())
 		backfillID = fmt.Sprintf("bridge-catchup-msg-%s::%s::%d", portal.Identifier.LocalID, lastMessage.GUID, time.Now().UnixMilli())
-		messages, err = portal.bridge.IM.GetMessagesSinceDate(portal.GUID, lastMessage.Time().Add(1*time.Millisecond), backfillID)
+		messages, err = portal.user.IM.GetMessagesSinceDate(portal.GUID, lastMessage.Time().Add(1*time.Millisecond), backfillID)
 	} else if portal.BackfillStartTS != 0 {
 		startTime := time.UnixMilli(portal.BackfillStartTS)
 		portal.log.Debugfln("Fetching messages since %s for catchup backfill after portal recovery", startTime.String())
 		backfillID = fmt.Sprintf("bridge-catchup-ts-%s::%d::%d", portal.Identifier.LocalID, startTime.UnixMilli(), time.Now().UnixMilli())
-		messages, err = portal.bridge.IM.GetMessagesSinceDate(portal.GUID, startTime, backfillID)
+		messages, err = portal.user.IM.GetMessagesSinceDate(portal.GUID, startTime, backfillID)
+	}
+	if err != nil {
+		portal.log.Errorln("Failed to fetch messages for backfilling:", err)
+		go portal.user.IM.SendBackfillResult(portal.GUID, backfillID, false, nil)
+		return nil, backfillID, 0, err
 	}
 	allSkipped := true
 	for index, msg := range messages {
-		if portal.bridge.DB.Message.GetByGUID(msg.ChatGUID, msg.GUID, 0) != nil {
+		if portal.bridge.DB.Message.GetByGUID(msg.ChatGUID, portal.Receiver, msg.GUID, 0) != nil {
 			portal.log.Debugfln("Skipping duplicate message %s at start of forward backfill batch", msg.GUID)
 			continue
 		}
@@ -87,13 +112,29 @@ func (portal *Portal) forwardBackfill() {
 		messages = messages[index:]
 		break
 	}
-	if err != nil {
-		portal.log.Errorln("Failed to fetch messages for backfilling:", err)
-		go portal.bridge.IM.SendBackfillResult(portal.GUID, backfillID, false, nil)
-	} else if len(messages) == 0 || allSkipped {
+	if allSkipped {
+		messages = nil
+	}
+	return messages, backfillID, remaining, nil
+}
+
+// sendForwardBackfill bridges fetched messages and queues the background backfill of older messages.
+// The caller must hold the backfill lock.
+func (portal *Portal) sendForwardBackfill(backfillID string, messages []*imessage.Message, remaining int) error {
+	if len(messages) == 0 {
 		portal.log.Debugln("Nothing to backfill")
-	} else {
-		portal.sendBackfill(backfillID, messages, true)
+	} else if !portal.sendBackfill(backfillID, messages, true) {
+		return errors.New("failed to send messages to Matrix")
+	} else if remaining > 0 {
+		portal.enqueueBackfill(database.BackfillJobBackward, remaining)
+	}
+	return nil
+}
+
+// retryForwardBackfill queues a forward backfill if the error means the connector didn't respond in time.
+func (portal *Portal) retryForwardBackfill(err error) {
+	if errors.Is(err, ipc.ErrIPCTimeout) {
+		portal.enqueueBackfill(database.BackfillJobForward, 0)
 	}
 }
 
@@ -101,7 +142,7 @@ func (portal *Portal) deterministicEventID(messageID string, partIndex int) id.E
 	data := fmt.Sprintf("%s/imessage/%s/%d", portal.MXID, messageID, partIndex)
 	sum := sha256.Sum256([]byte(data))
 	domain := "imessage.apple.com"
-	if portal.bridge.Config.IMessage.Platform == "android" {
+	if portal.connectorConfig().Platform == "android" {
 		domain = "sms.android.local"
 	}
 	return id.EventID(fmt.Sprintf("$%s:%s", base64.RawURLEncoding.EncodeToString(sum[:]), domain))
@@ -125,6 +166,7 @@ func (portal *Portal) convertBackfill(messages []*imessage.Message) ([]*event.Ev
 	metaIndexes := make(map[messageIndex]int, len(messages))
 	unreadThreshold := time.Duration(portal.bridge.Config.Bridge.Backfill.UnreadHoursThreshold) * time.Hour
 	var isRead bool
+	lazyMedia := portal.useLazyMedia()
 	for _, msg := range messages {
 		if msg.ItemType != imessage.ItemTypeMessage && msg.Tapback == nil {
 			portal.log.Debugln("Skipping", msg.GUID, "in backfill (not a message)")
@@ -142,7 +184,7 @@ func (portal *Portal) convertBackfill(messages []*imessage.Message) ([]*event.Ev
 			continue
 		}
 
-		converted := portal.convertiMessage(msg, intent)
+		converted := portal.convertiMessage(msg, intent, lazyMedia)
 		for index, conv := range converted {
 			evt := &event.Event{
 				Sender:    intent.UserID,
@@ -183,7 +225,7 @@ func (portal *Portal) sendBackfill(backfillID string, messages []*imessage.Messa
 			success = false
 			portal.log.Errorfln("Backfill task panicked: %v\n%s", err, debug.Stack())
 		}
-		portal.bridge.IM.SendBackfillResult(portal.GUID, backfillID, success, idMap)
+		portal.user.IM.SendBackfillResult(portal.GUID, backfillID, success, idMap)
 	}()
 	if !portal.bridge.Config.Bridge.Backfill.MSC2716 && !forward {
 		portal.log.Debugfln("Dropping non-forward backfill %s as MSC2716 is not enabled", backfillID)
@@ -205,10 +247,11 @@ func (portal *Portal) sendBackfill(backfillID string, messages []*imessage.Messa
 			StateEventsAtStart: nil,
 			Events:             events,
 		}
-		saveBatchID := forward
+		// Batch IDs are chained backwards, so backward backfills always save the next batch ID
+		saveBatchID := !forward
 		if forward {
 			req.BeeperNewMessages = forward
-			lastMessage := portal.bridge.DB.Message.GetLastInChat(portal.GUID)
+			lastMessage := portal.bridge.DB.Message.GetLastInChat(portal.GUID, portal.Receiver)
 			if lastMessage != nil {
 				req.PrevEventID = lastMessage.MXID
 			} else {
@@ -224,7 +267,7 @@ func (portal *Portal) sendBackfill(backfillID string, messages []*imessage.Messa
 			return true
 		}
 		if isRead {
-			req.BeeperMarkReadBy = portal.bridge.user.MXID
+			req.BeeperMarkReadBy = portal.user.MXID
 		}
 		resp, err := portal.MainIntent().BatchSend(portal.MXID, req)
 		if err != nil {
@@ -238,13 +281,20 @@ func (portal *Portal) sendBackfill(backfillID string, messages []*imessage.Messa
 		baseInsertionID = resp.BaseInsertionEventID
 	} else {
 		eventIDs = make([]id.EventID, len(events))
+		lastInThread := make(map[string]id.EventID)
 		for i, evt := range events {
 			meta := metas[i]
-			// Fill reply metadata for messages we just sent
+			// Fill thread metadata for messages we just sent
 			if meta.ReplyToGUID != "" && !meta.ReplyProcessed {
+				// metaIndexes are one-indexed
 				replyIndex, ok := metaIndexes[messageIndex{meta.ReplyToGUID, meta.ReplyToPart}]
-				if ok && replyIndex > 0 && replyIndex < len(eventIDs) && len(eventIDs[replyIndex]) > 0 {
-					evt.Content.AsMessage().RelatesTo = (&event.RelatesTo{}).SetReplyTo(eventIDs[replyIndex])
+				if ok && replyIndex > 0 && replyIndex <= len(eventIDs) && len(eventIDs[replyIndex-1]) > 0 {
+					originatorMXID := eventIDs[replyIndex-1]
+					fallbackMXID, ok := lastInThread[meta.ReplyToGUID]
+					if !ok {
+						fallbackMXID = originatorMXID
+					}
+					evt.Content.AsMessage().RelatesTo = (&event.RelatesTo{}).SetThread(originatorMXID, fallbackMXID)
 				}
 			}
 			resp, err := meta.Intent.SendMassagedMessageEvent(portal.MXID, evt.Type, &evt.Content, evt.Timestamp)
@@ -253,10 +303,13 @@ func (portal *Portal) sendBackfill(backfillID string, messages []*imessage.Messa
 				return false
 			}
 			eventIDs[i] = resp.EventID
+			if meta.ReplyToGUID != "" {
+				lastInThread[meta.ReplyToGUID] = resp.EventID
+			}
 		}
-		if isRead && portal.bridge.user.DoublePuppetIntent != nil {
+		if isRead && portal.user.DoublePuppetIntent != nil {
 			lastReadEvent := eventIDs[len(eventIDs)-1]
-			err := portal.markRead(portal.bridge.user.DoublePuppetIntent, lastReadEvent, time.Time{})
+			err := portal.markRead(portal.user.DoublePuppetIntent, lastReadEvent, time.Time{})
 			if err != nil {
 				portal.log.Warnfln("Failed to mark %s as read with double puppet: %v", lastReadEvent, err)
 			}
@@ -280,6 +333,9 @@ func (portal *Portal) sendBackfill(backfillID string, messages []*imessage.Messa
 	if portal.bridge.Config.Bridge.Backfill.MSC2716 && (!forward || portal.bridge.Config.Homeserver.Software != bridgeconfig.SoftwareHungry) {
 		go portal.sendPostBackfillDummy(baseInsertionID)
 	}
+	if portal.useLazyMedia() && portal.bridge.DB.LazyMedia.HasPending(portal.GUID, portal.Receiver) {
+		portal.enqueueBackfill(database.BackfillJobMedia, 0)
+	}
 	portal.log.Infofln("Finished backfill %s", backfillID)
 	return true
 }
@@ -306,22 +362,27 @@ func (portal *Portal) finishBackfill(txn dbutil.Transaction, eventIDs []id.Event
 				// TODO can existing tapbacks be modified in backfill?
 				dbTapback := portal.bridge.DB.Tapback.New()
 				dbTapback.PortalGUID = portal.GUID
+				dbTapback.PortalReceiver = portal.Receiver
 				dbTapback.SenderGUID = info.Sender.String()
 				dbTapback.MessageGUID = info.TapbackTarget.GUID
 				dbTapback.MessagePart = info.TapbackTarget.Part
 				dbTapback.GUID = info.GUID
 				dbTapback.Type = info.Tapback.Type
+				dbTapback.Emoji = info.Tapback.CustomEmoji
 				dbTapback.MXID = eventIDs[i]
 				dbTapback.Insert(txn)
 			}
 		} else {
 			dbMessage := portal.bridge.DB.Message.New()
 			dbMessage.PortalGUID = portal.GUID
+			dbMessage.PortalReceiver = portal.Receiver
 			dbMessage.SenderGUID = info.Sender.String()
 			dbMessage.GUID = info.GUID
 			dbMessage.Part = info.Index
 			dbMessage.Timestamp = info.Time.UnixMilli()
 			dbMessage.MXID = eventIDs[i]
+			dbMessage.ThreadOriginatorGUID = info.ReplyToGUID
+			dbMessage.ThreadOriginatorPart = info.ReplyToPart
 			dbMessage.Insert(txn)
 		}
 	}
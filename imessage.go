@@ -21,31 +21,34 @@ import (
 
 	log "maunium.net/go/maulogger/v2"
 
+	"go.mau.fi/mautrix-imessage/contacts"
 	"go.mau.fi/mautrix-imessage/imessage"
 )
 
 type iMessageHandler struct {
 	bridge *IMBridge
+	user   *User
 	log    log.Logger
 	stop   chan struct{}
 }
 
-func NewiMessageHandler(bridge *IMBridge) *iMessageHandler {
+func NewiMessageHandler(user *User) *iMessageHandler {
 	return &iMessageHandler{
-		bridge: bridge,
-		log:    bridge.Log.Sub("iMessage"),
+		bridge: user.bridge,
+		user:   user,
+		log:    user.log.Sub("iMessage"),
 		stop:   make(chan struct{}),
 	}
 }
 
 func (imh *iMessageHandler) Start() {
-	messages := imh.bridge.IM.MessageChan()
-	readReceipts := imh.bridge.IM.ReadReceiptChan()
-	typingNotifications := imh.bridge.IM.TypingNotificationChan()
-	chats := imh.bridge.IM.ChatChan()
-	contacts := imh.bridge.IM.ContactChan()
-	messageStatuses := imh.bridge.IM.MessageStatusChan()
-	backfillTasks := imh.bridge.IM.BackfillTaskChan()
+	messages := imh.user.IM.MessageChan()
+	readReceipts := imh.user.IM.ReadReceiptChan()
+	typingNotifications := imh.user.IM.TypingNotificationChan()
+	chats := imh.user.IM.ChatChan()
+	contacts := imh.user.IM.ContactChan()
+	messageStatuses := imh.user.IM.MessageStatusChan()
+	backfillTasks := imh.user.IM.BackfillTaskChan()
 	for {
 		var start time.Time
 		var thing string
@@ -99,9 +102,9 @@ func (imh *iMessageHandler) rerouteGroupMMS(portal *Portal, msg *imessage.Messag
 		portal.MXID != "" {
 		return portal
 	}
-	mergedChatGUID := imh.bridge.DB.MergedChat.Get(portal.GUID)
+	mergedChatGUID := imh.bridge.DB.MergedChat.Get(portal.GUID, portal.Receiver)
 	if mergedChatGUID != "" && mergedChatGUID != portal.GUID {
-		newPortal := imh.bridge.GetPortalByGUID(mergedChatGUID)
+		newPortal := imh.user.GetPortalByGUID(mergedChatGUID)
 		if newPortal.MXID != "" {
 			imh.log.Debugfln("Rerouted %s from %s to %s based on merged_chat table", msg.GUID, msg.ChatGUID, portal.GUID)
 			return newPortal
@@ -118,29 +121,29 @@ func (imh *iMessageHandler) rerouteGroupMMS(portal *Portal, msg *imessage.Messag
 	}
 	replyMsg := msg
 	for i := 0; i < 20; i++ {
-		chatGUID := imh.bridge.DB.Message.FindChatByGUID(replyMsg.ReplyToGUID)
+		chatGUID := imh.bridge.DB.Message.FindChatByGUID(portal.Receiver, replyMsg.ReplyToGUID)
 		if chatGUID != "" && !isCheckedGUID(chatGUID) {
-			newPortal := imh.bridge.GetPortalByGUID(chatGUID)
+			newPortal := imh.user.GetPortalByGUID(chatGUID)
 			if newPortal.MXID != "" {
 				imh.log.Debugfln("Rerouted %s from %s to %s based on reply metadata (found reply in local db)", msg.GUID, msg.ChatGUID, portal.GUID)
 				imh.log.Debugfln("Merging %+v -> %s", checkedChatGUIDs, newPortal.GUID)
-				imh.bridge.DB.MergedChat.Set(nil, newPortal.GUID, checkedChatGUIDs...)
+				imh.bridge.DB.MergedChat.Set(nil, newPortal.GUID, newPortal.Receiver, checkedChatGUIDs...)
 				return newPortal
 			}
 			checkedChatGUIDs = append(checkedChatGUIDs, chatGUID)
 		}
 		var err error
-		replyMsg, err = imh.bridge.IM.GetMessage(replyMsg.ReplyToGUID)
+		replyMsg, err = imh.user.IM.GetMessage(replyMsg.ReplyToGUID)
 		if err != nil {
 			imh.log.Warnfln("Failed to get reply target %s for rerouting %s: %v", replyMsg.ReplyToGUID, msg.GUID, err)
 			break
 		}
 		if !isCheckedGUID(replyMsg.ChatGUID) {
-			newPortal := imh.bridge.GetPortalByGUID(chatGUID)
+			newPortal := imh.user.GetPortalByGUID(chatGUID)
 			if newPortal.MXID != "" {
 				imh.log.Debugfln("Rerouted %s from %s to %s based on reply metadata (got reply msg from connector)", msg.GUID, msg.ChatGUID, portal.GUID)
 				imh.log.Debugfln("Merging %+v -> %s", checkedChatGUIDs, newPortal.GUID)
-				imh.bridge.DB.MergedChat.Set(nil, newPortal.GUID, checkedChatGUIDs...)
+				imh.bridge.DB.MergedChat.Set(nil, newPortal.GUID, newPortal.Receiver, checkedChatGUIDs...)
 				return newPortal
 			}
 			checkedChatGUIDs = append(checkedChatGUIDs, chatGUID)
@@ -153,7 +156,7 @@ func (imh *iMessageHandler) rerouteGroupMMS(portal *Portal, msg *imessage.Messag
 func (imh *iMessageHandler) HandleMessage(msg *imessage.Message) {
 	// TODO trace log
 	//imh.log.Debugfln("Received incoming message: %+v", msg)
-	portal := imh.rerouteGroupMMS(imh.bridge.GetPortalByGUID(msg.ChatGUID), msg)
+	portal := imh.rerouteGroupMMS(imh.user.GetPortalByGUID(msg.ChatGUID), msg)
 	if len(portal.MXID) == 0 {
 		if portal.ThreadID == "" {
 			portal.ThreadID = msg.ThreadID
@@ -173,7 +176,7 @@ func (imh *iMessageHandler) HandleMessage(msg *imessage.Message) {
 }
 
 func (imh *iMessageHandler) HandleMessageStatus(status *imessage.SendMessageStatus) {
-	portal := imh.bridge.GetPortalByGUID(status.ChatGUID)
+	portal := imh.user.GetPortalByGUID(status.ChatGUID)
 	if len(portal.MXID) == 0 {
 		imh.log.Debugfln("Ignoring message status for message from unknown portal %s/%s", status.GUID, status.ChatGUID)
 		return
@@ -186,7 +189,7 @@ func (imh *iMessageHandler) HandleMessageStatus(status *imessage.SendMessageStat
 }
 
 func (imh *iMessageHandler) HandleReadReceipt(rr *imessage.ReadReceipt) {
-	portal := imh.bridge.GetPortalByGUID(rr.ChatGUID)
+	portal := imh.user.GetPortalByGUID(rr.ChatGUID)
 	if len(portal.MXID) == 0 {
 		imh.log.Debugfln("Ignoring read receipt in unknown portal %s", rr.ChatGUID)
 		return
@@ -199,23 +202,16 @@ func (imh *iMessageHandler) HandleReadReceipt(rr *imessage.ReadReceipt) {
 }
 
 func (imh *iMessageHandler) HandleTypingNotification(notif *imessage.TypingNotification) {
-	portal := imh.bridge.GetPortalByGUID(notif.ChatGUID)
+	portal := imh.user.GetPortalByGUID(notif.ChatGUID)
 	if len(portal.MXID) == 0 {
 		return
 	}
-	_, err := portal.MainIntent().UserTyping(portal.MXID, notif.Typing, 60*time.Second)
-	if err != nil {
-		action := "typing"
-		if !notif.Typing {
-			action = "not typing"
-		}
-		portal.log.Warnln("Failed to mark %s as %s in %s: %v", portal.MainIntent().UserID, action, portal.MXID, err)
-	}
+	portal.HandleiMessageTyping(notif)
 }
 
 func (imh *iMessageHandler) HandleChat(chat *imessage.ChatInfo) {
 	chat.Identifier = imessage.ParseIdentifier(chat.JSONChatGUID)
-	portal := imh.bridge.GetPortalByGUID(chat.Identifier.String())
+	portal := imh.user.GetPortalByGUID(chat.Identifier.String())
 	if len(portal.MXID) > 0 {
 		portal.log.Infoln("Syncing Matrix room to handle chat command")
 		portal.SyncWithInfo(chat)
@@ -232,13 +228,13 @@ func (imh *iMessageHandler) HandleChat(chat *imessage.ChatInfo) {
 func (imh *iMessageHandler) HandleBackfillTask(task *imessage.BackfillTask) {
 	if !imh.bridge.Config.Bridge.Backfill.Enable {
 		imh.log.Warnfln("Connector sent backfill task, but backfill is disabled in bridge config")
-		imh.bridge.IM.SendBackfillResult(task.ChatGUID, task.BackfillID, false, nil)
+		imh.user.IM.SendBackfillResult(task.ChatGUID, task.BackfillID, false, nil)
 		return
 	}
-	portal := imh.bridge.GetPortalByGUID(task.ChatGUID)
+	portal := imh.user.GetPortalByGUID(task.ChatGUID)
 	if len(portal.MXID) == 0 {
 		portal.log.Errorfln("Tried to backfill chat %s with no portal", portal.GUID)
-		imh.bridge.IM.SendBackfillResult(portal.GUID, task.BackfillID, false, nil)
+		imh.user.IM.SendBackfillResult(portal.GUID, task.BackfillID, false, nil)
 		return
 	}
 	portal.log.Debugfln("Running backfill %s in background", task.BackfillID)
@@ -246,9 +242,12 @@ func (imh *iMessageHandler) HandleBackfillTask(task *imessage.BackfillTask) {
 }
 
 func (imh *iMessageHandler) HandleContact(contact *imessage.Contact) {
-	puppet := imh.bridge.GetPuppetByGUID(contact.UserGUID)
+	puppet := imh.user.GetPuppetByGUID(contact.UserGUID)
 	if len(puppet.MXID) > 0 {
 		puppet.log.Infoln("Syncing Puppet to handle contact command")
+		if imh.bridge.ContactStore != nil {
+			contact = contacts.MergeContact(contact, imh.bridge.ContactStore.Get(puppet.ID))
+		}
 		puppet.SyncWithContact(contact)
 	}
 }
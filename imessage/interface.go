@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	log "maunium.net/go/maulogger/v2"
@@ -44,11 +45,25 @@ type ChatInfoAPI interface {
 	GetGroupAvatar(chatID string) (*Attachment, error)
 }
 
+type GroupManagementAPI interface {
+	SetGroupTitle(chatID, title string) error
+	// SetGroupAvatar changes the photo of a group chat. A nil avatar removes the photo.
+	SetGroupAvatar(chatID string, avatar *Attachment) error
+	AddParticipants(chatID string, members []string) error
+	RemoveParticipants(chatID string, members []string) error
+}
+
+type ChatStateAPI interface {
+	SetChatState(chatID string, state ChatState) error
+}
+
 type API interface {
 	Start(readyCallback func()) error
 	Stop()
 	GetMessagesSinceDate(chatID string, minDate time.Time, backfillID string) ([]*Message, error)
 	GetMessagesWithLimit(chatID string, limit int, backfillID string) ([]*Message, error)
+	// GetMessagesBefore returns up to limit messages older than the given message, in chronological order.
+	GetMessagesBefore(chatID, beforeGUID string, beforeDate time.Time, limit int, backfillID string) ([]*Message, error)
 	GetChatsWithMessagesAfter(minDate time.Time) ([]ChatIdentifier, error)
 	GetMessage(guid string) (*Message, error)
 	MessageChan() <-chan *Message
@@ -60,6 +75,8 @@ type API interface {
 	BackfillTaskChan() <-chan *BackfillTask
 	ContactAPI
 	ChatInfoAPI
+	GroupManagementAPI
+	ChatStateAPI
 
 	ResolveIdentifier(identifier string) (string, error)
 	PrepareDM(guid string) error
@@ -67,7 +84,7 @@ type API interface {
 	SendMessage(chatID, text string, replyTo string, replyToPart int, richLink *RichLink, metadata MessageMetadata) (*SendResponse, error)
 	SendFile(chatID, text, filename string, pathOnDisk string, replyTo string, replyToPart int, mimeType string, voiceMemo bool, metadata MessageMetadata) (*SendResponse, error)
 	SendFileCleanup(sendFileDir string)
-	SendTapback(chatID, targetGUID string, targetPart int, tapback TapbackType, remove bool) (*SendResponse, error)
+	SendTapback(chatID, targetGUID string, targetPart int, tapback TapbackType, customEmoji string, remove bool) (*SendResponse, error)
 	SendReadReceipt(chatID, readUpTo string) error
 	SendTypingNotification(chatID string, typing bool) error
 	SendMessageBridgeResult(chatID, messageID string, eventID id.EventID, success bool)
@@ -120,6 +137,8 @@ type Bridge interface {
 	ReIDPortal(oldGUID, newGUID string, mergeExisting bool) bool
 	GetMessagesSince(chatGUID string, since time.Time) []string
 	SetPushKey(req *PushKeyRequest)
+	// SetAsleep is called by connectors that can detect when the host goes to sleep and wakes up again.
+	SetAsleep(asleep bool)
 }
 
 var AppleEpoch = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
@@ -139,6 +158,37 @@ type PlatformConfig struct {
 	PingInterval int64 `yaml:"ping_interval_seconds"`
 
 	DeleteMediaAfterUpload bool `yaml:"delete_media_after_upload"`
+
+	// Services lists the chat services (e.g. SMS) that are routed to this connector.
+	// Only used for additional connectors, the main connector handles everything else.
+	Services             []string         `yaml:"services"`
+	AdditionalConnectors []PlatformConfig `yaml:"additional_connectors"`
+}
+
+// ForChat returns the config of the connector that handles chats with the given GUID.
+func (pc *PlatformConfig) ForChat(chatGUID string) *PlatformConfig {
+	service, _, _ := strings.Cut(chatGUID, ";")
+	for i := range pc.AdditionalConnectors {
+		for _, connService := range pc.AdditionalConnectors[i].Services {
+			if connService == service {
+				return &pc.AdditionalConnectors[i]
+			}
+		}
+	}
+	return pc
+}
+
+// HasPlatform checks if the main connector or any of the additional connectors use the given platform.
+func (pc *PlatformConfig) HasPlatform(platform string) bool {
+	if pc.Platform == platform {
+		return true
+	}
+	for _, additional := range pc.AdditionalConnectors {
+		if additional.Platform == platform {
+			return true
+		}
+	}
+	return false
 }
 
 func (pc *PlatformConfig) BridgeName() string {
@@ -152,6 +202,9 @@ func (pc *PlatformConfig) BridgeName() string {
 
 func NewAPI(bridge Bridge) (API, error) {
 	cfg := bridge.GetConnectorConfig()
+	if len(cfg.AdditionalConnectors) > 0 {
+		return NewMultiAPI(bridge)
+	}
 	impl, ok := Implementations[cfg.Platform]
 	if !ok {
 		return nil, fmt.Errorf("no such platform \"%s\", available platforms: %+v", cfg.Platform, Implementations)
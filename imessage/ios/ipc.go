@@ -407,6 +407,21 @@ func (ios *iOSConnector) GetMessagesWithLimit(chatID string, limit int, backfill
 	return resp, err
 }
 
+func (ios *iOSConnector) GetMessagesBefore(chatID, beforeGUID string, beforeDate time.Time, limit int, backfillID string) ([]*imessage.Message, error) {
+	resp := make([]*imessage.Message, 0)
+	err := ios.IPC.Request(context.Background(), ReqGetMessagesBefore, &GetMessagesBeforeRequest{
+		ChatGUID:   chatID,
+		BeforeGUID: beforeGUID,
+		Timestamp:  timeToFloat(beforeDate),
+		Limit:      limit,
+		BackfillID: backfillID,
+	}, &resp)
+	for _, msg := range resp {
+		ios.postprocessMessage(msg, "messages before")
+	}
+	return resp, err
+}
+
 func (ios *iOSConnector) GetMessage(guid string) (resp *imessage.Message, err error) {
 	return resp, ios.IPC.Request(context.Background(), ReqGetMessage, &GetMessageRequest{
 		GUID: guid,
@@ -546,7 +561,7 @@ func (ios *iOSConnector) SendFileCleanup(sendFileDir string) {
 	_ = os.RemoveAll(sendFileDir)
 }
 
-func (ios *iOSConnector) SendTapback(chatID, targetGUID string, targetPart int, tapback imessage.TapbackType, remove bool) (*imessage.SendResponse, error) {
+func (ios *iOSConnector) SendTapback(chatID, targetGUID string, targetPart int, tapback imessage.TapbackType, customEmoji string, remove bool) (*imessage.SendResponse, error) {
 	if remove {
 		tapback += imessage.TapbackRemoveOffset
 	}
@@ -556,6 +571,7 @@ func (ios *iOSConnector) SendTapback(chatID, targetGUID string, targetPart int,
 		TargetGUID: targetGUID,
 		TargetPart: targetPart,
 		Type:       tapback,
+		Emoji:      customEmoji,
 	}, &resp)
 	if err != nil {
 		return nil, err
@@ -563,6 +579,41 @@ func (ios *iOSConnector) SendTapback(chatID, targetGUID string, targetPart int,
 	return &resp, err
 }
 
+func (ios *iOSConnector) SetGroupTitle(chatID, title string) error {
+	return ios.IPC.Request(context.Background(), ReqSetGroupTitle, &SetGroupTitleRequest{
+		ChatGUID: chatID,
+		Title:    title,
+	}, nil)
+}
+
+func (ios *iOSConnector) SetGroupAvatar(chatID string, avatar *imessage.Attachment) error {
+	return ios.IPC.Request(context.Background(), ReqSetGroupAvatar, &SetGroupAvatarRequest{
+		ChatGUID: chatID,
+		Avatar:   avatar,
+	}, nil)
+}
+
+func (ios *iOSConnector) AddParticipants(chatID string, members []string) error {
+	return ios.IPC.Request(context.Background(), ReqAddParticipants, &ParticipantsRequest{
+		ChatGUID: chatID,
+		Members:  members,
+	}, nil)
+}
+
+func (ios *iOSConnector) RemoveParticipants(chatID string, members []string) error {
+	return ios.IPC.Request(context.Background(), ReqRemoveParticipants, &ParticipantsRequest{
+		ChatGUID: chatID,
+		Members:  members,
+	}, nil)
+}
+
+func (ios *iOSConnector) SetChatState(chatID string, state imessage.ChatState) error {
+	return ios.IPC.Request(context.Background(), ReqSetChatState, &SetChatStateRequest{
+		ChatGUID:  chatID,
+		ChatState: state,
+	}, nil)
+}
+
 func (ios *iOSConnector) SendReadReceipt(chatID, readUpTo string) error {
 	return ios.IPC.Send(ReqSendReadReceipt, &SendReadReceiptRequest{
 		ChatGUID: chatID,
@@ -36,6 +36,7 @@ const (
 	ReqGetContactList      ipc.Command = "get_contact_list"
 	ReqGetMessagesAfter    ipc.Command = "get_messages_after"
 	ReqGetRecentMessages   ipc.Command = "get_recent_messages"
+	ReqGetMessagesBefore   ipc.Command = "get_messages_before"
 	ReqGetMessage          ipc.Command = "get_message"
 	ReqPreStartupSync      ipc.Command = "pre_startup_sync"
 	ReqPostStartupSync     ipc.Command = "post_startup_sync"
@@ -45,6 +46,11 @@ const (
 	ReqChatBridgeResult    ipc.Command = "chat_bridge_result"
 	ReqBackfillResult      ipc.Command = "backfill_result"
 	ReqUpcomingMessage     ipc.Command = "upcoming_message"
+	ReqSetGroupTitle       ipc.Command = "set_group_title"
+	ReqSetGroupAvatar      ipc.Command = "set_group_avatar"
+	ReqAddParticipants     ipc.Command = "add_participants"
+	ReqRemoveParticipants  ipc.Command = "remove_participants"
+	ReqSetChatState        ipc.Command = "set_chat_state"
 )
 
 type SendMessageRequest struct {
@@ -71,6 +77,27 @@ type SendTapbackRequest struct {
 	TargetGUID string               `json:"target_guid"`
 	TargetPart int                  `json:"target_part"`
 	Type       imessage.TapbackType `json:"type"`
+	Emoji      string               `json:"emoji,omitempty"`
+}
+
+type SetGroupTitleRequest struct {
+	ChatGUID string `json:"chat_guid"`
+	Title    string `json:"title"`
+}
+
+type SetChatStateRequest struct {
+	ChatGUID string `json:"chat_guid"`
+	imessage.ChatState
+}
+
+type SetGroupAvatarRequest struct {
+	ChatGUID string               `json:"chat_guid"`
+	Avatar   *imessage.Attachment `json:"avatar,omitempty"`
+}
+
+type ParticipantsRequest struct {
+	ChatGUID string   `json:"chat_guid"`
+	Members  []string `json:"members"`
 }
 
 type SendReadReceiptRequest struct {
@@ -106,6 +133,14 @@ type GetRecentMessagesRequest struct {
 	BackfillID string `json:"backfill_id"`
 }
 
+type GetMessagesBeforeRequest struct {
+	ChatGUID   string  `json:"chat_guid"`
+	BeforeGUID string  `json:"before_guid"`
+	Timestamp  float64 `json:"timestamp"`
+	Limit      int     `json:"limit"`
+	BackfillID string  `json:"backfill_id"`
+}
+
 type GetMessageRequest struct {
 	GUID string `json:"guid"`
 }
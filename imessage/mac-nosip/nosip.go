@@ -310,6 +310,7 @@ func (mac *MacNoSIPConnector) Capabilities() imessage.ConnectorCapabilities {
 	return imessage.ConnectorCapabilities{
 		MessageSendResponses:     true,
 		SendTapbacks:             true,
+		SendCustomTapbacks:       true,
 		SendReadReceipts:         true,
 		SendTypingNotifications:  true,
 		SendCaptions:             true,
@@ -317,6 +318,9 @@ func (mac *MacNoSIPConnector) Capabilities() imessage.ConnectorCapabilities {
 		MessageStatusCheckpoints: true,
 		ContactChatMerging:       true,
 		RichLinks:                true,
+		SendMentions:             true,
+		GroupManagement:          true,
+		ChatStateSync:            true,
 	}
 }
 
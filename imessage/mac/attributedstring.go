@@ -40,6 +40,11 @@ const (
 	AttrMessagePartIndex     AttributeKey = "__kIMMessagePartAttributeName"
 	AttrURLPreviewData       AttributeKey = "__kIMDataDetectedAttributeName"
 	AttrURL                  AttributeKey = "__kIMLinkAttributeName"
+	AttrMention              AttributeKey = "__kIMMentionConfirmedMention"
+	AttrBold                 AttributeKey = "__kIMTextBoldAttributeName"
+	AttrItalic               AttributeKey = "__kIMTextItalicAttributeName"
+	AttrUnderline            AttributeKey = "__kIMTextUnderlineAttributeName"
+	AttrStrikethrough        AttributeKey = "__kIMTextStrikethroughAttributeName"
 )
 
 type Attribute struct {
@@ -73,6 +78,43 @@ func (as *AttributedString) SortAttachments(log maulogger.Logger, attachments []
 	return output
 }
 
+func (attr *Attribute) isSet(key AttributeKey) bool {
+	switch val := attr.Values[key].(type) {
+	case float64:
+		return val != 0
+	case bool:
+		return val
+	default:
+		return false
+	}
+}
+
+// Formatting returns the link, mention and text style ranges of the attributed string.
+// Mentioned handles are converted into user GUIDs using the given service.
+func (as *AttributedString) Formatting(service string) []imessage.TextFormatRange {
+	var output []imessage.TextFormatRange
+	for _, attr := range as.Attributes {
+		formatRange := imessage.TextFormatRange{
+			Start:         attr.Location,
+			Length:        attr.Length,
+			Bold:          attr.isSet(AttrBold),
+			Italic:        attr.isSet(AttrItalic),
+			Underline:     attr.isSet(AttrUnderline),
+			Strikethrough: attr.isSet(AttrStrikethrough),
+		}
+		formatRange.Link, _ = attr.Values[AttrURL].(string)
+		mention, _ := attr.Values[AttrMention].(string)
+		if len(mention) > 0 {
+			formatRange.Mention = imessage.Identifier{LocalID: mention, Service: service}.String()
+		}
+		if formatRange.Bold || formatRange.Italic || formatRange.Underline || formatRange.Strikethrough ||
+			len(formatRange.Link) > 0 || len(formatRange.Mention) > 0 {
+			output = append(output, formatRange)
+		}
+	}
+	return output
+}
+
 func meowDecodeAttributedString(data []byte) (*AttributedString, error) {
 	runtime.LockOSThread()
 	pool := C.meowMakePool()
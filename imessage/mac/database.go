@@ -37,6 +37,7 @@ type macOSDatabase struct {
 	messagesQuery        *sql.Stmt
 	singleMessageQuery   *sql.Stmt
 	limitedMessagesQuery *sql.Stmt
+	olderMessagesQuery   *sql.Stmt
 	newMessagesQuery     *sql.Stmt
 	newReceiptsQuery     *sql.Stmt
 	attachmentsQuery     *sql.Stmt
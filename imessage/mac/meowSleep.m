@@ -38,6 +38,7 @@ void meowObjCSleepCallback(void *refCon, io_service_t service, natural_t message
             IOAllowPowerChange(rootPort, (long)messageArgument);
             break;
         case kIOMessageSystemWillSleep:
+            meowSleepCallback();
             IOAllowPowerChange(rootPort, (long)messageArgument);
             break;
         case kIOMessageSystemWillPowerOn:
@@ -74,6 +74,18 @@ ORDER BY message.date DESC
 LIMIT $2
 `
 
+// The exact date of the before message is used when it's found, as the date passed by the bridge only has
+// millisecond precision. Messages with the same date are paginated by ROWID so that they're not skipped.
+var olderMessagesQuery = baseMessagesQuery + `
+WHERE (chat.guid=$1 OR $1='')
+  AND (
+    message.date<COALESCE((SELECT date FROM message WHERE guid=$4), $2)
+    OR (message.date=(SELECT date FROM message WHERE guid=$4) AND message.ROWID<(SELECT ROWID FROM message WHERE guid=$4))
+  )
+ORDER BY message.date DESC, message.ROWID DESC
+LIMIT $3
+`
+
 const groupActionQuery = `
 SELECT attachment.filename, COALESCE(attachment.mime_type, ''), attachment.transfer_name
 FROM message
@@ -99,10 +111,11 @@ LIMIT 1
 `
 
 const recentChatsQuery = `
-SELECT DISTINCT(chat.guid) FROM message
+SELECT chat.guid, MAX(message.date) FROM message
 JOIN chat_message_join ON chat_message_join.message_id = message.ROWID
 JOIN chat              ON chat_message_join.chat_id = chat.ROWID
 WHERE message.date>$1
+GROUP BY chat.guid
 `
 
 const newReceiptsQuery = `
@@ -147,18 +160,21 @@ func (mac *macOSDatabase) prepareMessages() error {
 	if !columnExists(mac.chatDB, "message", "thread_originator_guid") {
 		messagesQuery = strings.ReplaceAll(messagesQuery, "COALESCE(message.thread_originator_guid, '')", "''")
 		limitedMessagesQuery = strings.ReplaceAll(limitedMessagesQuery, "COALESCE(message.thread_originator_guid, '')", "''")
+		olderMessagesQuery = strings.ReplaceAll(olderMessagesQuery, "COALESCE(message.thread_originator_guid, '')", "''")
 		newMessagesQuery = strings.ReplaceAll(newMessagesQuery, "COALESCE(message.thread_originator_guid, '')", "''")
 		singleMessageQuery = strings.ReplaceAll(singleMessageQuery, "COALESCE(message.thread_originator_guid, '')", "''")
 	}
 	if !columnExists(mac.chatDB, "message", "thread_originator_part") {
 		messagesQuery = strings.ReplaceAll(messagesQuery, "COALESCE(message.thread_originator_part, '')", "''")
 		limitedMessagesQuery = strings.ReplaceAll(limitedMessagesQuery, "COALESCE(message.thread_originator_part, '')", "''")
+		olderMessagesQuery = strings.ReplaceAll(olderMessagesQuery, "COALESCE(message.thread_originator_part, '')", "''")
 		newMessagesQuery = strings.ReplaceAll(newMessagesQuery, "COALESCE(message.thread_originator_part, '')", "''")
 		singleMessageQuery = strings.ReplaceAll(singleMessageQuery, "COALESCE(message.thread_originator_part, '')", "''")
 	}
 	if !columnExists(mac.chatDB, "message", "group_action_type") {
 		messagesQuery = strings.ReplaceAll(messagesQuery, "message.group_action_type", "0")
 		limitedMessagesQuery = strings.ReplaceAll(limitedMessagesQuery, "message.group_action_type", "0")
+		olderMessagesQuery = strings.ReplaceAll(olderMessagesQuery, "message.group_action_type", "0")
 		newMessagesQuery = strings.ReplaceAll(newMessagesQuery, "message.group_action_type", "0")
 		singleMessageQuery = strings.ReplaceAll(singleMessageQuery, "message.group_action_type", "0")
 	}
@@ -183,6 +199,10 @@ func (mac *macOSDatabase) prepareMessages() error {
 	if err != nil {
 		return fmt.Errorf("failed to prepare limited message query: %w", err)
 	}
+	mac.olderMessagesQuery, err = mac.chatDB.Prepare(olderMessagesQuery)
+	if err != nil {
+		return fmt.Errorf("failed to prepare older message query: %w", err)
+	}
 	mac.newMessagesQuery, err = mac.chatDB.Prepare(newMessagesQuery)
 	if err != nil {
 		return fmt.Errorf("failed to prepare new message query: %w", err)
@@ -260,6 +280,9 @@ func (mac *macOSDatabase) scanMessages(res *sql.Rows) (messages []*imessage.Mess
 				if len(message.Text) == 0 && len(decoded.Content) > 0 {
 					message.Text = strings.TrimSpace(decoded.Content)
 				}
+				if message.Text == decoded.Content {
+					message.Formatting = decoded.Formatting(message.Sender.Service)
+				}
 				message.Attachments = decoded.SortAttachments(mac.log, message.Attachments)
 			}
 		}
@@ -316,6 +339,19 @@ func (mac *macOSDatabase) GetMessagesWithLimit(chatID string, limit int, backfil
 	return messages, err
 }
 
+func (mac *macOSDatabase) GetMessagesBefore(chatID, beforeGUID string, beforeDate time.Time, limit int, _ string) ([]*imessage.Message, error) {
+	res, err := mac.olderMessagesQuery.Query(chatID, beforeDate.UnixNano()-imessage.AppleEpoch.UnixNano(), limit, beforeGUID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying messages before date: %w", err)
+	}
+	messages, err := mac.scanMessages(res)
+	if err != nil {
+		return messages, err
+	}
+	reverseArray(messages)
+	return messages, err
+}
+
 func (mac *macOSDatabase) GetMessagesSinceDate(chatID string, minDate time.Time, _ string) ([]*imessage.Message, error) {
 	res, err := mac.messagesQuery.Query(chatID, minDate.UnixNano()-imessage.AppleEpoch.UnixNano())
 	if err != nil {
@@ -400,11 +436,15 @@ func (mac *macOSDatabase) GetChatsWithMessagesAfter(minDate time.Time) ([]imessa
 	var chats []imessage.ChatIdentifier
 	for res.Next() {
 		var chatID string
-		err = res.Scan(&chatID)
+		var lastMessageAppleEpoch int64
+		err = res.Scan(&chatID, &lastMessageAppleEpoch)
 		if err != nil {
 			return chats, fmt.Errorf("error scanning row: %w", err)
 		}
-		chats = append(chats, imessage.ChatIdentifier{ChatGUID: chatID})
+		chats = append(chats, imessage.ChatIdentifier{
+			ChatGUID:        chatID,
+			LastMessageTime: time.Unix(imessage.AppleEpoch.Unix(), lastMessageAppleEpoch).UnixMilli(),
+		})
 	}
 	return chats, nil
 }
@@ -198,10 +198,32 @@ func (mac *macOSDatabase) SendFileCleanup(sendFileDir string) {
 	}()
 }
 
-func (mac *macOSDatabase) SendTapback(chatID, targetGUID string, targetPart int, tapback imessage.TapbackType, remove bool) (*imessage.SendResponse, error) {
+func (mac *macOSDatabase) SendTapback(chatID, targetGUID string, targetPart int, tapback imessage.TapbackType, customEmoji string, remove bool) (*imessage.SendResponse, error) {
 	return nil, nil
 }
 
+var errGroupManagementNotSupported = errors.New("changing group info is not supported by the mac connector")
+
+func (mac *macOSDatabase) SetGroupTitle(chatID, title string) error {
+	return errGroupManagementNotSupported
+}
+
+func (mac *macOSDatabase) SetGroupAvatar(chatID string, avatar *imessage.Attachment) error {
+	return errGroupManagementNotSupported
+}
+
+func (mac *macOSDatabase) AddParticipants(chatID string, members []string) error {
+	return errGroupManagementNotSupported
+}
+
+func (mac *macOSDatabase) RemoveParticipants(chatID string, members []string) error {
+	return errGroupManagementNotSupported
+}
+
+func (mac *macOSDatabase) SetChatState(chatID string, state imessage.ChatState) error {
+	return errors.New("changing the mute or archive state is not supported by the mac connector")
+}
+
 func (mac *macOSDatabase) SendReadReceipt(chatID, readUpTo string) error {
 	return nil
 }
@@ -31,6 +31,17 @@ import (
 var sleepLog log.Logger
 
 var actualWakeupCallback = make(chan struct{})
+var actualSleepCallback = make(chan struct{})
+
+//export meowSleepCallback
+func meowSleepCallback() {
+	sleepLog.Infoln("Received sleep notification")
+	select {
+	case actualSleepCallback <- struct{}{}:
+	default:
+		sleepLog.Debugln("Not sending sleep call as there's nobody waiting for it")
+	}
+}
 
 //export meowWakeupCallback
 func meowWakeupCallback() {
@@ -71,7 +82,10 @@ func (mac *macOSDatabase) ListenWakeup() {
 	sleepLog.Debugln("Starting wakeup listen loop")
 	for {
 		select {
+		case <-actualSleepCallback:
+			mac.bridge.SetAsleep(true)
 		case <-actualWakeupCallback:
+			mac.bridge.SetAsleep(false)
 			mac.bridge.PingServer()
 		case <-stop:
 			sleepLog.Debugln("Stopping wakeup listener")
@@ -0,0 +1,405 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package imessage
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// connectorBridge overrides the connector config of a Bridge, so that each connector
+// in a MultiAPI sees its own config section.
+type connectorBridge struct {
+	Bridge
+	config *PlatformConfig
+}
+
+func (cb *connectorBridge) GetConnectorConfig() *PlatformConfig {
+	return cb.config
+}
+
+type routedConnector struct {
+	API
+	config *PlatformConfig
+}
+
+// MultiAPI runs several connectors side by side. Chat-specific calls are routed to
+// the connector that handles the service of the chat (see PlatformConfig.Services),
+// while events from all connectors are merged into a single set of channels.
+type MultiAPI struct {
+	connectors []*routedConnector
+
+	messageChan       chan *Message
+	receiptChan       chan *ReadReceipt
+	typingChan        chan *TypingNotification
+	chatChan          chan *ChatInfo
+	contactChan       chan *Contact
+	messageStatusChan chan *SendMessageStatus
+	backfillTaskChan  chan *BackfillTask
+	stop              chan struct{}
+}
+
+var _ API = (*MultiAPI)(nil)
+
+func isStdioPlatform(platform string) bool {
+	return platform == "ios" || platform == "android"
+}
+
+func NewMultiAPI(bridge Bridge) (API, error) {
+	cfg := bridge.GetConnectorConfig()
+	configs := make([]*PlatformConfig, 0, 1+len(cfg.AdditionalConnectors))
+	configs = append(configs, cfg)
+	for i := range cfg.AdditionalConnectors {
+		additional := &cfg.AdditionalConnectors[i]
+		if len(additional.Services) == 0 {
+			return nil, fmt.Errorf("additional %s connector doesn't have any services configured", additional.Platform)
+		} else if len(additional.AdditionalConnectors) > 0 {
+			return nil, fmt.Errorf("additional %s connector can't have additional connectors", additional.Platform)
+		}
+		configs = append(configs, additional)
+	}
+	multi := &MultiAPI{
+		connectors:        make([]*routedConnector, 0, len(configs)),
+		messageChan:       make(chan *Message, 256),
+		receiptChan:       make(chan *ReadReceipt, 32),
+		typingChan:        make(chan *TypingNotification, 32),
+		chatChan:          make(chan *ChatInfo, 32),
+		contactChan:       make(chan *Contact, 2048),
+		messageStatusChan: make(chan *SendMessageStatus, 32),
+		backfillTaskChan:  make(chan *BackfillTask, 32),
+		stop:              make(chan struct{}),
+	}
+	usesStdio := false
+	for _, connCfg := range configs {
+		if isStdioPlatform(connCfg.Platform) {
+			if usesStdio {
+				return nil, errors.New("only one connector can use the stdio IPC (ios or android platforms)")
+			}
+			usesStdio = true
+		}
+		impl, ok := Implementations[connCfg.Platform]
+		if !ok {
+			return nil, fmt.Errorf("no such platform \"%s\", available platforms: %+v", connCfg.Platform, Implementations)
+		}
+		api, err := impl(&connectorBridge{Bridge: bridge, config: connCfg})
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize %s connector: %w", connCfg.Platform, err)
+		}
+		multi.connectors = append(multi.connectors, &routedConnector{API: api, config: connCfg})
+	}
+	return multi, nil
+}
+
+func (multi *MultiAPI) forChat(chatID string) *routedConnector {
+	cfg := multi.connectors[0].config.ForChat(chatID)
+	for _, conn := range multi.connectors {
+		if conn.config == cfg {
+			return conn
+		}
+	}
+	return multi.connectors[0]
+}
+
+// ChatCapabilities returns the capabilities of the connector that handles the given chat.
+// Contact chat merging is always enabled, as it's used to merge SMS and iMessage chats.
+func (multi *MultiAPI) ChatCapabilities(chatID string) ConnectorCapabilities {
+	caps := multi.forChat(chatID).Capabilities()
+	caps.ContactChatMerging = true
+	return caps
+}
+
+func forward[T any](from <-chan T, to chan<- T, stop <-chan struct{}) {
+	for {
+		select {
+		case item := <-from:
+			select {
+			case to <- item:
+			case <-stop:
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (multi *MultiAPI) Start(readyCallback func()) error {
+	var readyGroup sync.WaitGroup
+	readyGroup.Add(len(multi.connectors))
+	errs := make(chan error, len(multi.connectors))
+	for _, conn := range multi.connectors {
+		go forward(conn.MessageChan(), multi.messageChan, multi.stop)
+		go forward(conn.ReadReceiptChan(), multi.receiptChan, multi.stop)
+		go forward(conn.TypingNotificationChan(), multi.typingChan, multi.stop)
+		go forward(conn.ChatChan(), multi.chatChan, multi.stop)
+		go forward(conn.ContactChan(), multi.contactChan, multi.stop)
+		go forward(conn.MessageStatusChan(), multi.messageStatusChan, multi.stop)
+		go forward(conn.BackfillTaskChan(), multi.backfillTaskChan, multi.stop)
+		go func(conn *routedConnector) {
+			err := conn.Start(readyGroup.Done)
+			if err != nil {
+				errs <- fmt.Errorf("error in %s connector: %w", conn.config.Platform, err)
+			}
+		}(conn)
+	}
+	ready := make(chan struct{})
+	go func() {
+		readyGroup.Wait()
+		close(ready)
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-ready:
+		readyCallback()
+	}
+	// Like the single connectors, keep running until stopped so that errors after startup are still surfaced.
+	select {
+	case err := <-errs:
+		return err
+	case <-multi.stop:
+		return nil
+	}
+}
+
+func (multi *MultiAPI) Stop() {
+	close(multi.stop)
+	for _, conn := range multi.connectors {
+		conn.Stop()
+	}
+}
+
+func (multi *MultiAPI) GetMessagesSinceDate(chatID string, minDate time.Time, backfillID string) ([]*Message, error) {
+	return multi.forChat(chatID).GetMessagesSinceDate(chatID, minDate, backfillID)
+}
+
+func (multi *MultiAPI) GetMessagesBefore(chatID, beforeGUID string, beforeDate time.Time, limit int, backfillID string) ([]*Message, error) {
+	return multi.forChat(chatID).GetMessagesBefore(chatID, beforeGUID, beforeDate, limit, backfillID)
+}
+
+func (multi *MultiAPI) GetMessagesWithLimit(chatID string, limit int, backfillID string) ([]*Message, error) {
+	return multi.forChat(chatID).GetMessagesWithLimit(chatID, limit, backfillID)
+}
+
+func (multi *MultiAPI) GetChatsWithMessagesAfter(minDate time.Time) ([]ChatIdentifier, error) {
+	var allChats []ChatIdentifier
+	for _, conn := range multi.connectors {
+		chats, err := conn.GetChatsWithMessagesAfter(minDate)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get chats from %s connector: %w", conn.config.Platform, err)
+		}
+		for _, chat := range chats {
+			// Only include chats that would be routed to this connector
+			if multi.forChat(chat.ChatGUID) == conn {
+				allChats = append(allChats, chat)
+			}
+		}
+	}
+	return allChats, nil
+}
+
+func (multi *MultiAPI) GetMessage(guid string) (msg *Message, err error) {
+	for _, conn := range multi.connectors {
+		msg, err = conn.GetMessage(guid)
+		if err == nil && msg != nil {
+			return
+		}
+	}
+	return
+}
+
+func (multi *MultiAPI) MessageChan() <-chan *Message {
+	return multi.messageChan
+}
+
+func (multi *MultiAPI) ReadReceiptChan() <-chan *ReadReceipt {
+	return multi.receiptChan
+}
+
+func (multi *MultiAPI) TypingNotificationChan() <-chan *TypingNotification {
+	return multi.typingChan
+}
+
+func (multi *MultiAPI) ChatChan() <-chan *ChatInfo {
+	return multi.chatChan
+}
+
+func (multi *MultiAPI) ContactChan() <-chan *Contact {
+	return multi.contactChan
+}
+
+func (multi *MultiAPI) MessageStatusChan() <-chan *SendMessageStatus {
+	return multi.messageStatusChan
+}
+
+func (multi *MultiAPI) BackfillTaskChan() <-chan *BackfillTask {
+	return multi.backfillTaskChan
+}
+
+func (multi *MultiAPI) GetContactInfo(identifier string) (contact *Contact, err error) {
+	for _, conn := range multi.connectors {
+		contact, err = conn.GetContactInfo(identifier)
+		if err == nil && contact != nil {
+			return
+		}
+	}
+	return
+}
+
+func (multi *MultiAPI) GetContactList() ([]*Contact, error) {
+	var allContacts []*Contact
+	for _, conn := range multi.connectors {
+		contacts, err := conn.GetContactList()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get contacts from %s connector: %w", conn.config.Platform, err)
+		}
+		allContacts = append(allContacts, contacts...)
+	}
+	return allContacts, nil
+}
+
+func (multi *MultiAPI) GetChatInfo(chatID, threadID string) (*ChatInfo, error) {
+	return multi.forChat(chatID).GetChatInfo(chatID, threadID)
+}
+
+func (multi *MultiAPI) GetGroupAvatar(chatID string) (*Attachment, error) {
+	return multi.forChat(chatID).GetGroupAvatar(chatID)
+}
+
+func (multi *MultiAPI) SetGroupTitle(chatID, title string) error {
+	return multi.forChat(chatID).SetGroupTitle(chatID, title)
+}
+
+func (multi *MultiAPI) SetGroupAvatar(chatID string, avatar *Attachment) error {
+	return multi.forChat(chatID).SetGroupAvatar(chatID, avatar)
+}
+
+func (multi *MultiAPI) AddParticipants(chatID string, members []string) error {
+	return multi.forChat(chatID).AddParticipants(chatID, members)
+}
+
+func (multi *MultiAPI) RemoveParticipants(chatID string, members []string) error {
+	return multi.forChat(chatID).RemoveParticipants(chatID, members)
+}
+
+func (multi *MultiAPI) SetChatState(chatID string, state ChatState) error {
+	return multi.forChat(chatID).SetChatState(chatID, state)
+}
+
+func (multi *MultiAPI) ResolveIdentifier(identifier string) (guid string, err error) {
+	for _, conn := range multi.connectors {
+		guid, err = conn.ResolveIdentifier(identifier)
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+func (multi *MultiAPI) PrepareDM(guid string) error {
+	return multi.forChat(guid).PrepareDM(guid)
+}
+
+func (multi *MultiAPI) SendMessage(chatID, text string, replyTo string, replyToPart int, richLink *RichLink, metadata MessageMetadata) (*SendResponse, error) {
+	return multi.forChat(chatID).SendMessage(chatID, text, replyTo, replyToPart, richLink, metadata)
+}
+
+func (multi *MultiAPI) SendFile(chatID, text, filename string, pathOnDisk string, replyTo string, replyToPart int, mimeType string, voiceMemo bool, metadata MessageMetadata) (*SendResponse, error) {
+	return multi.forChat(chatID).SendFile(chatID, text, filename, pathOnDisk, replyTo, replyToPart, mimeType, voiceMemo, metadata)
+}
+
+func (multi *MultiAPI) SendFileCleanup(sendFileDir string) {
+	multi.connectors[0].SendFileCleanup(sendFileDir)
+}
+
+func (multi *MultiAPI) SendTapback(chatID, targetGUID string, targetPart int, tapback TapbackType, customEmoji string, remove bool) (*SendResponse, error) {
+	return multi.forChat(chatID).SendTapback(chatID, targetGUID, targetPart, tapback, customEmoji, remove)
+}
+
+func (multi *MultiAPI) SendReadReceipt(chatID, readUpTo string) error {
+	return multi.forChat(chatID).SendReadReceipt(chatID, readUpTo)
+}
+
+func (multi *MultiAPI) SendTypingNotification(chatID string, typing bool) error {
+	return multi.forChat(chatID).SendTypingNotification(chatID, typing)
+}
+
+func (multi *MultiAPI) SendMessageBridgeResult(chatID, messageID string, eventID id.EventID, success bool) {
+	multi.forChat(chatID).SendMessageBridgeResult(chatID, messageID, eventID, success)
+}
+
+func (multi *MultiAPI) SendBackfillResult(chatID, backfillID string, success bool, idMap map[string][]id.EventID) {
+	multi.forChat(chatID).SendBackfillResult(chatID, backfillID, success, idMap)
+}
+
+func (multi *MultiAPI) SendChatBridgeResult(guid string, mxid id.RoomID) {
+	multi.forChat(guid).SendChatBridgeResult(guid, mxid)
+}
+
+func (multi *MultiAPI) NotifyUpcomingMessage(eventID id.EventID) {
+	for _, conn := range multi.connectors {
+		conn.NotifyUpcomingMessage(eventID)
+	}
+}
+
+func (multi *MultiAPI) PreStartupSyncHook() (resp StartupSyncHookResponse, err error) {
+	resp.SkipSync = true
+	for _, conn := range multi.connectors {
+		connResp, connErr := conn.PreStartupSyncHook()
+		if connErr != nil {
+			err = connErr
+			resp.SkipSync = false
+		} else if !connResp.SkipSync {
+			resp.SkipSync = false
+		}
+	}
+	return
+}
+
+func (multi *MultiAPI) PostStartupSyncHook() {
+	for _, conn := range multi.connectors {
+		conn.PostStartupSyncHook()
+	}
+}
+
+// Capabilities returns the capabilities that are supported by at least one of the connectors.
+// Use ChatCapabilities to check what a specific chat supports.
+func (multi *MultiAPI) Capabilities() (caps ConnectorCapabilities) {
+	for _, conn := range multi.connectors {
+		connCaps := conn.Capabilities()
+		caps.MessageSendResponses = caps.MessageSendResponses || connCaps.MessageSendResponses
+		caps.SendTapbacks = caps.SendTapbacks || connCaps.SendTapbacks
+		caps.SendCustomTapbacks = caps.SendCustomTapbacks || connCaps.SendCustomTapbacks
+		caps.SendReadReceipts = caps.SendReadReceipts || connCaps.SendReadReceipts
+		caps.SendTypingNotifications = caps.SendTypingNotifications || connCaps.SendTypingNotifications
+		caps.SendCaptions = caps.SendCaptions || connCaps.SendCaptions
+		caps.BridgeState = caps.BridgeState || connCaps.BridgeState
+		caps.MessageStatusCheckpoints = caps.MessageStatusCheckpoints || connCaps.MessageStatusCheckpoints
+		caps.RichLinks = caps.RichLinks || connCaps.RichLinks
+		caps.ChatBridgeResult = caps.ChatBridgeResult || connCaps.ChatBridgeResult
+		caps.SendMentions = caps.SendMentions || connCaps.SendMentions
+		caps.GroupManagement = caps.GroupManagement || connCaps.GroupManagement
+		caps.ChatStateSync = caps.ChatStateSync || connCaps.ChatStateSync
+	}
+	// SMS and iMessage chats with the same contact can always be merged when running multiple connectors
+	caps.ContactChatMerging = true
+	return
+}
@@ -0,0 +1,147 @@
+package imessage_test
+
+import (
+	"testing"
+
+	"go.mau.fi/mautrix-imessage/imessage"
+)
+
+type fakeBridge struct {
+	imessage.Bridge
+	config *imessage.PlatformConfig
+}
+
+func (fb *fakeBridge) GetConnectorConfig() *imessage.PlatformConfig {
+	return fb.config
+}
+
+type fakeConnector struct {
+	imessage.API
+	name string
+	caps imessage.ConnectorCapabilities
+	sent []string
+}
+
+func (fc *fakeConnector) Capabilities() imessage.ConnectorCapabilities {
+	return fc.caps
+}
+
+func (fc *fakeConnector) SendMessage(chatID, _, _ string, _ int, _ *imessage.RichLink, _ imessage.MessageMetadata) (*imessage.SendResponse, error) {
+	fc.sent = append(fc.sent, chatID)
+	return &imessage.SendResponse{GUID: fc.name, ChatGUID: chatID}, nil
+}
+
+func registerTestConnectors(t *testing.T) map[string]*fakeConnector {
+	connectors := make(map[string]*fakeConnector)
+	for _, platform := range []string{"test-imessage", "test-sms"} {
+		platform := platform
+		imessage.Implementations[platform] = func(bridge imessage.Bridge) (imessage.API, error) {
+			conn := &fakeConnector{name: platform}
+			conn.caps.SendTapbacks = platform == "test-imessage"
+			conn.caps.MessageSendResponses = platform == "test-sms"
+			connectors[platform] = conn
+			return conn, nil
+		}
+	}
+	t.Cleanup(func() {
+		delete(imessage.Implementations, "test-imessage")
+		delete(imessage.Implementations, "test-sms")
+	})
+	return connectors
+}
+
+func newTestMultiAPI(t *testing.T, cfg *imessage.PlatformConfig) (imessage.API, map[string]*fakeConnector) {
+	t.Helper()
+	connectors := registerTestConnectors(t)
+	api, err := imessage.NewMultiAPI(&fakeBridge{config: cfg})
+	if err != nil {
+		t.Fatal("Failed to create MultiAPI:", err)
+	}
+	return api, connectors
+}
+
+func newTestMultiConfig() *imessage.PlatformConfig {
+	return &imessage.PlatformConfig{
+		Platform: "test-imessage",
+		AdditionalConnectors: []imessage.PlatformConfig{{
+			Platform: "test-sms",
+			Services: []string{"SMS", "RCS"},
+		}},
+	}
+}
+
+func TestPlatformConfig_ForChat(t *testing.T) {
+	cfg := newTestMultiConfig()
+	tests := []struct {
+		chatGUID string
+		expected *imessage.PlatformConfig
+	}{
+		{"iMessage;-;+12025550123", cfg},
+		{"SMS;-;+12025550123", &cfg.AdditionalConnectors[0]},
+		{"RCS;+;chat123456", &cfg.AdditionalConnectors[0]},
+		{"unknown;-;+12025550123", cfg},
+		{"", cfg},
+	}
+	for _, test := range tests {
+		if output := cfg.ForChat(test.chatGUID); output != test.expected {
+			t.Errorf("ForChat(%q) returned the %s config, expected %s", test.chatGUID, output.Platform, test.expected.Platform)
+		}
+	}
+}
+
+func TestMultiAPI_Routing(t *testing.T) {
+	api, connectors := newTestMultiAPI(t, newTestMultiConfig())
+	for _, chatGUID := range []string{"iMessage;-;+12025550123", "SMS;-;+12025550123", "RCS;-;+12025550123"} {
+		_, err := api.SendMessage(chatGUID, "hello", "", 0, nil, nil)
+		if err != nil {
+			t.Fatalf("Failed to send message to %s: %v", chatGUID, err)
+		}
+	}
+	if sent := connectors["test-imessage"].sent; len(sent) != 1 || sent[0] != "iMessage;-;+12025550123" {
+		t.Errorf("Expected iMessage chat to be routed to the main connector, got %v", sent)
+	}
+	if sent := connectors["test-sms"].sent; len(sent) != 2 {
+		t.Errorf("Expected SMS and RCS chats to be routed to the additional connector, got %v", sent)
+	}
+
+	multi := api.(*imessage.MultiAPI)
+	if caps := multi.ChatCapabilities("SMS;-;+12025550123"); caps.SendTapbacks || !caps.MessageSendResponses || !caps.ContactChatMerging {
+		t.Errorf("Unexpected capabilities for SMS chat: %+v", caps)
+	}
+	if caps := multi.ChatCapabilities("iMessage;-;+12025550123"); !caps.SendTapbacks || caps.MessageSendResponses {
+		t.Errorf("Unexpected capabilities for iMessage chat: %+v", caps)
+	}
+	if caps := api.Capabilities(); !caps.SendTapbacks || !caps.MessageSendResponses {
+		t.Errorf("Expected combined capabilities to include both connectors, got %+v", caps)
+	}
+}
+
+func TestNewMultiAPI_InvalidConfig(t *testing.T) {
+	registerTestConnectors(t)
+	tests := []struct {
+		name string
+		cfg  *imessage.PlatformConfig
+	}{
+		{"no services", &imessage.PlatformConfig{
+			Platform:             "test-imessage",
+			AdditionalConnectors: []imessage.PlatformConfig{{Platform: "test-sms"}},
+		}},
+		{"nested connectors", &imessage.PlatformConfig{
+			Platform: "test-imessage",
+			AdditionalConnectors: []imessage.PlatformConfig{{
+				Platform:             "test-sms",
+				Services:             []string{"SMS"},
+				AdditionalConnectors: []imessage.PlatformConfig{{Platform: "test-sms", Services: []string{"RCS"}}},
+			}},
+		}},
+		{"unknown platform", &imessage.PlatformConfig{
+			Platform:             "test-imessage",
+			AdditionalConnectors: []imessage.PlatformConfig{{Platform: "nonexistent", Services: []string{"SMS"}}},
+		}},
+	}
+	for _, test := range tests {
+		if _, err := imessage.NewMultiAPI(&fakeBridge{config: test.cfg}); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
@@ -17,9 +17,12 @@
 package imessage
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -72,6 +75,8 @@ type Message struct {
 
 	RichLink *RichLink `json:"rich_link,omitempty"`
 
+	Formatting []TextFormatRange `json:"formatting,omitempty"`
+
 	Metadata MessageMetadata `json:"metadata,omitempty"`
 
 	ThreadID string `json:"thread_id,omitempty"`
@@ -79,6 +84,22 @@ type Message struct {
 
 type MessageMetadata = map[string]interface{}
 
+// TextFormatRange is a formatted range in a message's text. The start and length are in UTF-16 code units,
+// which is what NSAttributedString uses.
+type TextFormatRange struct {
+	Start  int `json:"start"`
+	Length int `json:"length"`
+
+	Bold          bool `json:"bold,omitempty"`
+	Italic        bool `json:"italic,omitempty"`
+	Underline     bool `json:"underline,omitempty"`
+	Strikethrough bool `json:"strikethrough,omitempty"`
+
+	Link string `json:"link,omitempty"`
+	// The user GUID of the mentioned user, e.g. iMessage;-;+123456789
+	Mention string `json:"mention,omitempty"`
+}
+
 func (msg *Message) SenderText() string {
 	if msg.IsFromMe {
 		return "self"
@@ -91,6 +112,9 @@ type ReadReceipt struct {
 	IsFromMe   bool   `json:"is_from_me"`
 	ChatGUID   string `json:"chat_guid"`
 	ReadUpTo   string `json:"read_up_to"`
+	// The phone number or email of the participant who read the message. Only set for group chats,
+	// and only by IPC connectors: the macOS chat database doesn't record who read a group message.
+	Reader string `json:"reader,omitempty"`
 
 	ReadAt         time.Time `json:"-"`
 	JSONUnixReadAt float64   `json:"read_at"`
@@ -99,6 +123,8 @@ type ReadReceipt struct {
 type TypingNotification struct {
 	ChatGUID string `json:"chat_guid"`
 	Typing   bool   `json:"typing"`
+	// Sender is the local ID of the participant who is typing in a group chat.
+	Sender string `json:"sender,omitempty"`
 }
 
 type GroupActionType int
@@ -188,17 +214,36 @@ func (attachment *Attachment) GetFileName() string {
 	return attachment.FileName
 }
 
-func (attachment *Attachment) Read() ([]byte, error) {
+func (attachment *Attachment) expandPath() error {
 	if strings.HasPrefix(attachment.PathOnDisk, "~/") {
 		home, err := os.UserHomeDir()
 		if err != nil {
-			return nil, fmt.Errorf("failed to get home directory: %w", err)
+			return fmt.Errorf("failed to get home directory: %w", err)
 		}
 		attachment.PathOnDisk = filepath.Join(home, attachment.PathOnDisk[2:])
 	}
+	return nil
+}
+
+func (attachment *Attachment) Read() ([]byte, error) {
+	if err := attachment.expandPath(); err != nil {
+		return nil, err
+	}
 	return os.ReadFile(attachment.PathOnDisk)
 }
 
+// Size returns the size of the attachment file without reading it.
+func (attachment *Attachment) Size() (int, error) {
+	if err := attachment.expandPath(); err != nil {
+		return 0, err
+	}
+	stat, err := os.Stat(attachment.PathOnDisk)
+	if err != nil {
+		return 0, err
+	}
+	return int(stat.Size()), nil
+}
+
 func (attachment *Attachment) Delete() error {
 	return os.Remove(attachment.PathOnDisk)
 }
@@ -206,6 +251,8 @@ func (attachment *Attachment) Delete() error {
 type ChatIdentifier struct {
 	ChatGUID string `json:"chat_guid"`
 	ThreadID string `json:"thread_id,omitempty"`
+	// Time of the latest message in the chat as unix milliseconds. Optional, used to prioritize the startup sync.
+	LastMessageTime int64 `json:"last_message_ts,omitempty"`
 }
 
 type ChatInfo struct {
@@ -215,6 +262,39 @@ type ChatInfo struct {
 	Members      []string `json:"members"`
 	NoCreateRoom bool     `json:"no_create_room"`
 	ThreadID     string   `json:"thread_id,omitempty"`
+	// The group avatar, filled by the bridge from GetGroupAvatar rather than by the connector.
+	Avatar *Attachment `json:"-"`
+
+	ChatState
+}
+
+// Hash returns a hash of the name, member list and avatar of the chat, which can be used to check if anything changed.
+func (chat *ChatInfo) Hash() string {
+	members := make([]string, len(chat.Members))
+	copy(members, chat.Members)
+	sort.Strings(members)
+	hash := sha256.New()
+	hash.Write([]byte(chat.DisplayName))
+	for _, member := range members {
+		hash.Write([]byte{0})
+		hash.Write([]byte(member))
+	}
+	if chat.Avatar != nil {
+		// New avatars are stored as new attachments, so the identifier is enough to detect changes without reading the file
+		avatarID := chat.Avatar.GUID
+		if avatarID == "" {
+			avatarID = chat.Avatar.PathOnDisk
+		}
+		hash.Write([]byte{1})
+		hash.Write([]byte(avatarID))
+	}
+	return base64.RawStdEncoding.EncodeToString(hash.Sum(nil))
+}
+
+// ChatState contains the mute and archive state of a chat. Nil fields mean the state is unknown or unchanged.
+type ChatState struct {
+	Muted    *bool `json:"muted,omitempty"`
+	Archived *bool `json:"archived,omitempty"`
 }
 
 type Identifier struct {
@@ -258,6 +338,7 @@ type SendResponse struct {
 type ConnectorCapabilities struct {
 	MessageSendResponses     bool
 	SendTapbacks             bool
+	SendCustomTapbacks       bool
 	SendReadReceipts         bool
 	SendTypingNotifications  bool
 	SendCaptions             bool
@@ -266,6 +347,9 @@ type ConnectorCapabilities struct {
 	ContactChatMerging       bool
 	RichLinks                bool
 	ChatBridgeResult         bool
+	SendMentions             bool
+	GroupManagement          bool
+	ChatStateSync            bool
 }
 
 type PushKeyRequest struct {
@@ -30,6 +30,8 @@ const (
 	TapbackLaugh
 	TapbackEmphasis
 	TapbackQuestion
+	// TapbackEmoji is a tapback with an arbitrary emoji, which is stored in Tapback.CustomEmoji
+	TapbackEmoji
 
 	TapbackRemoveOffset = 1000
 )
@@ -39,6 +41,16 @@ type Tapback struct {
 	TargetPart int         `json:"-"`
 	Remove     bool        `json:"-"`
 	Type       TapbackType `json:"type"`
+
+	CustomEmoji string `json:"emoji,omitempty"`
+}
+
+// Emoji returns the emoji that should be used as the reaction key for this tapback.
+func (tapback *Tapback) Emoji() string {
+	if tapback.Type == TapbackEmoji {
+		return tapback.CustomEmoji
+	}
+	return tapback.Type.Emoji()
 }
 
 var (
@@ -95,6 +107,35 @@ func TapbackFromEmoji(emoji string) TapbackType {
 	}
 }
 
+// NearestTapback finds the classic tapback that is closest to the given emoji.
+// Emojis that don't resemble any of the classic tapbacks are mapped to TapbackLike.
+func NearestTapback(emoji string) TapbackType {
+	if len(emoji) == 0 {
+		return 0
+	} else if tapback := TapbackFromEmoji(emoji); tapback != 0 {
+		return tapback
+	}
+	switch []rune(emoji)[0] {
+	case '\U0001f60d', '\U0001f970', '\U0001f618', '\U0001f63b', '\U0001f48b', '\U0001f498', '\U0001f49d', '\U0001f497', '\U0001f493':
+		// '😍', '🥰', '😘', '😻', '💋', '💘', '💝', '💗', '💓'
+		return TapbackLove
+	case '\U0001f600', '\U0001f603', '\U0001f604', '\U0001f601', '\U0001f605', '\U0001f638', '\U0001f92a', '\U0001f61d':
+		// '😀', '😃', '😄', '😁', '😅', '😸', '🤪', '😝'
+		return TapbackLaugh
+	case '\u26a0', '\U0001f4a5', '\U0001f631', '\U0001f62e', '\U0001f632', '\U0001f92f', '\U0001f440':
+		// '⚠', '💥', '😱', '😮', '😲', '🤯', '👀'
+		return TapbackEmphasis
+	case '\U0001f914', '\U0001f9d0', '\U0001f615', '\U0001f928', '\U0001f937':
+		// '🤔', '🧐', '😕', '🤨', '🤷'
+		return TapbackQuestion
+	case '\U0001f622', '\U0001f62d', '\U0001f620', '\U0001f621', '\U0001f612', '\U0001f4a9', '\u274c', '\U0001f6ab':
+		// '😢', '😭', '😠', '😡', '😒', '💩', '❌', '🚫'
+		return TapbackDislike
+	default:
+		return TapbackLike
+	}
+}
+
 func (amt TapbackType) String() string {
 	return amt.Emoji()
 }
@@ -0,0 +1,128 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-imessage/database"
+	"go.mau.fi/mautrix-imessage/imessage"
+)
+
+// useLazyMedia returns true if attachments in backfilled messages should be uploaded in the background.
+// Encrypted rooms need the file hash in the event, so they always upload immediately.
+func (portal *Portal) useLazyMedia() bool {
+	return portal.bridge.Config.Bridge.Backfill.LazyMedia &&
+		portal.bridge.Config.Homeserver.AsyncMedia &&
+		!portal.Encrypted
+}
+
+// convertIMAttachmentLazy reserves a content URI for the attachment and returns a message pointing at it
+// without reading the file. The attachment is uploaded into the URI later by the backfill queue.
+// Attachments that need to be converted must not be sent through here.
+func (portal *Portal) convertIMAttachmentLazy(msg *imessage.Message, attach *imessage.Attachment, intent *appservice.IntentAPI) (*event.MessageEventContent, map[string]interface{}, error) {
+	mimeType := attach.GetMimeType()
+	size, err := attach.Size()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to stat attachment: %w", err)
+	}
+
+	resp, err := intent.UnstableCreateMXC()
+	if err != nil {
+		return nil, nil, err
+	}
+	lazyMedia := portal.bridge.DB.LazyMedia.New()
+	lazyMedia.MXC = resp.ContentURI
+	lazyMedia.PortalGUID = portal.GUID
+	lazyMedia.Receiver = portal.Receiver
+	lazyMedia.MessageGUID = msg.GUID
+	lazyMedia.Uploader = intent.UserID
+	lazyMedia.UploadURL = resp.UploadURL
+	lazyMedia.Attachment = *attach
+	lazyMedia.IsAudio = msg.IsAudioMessage
+	lazyMedia.Insert()
+
+	return &event.MessageEventContent{
+		MsgType: msgTypeForMime(mimeType),
+		Body:    attach.GetFileName(),
+		URL:     resp.ContentURI.CUString(),
+		Info: &event.FileInfo{
+			MimeType: mimeType,
+			Size:     size,
+		},
+	}, map[string]interface{}{}, nil
+}
+
+var errLazyMediaUploadFailed = errors.New("failed to upload lazy media")
+
+// runLazyMediaJob uploads one batch of pending media in the portal and returns true when there's nothing left.
+// Uploads that fail temporarily are kept in the database and returned as an error so the job is retried later.
+func (portal *Portal) runLazyMediaJob() (bool, error) {
+	limit := portal.bridge.Config.Bridge.Backfill.Queue.BatchSize
+	pending := portal.bridge.DB.LazyMedia.GetPending(portal.GUID, portal.Receiver, limit)
+	for _, lazyMedia := range pending {
+		err := portal.uploadLazyMedia(lazyMedia)
+		if err != nil {
+			return false, err
+		}
+	}
+	return len(pending) < limit, nil
+}
+
+func isPermanentLazyMediaError(err error) bool {
+	return errors.Is(err, os.ErrNotExist) || errors.Is(err, mautrix.MTooLarge) || errors.Is(err, mautrix.MNotFound)
+}
+
+func (portal *Portal) uploadLazyMedia(lazyMedia *database.LazyMedia) error {
+	attach := &lazyMedia.Attachment
+	data, err := attach.Read()
+	if err == nil {
+		_, err = portal.bridge.AS.Intent(lazyMedia.Uploader).UploadMedia(mautrix.ReqUploadMedia{
+			ContentBytes: data,
+			ContentType:  attach.GetMimeType(),
+			FileName:     attach.GetFileName(),
+			UnstableMXC:  lazyMedia.MXC,
+			UploadURL:    lazyMedia.UploadURL,
+		})
+	}
+	if err != nil && isPermanentLazyMediaError(err) {
+		portal.log.Errorfln("Dropping lazy media %s in %s: %v", lazyMedia.MXC, lazyMedia.MessageGUID, err)
+		lazyMedia.Delete()
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("%w %s in %s: %v", errLazyMediaUploadFailed, lazyMedia.MXC, lazyMedia.MessageGUID, err)
+	}
+	lazyMedia.Delete()
+	portal.log.Debugfln("Uploaded lazy media %s in %s", lazyMedia.MXC, lazyMedia.MessageGUID)
+	chatGUID := portal.GUID
+	if dbMessage := portal.bridge.DB.Message.GetLastByGUID(portal.GUID, portal.Receiver, lazyMedia.MessageGUID); dbMessage != nil && dbMessage.HandleGUID != "" {
+		chatGUID = dbMessage.HandleGUID
+	}
+	if portal.connectorConfigFor(chatGUID).DeleteMediaAfterUpload {
+		err = attach.Delete()
+		if err != nil {
+			portal.log.Warnfln("Failed to delete attachment in %s: %v", lazyMedia.MessageGUID, err)
+		}
+	}
+	return nil
+}
@@ -41,6 +41,7 @@ import (
 	"maunium.net/go/mautrix/util/configupgrade"
 
 	"go.mau.fi/mautrix-imessage/config"
+	"go.mau.fi/mautrix-imessage/contacts"
 	"go.mau.fi/mautrix-imessage/database"
 	"go.mau.fi/mautrix-imessage/imessage"
 	_ "go.mau.fi/mautrix-imessage/imessage/ios"
@@ -64,26 +65,27 @@ var checkPermissions = flag.MakeFull("p", "check-permissions", "Check for full d
 
 type IMBridge struct {
 	bridge.Bridge
-	Config    *config.Config
-	DB        *database.Database
-	IM        imessage.API
-	IMHandler *iMessageHandler
-	IPC       *ipc.Processor
+	Config *config.Config
+	DB     *database.Database
+	IPC    *ipc.Processor
+
+	ContactStore *contacts.Store
 
 	WebsocketHandler *WebsocketCommandHandler
 
-	user          *User
-	portalsByMXID map[id.RoomID]*Portal
-	portalsByGUID map[string]*Portal
-	portalsLock   sync.Mutex
-	userCache     map[id.UserID]*User
-	puppets       map[string]*Puppet
-	puppetsLock   sync.Mutex
-	stopping      bool
-	stop          chan struct{}
-	stopPinger    chan struct{}
-	latestState   *imessage.BridgeStatus
-	pushKey       *imessage.PushKeyRequest
+	user            *User
+	users           map[id.UserID]*User
+	usersByReceiver map[string]*User
+	portalsByMXID   map[id.RoomID]*Portal
+	portalsByGUID   map[portalKey]*Portal
+	portalsLock     sync.Mutex
+	userCache       map[id.UserID]*User
+	puppets         map[puppetKey]*Puppet
+	puppetsLock     sync.Mutex
+	stopping        bool
+	stop            chan struct{}
+	stopPinger      chan struct{}
+	pushKey         *imessage.PushKeyRequest
 
 	shortCircuitReconnectBackoff chan struct{}
 	websocketStarted             chan struct{}
@@ -97,6 +99,9 @@ type IMBridge struct {
 	pendingHackyTestGUID     string
 	pendingHackyTestRandomID string
 	hackyTestSuccess         bool
+
+	asleep    chan struct{}
+	sleepLock sync.Mutex
 }
 
 func (br *IMBridge) GetExampleConfig() string {
@@ -129,8 +134,8 @@ func (br *IMBridge) GetAllIPortals() (iportals []bridge.Portal) {
 }
 
 func (br *IMBridge) GetIUser(id id.UserID, create bool) bridge.User {
-	if id == br.user.MXID {
-		return br.user
+	if user, ok := br.users[id]; ok {
+		return user
 	}
 	cached, ok := br.userCache[id]
 	if !ok {
@@ -148,7 +153,7 @@ func (br *IMBridge) GetIUser(id id.UserID, create bool) bridge.User {
 }
 
 func (br *IMBridge) IsGhost(userID id.UserID) bool {
-	_, isPuppet := br.ParsePuppetMXID(userID)
+	_, _, isPuppet := br.ParsePuppetMXID(userID)
 	return isPuppet
 }
 
@@ -196,20 +201,33 @@ func (br *IMBridge) Init() {
 	br.IPC.SetHandler("stop", br.ipcStop)
 	br.IPC.SetHandler("merge-rooms", br.ipcMergeRooms)
 	br.IPC.SetHandler("split-rooms", br.ipcSplitRooms)
+	br.IPC.SetHandler("undo-merge", br.ipcUndoMerge)
 	br.IPC.SetHandler("do-auto-merge", br.ipcDoAutoMerge)
+	br.IPC.SetHandler("backfill-older", br.ipcBackfillOlder)
 
-	br.Log.Debugln("Initializing iMessage connector")
-	var err error
-	br.IM, err = imessage.NewAPI(br)
-	if err != nil {
-		br.Log.Fatalln("Failed to initialize iMessage connector:", err)
-		os.Exit(14)
+	var contactSources []contacts.Source
+	if cardDAV := br.Config.Bridge.ContactSources.CardDAV; cardDAV.URL != "" {
+		contactSources = append(contactSources, contacts.NewCardDAVSource(cardDAV.URL, cardDAV.Username, cardDAV.Password))
+	}
+	if vcfDir := br.Config.Bridge.ContactSources.VCFDirectory; vcfDir != "" {
+		contactSources = append(contactSources, &contacts.VCFDirectorySource{Path: vcfDir})
+	}
+	if len(contactSources) > 0 {
+		br.ContactStore = contacts.NewStore(br.Log.Sub("Contacts"), contactSources...)
 	}
 
-	if br.Config.IMessage.Platform == "android" {
+	br.CommandProcessor.(*commands.Processor).AddHandlers(cmdLogin, cmdLogout, cmdSetSendPolicy, cmdEditGhost, cmdMergeHistory, cmdUndoMerge, cmdAutoMerge, cmdMergeOptOut, cmdMergeOptIn, cmdMoveToSpace, cmdMessageStatus, cmdBackfillOlder, cmdBackfillQueue, cmdPortalSettings, cmdPortalPermissions)
+
+	br.EventProcessor.On(PortalSettingsEventType, br.HandlePortalSettingsEvent)
+
+	if br.Config.IMessage.HasPlatform("android") {
 		br.EventProcessor.PrependHandler(event.EventEncrypted, func(evt *event.Event) {
-			go br.IM.NotifyUpcomingMessage(evt.ID)
+			if br.user.IM != nil {
+				go br.user.IM.NotifyUpcomingMessage(evt.ID)
+			}
 		})
+	}
+	if br.Config.IMessage.Platform == "android" {
 		br.Bridge.BeeperNetworkName = "androidsms"
 		br.Bridge.BeeperServiceName = "androidsms"
 	} else if br.Config.IMessage.Platform == "mac-nosip" {
@@ -220,7 +238,6 @@ func (br *IMBridge) Init() {
 		br.Bridge.BeeperServiceName = "imessage"
 	}
 
-	br.IMHandler = NewiMessageHandler(br)
 	br.WebsocketHandler = NewWebsocketCommandHandler(br)
 }
 
@@ -307,7 +324,8 @@ func (br *IMBridge) ipcPingServer(_ json.RawMessage) interface{} {
 }
 
 type ipcMergeRequest struct {
-	GUIDs []string `json:"guids"`
+	GUIDs    []string `json:"guids"`
+	Receiver string   `json:"receiver,omitempty"`
 }
 
 type ipcMergeResponse struct {
@@ -320,9 +338,13 @@ func (br *IMBridge) ipcMergeRooms(rawReq json.RawMessage) interface{} {
 	if err != nil {
 		return err
 	}
+	user, err := br.getUserByReceiver(req.Receiver)
+	if err != nil {
+		return err
+	}
 	var portals []*Portal
 	for _, guid := range req.GUIDs {
-		portals = append(portals, br.GetPortalByGUID(guid))
+		portals = append(portals, user.GetPortalByGUID(guid))
 	}
 	if len(portals) < 2 {
 		return fmt.Errorf("must pass at least 2 portals to merge")
@@ -332,8 +354,9 @@ func (br *IMBridge) ipcMergeRooms(rawReq json.RawMessage) interface{} {
 }
 
 type ipcSplitRequest struct {
-	GUID  string              `json:"guid"`
-	Parts map[string][]string `json:"parts"`
+	GUID     string              `json:"guid"`
+	Parts    map[string][]string `json:"parts"`
+	Receiver string              `json:"receiver,omitempty"`
 }
 
 type ipcSplitResponse struct{}
@@ -344,20 +367,96 @@ func (br *IMBridge) ipcSplitRooms(rawReq json.RawMessage) interface{} {
 	if err != nil {
 		return err
 	}
-	sourcePortal := br.GetPortalByGUID(req.GUID)
+	user, err := br.getUserByReceiver(req.Receiver)
+	if err != nil {
+		return err
+	}
+	sourcePortal := user.GetPortalByGUID(req.GUID)
 	sourcePortal.Split(req.Parts)
 	return ipcSplitResponse{}
 }
 
-func (br *IMBridge) ipcDoAutoMerge(_ json.RawMessage) any {
-	contacts, err := br.IM.GetContactList()
+type ipcUndoMergeRequest struct {
+	ID       int64  `json:"id"`
+	Receiver string `json:"receiver,omitempty"`
+}
+
+func (br *IMBridge) ipcUndoMerge(rawReq json.RawMessage) interface{} {
+	var req ipcUndoMergeRequest
+	err := json.Unmarshal(rawReq, &req)
 	if err != nil {
-		return fmt.Errorf("failed to get contact list: %w", err)
+		return err
+	}
+	user, err := br.getUserByReceiver(req.Receiver)
+	if err != nil {
+		return err
+	}
+	err = user.UndoMerge(req.ID)
+	if err != nil {
+		return err
 	}
-	br.UpdateMerges(contacts)
 	return struct{}{}
 }
 
+type ipcBackfillOlderRequest struct {
+	ChatGUID string `json:"chat_guid"`
+	Limit    int    `json:"limit"`
+	Receiver string `json:"receiver,omitempty"`
+}
+
+type ipcBackfillOlderResponse struct {
+	Count int `json:"count"`
+}
+
+func (br *IMBridge) ipcBackfillOlder(rawReq json.RawMessage) interface{} {
+	var req ipcBackfillOlderRequest
+	err := json.Unmarshal(rawReq, &req)
+	if err != nil {
+		return err
+	}
+	user, err := br.getUserByReceiver(req.Receiver)
+	if err != nil {
+		return err
+	}
+	portal := user.GetPortalByGUIDIfExists(req.ChatGUID)
+	if portal == nil {
+		return fmt.Errorf("portal not found")
+	}
+	count, err := portal.BackwardBackfill(req.Limit)
+	if err != nil {
+		return err
+	}
+	return ipcBackfillOlderResponse{Count: count}
+}
+
+type ipcAutoMergeRequest struct {
+	DryRun   bool   `json:"dry_run"`
+	Receiver string `json:"receiver,omitempty"`
+}
+
+type ipcAutoMergeResponse struct {
+	Merges []*MergePlan `json:"merges"`
+}
+
+func (br *IMBridge) ipcDoAutoMerge(rawReq json.RawMessage) any {
+	var req ipcAutoMergeRequest
+	if len(rawReq) > 0 {
+		err := json.Unmarshal(rawReq, &req)
+		if err != nil {
+			return err
+		}
+	}
+	user, err := br.getUserByReceiver(req.Receiver)
+	if err != nil {
+		return err
+	}
+	contactList, err := user.Contacts.GetContactList()
+	if err != nil {
+		return fmt.Errorf("failed to get contact list: %w", err)
+	}
+	return ipcAutoMergeResponse{Merges: user.UpdateMerges(contactList, req.DryRun)}
+}
+
 const defaultReconnectBackoff = 2 * time.Second
 const maxReconnectBackoff = 2 * time.Minute
 const reconnectBackoffReset = 5 * time.Minute
@@ -369,6 +468,7 @@ type StartSyncRequest struct {
 }
 
 const BridgeStatusConnected = "CONNECTED"
+const BridgeStatusUnknownError = "UNKNOWN_ERROR"
 
 func (br *IMBridge) SendBridgeStatus(state imessage.BridgeStatus) {
 	br.Log.Debugfln("Sending bridge status to server: %+v", state)
@@ -384,9 +484,6 @@ func (br *IMBridge) SendBridgeStatus(state imessage.BridgeStatus) {
 	if len(state.UserID) == 0 {
 		state.UserID = br.user.MXID
 	}
-	if br.IM.Capabilities().BridgeState {
-		br.latestState = &state
-	}
 	err := br.AS.SendWebsocket(&appservice.WebsocketRequest{
 		Command: "bridge_status",
 		Data:    &state,
@@ -394,7 +491,7 @@ func (br *IMBridge) SendBridgeStatus(state imessage.BridgeStatus) {
 	if err != nil {
 		br.Log.Warnln("Error sending bridge status:", err)
 	}
-	if br.Config.HackyStartupTest.Identifier != "" && state.StateEvent == BridgeStatusConnected && !br.Config.HackyStartupTest.EchoMode {
+	if br.Config.HackyStartupTest.Identifier != "" && state.UserID == br.user.MXID && state.StateEvent == BridgeStatusConnected && !br.Config.HackyStartupTest.EchoMode {
 		br.wasConnected = true
 		if !br.wasConnected {
 			go br.hackyStartupTests(true, false)
@@ -463,13 +560,8 @@ func (br *IMBridge) RequestStartSync() {
 func (br *IMBridge) startWebsocket(wg *sync.WaitGroup) {
 	var wgOnce sync.Once
 	onConnect := func() {
-		if br.latestState != nil {
-			go br.SendBridgeStatus(*br.latestState)
-		} else if !br.IM.Capabilities().BridgeState {
-			go br.SendBridgeStatus(imessage.BridgeStatus{
-				StateEvent: BridgeStatusConnected,
-				RemoteID:   "unknown",
-			})
+		for _, user := range br.users {
+			user.resendBridgeStatus()
 		}
 		go br.sendPushKey()
 		br.RequestStartSync()
@@ -521,14 +613,6 @@ func (br *IMBridge) startWebsocket(wg *sync.WaitGroup) {
 	}
 }
 
-func (br *IMBridge) connectToiMessage(wg *sync.WaitGroup) {
-	err := br.IM.Start(wg.Done)
-	if err != nil {
-		br.Log.Fatalln("Error in iMessage connection:", err)
-		os.Exit(40)
-	}
-}
-
 func (br *IMBridge) Start() {
 	if br.Config.Bridge.MessageStatusEvents {
 		sendStatusStart := br.DB.KV.Get(database.KVSendStatusStart)
@@ -545,13 +629,24 @@ func (br *IMBridge) Start() {
 
 	needsPortalFinding := br.Config.Bridge.FindPortalsIfEmpty && br.DB.Portal.Count() == 0
 
-	br.Log.Debugln("Finding bridge user")
-	br.user = br.loadDBUser()
-	br.user.initDoublePuppet()
+	br.Log.Debugln("Finding bridge users")
+	br.loadUsers()
 	var startupGroup sync.WaitGroup
-	startupGroup.Add(2)
-	br.Log.Debugln("Connecting to iMessage")
-	go br.connectToiMessage(&startupGroup)
+	startupGroup.Add(1)
+	for _, user := range br.users {
+		br.Log.Debugfln("Initializing iMessage connector for %s", user.MXID)
+		err := user.initConnector()
+		if err != nil {
+			br.Log.Fatalfln("Failed to initialize iMessage connector for %s: %v", user.MXID, err)
+			os.Exit(14)
+		}
+		user.initDoublePuppet()
+		if user.IsLoggedIn() {
+			startupGroup.Add(1)
+			br.Log.Debugfln("Connecting to iMessage as %s", user.MXID)
+			go user.connectOnStartup(startupGroup.Done)
+		}
+	}
 
 	if needsPortalFinding {
 		br.Log.Infoln("Portal database is empty, finding portals from Matrix room state")
@@ -577,15 +672,19 @@ func (br *IMBridge) Start() {
 		br.Log.Debugln("Websocket proxy not configured, not starting application service websocket")
 	}
 
-	br.Log.Debugln("Starting iMessage handler")
-	go br.IMHandler.Start()
 	startupGroup.Wait()
 	br.Log.Debugln("Starting IPC loop")
 	go br.IPC.Loop()
 
-	go br.StartupSync()
+	for _, user := range br.users {
+		// Extra users whose connector failed to start are skipped
+		if user.IsLoggedIn() && user.IsConnected() {
+			go user.StartupSync()
+		}
+	}
 	br.Log.Infoln("Initialization complete")
 	go br.PeriodicSync()
+	go br.ContactSourceSync()
 
 	br.stopPinger = make(chan struct{})
 	if br.Config.Homeserver.WSPingInterval > 0 {
@@ -614,82 +713,27 @@ func (br *IMBridge) serverPinger() {
 	}
 }
 
-func (br *IMBridge) StartupSync() {
-	resp, err := br.IM.PreStartupSyncHook()
-	if err != nil {
-		br.Log.Errorln("iMessage connector returned error in startup sync hook:", err)
-	} else if resp.SkipSync {
-		br.Log.Debugln("Skipping startup sync")
+func (br *IMBridge) ContactSourceSync() {
+	if br.ContactStore == nil {
 		return
 	}
-
-	forceUpdateBridgeInfo := br.sendStatusUpdateInfo ||
-		br.DB.KV.Get(database.KVBridgeInfoVersion) != database.ExpectedBridgeInfoVersion
-	alreadySynced := make(map[string]bool)
-	for _, portal := range br.GetAllPortals() {
-		removed := portal.CleanupIfEmpty(true)
-		if !removed && len(portal.MXID) > 0 {
-			if br.Config.Bridge.DisableSMSPortals && portal.Identifier.Service == "SMS" && !portal.Identifier.IsGroup {
-				imIdentifier := portal.Identifier
-				imIdentifier.Service = "iMessage"
-				if !portal.reIDInto(imIdentifier.String(), true, true) {
-					// Portal was dropped/merged, don't sync it
-					continue
-				} // else: portal was re-id'd, sync it as usual
-			} else if !br.Config.Bridge.DisableSMSPortals && portal.Identifier.Service == "iMessage" && !portal.Identifier.IsGroup && portal.LastSeenHandle != "" {
-				lastSeenHandle := imessage.ParseIdentifier(portal.LastSeenHandle)
-				if lastSeenHandle.Service == "SMS" && lastSeenHandle.LocalID == portal.Identifier.LocalID {
-					if !portal.reIDInto(portal.LastSeenHandle, true, true) {
-						continue
-					}
-				}
-			}
-			portal.log.Infoln("Syncing portal (startup sync, existing portal)")
-			portal.Sync(true)
-			alreadySynced[portal.GUID] = true
-			if forceUpdateBridgeInfo {
-				portal.UpdateBridgeInfo()
-			}
+	interval := time.Duration(br.Config.Bridge.ContactSources.RefreshInterval) * time.Second
+	for {
+		contactList, err := br.ContactStore.Refresh()
+		if err != nil {
+			// The contacts of the other sources were still refreshed, so they're synced anyway
+			br.Log.Errorln("Failed to refresh contacts from some external sources:", err)
 		}
-	}
-	if forceUpdateBridgeInfo {
-		br.DB.KV.Set(database.KVBridgeInfoVersion, database.ExpectedBridgeInfoVersion)
-	}
-	syncChatMaxAge := time.Duration(br.Config.Bridge.Backfill.InitialSyncMaxAge*24*60) * time.Minute
-	chats, err := br.IM.GetChatsWithMessagesAfter(time.Now().Add(-syncChatMaxAge))
-	if err != nil {
-		br.Log.Errorln("Failed to get chat list to backfill:", err)
-		return
-	}
-	for _, chat := range chats {
-		if _, isSynced := alreadySynced[chat.ChatGUID]; !isSynced {
-			portal := br.GetPortalByGUID(chat.ChatGUID)
-			if portal.ThreadID == "" {
-				portal.ThreadID = chat.ThreadID
+		br.Log.Infofln("Fetched %d contacts from external sources", len(contactList))
+		for _, user := range br.users {
+			if user.IsLoggedIn() {
+				user.syncContactSources()
 			}
-			portal.log.Infoln("Syncing portal (startup sync, new portal)")
-			portal.Sync(true)
 		}
-	}
-	br.Log.Infoln("Startup sync complete")
-	br.IM.PostStartupSyncHook()
-}
-
-func (br *IMBridge) PeriodicSync() {
-	if !br.Config.Bridge.PeriodicSync {
-		br.Log.Debugln("Periodic sync is disabled")
-		return
-	}
-	br.Log.Debugln("Periodic sync is enabled")
-	for {
-		time.Sleep(time.Hour)
-		br.Log.Infoln("Executing periodic chat/contact info sync")
-		for _, portal := range br.GetAllPortals() {
-			if len(portal.MXID) > 0 {
-				portal.log.Infoln("Syncing portal (periodic sync, existing portal)")
-				portal.Sync(false)
-			}
+		if interval <= 0 || br.stopping {
+			return
 		}
+		time.Sleep(interval)
 	}
 }
 
@@ -742,9 +786,10 @@ func (br *IMBridge) internalStop() {
 	br.AS.StopWebsocket(appservice.ErrWebsocketManualStop)
 	br.Log.Debugln("Stopping event processor")
 	br.EventProcessor.Stop()
-	br.Log.Debugln("Stopping iMessage connector")
-	br.IM.Stop()
-	br.IMHandler.Stop()
+	br.Log.Debugln("Stopping iMessage connectors")
+	for _, user := range br.users {
+		user.Disconnect()
+	}
 	// Short-circuit reconnect backoff so the websocket loop exits even if it's disconnected
 	select {
 	case br.shortCircuitReconnectBackoff <- struct{}{}:
@@ -774,11 +819,13 @@ func (br *IMBridge) HandleFlags() bool {
 
 func main() {
 	br := &IMBridge{
-		portalsByMXID: make(map[id.RoomID]*Portal),
-		portalsByGUID: make(map[string]*Portal),
-		puppets:       make(map[string]*Puppet),
-		userCache:     make(map[id.UserID]*User),
-		stop:          make(chan struct{}, 1),
+		portalsByMXID:   make(map[id.RoomID]*Portal),
+		portalsByGUID:   make(map[portalKey]*Portal),
+		puppets:         make(map[puppetKey]*Puppet),
+		users:           make(map[id.UserID]*User),
+		usersByReceiver: make(map[string]*User),
+		userCache:       make(map[id.UserID]*User),
+		stop:            make(chan struct{}, 1),
 
 		shortCircuitReconnectBackoff: make(chan struct{}),
 		websocketStarted:             make(chan struct{}),
@@ -29,6 +29,7 @@ import (
 	"maunium.net/go/mautrix/appservice"
 	"maunium.net/go/mautrix/id"
 
+	"go.mau.fi/mautrix-imessage/database"
 	"go.mau.fi/mautrix-imessage/imessage"
 )
 
@@ -60,6 +61,7 @@ func NewWebsocketCommandHandler(br *IMBridge) *WebsocketCommandHandler {
 	br.AS.SetWebsocketCommandHandler("list_contacts", handler.handleWSGetContacts)
 	br.AS.SetWebsocketCommandHandler("upload_contacts", handler.handleWSUploadContacts)
 	br.AS.SetWebsocketCommandHandler("edit_ghost", handler.handleWSEditGhost)
+	br.AS.SetWebsocketCommandHandler("backfill_older", handler.handleWSBackfillOlder)
 	br.AS.SetWebsocketCommandHandler("do_hacky_test", handler.handleWSHackyTest)
 	return handler
 }
@@ -70,17 +72,37 @@ func (mx *WebsocketCommandHandler) handleWSHackyTest(cmd appservice.WebsocketCom
 	return true, nil
 }
 
+type ReceiverRequest struct {
+	Receiver string `json:"receiver,omitempty"`
+}
+
+// parseReceiverRequest finds the user for websocket commands whose only optional parameter is the receiver.
+func (mx *WebsocketCommandHandler) parseReceiverRequest(cmd appservice.WebsocketCommand) (*User, error) {
+	var req ReceiverRequest
+	if len(cmd.Data) > 0 {
+		if err := json.Unmarshal(cmd.Data, &req); err != nil {
+			return nil, fmt.Errorf("failed to parse request: %w", err)
+		}
+	}
+	return mx.bridge.getUserByReceiver(req.Receiver)
+}
+
 func (mx *WebsocketCommandHandler) handleWSPing(cmd appservice.WebsocketCommand) (bool, interface{}) {
 	var status imessage.BridgeStatus
 
-	if mx.bridge.latestState != nil {
-		status = *mx.bridge.latestState
+	user, err := mx.parseReceiverRequest(cmd)
+	if err != nil {
+		return false, err
+	}
+	if user.latestState != nil {
+		status = *user.latestState
 	} else {
 		status = imessage.BridgeStatus{
 			StateEvent: BridgeStatusConnected,
 			Timestamp:  time.Now().Unix(),
 			TTL:        600,
 			Source:     "bridge",
+			UserID:     user.MXID,
 		}
 	}
 
@@ -115,6 +137,7 @@ type EditGhostRequest struct {
 	RoomID id.RoomID `json:"room_id"`
 	Reset  bool      `json:"reset"`
 	ProfileOverride
+	HideIdentifier *bool `json:"hide_identifier,omitempty"`
 }
 
 func (mx *WebsocketCommandHandler) handleWSEditGhost(cmd appservice.WebsocketCommand) (bool, interface{}) {
@@ -141,20 +164,63 @@ func (mx *WebsocketCommandHandler) handleWSEditGhost(cmd appservice.WebsocketCom
 		return false, fmt.Errorf("neither room nor user ID were provided")
 	}
 	if req.Reset {
-		puppet.log.Debugfln("Marking name as not overridden and resyncing profile")
-		puppet.NameOverridden = false
-		puppet.Update()
-		puppet.Sync()
-	} else {
-		puppet.log.Debugfln("Updating profile with %+v", req.ProfileOverride)
-		puppet.SyncWithProfileOverride(req.ProfileOverride)
+		puppet.log.Debugfln("Removing profile overrides and resyncing profile")
+		puppet.ResetOverride()
+		return true, struct{}{}
 	}
+	var avatarURL id.ContentURI
+	if len(req.PhotoURL) > 0 {
+		var err error
+		avatarURL, err = puppet.ResolveAvatarURL(req.PhotoURL)
+		if err != nil {
+			return false, err
+		}
+	}
+	puppet.log.Debugfln("Updating profile override with %+v", req.ProfileOverride)
+	puppet.EditOverride(func(override *database.PuppetOverride) {
+		if len(req.Displayname) > 0 {
+			override.Displayname = req.Displayname
+		}
+		if !avatarURL.IsEmpty() {
+			override.AvatarURL = avatarURL
+		}
+		if req.HideIdentifier != nil {
+			override.HideIdentifier = *req.HideIdentifier
+		}
+	})
 	return true, struct{}{}
 }
 
+type BackfillOlderRequest struct {
+	RoomID id.RoomID `json:"room_id"`
+	Limit  int       `json:"limit"`
+}
+
+type BackfillOlderResponse struct {
+	Count int `json:"count"`
+}
+
+// handleWSBackfillOlder is sent by clients that reach the start of a room's history to load older messages.
+func (mx *WebsocketCommandHandler) handleWSBackfillOlder(cmd appservice.WebsocketCommand) (bool, interface{}) {
+	var req BackfillOlderRequest
+	if err := json.Unmarshal(cmd.Data, &req); err != nil {
+		return false, fmt.Errorf("failed to parse request: %w", err)
+	}
+	portal := mx.bridge.GetPortalByMXID(req.RoomID)
+	if portal == nil {
+		return false, fmt.Errorf("unknown room ID provided")
+	}
+	count, err := portal.BackwardBackfill(req.Limit)
+	if err != nil {
+		return false, err
+	}
+	return true, &BackfillOlderResponse{Count: count}
+}
+
 type StartDMRequest struct {
 	Identifier string `json:"identifier"`
 	Force      bool   `json:"force"`
+	Receiver   string `json:"receiver,omitempty"`
 	ProfileOverride
 
 	ActuallyStart bool `json:"-"`
@@ -181,8 +247,12 @@ func (mx *WebsocketCommandHandler) handleWSStartDM(cmd appservice.WebsocketComma
 	}
 }
 
-func (mx *WebsocketCommandHandler) handleWSGetContacts(_ appservice.WebsocketCommand) (bool, interface{}) {
-	contacts, err := mx.bridge.IM.GetContactList()
+func (mx *WebsocketCommandHandler) handleWSGetContacts(cmd appservice.WebsocketCommand) (bool, interface{}) {
+	user, err := mx.parseReceiverRequest(cmd)
+	if err != nil {
+		return false, err
+	}
+	contacts, err := user.Contacts.GetContactList()
 	if err != nil {
 		return false, err
 	}
@@ -191,6 +261,7 @@ func (mx *WebsocketCommandHandler) handleWSGetContacts(_ appservice.WebsocketCom
 
 type UploadContactsRequest struct {
 	Contacts []*imessage.Contact `json:"contacts"`
+	Receiver string              `json:"receiver,omitempty"`
 }
 
 func (mx *WebsocketCommandHandler) handleWSUploadContacts(cmd appservice.WebsocketCommand) (bool, any) {
@@ -198,7 +269,11 @@ func (mx *WebsocketCommandHandler) handleWSUploadContacts(cmd appservice.Websock
 	if err := json.Unmarshal(cmd.Data, &req); err != nil {
 		return false, fmt.Errorf("failed to parse request: %w", err)
 	}
-	mx.bridge.UpdateMerges(req.Contacts)
+	user, err := mx.bridge.getUserByReceiver(req.Receiver)
+	if err != nil {
+		return false, err
+	}
+	user.UpdateMerges(req.Contacts, false)
 	return true, nil
 }
 
@@ -232,7 +307,12 @@ func (mx *WebsocketCommandHandler) StartChat(req StartDMRequest) (*StartDMRespon
 	var err error
 	var forced bool
 
-	if resp.GUID, err = mx.bridge.IM.ResolveIdentifier(req.Identifier); err != nil {
+	user, err := mx.bridge.getUserByReceiver(req.Receiver)
+	if err != nil {
+		return nil, err
+	}
+	req.Identifier = mx.bridge.NormalizeLocalID(req.Identifier)
+	if resp.GUID, err = user.IM.ResolveIdentifier(req.Identifier); err != nil {
 		if req.Force && req.ActuallyStart {
 			mx.log.Debugfln("Failed to resolve identifier %s (%v), but forcing creation anyway", req.Identifier, err)
 			resp.GUID = req.Identifier
@@ -242,10 +322,11 @@ func (mx *WebsocketCommandHandler) StartChat(req StartDMRequest) (*StartDMRespon
 			return nil, fmt.Errorf("failed to resolve identifier: %w", err)
 		}
 	}
+	resp.GUID = mx.bridge.NormalizeGUID(resp.GUID)
 	if parsed := imessage.ParseIdentifier(resp.GUID); parsed.Service == "SMS" && !isNumber(parsed.LocalID) {
 		mx.trackResolveIdentifier(!req.ActuallyStart, req.Identifier, "fail")
 		return nil, fmt.Errorf("can't start SMS with non-numeric identifier")
-	} else if portal := mx.bridge.GetPortalByGUID(resp.GUID); len(portal.MXID) > 0 || !req.ActuallyStart {
+	} else if portal := user.GetPortalByGUID(resp.GUID); len(portal.MXID) > 0 || !req.ActuallyStart {
 		status := "success"
 		if parsed.Service == "SMS" {
 			status = "sms"
@@ -255,7 +336,7 @@ func (mx *WebsocketCommandHandler) StartChat(req StartDMRequest) (*StartDMRespon
 		}
 		resp.RoomID = portal.MXID
 		return &resp, nil
-	} else if err = mx.bridge.IM.PrepareDM(resp.GUID); err != nil {
+	} else if err = user.IM.PrepareDM(resp.GUID); err != nil {
 		return nil, fmt.Errorf("failed to prepare DM: %w", err)
 	} else if err = portal.CreateMatrixRoom(nil, &req.ProfileOverride); err != nil {
 		return nil, fmt.Errorf("failed to create Matrix room: %w", err)
@@ -0,0 +1,145 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mau.fi/mautrix-imessage/database"
+)
+
+func layoutOf(portals ...*Portal) database.PortalLayout {
+	layout := make(database.PortalLayout, len(portals))
+	for _, portal := range portals {
+		if portal == nil {
+			continue
+		}
+		guids := append([]string{portal.GUID}, portal.SecondaryGUIDs...)
+		sort.Strings(guids)
+		filtered := guids[:0]
+		for i, guid := range guids {
+			if i == 0 || guid != guids[i-1] {
+				filtered = append(filtered, guid)
+			}
+		}
+		layout[portal.GUID] = filtered
+	}
+	return layout
+}
+
+func (user *User) recordMergeHistory(action string, before, after database.PortalLayout) {
+	if reflect.DeepEqual(before, after) {
+		return
+	}
+	entry := user.bridge.DB.MergeHistory.New()
+	entry.Receiver = user.Receiver
+	entry.Action = action
+	entry.Before = before
+	entry.After = after
+	entry.Timestamp = time.Now()
+	entry.Insert(nil)
+	user.log.Debugfln("Recorded %s #%d: %s -> %s", action, entry.ID, formatPortalLayout(before), formatPortalLayout(after))
+}
+
+func formatPortalLayout(layout database.PortalLayout) string {
+	primaries := make([]string, 0, len(layout))
+	for primary := range layout {
+		primaries = append(primaries, primary)
+	}
+	sort.Strings(primaries)
+	parts := make([]string, len(primaries))
+	for i, primary := range primaries {
+		parts[i] = fmt.Sprintf("[%s]", strings.Join(layout[primary], ", "))
+	}
+	return strings.Join(parts, " ")
+}
+
+// currentLayout returns the current layout of the portals that contain any of the GUIDs in the given layout.
+func (user *User) currentLayout(layout database.PortalLayout) database.PortalLayout {
+	var portals []*Portal
+	for _, guids := range layout {
+		for _, guid := range guids {
+			if portal := user.GetPortalByGUIDIfExists(guid); portal != nil {
+				portals = append(portals, portal)
+			}
+		}
+	}
+	return layoutOf(portals...)
+}
+
+// UndoMerge restores the portal layout from before the given merge or split.
+// The undo itself is recorded as a new merge history entry.
+func (user *User) UndoMerge(entryID int64) error {
+	entry := user.bridge.DB.MergeHistory.Get(entryID, user.Receiver)
+	if entry == nil {
+		return fmt.Errorf("merge history entry #%d not found", entryID)
+	} else if entry.Undone {
+		return fmt.Errorf("#%d has already been undone", entryID)
+	} else if !reflect.DeepEqual(user.currentLayout(entry.After), entry.After) {
+		return fmt.Errorf("the chats in #%d have been merged or split again since, undo the later changes first", entryID)
+	}
+	switch entry.Action {
+	case database.MergeActionMerge:
+		var portal *Portal
+		for primary := range entry.After {
+			portal = user.GetPortalByGUIDIfExists(primary)
+		}
+		if portal == nil {
+			return fmt.Errorf("merged portal not found")
+		}
+		parts := make(map[string][]string, len(entry.Before))
+		for primary, guids := range entry.Before {
+			for _, guid := range guids {
+				if guid != primary {
+					parts[primary] = append(parts[primary], guid)
+				}
+			}
+			if _, ok := parts[primary]; !ok {
+				parts[primary] = []string{}
+			}
+		}
+		user.log.Infofln("Undoing merge #%d by splitting %s into %s", entry.ID, portal.GUID, formatPortalLayout(entry.Before))
+		portal.Split(parts)
+	case database.MergeActionSplit:
+		var target *Portal
+		for primary := range entry.Before {
+			target = user.GetPortalByGUIDIfExists(primary)
+		}
+		if target == nil {
+			return fmt.Errorf("original portal not found")
+		}
+		others := make([]*Portal, 0, len(entry.After))
+		for primary := range entry.After {
+			if other := user.GetPortalByGUIDIfExists(primary); other != nil && other != target {
+				others = append(others, other)
+			}
+		}
+		user.log.Infofln("Undoing split #%d by merging %s", entry.ID, formatPortalLayout(entry.After))
+		target.Merge(others)
+	default:
+		return fmt.Errorf("unknown action %q", entry.Action)
+	}
+	if !reflect.DeepEqual(user.currentLayout(entry.Before), entry.Before) {
+		return fmt.Errorf("failed to restore the previous layout, check the logs for more details")
+	}
+	entry.MarkUndone()
+	return nil
+}
@@ -0,0 +1,91 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+const defaultPeriodicSyncInterval = time.Hour
+
+func (br *IMBridge) nextPeriodicSyncDelay() time.Duration {
+	interval := time.Duration(br.Config.Bridge.PeriodicSyncInterval) * time.Second
+	if interval <= 0 {
+		interval = defaultPeriodicSyncInterval
+	}
+	jitter := time.Duration(br.Config.Bridge.PeriodicSyncJitter) * time.Second
+	if jitter > 0 {
+		interval += time.Duration(rand.Int63n(int64(2*jitter))) - jitter
+	}
+	if interval < time.Minute {
+		interval = time.Minute
+	}
+	return interval
+}
+
+func (br *IMBridge) PeriodicSync() {
+	if !br.Config.Bridge.PeriodicSync {
+		br.Log.Debugln("Periodic sync is disabled")
+		return
+	}
+	br.Log.Debugln("Periodic sync is enabled")
+	for {
+		delay := br.nextPeriodicSyncDelay()
+		br.Log.Debugfln("Next periodic sync in %s", delay)
+		time.Sleep(delay)
+		br.waitUntilAwake()
+		br.Log.Infoln("Executing periodic chat/contact info sync")
+		for _, portal := range br.GetAllPortals() {
+			if br.stopping {
+				return
+			}
+			br.waitUntilAwake()
+			if len(portal.MXID) > 0 && portal.user.IsLoggedIn() {
+				portal.log.Infoln("Syncing portal (periodic sync, existing portal)")
+				portal.Sync(false)
+			}
+		}
+	}
+}
+
+// SetAsleep marks the host as sleeping or awake. Periodic syncs are paused while the host is asleep.
+func (br *IMBridge) SetAsleep(asleep bool) {
+	br.sleepLock.Lock()
+	defer br.sleepLock.Unlock()
+	if asleep && br.asleep == nil {
+		br.Log.Debugln("Host is going to sleep, pausing periodic sync")
+		br.asleep = make(chan struct{})
+	} else if !asleep && br.asleep != nil {
+		br.Log.Debugln("Host woke up, resuming periodic sync")
+		close(br.asleep)
+		br.asleep = nil
+	}
+}
+
+func (br *IMBridge) waitUntilAwake() {
+	br.sleepLock.Lock()
+	asleep := br.asleep
+	br.sleepLock.Unlock()
+	if asleep != nil {
+		<-asleep
+	}
+}
+
+func (user *User) SetAsleep(asleep bool) {
+	user.bridge.SetAsleep(asleep)
+}
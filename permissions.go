@@ -0,0 +1,130 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"maunium.net/go/mautrix/bridge/status"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	portalActionSend    = "send"
+	portalActionReact   = "react"
+	portalActionRename  = "rename"
+	portalActionMembers = "members"
+)
+
+const (
+	// permissionOwner allows the user whose iMessage account the portal belongs to.
+	permissionOwner = "owner"
+	// permissionRelay allows any user in the relay whitelist.
+	permissionRelay = "relay"
+)
+
+var portalActionDescriptions = map[string]string{
+	portalActionSend:    "send messages",
+	portalActionReact:   "react to messages",
+	portalActionRename:  "change the group name or photo",
+	portalActionMembers: "add or remove members",
+}
+
+var portalActions = []string{portalActionSend, portalActionReact, portalActionRename, portalActionMembers}
+
+// defaultPortalPermissions are used for actions that don't have rules in the portal settings.
+var defaultPortalPermissions = map[string][]string{
+	portalActionSend:    {permissionOwner, permissionRelay},
+	portalActionReact:   {permissionOwner, permissionRelay},
+	portalActionRename:  {permissionOwner},
+	portalActionMembers: {permissionOwner},
+}
+
+func (portal *Portal) getPermissionRules(action string) []string {
+	if rules, ok := portal.Settings.Permissions[action]; ok {
+		return rules
+	}
+	return defaultPortalPermissions[action]
+}
+
+func (portal *Portal) isActionAllowed(userID id.UserID, action string) bool {
+	for _, rule := range portal.getPermissionRules(action) {
+		switch rule {
+		case permissionOwner:
+			if userID == portal.user.MXID {
+				return true
+			}
+		case permissionRelay:
+			if portal.bridge.Config.Bridge.Relay.IsWhitelisted(userID) {
+				return true
+			}
+		default:
+			if id.UserID(rule) == userID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func errActionNotAllowed(action string) error {
+	return fmt.Errorf("you're not allowed to %s in this chat", portalActionDescriptions[action])
+}
+
+// checkEventPermission returns true if the sender of the event may do the given action.
+// Otherwise, the event is rejected with an error message.
+func (portal *Portal) checkEventPermission(evt *event.Event, action string) bool {
+	if portal.isActionAllowed(evt.Sender, action) {
+		return true
+	}
+	err := errActionNotAllowed(action)
+	portal.log.Debugfln("Rejecting %s %s from %s: %v", evt.Type.Type, evt.ID, evt.Sender, err)
+	portal.sendErrorMessage(evt, err, err.Error(), true, status.MsgStatusPermFailure, "")
+	return false
+}
+
+func validatePermissionRules(action string, rules []string) error {
+	if _, ok := portalActionDescriptions[action]; !ok {
+		return fmt.Errorf("unknown action %q (expected one of %s)", action, strings.Join(portalActions, ", "))
+	}
+	for _, rule := range rules {
+		if rule == permissionOwner || rule == permissionRelay {
+			continue
+		} else if _, _, err := id.UserID(rule).Parse(); err != nil {
+			return fmt.Errorf("invalid rule %q (expected %s, %s or a user ID)", rule, permissionOwner, permissionRelay)
+		}
+	}
+	return nil
+}
+
+func formatPortalPermissions(portal *Portal) string {
+	lines := make([]string, len(portalActions))
+	for i, action := range portalActions {
+		rules := portal.getPermissionRules(action)
+		formatted := "nobody"
+		if len(rules) > 0 {
+			formatted = strings.Join(rules, ", ")
+		}
+		if _, ok := portal.Settings.Permissions[action]; !ok {
+			formatted += " (default)"
+		}
+		lines[i] = fmt.Sprintf("* %s (%s): %s", action, portalActionDescriptions[action], formatted)
+	}
+	return strings.Join(lines, "\n")
+}
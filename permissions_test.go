@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+
+	"maunium.net/go/mautrix/id"
+)
+
+func TestPortal_IsActionAllowed(t *testing.T) {
+	br := newTestBridge("")
+	owner := newTestUser(br, "@owner:example.com", "", &br.Config.IMessage)
+	portal := newTestPortal("iMessage;+;chat123", "!room:example.com")
+	portal.bridge = br
+	portal.user = owner
+	portal.Settings.Permissions = map[string][]string{
+		portalActionSend:    {permissionOwner, "@friend:example.com"},
+		portalActionMembers: {},
+	}
+
+	tests := []struct {
+		user     id.UserID
+		action   string
+		expected bool
+	}{
+		{owner.MXID, portalActionSend, true},
+		{"@friend:example.com", portalActionSend, true},
+		{"@stranger:example.com", portalActionSend, false},
+		// The relay isn't enabled, so the default rules only allow the owner
+		{owner.MXID, portalActionReact, true},
+		{"@friend:example.com", portalActionReact, false},
+		{owner.MXID, portalActionRename, true},
+		{"@friend:example.com", portalActionRename, false},
+		// An empty list of rules allows nobody
+		{owner.MXID, portalActionMembers, false},
+	}
+	for _, test := range tests {
+		if allowed := portal.isActionAllowed(test.user, test.action); allowed != test.expected {
+			t.Errorf("isActionAllowed(%s, %s) returned %t, expected %t", test.user, test.action, allowed, test.expected)
+		}
+	}
+}
+
+func TestValidatePermissionRules(t *testing.T) {
+	tests := []struct {
+		action string
+		rules  []string
+		valid  bool
+	}{
+		{portalActionSend, []string{permissionOwner, permissionRelay}, true},
+		{portalActionReact, []string{"@user:example.com"}, true},
+		{portalActionRename, nil, true},
+		{"delete", []string{permissionOwner}, false},
+		{portalActionMembers, []string{"everyone"}, false},
+	}
+	for _, test := range tests {
+		err := validatePermissionRules(test.action, test.rules)
+		if test.valid && err != nil {
+			t.Errorf("Expected rules %v for %s to be valid, got %v", test.rules, test.action, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("Expected rules %v for %s to be invalid", test.rules, test.action)
+		}
+	}
+}
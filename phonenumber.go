@@ -0,0 +1,206 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nyaruka/phonenumbers"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-imessage/database"
+	"go.mau.fi/mautrix-imessage/imessage"
+)
+
+func looksLikePhoneNumber(identifier string) bool {
+	if len(identifier) == 0 {
+		return false
+	}
+	for _, char := range identifier {
+		if (char < '0' || char > '9') && !strings.ContainsRune("+ ()-.", char) {
+			return false
+		}
+	}
+	return true
+}
+
+// NormalizeLocalID converts phone numbers to the E.164 format using the configured default region.
+// Emails, short codes and anything else that isn't a valid phone number are returned as-is.
+func (br *IMBridge) NormalizeLocalID(localID string) string {
+	if !looksLikePhoneNumber(localID) {
+		return localID
+	}
+	parsed, err := phonenumbers.Parse(localID, br.Config.Bridge.PhoneRegion)
+	if err != nil || !phonenumbers.IsValidNumber(parsed) {
+		return localID
+	}
+	return phonenumbers.Format(parsed, phonenumbers.E164)
+}
+
+// NormalizeGUID normalizes the local ID of a private chat GUID. Group chat GUIDs are returned as-is.
+func (br *IMBridge) NormalizeGUID(guid string) string {
+	if strings.Count(guid, ";") != 2 {
+		return guid
+	}
+	parsed := imessage.ParseIdentifier(guid)
+	if parsed.IsGroup {
+		return guid
+	}
+	parsed.LocalID = br.NormalizeLocalID(parsed.LocalID)
+	return parsed.String()
+}
+
+// normalizeExistingIdentifiers merges puppets and private chat portals whose phone numbers were
+// stored in different formats. It only runs once per receiver and phone number region.
+func (user *User) normalizeExistingIdentifiers() {
+	br := user.bridge
+	kvKey := fmt.Sprintf("%s:%s:%s", database.KVPhoneNumbersNormalized, user.Receiver, br.Config.Bridge.PhoneRegion)
+	if br.DB.KV.Get(kvKey) == "true" {
+		return
+	}
+	user.log.Infoln("Normalizing phone numbers of existing ghosts and portals")
+
+	movedGhosts := make(map[string]string)
+	br.puppetsLock.Lock()
+	dbPuppets := br.DB.Puppet.GetAll(user.Receiver)
+	existingPuppets := make(map[string]struct{}, len(dbPuppets))
+	for _, dbPuppet := range dbPuppets {
+		existingPuppets[dbPuppet.ID] = struct{}{}
+	}
+	for _, dbPuppet := range dbPuppets {
+		oldID := dbPuppet.ID
+		normalized := br.NormalizeLocalID(oldID)
+		if normalized == oldID {
+			continue
+		}
+		delete(br.puppets, puppetKey{oldID, user.Receiver})
+		if _, exists := existingPuppets[normalized]; exists {
+			user.log.Debugfln("Deleting ghost %s, as it's a duplicate of %s", oldID, normalized)
+			dbPuppet.Delete()
+		} else {
+			user.log.Debugfln("Changing ghost ID %s -> %s", oldID, normalized)
+			dbPuppet.ReID(normalized)
+			existingPuppets[normalized] = struct{}{}
+		}
+		movedGhosts[oldID] = normalized
+	}
+	br.puppetsLock.Unlock()
+	for oldID, newID := range movedGhosts {
+		user.moveGhostMembership(oldID, newID)
+	}
+
+	var portals []*Portal
+	for _, dbPortal := range br.DB.Portal.FindPrivateChats(user.Receiver) {
+		br.portalsLock.Lock()
+		portal := user.maybeGetPortalByExactGUID(dbPortal.GUID, false)
+		br.portalsLock.Unlock()
+		if portal != nil && portal.GUID == dbPortal.GUID {
+			portals = append(portals, portal)
+		}
+	}
+	for normalized, group := range groupPortalsToNormalize(portals, br.NormalizeGUID) {
+		target := normalizationTarget(normalized, group)
+		if len(group) > 1 {
+			user.log.Debugfln("Merging %d portals with duplicate phone numbers into %s", len(group)-1, target.GUID)
+			target.Merge(group)
+		}
+		// Portals are looked up by the normalized GUID, so the remaining portal has to be renamed too
+		if target.GUID != normalized {
+			target.reIDInto(normalized, true, false)
+		}
+	}
+	br.DB.KV.Set(kvKey, "true")
+	user.log.Infoln("Finished normalizing phone numbers")
+}
+
+// groupPortalsToNormalize groups private chat portals by their normalized GUID. Groups where the only portal
+// already has the normalized GUID are left out, as there's nothing to merge or re-ID in them.
+func groupPortalsToNormalize(portals []*Portal, normalize func(guid string) string) map[string][]*Portal {
+	groups := make(map[string][]*Portal)
+	for _, portal := range portals {
+		normalized := normalize(portal.GUID)
+		groups[normalized] = append(groups[normalized], portal)
+	}
+	for normalized, group := range groups {
+		if len(group) == 1 && group[0].GUID == normalized {
+			delete(groups, normalized)
+		}
+	}
+	return groups
+}
+
+// normalizationTarget picks the portal that the rest of the group is merged into. A portal that already has
+// the normalized GUID is preferred, followed by the first portal that has a room.
+func normalizationTarget(normalized string, portals []*Portal) *Portal {
+	target := portals[0]
+	for _, portal := range portals {
+		if portal.GUID == normalized || (target.GUID != normalized && target.MXID == "" && portal.MXID != "") {
+			target = portal
+		}
+	}
+	return target
+}
+
+// moveGhostMembership replaces the ghost with an unnormalized ID with the normalized ghost in all rooms,
+// as changing the puppet ID also changes the Matrix user ID of the ghost.
+func (user *User) moveGhostMembership(oldID, newID string) {
+	br := user.bridge
+	oldIntent := br.AS.Intent(br.FormatPuppetMXID(oldID, user.Receiver))
+	resp, err := oldIntent.JoinedRooms()
+	if err != nil {
+		user.log.Warnfln("Failed to get joined rooms of old ghost %s: %v", oldIntent.UserID, err)
+		return
+	}
+	puppet := user.GetPuppetByLocalID(newID)
+	// The ghost user ID changed, so the profile has to be set again
+	puppet.Displayname = ""
+	puppet.AvatarURL = id.ContentURI{}
+	puppet.AvatarHash = nil
+	puppet.ContactInfoSet = false
+	puppet.Sync()
+	for _, roomID := range resp.JoinedRooms {
+		// The old ghost is the only bridge user in private chats, so it has to do the invite
+		err = puppet.Intent.EnsureJoined(roomID, appservice.EnsureJoinedParams{BotOverride: oldIntent.Client})
+		if err != nil {
+			user.log.Warnfln("Failed to join %s to %s in place of %s: %v", puppet.MXID, roomID, oldIntent.UserID, err)
+			continue
+		}
+		levels, err := oldIntent.PowerLevels(roomID)
+		if err == nil && levels.GetUserLevel(oldIntent.UserID) > levels.GetUserLevel(puppet.MXID) {
+			levels.SetUserLevel(puppet.MXID, levels.GetUserLevel(oldIntent.UserID))
+			_, err = oldIntent.SetPowerLevels(roomID, levels)
+		}
+		if err != nil {
+			user.log.Warnfln("Failed to copy power level of %s to %s in %s: %v", oldIntent.UserID, puppet.MXID, roomID, err)
+		}
+		_, err = oldIntent.LeaveRoom(roomID)
+		if err != nil {
+			user.log.Warnfln("Failed to make old ghost %s leave %s: %v", oldIntent.UserID, roomID, err)
+		}
+	}
+}
+
+func (br *IMBridge) normalizeOptOutIdentifier(identifier string) string {
+	identifier = strings.TrimSpace(identifier)
+	if strings.ContainsRune(identifier, '@') {
+		return strings.ToLower(identifier)
+	}
+	return br.NormalizeLocalID(identifier)
+}
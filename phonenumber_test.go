@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-imessage/config"
+	"go.mau.fi/mautrix-imessage/database"
+)
+
+func newTestBridge(region string) *IMBridge {
+	return &IMBridge{Config: &config.Config{Bridge: config.BridgeConfig{PhoneRegion: region}}}
+}
+
+func TestNormalizeLocalID(t *testing.T) {
+	br := newTestBridge("US")
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"+12025550123", "+12025550123"},
+		{"2025550123", "+12025550123"},
+		{"(202) 555-0123", "+12025550123"},
+		{"+44 20 7946 0000", "+442079460000"},
+		{"user@example.com", "user@example.com"},
+		{"12345", "12345"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if output := br.NormalizeLocalID(test.input); output != test.expected {
+			t.Errorf("NormalizeLocalID(%q) returned %q, expected %q", test.input, output, test.expected)
+		}
+	}
+}
+
+func TestNormalizeGUID(t *testing.T) {
+	br := newTestBridge("US")
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"iMessage;-;2025550123", "iMessage;-;+12025550123"},
+		{"SMS;-;+1 202 555 0123", "SMS;-;+12025550123"},
+		{"iMessage;-;user@example.com", "iMessage;-;user@example.com"},
+		{"iMessage;+;chat123456", "iMessage;+;chat123456"},
+		{"not a guid", "not a guid"},
+	}
+	for _, test := range tests {
+		if output := br.NormalizeGUID(test.input); output != test.expected {
+			t.Errorf("NormalizeGUID(%q) returned %q, expected %q", test.input, output, test.expected)
+		}
+	}
+}
+
+func newTestPortal(guid string, mxid id.RoomID) *Portal {
+	return &Portal{Portal: &database.Portal{GUID: guid, MXID: mxid}}
+}
+
+func TestGroupPortalsToNormalize(t *testing.T) {
+	br := newTestBridge("US")
+	normalized := newTestPortal("iMessage;-;+12025550123", "")
+	duplicate := newTestPortal("iMessage;-;(202) 555-0123", "!room:example.com")
+	single := newTestPortal("iMessage;-;2025550199", "!other:example.com")
+	email := newTestPortal("iMessage;-;user@example.com", "!email:example.com")
+
+	groups := groupPortalsToNormalize([]*Portal{normalized, duplicate, single, email}, br.NormalizeGUID)
+	if len(groups) != 2 {
+		t.Fatalf("Expected 2 groups, got %d: %v", len(groups), groups)
+	}
+	if group := groups["iMessage;-;+12025550123"]; len(group) != 2 {
+		t.Errorf("Expected duplicate portals to be grouped, got %v", group)
+	}
+	if group := groups["iMessage;-;+12025550199"]; len(group) != 1 || group[0] != single {
+		t.Errorf("Expected single unnormalized portal to be re-IDed, got %v", group)
+	}
+	if _, ok := groups[email.GUID]; ok {
+		t.Error("Portal that is already normalized shouldn't be included")
+	}
+}
+
+func TestNormalizationTarget(t *testing.T) {
+	const normalized = "iMessage;-;+12025550123"
+	withoutRoom := newTestPortal("iMessage;-;2025550123", "")
+	withRoom := newTestPortal("iMessage;-;(202) 555-0123", "!room:example.com")
+	alreadyNormalized := newTestPortal(normalized, "")
+
+	tests := []struct {
+		name     string
+		portals  []*Portal
+		expected *Portal
+	}{
+		{"single", []*Portal{withoutRoom}, withoutRoom},
+		{"prefer room", []*Portal{withoutRoom, withRoom}, withRoom},
+		{"prefer normalized", []*Portal{withRoom, alreadyNormalized, withoutRoom}, alreadyNormalized},
+	}
+	for _, test := range tests {
+		if target := normalizationTarget(normalized, test.portals); target != test.expected {
+			t.Errorf("%s: expected %s as target, got %s", test.name, test.expected.GUID, target.GUID)
+		}
+	}
+}
@@ -59,19 +59,31 @@ func (br *IMBridge) GetPortalByMXID(mxid id.RoomID) *Portal {
 	return portal
 }
 
-func (br *IMBridge) GetPortalByGUID(guid string) *Portal {
-	br.portalsLock.Lock()
-	defer br.portalsLock.Unlock()
-	return br.maybeGetPortalByGUID(guid, true)
+type portalKey struct {
+	GUID     string
+	Receiver string
 }
 
-func (br *IMBridge) GetPortalByGUIDIfExists(guid string) *Portal {
-	br.portalsLock.Lock()
-	defer br.portalsLock.Unlock()
-	return br.maybeGetPortalByGUID(guid, false)
+func (user *User) GetPortalByGUID(guid string) *Portal {
+	user.bridge.portalsLock.Lock()
+	defer user.bridge.portalsLock.Unlock()
+	return user.maybeGetPortalByGUID(guid, true)
+}
+
+func (user *User) GetPortalByGUIDIfExists(guid string) *Portal {
+	user.bridge.portalsLock.Lock()
+	defer user.bridge.portalsLock.Unlock()
+	return user.maybeGetPortalByGUID(guid, false)
+}
+
+func (user *User) maybeGetPortalByGUID(guid string, createIfNotExist bool) *Portal {
+	return user.maybeGetPortalByExactGUID(user.bridge.NormalizeGUID(guid), createIfNotExist)
 }
 
-func (br *IMBridge) maybeGetPortalByGUID(guid string, createIfNotExist bool) *Portal {
+// maybeGetPortalByExactGUID finds a portal without normalizing the phone number in the GUID.
+// This should only be used for portals that were stored before phone numbers were normalized.
+func (user *User) maybeGetPortalByExactGUID(guid string, createIfNotExist bool) *Portal {
+	br := user.bridge
 	if br.Config.Bridge.DisableSMSPortals && strings.HasPrefix(guid, "SMS;-;") {
 		parsed := imessage.ParseIdentifier(guid)
 		if !parsed.IsGroup && parsed.Service == "SMS" {
@@ -83,23 +95,23 @@ func (br *IMBridge) maybeGetPortalByGUID(guid string, createIfNotExist bool) *Po
 	if !createIfNotExist {
 		fallbackGUID = ""
 	}
-	portal, ok := br.portalsByGUID[guid]
+	portal, ok := br.portalsByGUID[portalKey{guid, user.Receiver}]
 	if !ok {
-		return br.loadDBPortal(nil, br.DB.Portal.GetByGUID(guid), fallbackGUID)
+		return user.loadDBPortal(nil, br.DB.Portal.GetByGUID(guid, user.Receiver), fallbackGUID)
 	}
 	return portal
 }
 
-func (br *IMBridge) GetMessagesSince(chatGUID string, since time.Time) (out []string) {
-	return br.DB.Message.GetIDsSince(chatGUID, since)
+func (user *User) GetMessagesSince(chatGUID string, since time.Time) (out []string) {
+	return user.bridge.DB.Message.GetIDsSince(chatGUID, user.Receiver, since)
 }
 
-func (br *IMBridge) ReIDPortal(oldGUID, newGUID string, mergeExisting bool) bool {
-	br.portalsLock.Lock()
-	defer br.portalsLock.Unlock()
-	portal := br.maybeGetPortalByGUID(oldGUID, false)
+func (user *User) ReIDPortal(oldGUID, newGUID string, mergeExisting bool) bool {
+	user.bridge.portalsLock.Lock()
+	defer user.bridge.portalsLock.Unlock()
+	portal := user.maybeGetPortalByGUID(oldGUID, false)
 	if portal == nil {
-		br.Log.Debugfln("Ignoring chat ID change %s->%s, no portal with old ID found", oldGUID, newGUID)
+		user.log.Debugfln("Ignoring chat ID change %s->%s, no portal with old ID found", oldGUID, newGUID)
 		return false
 	}
 
@@ -112,7 +124,11 @@ func (portal *Portal) reIDInto(newGUID string, lock, mergeExisting bool) bool {
 		br.portalsLock.Lock()
 		defer br.portalsLock.Unlock()
 	}
-	newPortal := br.maybeGetPortalByGUID(newGUID, false)
+	newGUID = br.NormalizeGUID(newGUID)
+	if newGUID == portal.GUID {
+		return false
+	}
+	newPortal := portal.user.maybeGetPortalByGUID(newGUID, false)
 	if newPortal != nil {
 		if mergeExisting && portal.MXID != "" && newPortal.MXID != "" && br.Config.Homeserver.Software == bridgeconfig.SoftwareHungry {
 			br.Log.Infofln("Got chat ID change %s->%s, but portal with new ID already exists. Merging portals in background", portal.GUID, newGUID)
@@ -123,8 +139,8 @@ func (portal *Portal) reIDInto(newGUID string, lock, mergeExisting bool) bool {
 		} else {
 			br.Log.Warnfln("Got chat ID change %s->%s, but portal with new ID already exists. Nuking old portal", portal.GUID, newGUID)
 			portal.Delete()
-			if len(portal.MXID) > 0 && portal.bridge.user.DoublePuppetIntent != nil {
-				_, _ = portal.bridge.user.DoublePuppetIntent.LeaveRoom(portal.MXID)
+			if len(portal.MXID) > 0 && portal.user.DoublePuppetIntent != nil {
+				_, _ = portal.user.DoublePuppetIntent.LeaveRoom(portal.MXID)
 			}
 			portal.Cleanup(false)
 		}
@@ -132,11 +148,11 @@ func (portal *Portal) reIDInto(newGUID string, lock, mergeExisting bool) bool {
 	}
 
 	portal.log.Infoln("Changing chat ID to", newGUID)
-	delete(br.portalsByGUID, portal.GUID)
+	delete(br.portalsByGUID, portal.key())
 	portal.Portal.ReID(newGUID)
 	portal.Identifier = imessage.ParseIdentifier(portal.GUID)
 	portal.log = portal.bridge.Log.Sub(fmt.Sprintf("Portal/%s", portal.GUID))
-	br.portalsByGUID[portal.GUID] = portal
+	br.portalsByGUID[portal.key()] = portal
 	if len(portal.MXID) > 0 {
 		portal.UpdateBridgeInfo()
 	}
@@ -148,44 +164,72 @@ func (br *IMBridge) GetAllPortals() []*Portal {
 	return br.dbPortalsToPortals(br.DB.Portal.GetAllWithMXID())
 }
 
+// GetAllPortals returns the portals with rooms that belong to the user.
+func (user *User) GetAllPortals() []*Portal {
+	allPortals := user.bridge.GetAllPortals()
+	portals := allPortals[:0]
+	for _, portal := range allPortals {
+		if portal.user == user {
+			portals = append(portals, portal)
+		}
+	}
+	return portals
+}
+
 func (br *IMBridge) dbPortalsToPortals(dbPortals []*database.Portal) []*Portal {
 	br.portalsLock.Lock()
 	defer br.portalsLock.Unlock()
-	output := make([]*Portal, len(dbPortals))
-	for index, dbPortal := range dbPortals {
+	output := make([]*Portal, 0, len(dbPortals))
+	for _, dbPortal := range dbPortals {
 		if dbPortal == nil {
 			continue
 		}
-		portal, ok := br.portalsByGUID[dbPortal.GUID]
+		portal, ok := br.portalsByGUID[portalKey{dbPortal.GUID, dbPortal.Receiver}]
 		if !ok {
 			portal = br.loadDBPortal(nil, dbPortal, "")
 		}
-		output[index] = portal
+		if portal != nil {
+			output = append(output, portal)
+		}
 	}
 	return output
 }
 
 func (br *IMBridge) loadDBPortal(txn dbutil.Execable, dbPortal *database.Portal, guid string) *Portal {
+	if dbPortal == nil {
+		return nil
+	}
+	user, ok := br.usersByReceiver[dbPortal.Receiver]
+	if !ok {
+		br.Log.Warnfln("Ignoring portal %s of unknown receiver %q", dbPortal.GUID, dbPortal.Receiver)
+		return nil
+	}
+	return user.loadDBPortal(txn, dbPortal, guid)
+}
+
+func (user *User) loadDBPortal(txn dbutil.Execable, dbPortal *database.Portal, guid string) *Portal {
+	br := user.bridge
 	if dbPortal == nil {
 		if guid == "" {
 			return nil
 		}
 		dbPortal = br.DB.Portal.New()
 		dbPortal.GUID = guid
+		dbPortal.Receiver = user.Receiver
 		dbPortal.Insert(txn)
 	} else if guid != dbPortal.GUID {
-		aliasedPortal, ok := br.portalsByGUID[dbPortal.GUID]
+		aliasedPortal, ok := br.portalsByGUID[portalKey{dbPortal.GUID, user.Receiver}]
 		if ok {
-			br.portalsByGUID[guid] = aliasedPortal
+			br.portalsByGUID[portalKey{guid, user.Receiver}] = aliasedPortal
 			return aliasedPortal
 		}
 	}
-	portal := br.NewPortal(dbPortal)
-	br.portalsByGUID[portal.GUID] = portal
+	portal := user.NewPortal(dbPortal)
+	br.portalsByGUID[portal.key()] = portal
 	if portal.IsPrivateChat() {
-		portal.SecondaryGUIDs = br.DB.MergedChat.GetAllForTarget(portal.GUID)
+		portal.SecondaryGUIDs = br.DB.MergedChat.GetAllForTarget(portal.GUID, portal.Receiver)
 		for _, sourceGUID := range portal.SecondaryGUIDs {
-			br.portalsByGUID[sourceGUID] = portal
+			br.portalsByGUID[portalKey{sourceGUID, user.Receiver}] = portal
 		}
 	}
 	if len(portal.MXID) > 0 {
@@ -194,11 +238,13 @@ func (br *IMBridge) loadDBPortal(txn dbutil.Execable, dbPortal *database.Portal,
 	return portal
 }
 
-func (br *IMBridge) NewPortal(dbPortal *database.Portal) *Portal {
+func (user *User) NewPortal(dbPortal *database.Portal) *Portal {
+	br := user.bridge
 	portal := &Portal{
 		Portal: dbPortal,
 		bridge: br,
-		zlog:   br.ZLog.With().Str("portal_guid", dbPortal.GUID).Logger(),
+		user:   user,
+		zlog:   br.ZLog.With().Str("portal_guid", dbPortal.GUID).Str("receiver", dbPortal.Receiver).Logger(),
 
 		Identifier:      imessage.ParseIdentifier(dbPortal.GUID),
 		Messages:        make(chan *imessage.Message, 100),
@@ -206,9 +252,11 @@ func (br *IMBridge) NewPortal(dbPortal *database.Portal) *Portal {
 		MessageStatuses: make(chan *imessage.SendMessageStatus, 100),
 		MatrixMessages:  make(chan *event.Event, 100),
 		backfillStart:   make(chan struct{}),
+		remoteTyping:    make(map[id.UserID]*typingState),
 	}
+	portal.matrixTyping = newTypingState(matrixTypingTimeout, portal.sendMatrixTyping, nil)
 	portal.log = maulogadapt.ZeroAsMau(&portal.zlog)
-	if !br.IM.Capabilities().MessageSendResponses {
+	if !user.IM.Capabilities().MessageSendResponses {
 		portal.messageDedup = make(map[string]SentMessage)
 	}
 	go portal.handleMessageLoop()
@@ -224,6 +272,7 @@ type Portal struct {
 	*database.Portal
 
 	bridge *IMBridge
+	user   *User
 	// Deprecated
 	log  log.Logger
 	zlog zerolog.Logger
@@ -242,8 +291,18 @@ type Portal struct {
 	messageDedupLock sync.Mutex
 	Identifier       imessage.Identifier
 
-	userIsTyping bool
-	typingLock   sync.Mutex
+	matrixTyping     *typingState
+	remoteTyping     map[id.UserID]*typingState
+	remoteTypingLock sync.Mutex
+
+	pendingSMSFallbacks    map[string]*pendingSMSFallback
+	pendingSMSFallbackLock sync.Mutex
+
+	groupReceipts     map[string]*imessage.ReadReceipt
+	groupReceiptTimer *time.Timer
+	groupReceiptLock  sync.Mutex
+
+	backwardBackfillLock sync.Mutex
 }
 
 var (
@@ -255,6 +314,32 @@ var (
 	//	_ bridge.DisappearingPortal = (*Portal)(nil)
 )
 
+func (portal *Portal) key() portalKey {
+	return portalKey{portal.GUID, portal.Receiver}
+}
+
+// connectorConfig returns the config of the connector that handles this portal's chat.
+func (portal *Portal) connectorConfig() *imessage.PlatformConfig {
+	return portal.connectorConfigFor(portal.GUID)
+}
+
+// connectorConfigFor returns the config of the connector that handles the given chat. In merged portals,
+// this can be a different connector than the one handling the portal GUID itself.
+func (portal *Portal) connectorConfigFor(chatGUID string) *imessage.PlatformConfig {
+	return portal.user.GetConnectorConfig().ForChat(chatGUID)
+}
+
+func (portal *Portal) capabilities() imessage.ConnectorCapabilities {
+	return portal.capabilitiesFor(portal.GUID)
+}
+
+func (portal *Portal) capabilitiesFor(chatGUID string) imessage.ConnectorCapabilities {
+	if multi, ok := portal.user.IM.(*imessage.MultiAPI); ok {
+		return multi.ChatCapabilities(chatGUID)
+	}
+	return portal.user.IM.Capabilities()
+}
+
 func (portal *Portal) IsEncrypted() bool {
 	return portal.Encrypted
 }
@@ -280,16 +365,41 @@ func (portal *Portal) addSecondaryGUIDs(guids []string) {
 	portal.SecondaryGUIDs = filtered
 }
 
+func (portal *Portal) removeSecondaryGUIDs(guids []string) {
+	if len(guids) == 0 {
+		return
+	}
+	remove := make(map[string]struct{}, len(guids))
+	for _, guid := range guids {
+		remove[guid] = struct{}{}
+	}
+	filtered := portal.SecondaryGUIDs[:0]
+	for _, guid := range portal.SecondaryGUIDs {
+		if _, ok := remove[guid]; !ok {
+			filtered = append(filtered, guid)
+		}
+	}
+	portal.SecondaryGUIDs = filtered
+}
+
 func (portal *Portal) SyncParticipants(chatInfo *imessage.ChatInfo) (memberIDs []id.UserID) {
+	memberIDs, _ = portal.syncParticipants(chatInfo)
+	return
+}
+
+// syncParticipants syncs the room members with the chat info. ok is false if any member couldn't be added or removed.
+func (portal *Portal) syncParticipants(chatInfo *imessage.ChatInfo) (memberIDs []id.UserID, ok bool) {
+	ok = true
 	var members map[id.UserID]mautrix.JoinedMember
 	if portal.MXID != "" {
 		membersResp, err := portal.MainIntent().JoinedMembers(portal.MXID)
 		if err != nil {
 			portal.log.Warnfln("Failed to get members in room to remove extra members: %v", err)
+			ok = false
 		} else {
 			members = membersResp.Joined
 			delete(members, portal.bridge.Bot.UserID)
-			delete(members, portal.bridge.user.MXID)
+			delete(members, portal.user.MXID)
 		}
 	}
 	portal.zlog.Debug().
@@ -297,13 +407,14 @@ func (portal *Portal) SyncParticipants(chatInfo *imessage.ChatInfo) (memberIDs [
 		Int("room_member_count", len(members)).
 		Msg("Syncing participants")
 	for _, member := range chatInfo.Members {
-		puppet := portal.bridge.GetPuppetByLocalID(member)
+		puppet := portal.user.GetPuppetByLocalID(member)
 		puppet.Sync()
 		memberIDs = append(memberIDs, puppet.MXID)
 		if portal.MXID != "" {
 			err := puppet.Intent.EnsureJoined(portal.MXID)
 			if err != nil {
 				portal.log.Warnfln("Failed to make puppet of %s join %s: %v", member, portal.MXID, err)
+				ok = false
 			}
 		}
 		if members != nil {
@@ -319,10 +430,11 @@ func (portal *Portal) SyncParticipants(chatInfo *imessage.ChatInfo) (memberIDs [
 			})
 			if err != nil {
 				portal.log.Errorfln("Failed to remove %s: %v", userID, err)
+				ok = false
 			}
 		}
 	}
-	return memberIDs
+	return
 }
 
 func (portal *Portal) UpdateName(name string, intent *appservice.IntentAPI) *id.EventID {
@@ -345,17 +457,46 @@ func (portal *Portal) UpdateName(name string, intent *appservice.IntentAPI) *id.
 	return nil
 }
 
+func (portal *Portal) getGroupAvatar() *imessage.Attachment {
+	avatar, err := portal.user.IM.GetGroupAvatar(portal.GUID)
+	if err != nil {
+		portal.log.Warnln("Failed to get avatar:", err)
+	}
+	return avatar
+}
+
 func (portal *Portal) SyncWithInfo(chatInfo *imessage.ChatInfo) {
 	portal.zlog.Debug().Interface("chat_info", chatInfo).Msg("Syncing with chat info")
+	if !portal.IsPrivateChat() && chatInfo.Avatar == nil {
+		chatInfo.Avatar = portal.getGroupAvatar()
+	}
+	infoHash := chatInfo.Hash()
+	if infoHash == portal.InfoHash {
+		portal.log.Debugln("Chat info hash didn't change, not syncing name, participants and avatar")
+		portal.UpdateChatState(chatInfo.ChatState)
+		return
+	}
 	update := false
+	synced := true
 	if len(chatInfo.DisplayName) > 0 {
 		update = portal.UpdateName(chatInfo.DisplayName, nil) != nil || update
+		synced = portal.Name == chatInfo.DisplayName
 	}
 	if !portal.IsPrivateChat() {
-		portal.SyncParticipants(chatInfo)
+		_, participantsSynced := portal.syncParticipants(chatInfo)
+		synced = synced && participantsSynced
+		if chatInfo.Avatar != nil {
+			portal.UpdateAvatar(chatInfo.Avatar, portal.MainIntent())
+			synced = synced && portal.AvatarHash != nil
+		}
+	}
+	portal.UpdateChatState(chatInfo.ChatState)
+	if synced {
+		// Only store the hash once everything is synced, so that failed parts are retried on the next sync
+		portal.InfoHash = infoHash
 	}
+	portal.Update(nil)
 	if update {
-		portal.Update(nil)
 		portal.UpdateBridgeInfo()
 	}
 }
@@ -374,41 +515,46 @@ func (portal *Portal) Sync(backfill bool) {
 		return
 	}
 
-	portal.ensureUserInvited(portal.bridge.user)
-	portal.addToSpace(portal.bridge.user)
+	portal.ensureUserInvited(portal.user)
+	portal.addToSpace(portal.user)
 
 	if !portal.IsPrivateChat() {
-		chatInfo, err := portal.bridge.IM.GetChatInfo(portal.GUID, portal.ThreadID)
+		chatInfo, err := portal.user.IM.GetChatInfo(portal.GUID, portal.ThreadID)
 		if err != nil {
 			portal.log.Errorln("Failed to get chat info:", err)
 		}
 		if chatInfo != nil {
 			portal.SyncWithInfo(chatInfo)
+		} else if avatar := portal.getGroupAvatar(); avatar != nil {
+			portal.log.Warnln("Didn't get any chat info, only syncing avatar")
+			portal.UpdateAvatar(avatar, portal.MainIntent())
 		} else {
 			portal.log.Warnln("Didn't get any chat info")
 		}
-
-		avatar, err := portal.bridge.IM.GetGroupAvatar(portal.GUID)
-		if err != nil {
-			portal.log.Warnln("Failed to get avatar:", err)
-		} else if avatar != nil {
-			portal.UpdateAvatar(avatar, portal.MainIntent())
-		}
 	} else {
-		puppet := portal.bridge.GetPuppetByLocalID(portal.Identifier.LocalID)
+		puppet := portal.user.GetPuppetByLocalID(portal.Identifier.LocalID)
 		puppet.Sync()
 	}
 
-	if backfill && portal.bridge.Config.Bridge.Backfill.Enable {
-		portal.log.Debugln("Locking backfill (sync)")
-		portal.lockBackfill()
-		portal.log.Debugln("Starting sync backfill")
-		portal.forwardBackfill()
-		portal.log.Debugln("Unlocking backfill (sync)")
-		portal.unlockBackfill()
+	if backfill {
+		portal.syncBackfill()
 	}
 }
 
+// syncBackfill bridges the messages that were sent since the last bridged message.
+func (portal *Portal) syncBackfill() {
+	if !portal.bridge.Config.Bridge.Backfill.Enable {
+		return
+	}
+	portal.log.Debugln("Locking backfill (sync)")
+	portal.lockBackfill()
+	portal.log.Debugln("Starting sync backfill")
+	err := portal.forwardBackfill()
+	portal.log.Debugln("Unlocking backfill (sync)")
+	portal.unlockBackfill()
+	portal.retryForwardBackfill(err)
+}
+
 type CustomReadReceipt struct {
 	Timestamp          int64  `json:"ts,omitempty"`
 	DoublePuppetSource string `json:"fi.mau.double_puppet_source,omitempty"`
@@ -425,7 +571,7 @@ func (portal *Portal) markRead(intent *appservice.IntentAPI, eventID id.EventID,
 		return nil
 	}
 	var extra CustomReadReceipt
-	if intent == portal.bridge.user.DoublePuppetIntent {
+	if intent == portal.user.DoublePuppetIntent {
 		extra.DoublePuppetSource = portal.bridge.Name
 	}
 	if !readAt.IsZero() {
@@ -448,7 +594,10 @@ func (portal *Portal) HandleiMessageReadReceipt(rr *imessage.ReadReceipt) {
 	}
 	var intent *appservice.IntentAPI
 	if rr.IsFromMe {
-		intent = portal.bridge.user.DoublePuppetIntent
+		intent = portal.user.DoublePuppetIntent
+	} else if !portal.IsPrivateChat() && len(rr.Reader) > 0 {
+		portal.queueGroupReadReceipt(rr)
+		return
 	} else if rr.SenderGUID == rr.ChatGUID {
 		intent = portal.MainIntent()
 	} else {
@@ -458,16 +607,56 @@ func (portal *Portal) HandleiMessageReadReceipt(rr *imessage.ReadReceipt) {
 	if intent == nil {
 		return
 	}
+	portal.sendReadReceipt(intent, rr)
+}
+
+// GroupReadReceiptDelay is how long group chat read receipts are buffered before being sent to Matrix.
+// Only the latest receipt of each participant is sent, so bursts are collapsed into one receipt per reader.
+const GroupReadReceiptDelay = 3 * time.Second
+
+func (portal *Portal) queueGroupReadReceipt(rr *imessage.ReadReceipt) {
+	// Normalize the reader so that receipts with differently formatted phone numbers are collapsed
+	rr.Reader = portal.bridge.NormalizeLocalID(rr.Reader)
+	portal.groupReceiptLock.Lock()
+	defer portal.groupReceiptLock.Unlock()
+	if portal.groupReceipts == nil {
+		portal.groupReceipts = make(map[string]*imessage.ReadReceipt)
+	}
+	if existing, ok := portal.groupReceipts[rr.Reader]; ok && existing.ReadAt.After(rr.ReadAt) {
+		return
+	}
+	portal.groupReceipts[rr.Reader] = rr
+	if portal.groupReceiptTimer == nil {
+		portal.groupReceiptTimer = time.AfterFunc(GroupReadReceiptDelay, portal.flushGroupReadReceipts)
+	}
+}
+
+func (portal *Portal) flushGroupReadReceipts() {
+	portal.groupReceiptLock.Lock()
+	receipts := portal.groupReceipts
+	portal.groupReceipts = nil
+	portal.groupReceiptTimer = nil
+	portal.groupReceiptLock.Unlock()
 
-	if message := portal.bridge.DB.Message.GetLastByGUID(portal.GUID, rr.ReadUpTo); message != nil {
+	portal.log.Debugfln("Sending %d collapsed group read receipts", len(receipts))
+	for _, rr := range receipts {
+		portal.sendReadReceipt(portal.user.GetPuppetByLocalID(rr.Reader).Intent, rr)
+	}
+}
+
+func (portal *Portal) sendReadReceipt(intent *appservice.IntentAPI, rr *imessage.ReadReceipt) {
+	if message := portal.bridge.DB.Message.GetLastByGUID(portal.GUID, portal.Receiver, rr.ReadUpTo); message != nil {
 		err := portal.markRead(intent, message.MXID, rr.ReadAt)
 		if err != nil {
-			portal.log.Warnln("Failed to send read receipt for %s from %s: %v", message.MXID, intent.UserID)
+			portal.log.Warnfln("Failed to send read receipt for %s from %s: %v", message.MXID, intent.UserID, err)
 		}
-	} else if tapback := portal.bridge.DB.Tapback.GetByTapbackGUID(portal.GUID, rr.ReadUpTo); tapback != nil {
+		if !rr.IsFromMe && portal.IsPrivateChat() {
+			portal.markReadByRemoteUpTo(message, rr.ReadAt)
+		}
+	} else if tapback := portal.bridge.DB.Tapback.GetByTapbackGUID(portal.GUID, portal.Receiver, rr.ReadUpTo); tapback != nil {
 		err := portal.markRead(intent, tapback.MXID, rr.ReadAt)
 		if err != nil {
-			portal.log.Warnln("Failed to send read receipt for %s from %s: %v", tapback.MXID, intent.UserID)
+			portal.log.Warnfln("Failed to send read receipt for %s from %s: %v", tapback.MXID, intent.UserID, err)
 		}
 	} else {
 		portal.log.Debugfln("Dropping read receipt for %s: not found in db messages or tapbacks", rr.ReadUpTo)
@@ -529,9 +718,10 @@ func (portal *Portal) HandleiMessageSendMessageStatus(msgStatus *imessage.SendMe
 	}
 
 	var eventID id.EventID
-	if msg := portal.bridge.DB.Message.GetLastByGUID(portal.GUID, msgStatus.GUID); msg != nil {
-		eventID = msg.MXID
-	} else if tapback := portal.bridge.DB.Tapback.GetByTapbackGUID(portal.GUID, msgStatus.GUID); tapback != nil {
+	dbMessage := portal.bridge.DB.Message.GetLastByGUID(portal.GUID, portal.Receiver, msgStatus.GUID)
+	if dbMessage != nil {
+		eventID = dbMessage.MXID
+	} else if tapback := portal.bridge.DB.Tapback.GetByTapbackGUID(portal.GUID, portal.Receiver, msgStatus.GUID); tapback != nil {
 		eventID = tapback.MXID
 	} else {
 		portal.log.Debugfln("Dropping send message status for %s: not found in db messages or tapbacks", msgStatus.GUID)
@@ -540,6 +730,7 @@ func (portal *Portal) HandleiMessageSendMessageStatus(msgStatus *imessage.SendMe
 	portal.log.Debugfln("Processing message status with type %s/%s for event %s/%s in %s/%s", msgStatus.Status, msgStatus.StatusCode, eventID, msgStatus.GUID, portal.MXID, msgStatus.ChatGUID)
 	switch msgStatus.Status {
 	case "delivered":
+		portal.cancelSMSFallback(msgStatus.GUID)
 		go portal.bridge.SendRawMessageCheckpoint(&status.MessageCheckpoint{
 			EventID:    eventID,
 			RoomID:     portal.MXID,
@@ -548,9 +739,18 @@ func (portal *Portal) HandleiMessageSendMessageStatus(msgStatus *imessage.SendMe
 			Status:     "DELIVERED",
 			ReportedBy: status.MsgReportedByBridge,
 		})
+		if dbMessage != nil {
+			portal.markMessageDelivered(dbMessage, time.Now())
+		}
 	case "sent":
 		portal.sendSuccessCheckpoint(eventID, msgStatus.Service, msgStatus.ChatGUID)
+		if dbMessage != nil {
+			portal.markMessageSent(dbMessage, time.Now())
+		}
 	case "failed":
+		if portal.triggerSMSFallback(msgStatus.GUID) {
+			return
+		}
 		evt, err := portal.MainIntent().GetEvent(portal.MXID, eventID)
 		if err != nil {
 			portal.log.Warnfln("Failed to lookup event %s/%s %s/%s: %v", string(eventID), portal.MXID, msgStatus.GUID, msgStatus.ChatGUID, err)
@@ -592,6 +792,8 @@ func (portal *Portal) GetBasePowerLevels() *event.PowerLevelsEventContent {
 			event.StateRoomName.Type:   anyone,
 			event.StateRoomAvatar.Type: anyone,
 			event.StateTopic.Type:      anyone,
+			// Only accepted from the bridge user, see HandlePortalSettingsEvent
+			PortalSettingsEventType.Type: anyone,
 		},
 	}
 }
@@ -624,16 +826,17 @@ func (portal *Portal) getBridgeInfo() (string, CustomBridgeInfoContent) {
 				AvatarURL:   portal.AvatarURL.CUString(),
 			},
 
-			GUID:    portal.GUID,
-			IsGroup: portal.Identifier.IsGroup,
-			Service: portal.Identifier.Service,
+			GUID:     portal.GUID,
+			Receiver: portal.Receiver,
+			IsGroup:  portal.Identifier.IsGroup,
+			Service:  portal.Identifier.Service,
 
 			SendStatusStart: portal.bridge.SendStatusStartTS,
 			TimeoutSeconds:  portal.bridge.Config.Bridge.MaxHandleSeconds,
 		},
 	}
 	if portal.Identifier.Service == "SMS" {
-		if portal.bridge.Config.IMessage.Platform == "android" {
+		if portal.connectorConfig().Platform == "android" {
 			bridgeInfo.Protocol.ID = "android-sms"
 			bridgeInfo.Protocol.DisplayName = "Android SMS"
 			bridgeInfo.Protocol.ExternalURL = ""
@@ -643,9 +846,9 @@ func (portal *Portal) getBridgeInfo() (string, CustomBridgeInfoContent) {
 			bridgeInfo.Protocol.ID = "imessage-sms"
 			bridgeInfo.Protocol.DisplayName = "iMessage (SMS)"
 		}
-	} else if portal.bridge.Config.IMessage.Platform == "ios" {
+	} else if portal.connectorConfig().Platform == "ios" {
 		bridgeInfo.Protocol.ID = "imessage-ios"
-	} else if portal.bridge.Config.IMessage.Platform == "mac-nosip" {
+	} else if portal.connectorConfig().Platform == "mac-nosip" {
 		bridgeInfo.Protocol.ID = "imessage-nosip"
 	}
 	return portal.getBridgeInfoStateKey(), bridgeInfo
@@ -678,9 +881,10 @@ func (portal *Portal) GetEncryptionEventContent() (evt *event.EncryptionEventCon
 }
 
 func (portal *Portal) shouldSetDMRoomMetadata() bool {
+	privateChatPortalMeta := portal.effectiveSettings().PrivateChatPortalMeta
 	return !portal.IsPrivateChat() ||
-		portal.bridge.Config.Bridge.PrivateChatPortalMeta == "always" ||
-		(portal.IsEncrypted() && portal.bridge.Config.Bridge.PrivateChatPortalMeta != "never")
+		privateChatPortalMeta == "always" ||
+		(portal.IsEncrypted() && privateChatPortalMeta != "never")
 }
 
 func (portal *Portal) getRoomCreateContent() *mautrix.ReqCreateRoom {
@@ -727,7 +931,7 @@ func (portal *Portal) getRoomCreateContent() *mautrix.ReqCreateRoom {
 
 	autoJoinInvites := portal.bridge.Config.Homeserver.Software == bridgeconfig.SoftwareHungry
 	if autoJoinInvites {
-		invite = append(invite, portal.bridge.user.MXID)
+		invite = append(invite, portal.user.MXID)
 	}
 
 	creationContent := make(map[string]interface{})
@@ -752,7 +956,7 @@ func (portal *Portal) getRoomCreateContent() *mautrix.ReqCreateRoom {
 }
 
 func (portal *Portal) preCreateDMSync(profileOverride *ProfileOverride) {
-	puppet := portal.bridge.GetPuppetByLocalID(portal.Identifier.LocalID)
+	puppet := portal.user.GetPuppetByLocalID(portal.Identifier.LocalID)
 	puppet.Sync()
 	if profileOverride != nil {
 		puppet.SyncWithProfileOverride(*profileOverride)
@@ -777,7 +981,7 @@ func (portal *Portal) CreateMatrixRoom(chatInfo *imessage.ChatInfo, profileOverr
 
 	if chatInfo == nil {
 		portal.log.Debugln("Getting chat info to create Matrix room")
-		chatInfo, err = portal.bridge.IM.GetChatInfo(portal.GUID, portal.ThreadID)
+		chatInfo, err = portal.user.IM.GetChatInfo(portal.GUID, portal.ThreadID)
 		if err != nil && !portal.IsPrivateChat() {
 			// If there's no chat info for a group, it probably doesn't exist, and we shouldn't auto-create a Matrix room for it.
 			return fmt.Errorf("failed to get chat info: %w", err)
@@ -790,15 +994,15 @@ func (portal *Portal) CreateMatrixRoom(chatInfo *imessage.ChatInfo, profileOverr
 		portal.log.Warnln("Didn't get any chat info")
 	}
 
+	var avatar *imessage.Attachment
 	if portal.IsPrivateChat() {
 		portal.preCreateDMSync(profileOverride)
-	} else {
-		avatar, err := portal.bridge.IM.GetGroupAvatar(portal.GUID)
-		if err != nil {
-			portal.log.Warnln("Failed to get avatar:", err)
-		} else if avatar != nil {
-			portal.UpdateAvatar(avatar, portal.MainIntent())
-		}
+	} else if avatar = portal.getGroupAvatar(); avatar != nil {
+		portal.UpdateAvatar(avatar, portal.MainIntent())
+	}
+	if chatInfo != nil && (avatar == nil || portal.AvatarHash != nil) {
+		chatInfo.Avatar = avatar
+		portal.InfoHash = chatInfo.Hash()
 	}
 
 	req := portal.getRoomCreateContent()
@@ -838,9 +1042,9 @@ func (portal *Portal) CreateMatrixRoom(chatInfo *imessage.ChatInfo, profileOverr
 	}
 
 	if !req.BeeperAutoJoinInvites {
-		portal.ensureUserInvited(portal.bridge.user)
+		portal.ensureUserInvited(portal.user)
 	}
-	portal.addToSpace(portal.bridge.user)
+	portal.addToSpace(portal.user)
 
 	if !portal.IsPrivateChat() {
 		if !req.BeeperAutoJoinInvites {
@@ -848,7 +1052,10 @@ func (portal *Portal) CreateMatrixRoom(chatInfo *imessage.ChatInfo, profileOverr
 			portal.SyncParticipants(chatInfo)
 		}
 	} else {
-		portal.bridge.user.UpdateDirectChats(map[id.UserID][]id.RoomID{portal.GetDMPuppet().MXID: {portal.MXID}})
+		portal.user.UpdateDirectChats(map[id.UserID][]id.RoomID{portal.GetDMPuppet().MXID: {portal.MXID}})
+	}
+	if chatInfo != nil {
+		portal.UpdateChatState(chatInfo.ChatState)
 	}
 	if portal.bridge.Config.Homeserver.Software != bridgeconfig.SoftwareHungry {
 		firstEventResp, err := portal.MainIntent().SendMessageEvent(portal.MXID, PortalCreationDummyEvent, struct{}{})
@@ -862,15 +1069,16 @@ func (portal *Portal) CreateMatrixRoom(chatInfo *imessage.ChatInfo, profileOverr
 	if portal.bridge.Config.Bridge.Backfill.Enable {
 		go func() {
 			portal.log.Debugln("Starting initial backfill")
-			portal.forwardBackfill()
+			err := portal.forwardBackfill()
 			portal.log.Debugln("Unlocking backfill (create)")
 			portal.unlockBackfill()
+			portal.retryForwardBackfill(err)
 		}()
 	}
 	portal.log.Debugln("Finished creating Matrix room")
 
-	if portal.bridge.IM.Capabilities().ChatBridgeResult {
-		portal.bridge.IM.SendChatBridgeResult(portal.GUID, portal.MXID)
+	if portal.capabilities().ChatBridgeResult {
+		portal.user.IM.SendChatBridgeResult(portal.GUID, portal.MXID)
 	}
 
 	return nil
@@ -878,19 +1086,21 @@ func (portal *Portal) CreateMatrixRoom(chatInfo *imessage.ChatInfo, profileOverr
 
 func (portal *Portal) addToSpace(user *User) {
 	spaceID := user.GetSpaceRoom()
-	if len(spaceID) == 0 || portal.InSpace {
+	if len(spaceID) == 0 {
 		return
+	} else if !portal.InSpace {
+		_, err := portal.bridge.Bot.SendStateEvent(spaceID, event.StateSpaceChild, portal.MXID.String(), &event.SpaceChildEventContent{
+			Via: []string{portal.bridge.Config.Homeserver.Domain},
+		})
+		if err != nil {
+			portal.log.Errorfln("Failed to add room to %s's personal filtering space (%s): %v", user.MXID, spaceID, err)
+		} else {
+			portal.log.Debugfln("Added room to %s's personal filtering space (%s)", user.MXID, spaceID)
+			portal.InSpace = true
+			portal.Update(nil)
+		}
 	}
-	_, err := portal.bridge.Bot.SendStateEvent(spaceID, event.StateSpaceChild, portal.MXID.String(), &event.SpaceChildEventContent{
-		Via: []string{portal.bridge.Config.Homeserver.Domain},
-	})
-	if err != nil {
-		portal.log.Errorfln("Failed to add room to %s's personal filtering space (%s): %v", user.MXID, spaceID, err)
-	} else {
-		portal.log.Debugfln("Added room to %s's personal filtering space (%s)", user.MXID, spaceID)
-		portal.InSpace = true
-		portal.Update(nil)
-	}
+	portal.syncSubSpaces(user)
 }
 
 func (portal *Portal) IsPrivateChat() bool {
@@ -899,7 +1109,7 @@ func (portal *Portal) IsPrivateChat() bool {
 
 func (portal *Portal) GetDMPuppet() *Puppet {
 	if portal.IsPrivateChat() {
-		return portal.bridge.GetPuppetByLocalID(portal.Identifier.LocalID)
+		return portal.user.GetPuppetByLocalID(portal.Identifier.LocalID)
 	}
 	return nil
 }
@@ -943,6 +1153,7 @@ func (portal *Portal) sendMessage(intent *appservice.IntentAPI, eventType event.
 	}
 
 	_, _ = intent.UserTyping(portal.MXID, false, 0)
+	portal.clearRemoteTyping(intent.UserID)
 	if timestamp == 0 {
 		return intent.SendMessageEvent(portal.MXID, eventType, &wrappedContent)
 	} else {
@@ -1000,7 +1211,7 @@ func (portal *Portal) sendErrorMessage(evt *event.Event, rootErr error, humanRea
 			Message: humanReadableError,
 		}
 		extraContent := map[string]any{}
-		if handle != "" && portal.bridge.IM.Capabilities().ContactChatMerging {
+		if handle != "" && portal.capabilities().ContactChatMerging {
 			extraContent[bridgeInfoHandle] = handle
 			content.MutateEventKey = bridgeInfoHandle
 		}
@@ -1052,7 +1263,7 @@ func (portal *Portal) sendSuccessCheckpoint(eventID id.EventID, service, handle
 	}
 	go func() {
 		portal.bridge.SendRawMessageCheckpoint(&checkpoint)
-		if (portal.Identifier.IsGroup || portal.Identifier.Service == "SMS") && portal.bridge.Config.IMessage.Platform == "mac-nosip" {
+		if (portal.Identifier.IsGroup || portal.Identifier.Service == "SMS") && portal.connectorConfig().Platform == "mac-nosip" {
 			portal.bridge.SendRawMessageCheckpoint(&status.MessageCheckpoint{
 				EventID:    eventID,
 				RoomID:     portal.MXID,
@@ -1074,12 +1285,13 @@ func (portal *Portal) sendSuccessCheckpoint(eventID id.EventID, service, handle
 			},
 			Status: event.MessageStatusSuccess,
 		}
-		var extraContent map[string]any
-		if portal.bridge.IM.Capabilities().ContactChatMerging {
-			extraContent = map[string]any{
-				bridgeInfoService: service,
-				bridgeInfoHandle:  handle,
-			}
+		// Always include the service, so clients can show whether the message went out as iMessage or SMS
+		extraContent := map[string]any{}
+		if service != "" {
+			extraContent[bridgeInfoService] = service
+		}
+		if portal.capabilities().ContactChatMerging {
+			extraContent[bridgeInfoHandle] = handle
 			mainContent.MutateEventKey = bridgeInfoHandle
 		}
 		content := &event.Content{
@@ -1127,7 +1339,7 @@ func (portal *Portal) addRelaybotFormat(sender id.UserID, content *event.Message
 		member = &event.MemberEventContent{}
 	}
 
-	data, err := portal.bridge.Config.Bridge.Relay.FormatMessage(content, sender, *member)
+	data, err := portal.bridge.Config.Bridge.Relay.FormatMessageWithOverrides(portal.effectiveSettings().RelayFormats, content, sender, *member)
 	if err != nil {
 		portal.log.Errorln("Failed to apply relaybot format:", err)
 	}
@@ -1136,7 +1348,7 @@ func (portal *Portal) addRelaybotFormat(sender id.UserID, content *event.Message
 }
 
 func (portal *Portal) getTargetGUID(thing string, eventID id.EventID, targetGUID string) string {
-	if portal.IsPrivateChat() && portal.bridge.IM.Capabilities().ContactChatMerging {
+	if portal.IsPrivateChat() && portal.capabilities().ContactChatMerging {
 		if targetGUID != "" {
 			portal.log.Debugfln("Sending Matrix %s %s to %s (target guid)", thing, eventID, targetGUID)
 			return targetGUID
@@ -1150,32 +1362,56 @@ func (portal *Portal) getTargetGUID(thing string, eventID id.EventID, targetGUID
 }
 
 func (portal *Portal) HandleMatrixMessage(evt *event.Event) {
+	portal.handleMatrixMessage(evt, "")
+}
+
+// handleMatrixMessage sends a Matrix message to iMessage. If forceTarget is set, the message is
+// sent to that chat GUID instead of the one chosen by the send policy (used for SMS fallback).
+func (portal *Portal) handleMatrixMessage(evt *event.Event, forceTarget string) {
 	msg, ok := evt.Content.Parsed.(*event.MessageEventContent)
 	if !ok {
 		// TODO log
 		return
 	}
 	portal.log.Debugln("Starting handling Matrix message", evt.ID)
+	// Keep a copy of the original content in case the message needs to be re-sent as SMS
+	originalContent := *msg
 
 	var messageReplyID string
 	var messageReplyPart int
-	replyToID := msg.RelatesTo.GetReplyTo()
+	replyToID := msg.RelatesTo.GetThreadParent()
+	if len(replyToID) == 0 {
+		replyToID = msg.RelatesTo.GetReplyTo()
+	}
 	if len(replyToID) > 0 {
 		imsg := portal.bridge.DB.Message.GetByMXID(replyToID)
-		if imsg != nil {
+		if imsg != nil && len(imsg.ThreadOriginatorGUID) > 0 {
+			// iMessage threads always point at the first message, so replies to messages in a thread go to the originator
+			messageReplyID = imsg.ThreadOriginatorGUID
+			messageReplyPart = imsg.ThreadOriginatorPart
+		} else if imsg != nil {
 			messageReplyID = imsg.GUID
 			messageReplyPart = imsg.Part
 		}
 	}
 
-	if err := portal.shouldHandleMessage(evt); err != nil {
+	if forceTarget != "" {
+		// Fallback re-sends are allowed to be older than the max handle time
+	} else if !portal.checkEventPermission(evt, portalActionSend) {
+		return
+	} else if err := portal.shouldHandleMessage(evt); err != nil {
 		portal.log.Debug(err)
 		portal.sendErrorMessage(evt, err, err.Error(), true, status.MsgStatusTimeout, "")
 		return
 	}
+	target := forceTarget
+	if target == "" {
+		target = portal.getMessageTargetGUID(evt.ID)
+	}
 
+	caps := portal.capabilitiesFor(target)
 	var imessageRichLink *imessage.RichLink
-	if portal.bridge.IM.Capabilities().RichLinks {
+	if caps.RichLinks && portal.effectiveSettings().LinkPreviews {
 		imessageRichLink = portal.convertURLPreviewToIMessage(evt)
 	}
 	metadata, _ := evt.Content.Raw["com.beeper.message_metadata"].(imessage.MessageMetadata)
@@ -1183,7 +1419,10 @@ func (portal *Portal) HandleMatrixMessage(evt *event.Event) {
 	var err error
 	var resp *imessage.SendResponse
 	if msg.MsgType == event.MsgText || msg.MsgType == event.MsgNotice || msg.MsgType == event.MsgEmote {
-		if evt.Sender != portal.bridge.user.MXID {
+		var mentions []imessage.TextFormatRange
+		msg.Body, mentions = portal.convertMatrixFormatting(msg, target)
+		text := msg.Body
+		if evt.Sender != portal.user.MXID {
 			portal.addRelaybotFormat(evt.Sender, msg)
 			if len(msg.Body) == 0 {
 				return
@@ -1191,10 +1430,18 @@ func (portal *Portal) HandleMatrixMessage(evt *event.Event) {
 		} else if msg.MsgType == event.MsgEmote {
 			msg.Body = "/me " + msg.Body
 		}
+		// Relay formats and emotes wrap the text, so the mentions have to be moved to where the text ended up
+		mentions = moveFormatRanges(mentions, msg.Body, text)
+		if len(mentions) > 0 && caps.SendMentions {
+			if metadata == nil {
+				metadata = make(imessage.MessageMetadata)
+			}
+			metadata["mentions"] = mentions
+		}
 		portal.addDedup(evt.ID, msg.Body)
-		resp, err = portal.bridge.IM.SendMessage(portal.getTargetGUID("text message", evt.ID, ""), msg.Body, messageReplyID, messageReplyPart, imessageRichLink, metadata)
+		resp, err = portal.user.IM.SendMessage(target, msg.Body, messageReplyID, messageReplyPart, imessageRichLink, metadata)
 	} else if len(msg.URL) > 0 || msg.File != nil {
-		resp, err = portal.handleMatrixMedia(msg, evt, messageReplyID, messageReplyPart, metadata)
+		resp, err = portal.handleMatrixMedia(msg, evt, target, messageReplyID, messageReplyPart, metadata)
 	}
 	if err != nil {
 		portal.log.Errorln("Error sending to iMessage:", err)
@@ -1217,21 +1464,36 @@ func (portal *Portal) HandleMatrixMessage(evt *event.Event) {
 		}
 		portal.sendErrorMessage(evt, err, ipcErr.Message, certain, statusCode, "")
 	} else if resp != nil {
+		if forceTarget != "" {
+			// Replace the failed iMessage with the SMS in the database
+			if oldMessage := portal.bridge.DB.Message.GetByMXID(evt.ID); oldMessage != nil {
+				oldMessage.Delete()
+			}
+		}
 		dbMessage := portal.bridge.DB.Message.New()
 		dbMessage.PortalGUID = portal.GUID
+		dbMessage.PortalReceiver = portal.Receiver
 		dbMessage.HandleGUID = resp.ChatGUID
 		dbMessage.GUID = resp.GUID
 		dbMessage.MXID = evt.ID
 		dbMessage.Timestamp = resp.Time.UnixMilli()
-		portal.sendDeliveryReceipt(evt.ID, resp.Service, resp.ChatGUID, !portal.bridge.IM.Capabilities().MessageStatusCheckpoints)
+		dbMessage.ThreadOriginatorGUID = messageReplyID
+		dbMessage.ThreadOriginatorPart = messageReplyPart
+		if !caps.MessageStatusCheckpoints {
+			dbMessage.SentAt = resp.Time.UnixMilli()
+		}
+		portal.sendDeliveryReceipt(evt.ID, resp.Service, resp.ChatGUID, !caps.MessageStatusCheckpoints)
 		dbMessage.Insert(nil)
+		if forceTarget == "" {
+			portal.trackSMSFallback(evt, &originalContent, resp)
+		}
 		portal.log.Debugln("Handled Matrix message", evt.ID, "->", resp.GUID)
 	} else {
 		portal.log.Debugln("Handled Matrix message", evt.ID, "(waiting for echo)")
 	}
 }
 
-func (portal *Portal) handleMatrixMedia(msg *event.MessageEventContent, evt *event.Event, messageReplyID string, messageReplyPart int, metadata imessage.MessageMetadata) (*imessage.SendResponse, error) {
+func (portal *Portal) handleMatrixMedia(msg *event.MessageEventContent, evt *event.Event, target, messageReplyID string, messageReplyPart int, metadata imessage.MessageMetadata) (*imessage.SendResponse, error) {
 	var url id.ContentURI
 	var file *event.EncryptedFileInfo
 	var err error
@@ -1253,7 +1515,7 @@ func (portal *Portal) handleMatrixMedia(msg *event.MessageEventContent, evt *eve
 		caption = msg.Body
 	}
 	portal.addDedup(evt.ID, filename)
-	if evt.Sender != portal.bridge.user.MXID {
+	if evt.Sender != portal.user.MXID {
 		portal.addRelaybotFormat(evt.Sender, msg)
 		caption = msg.Body
 	}
@@ -1285,18 +1547,18 @@ func (portal *Portal) handleMatrixMedia(msg *event.MessageEventContent, evt *eve
 			} else {
 				url, err = msg.Info.ThumbnailURL.Parse()
 			}
-			hasUsableThumbnail = err == nil && !url.IsEmpty() && portal.bridge.IM.Capabilities().SendCaptions
+			hasUsableThumbnail = err == nil && !url.IsEmpty() && portal.capabilitiesFor(target).SendCaptions
 		}
 		if !hasUsableThumbnail {
 			portal.addDedup(evt.ID, caption)
-			return portal.bridge.IM.SendMessage(portal.getTargetGUID("media message (+viewer)", evt.ID, ""), caption, messageReplyID, messageReplyPart, nil, metadata)
+			return portal.user.IM.SendMessage(target, caption, messageReplyID, messageReplyPart, nil, metadata)
 		}
 	}
 
-	return portal.handleMatrixMediaDirect(url, file, filename, caption, evt, messageReplyID, messageReplyPart, metadata)
+	return portal.handleMatrixMediaDirect(url, file, filename, caption, evt, target, messageReplyID, messageReplyPart, metadata)
 }
 
-func (portal *Portal) handleMatrixMediaDirect(url id.ContentURI, file *event.EncryptedFileInfo, filename, caption string, evt *event.Event, messageReplyID string, messageReplyPart int, metadata imessage.MessageMetadata) (resp *imessage.SendResponse, err error) {
+func (portal *Portal) handleMatrixMediaDirect(url id.ContentURI, file *event.EncryptedFileInfo, filename, caption string, evt *event.Event, target, messageReplyID string, messageReplyPart int, metadata imessage.MessageMetadata) (resp *imessage.SendResponse, err error) {
 	var data []byte
 	data, err = portal.MainIntent().DownloadBytes(url)
 	if err != nil {
@@ -1333,8 +1595,8 @@ func (portal *Portal) handleMatrixMediaDirect(url id.ContentURI, file *event.Enc
 		}
 	}
 
-	resp, err = portal.bridge.IM.SendFile(portal.getTargetGUID("media message", evt.ID, ""), caption, filename, filePath, messageReplyID, messageReplyPart, mimeType, isVoiceMemo, metadata)
-	portal.bridge.IM.SendFileCleanup(dir)
+	resp, err = portal.user.IM.SendFile(target, caption, filename, filePath, messageReplyID, messageReplyPart, mimeType, isVoiceMemo, metadata)
+	portal.user.IM.SendFileCleanup(dir)
 	return
 }
 
@@ -1366,19 +1628,19 @@ func (portal *Portal) sendUnsupportedCheckpoint(evt *event.Event, step status.Me
 }
 
 func (portal *Portal) HandleMatrixReadReceipt(user bridge.User, eventID id.EventID, receipt event.ReadReceipt) {
-	if user.GetMXID() != portal.bridge.user.MXID {
+	if user.GetMXID() != portal.user.MXID {
 		return
 	}
 
 	if message := portal.bridge.DB.Message.GetByMXID(eventID); message != nil {
 		portal.log.Debugfln("Marking %s/%s as read", message.GUID, message.MXID)
-		err := portal.bridge.IM.SendReadReceipt(portal.getTargetGUID("read receipt to message", eventID, message.HandleGUID), message.GUID)
+		err := portal.user.IM.SendReadReceipt(portal.getTargetGUID("read receipt to message", eventID, message.HandleGUID), message.GUID)
 		if err != nil {
 			portal.log.Warnln("Error marking message as read:", err)
 		}
 	} else if tapback := portal.bridge.DB.Tapback.GetByMXID(eventID); tapback != nil {
 		portal.log.Debugfln("Marking %s/%s as read in %s", tapback.GUID, tapback.MXID)
-		err := portal.bridge.IM.SendReadReceipt(portal.getTargetGUID("read receipt to tapback", eventID, tapback.HandleGUID), tapback.GUID)
+		err := portal.user.IM.SendReadReceipt(portal.getTargetGUID("read receipt to tapback", eventID, tapback.HandleGUID), tapback.GUID)
 		if err != nil {
 			portal.log.Warnln("Error marking tapback as read:", err)
 		}
@@ -1394,40 +1656,22 @@ func (portal *Portal) HandleMatrixTyping(userIDs []id.UserID) {
 		portal.log.Debugfln("Dropping typing notification %v", userIDs)
 		return
 	}
-	portal.typingLock.Lock()
-	defer portal.typingLock.Unlock()
-
 	isTyping := false
 	for _, userID := range userIDs {
-		if userID == portal.bridge.user.MXID {
+		if userID == portal.user.MXID {
 			isTyping = true
 			break
 		}
 	}
-	if isTyping != portal.userIsTyping {
-		portal.userIsTyping = isTyping
-		if !isTyping {
-			portal.log.Debugfln("Sending typing stop notification")
-		} else {
-			portal.log.Debugfln("Sending typing start notification")
-		}
-		err := portal.bridge.IM.SendTypingNotification(portal.getTargetGUID("typing notification", "", ""), isTyping)
-		if err != nil {
-			portal.log.Warnfln("Failed to bridge typing status change: %v", err)
-		} else {
-			portal.log.Debugfln("Typing update sent")
-		}
-	}
+	portal.matrixTyping.Set(isTyping)
 }
 
 func (portal *Portal) HandleMatrixReaction(evt *event.Event) {
-	if !portal.bridge.IM.Capabilities().SendTapbacks {
-		portal.sendUnsupportedCheckpoint(evt, status.MsgStepRemote, errors.New("reactions are not supported"))
-		return
-	}
 	portal.log.Debugln("Starting handling of Matrix reaction", evt.ID)
 
-	if err := portal.shouldHandleMessage(evt); err != nil {
+	if !portal.checkEventPermission(evt, portalActionReact) {
+		return
+	} else if err := portal.shouldHandleMessage(evt); err != nil {
 		portal.log.Debug(err)
 		portal.sendErrorMessage(evt, err, err.Error(), true, status.MsgStatusTimeout, "")
 		return
@@ -1438,36 +1682,49 @@ func (portal *Portal) HandleMatrixReaction(evt *event.Event) {
 		portal.bridge.SendMessageErrorCheckpoint(evt, status.MsgStepRemote, fmt.Errorf(msg, args...), true, 0)
 	}
 
-	if reaction, ok := evt.Content.Parsed.(*event.ReactionEventContent); !ok || reaction.RelatesTo.Type != event.RelAnnotation {
+	reaction, ok := evt.Content.Parsed.(*event.ReactionEventContent)
+	if !ok || reaction.RelatesTo.Type != event.RelAnnotation {
 		doError("Ignoring reaction %s due to unknown m.relates_to data", evt.ID)
-	} else if tapbackType := imessage.TapbackFromEmoji(reaction.RelatesTo.Key); tapbackType == 0 {
-		doError("Unknown reaction type %s in %s", reaction.RelatesTo.Key, reaction.RelatesTo.EventID)
-	} else if target := portal.bridge.DB.Message.GetByMXID(reaction.RelatesTo.EventID); target == nil {
+		return
+	}
+	target := portal.bridge.DB.Message.GetByMXID(reaction.RelatesTo.EventID)
+	if target == nil {
 		doError("Unknown reaction target %s", reaction.RelatesTo.EventID)
-	} else if existing := portal.bridge.DB.Tapback.GetByGUID(portal.GUID, target.GUID, target.Part, ""); existing != nil && existing.Type == tapbackType {
+		return
+	}
+	targetChatGUID := portal.getTargetGUID("reaction", evt.ID, target.HandleGUID)
+	caps := portal.capabilitiesFor(targetChatGUID)
+	if !caps.SendTapbacks {
+		portal.sendUnsupportedCheckpoint(evt, status.MsgStepRemote, errors.New("reactions are not supported"))
+	} else if tapbackType, customEmoji := portal.getTapbackForReaction(reaction.RelatesTo.Key, caps); tapbackType == 0 && portal.bridge.Config.Bridge.TapbackFallback == "text" {
+		portal.sendTapbackTextFallback(evt, reaction.RelatesTo.Key, target, targetChatGUID)
+	} else if tapbackType == 0 {
+		doError("Unknown reaction type %s in %s", reaction.RelatesTo.Key, reaction.RelatesTo.EventID)
+	} else if existing := portal.bridge.DB.Tapback.GetByGUID(portal.GUID, portal.Receiver, target.GUID, target.Part, ""); existing != nil && existing.Type == tapbackType && existing.Emoji == customEmoji {
 		doError("Ignoring outgoing tapback to %s/%s: type is same", reaction.RelatesTo.EventID, target.GUID)
 	} else {
-		targetChatGUID := portal.getTargetGUID("reaction", evt.ID, target.HandleGUID)
-		if resp, err := portal.bridge.IM.SendTapback(targetChatGUID, target.GUID, target.Part, tapbackType, false); err != nil {
+		if resp, err := portal.user.IM.SendTapback(targetChatGUID, target.GUID, target.Part, tapbackType, customEmoji, false); err != nil {
 			doError("Failed to send tapback %d to %s: %v", tapbackType, target.GUID, err)
 		} else if existing == nil {
 			// TODO should timestamp be stored?
 			portal.log.Debugfln("Handled Matrix reaction %s into new iMessage tapback %s", evt.ID, resp.GUID)
-			if !portal.bridge.IM.Capabilities().MessageStatusCheckpoints {
+			if !caps.MessageStatusCheckpoints {
 				portal.bridge.SendMessageSuccessCheckpoint(evt, status.MsgStepRemote, 0)
 			}
 			tapback := portal.bridge.DB.Tapback.New()
 			tapback.PortalGUID = portal.GUID
+			tapback.PortalReceiver = portal.Receiver
 			tapback.HandleGUID = resp.ChatGUID
 			tapback.GUID = resp.GUID
 			tapback.MessageGUID = target.GUID
 			tapback.MessagePart = target.Part
 			tapback.Type = tapbackType
+			tapback.Emoji = customEmoji
 			tapback.MXID = evt.ID
 			tapback.Insert(nil)
 		} else {
 			portal.log.Debugfln("Handled Matrix reaction %s into iMessage tapback %s, replacing old %s", evt.ID, resp.GUID, existing.MXID)
-			if !portal.bridge.IM.Capabilities().MessageStatusCheckpoints {
+			if !caps.MessageStatusCheckpoints {
 				portal.bridge.SendMessageSuccessCheckpoint(evt, status.MsgStepRemote, 0)
 			}
 			_, err = portal.MainIntent().RedactEvent(portal.MXID, existing.MXID)
@@ -1476,19 +1733,58 @@ func (portal *Portal) HandleMatrixReaction(evt *event.Event) {
 			}
 			existing.GUID = resp.GUID
 			existing.Type = tapbackType
+			existing.Emoji = customEmoji
 			existing.MXID = evt.ID
 			existing.Update()
 		}
 	}
 }
 
-func (portal *Portal) HandleMatrixRedaction(evt *event.Event) {
-	if !portal.bridge.IM.Capabilities().SendTapbacks {
-		portal.sendUnsupportedCheckpoint(evt, status.MsgStepRemote, errors.New("redactions are not supported"))
+// getTapbackForReaction finds the tapback to send for a Matrix reaction. Reactions that aren't classic tapbacks
+// are sent as custom emoji tapbacks if the connector supports it, otherwise the configured fallback is used.
+func (portal *Portal) getTapbackForReaction(key string, caps imessage.ConnectorCapabilities) (imessage.TapbackType, string) {
+	if len(key) == 0 {
+		return 0, ""
+	} else if tapbackType := imessage.TapbackFromEmoji(key); tapbackType != 0 {
+		return tapbackType, ""
+	} else if caps.SendCustomTapbacks {
+		return imessage.TapbackEmoji, key
+	} else if portal.bridge.Config.Bridge.TapbackFallback == "nearest" {
+		return imessage.NearestTapback(key), ""
+	}
+	return 0, ""
+}
+
+func (portal *Portal) sendTapbackTextFallback(evt *event.Event, key string, target *database.Message, targetChatGUID string) {
+	text := fmt.Sprintf("reacted %s", key)
+	portal.addDedup(evt.ID, text)
+	resp, err := portal.user.IM.SendMessage(targetChatGUID, text, target.GUID, target.Part, nil, nil)
+	if err != nil {
+		portal.log.Errorfln("Failed to send text fallback for reaction %s to %s: %v", evt.ID, target.GUID, err)
+		portal.bridge.SendMessageErrorCheckpoint(evt, status.MsgStepRemote, err, true, 0)
 		return
 	}
+	if !portal.capabilitiesFor(targetChatGUID).MessageStatusCheckpoints {
+		portal.bridge.SendMessageSuccessCheckpoint(evt, status.MsgStepRemote, 0)
+	}
+	if resp != nil {
+		dbMessage := portal.bridge.DB.Message.New()
+		dbMessage.PortalGUID = portal.GUID
+		dbMessage.PortalReceiver = portal.Receiver
+		dbMessage.HandleGUID = resp.ChatGUID
+		dbMessage.GUID = resp.GUID
+		dbMessage.MXID = evt.ID
+		dbMessage.Timestamp = resp.Time.UnixMilli()
+		dbMessage.Insert(nil)
+		portal.log.Debugfln("Handled Matrix reaction %s into text fallback %s", evt.ID, resp.GUID)
+	}
+}
 
-	if err := portal.shouldHandleMessage(evt); err != nil {
+func (portal *Portal) HandleMatrixRedaction(evt *event.Event) {
+	// Only tapbacks can be redacted, so removing them requires the same permission as adding them
+	if !portal.checkEventPermission(evt, portalActionReact) {
+		return
+	} else if err := portal.shouldHandleMessage(evt); err != nil {
 		portal.log.Debug(err)
 		portal.sendErrorMessage(evt, err, err.Error(), true, status.MsgStatusTimeout, "")
 		return
@@ -1497,19 +1793,40 @@ func (portal *Portal) HandleMatrixRedaction(evt *event.Event) {
 	redactedTapback := portal.bridge.DB.Tapback.GetByMXID(evt.Redacts)
 	if redactedTapback != nil {
 		portal.log.Debugln("Starting handling of Matrix redaction", evt.ID)
+		targetChatGUID := portal.getTargetGUID("tapback redaction", evt.ID, redactedTapback.HandleGUID)
+		caps := portal.capabilitiesFor(targetChatGUID)
+		if !caps.SendTapbacks {
+			portal.sendUnsupportedCheckpoint(evt, status.MsgStepRemote, errors.New("redactions are not supported"))
+			return
+		}
 		redactedTapback.Delete()
-		_, err := portal.bridge.IM.SendTapback(portal.getTargetGUID("tapback redaction", evt.ID, redactedTapback.HandleGUID), redactedTapback.MessageGUID, redactedTapback.MessagePart, redactedTapback.Type, true)
+		_, err := portal.user.IM.SendTapback(targetChatGUID, redactedTapback.MessageGUID, redactedTapback.MessagePart, redactedTapback.Type, redactedTapback.Emoji, true)
 		if err != nil {
 			portal.log.Errorfln("Failed to send removal of tapback %d to %s/%d: %v", redactedTapback.Type, redactedTapback.MessageGUID, redactedTapback.MessagePart, err)
 			portal.bridge.SendMessageErrorCheckpoint(evt, status.MsgStepRemote, err, true, 0)
 		} else {
 			portal.log.Debugfln("Handled Matrix redaction %s of iMessage tapback %d to %s/%d", evt.ID, redactedTapback.Type, redactedTapback.MessageGUID, redactedTapback.MessagePart)
-			if !portal.bridge.IM.Capabilities().MessageStatusCheckpoints {
+			if !caps.MessageStatusCheckpoints {
 				portal.bridge.SendMessageSuccessCheckpoint(evt, status.MsgStepRemote, 0)
 			}
 		}
 		return
 	}
+	if portal.bridge.DB.Message.GetByMXID(evt.Redacts) != nil {
+		// Reactions that were sent as text fallbacks are stored as messages, and sent messages can't be unsent,
+		// so tell the user that the text is still visible in iMessage.
+		portal.sendUnsupportedCheckpoint(evt, status.MsgStepRemote, errors.New("can't unsend messages"))
+		if portal.bridge.Config.Bridge.SendErrorNotices {
+			_, err := portal.sendMainIntentMessage(&event.MessageEventContent{
+				MsgType: event.MsgNotice,
+				Body:    "\u26a0 Your redaction was not bridged: messages and reactions that were sent as text can't be removed from iMessage",
+			})
+			if err != nil {
+				portal.log.Warnfln("Failed to send redaction error notice: %v", err)
+			}
+		}
+		return
+	}
 	portal.sendUnsupportedCheckpoint(evt, status.MsgStepRemote, fmt.Errorf("can't redact non-reaction event"))
 }
 
@@ -1570,6 +1887,7 @@ func (portal *Portal) isDuplicate(dbMessage *database.Message, msg *imessage.Mes
 		}
 		dbMessage.MXID = dedup.EventID
 		dbMessage.Timestamp = msg.Time.UnixMilli()
+		dbMessage.SentAt = msg.Time.UnixMilli()
 		dbMessage.Insert(nil)
 		portal.sendDeliveryReceipt(dbMessage.MXID, msg.Service, msg.ChatGUID, true)
 		return true
@@ -1627,7 +1945,7 @@ func (portal *Portal) handleIMMemberChange(msg *imessage.Message, dbMessage *dat
 		portal.log.Debugfln("Ignoring member change item with empty target")
 		return nil
 	}
-	puppet := portal.bridge.GetPuppetByLocalID(msg.Target.LocalID)
+	puppet := portal.user.GetPuppetByLocalID(msg.Target.LocalID)
 	puppet.Sync()
 	if msg.GroupActionType == imessage.GroupActionAddUser {
 		return portal.setMembership(intent, puppet, event.MembershipJoin, dbMessage.Timestamp)
@@ -1645,7 +1963,7 @@ func (portal *Portal) convertIMAttachment(msg *imessage.Message, attach *imessag
 		portal.log.Errorfln("Failed to read attachment in %s: %v", msg.GUID, err)
 		return nil, nil, fmt.Errorf("failed to read attachment: %w", err)
 	}
-	if portal.bridge.Config.IMessage.DeleteMediaAfterUpload {
+	if portal.connectorConfigFor(msg.ChatGUID).DeleteMediaAfterUpload {
 		defer func() {
 			err = attach.Delete()
 			if err != nil {
@@ -1654,56 +1972,8 @@ func (portal *Portal) convertIMAttachment(msg *imessage.Message, attach *imessag
 		}()
 	}
 
-	mimeType := attach.GetMimeType()
-	fileName := attach.GetFileName()
 	extraContent := map[string]interface{}{}
-
-	if msg.IsAudioMessage {
-		ogg, err := ffmpeg.ConvertBytes(context.TODO(), data, ".ogg", []string{}, []string{"-c:a", "libopus"}, "audio/x-caf")
-		if err == nil {
-			extraContent["org.matrix.msc1767.audio"] = map[string]interface{}{}
-			extraContent["org.matrix.msc3245.voice"] = map[string]interface{}{}
-			mimeType = "audio/ogg"
-			fileName = "Voice Message.ogg"
-			data = ogg
-		} else {
-			portal.log.Errorf("Failed to convert audio message to ogg/opus: %v - sending without conversion", err)
-		}
-	}
-
-	if CanConvertHEIF && portal.bridge.Config.Bridge.ConvertHEIF && (mimeType == "image/heic" || mimeType == "image/heif") {
-		convertedData, err := ConvertHEIF(data)
-		if err == nil {
-			mimeType = "image/jpeg"
-			fileName += ".jpg"
-			data = convertedData
-		} else {
-			portal.log.Errorf("Failed to convert heif image to jpeg: %v - sending without conversion", err)
-		}
-	}
-
-	if portal.bridge.Config.Bridge.ConvertTIFF && mimeType == "image/tiff" {
-		convertedData, err := ConvertTIFF(data)
-		if err == nil {
-			mimeType = "image/jpeg"
-			fileName += ".jpg"
-			data = convertedData
-		} else {
-			portal.log.Errorf("Failed to convert tiff image to jpeg: %v - sending without conversion", err)
-		}
-	}
-
-	if portal.bridge.Config.Bridge.ConvertVideo.Enabled && mimeType == "video/quicktime" {
-		conv := portal.bridge.Config.Bridge.ConvertVideo
-		convertedData, err := ffmpeg.ConvertBytes(context.TODO(), data, "."+conv.Extension, []string{}, conv.FFMPEGArgs, "video/quicktime")
-		if err == nil {
-			mimeType = conv.MimeType
-			fileName += "." + conv.Extension
-			data = convertedData
-		} else {
-			portal.log.Errorf("Failed to convert quicktime video to webm: %v - sending without conversion", err)
-		}
-	}
+	data, mimeType, fileName := portal.convertAttachmentData(msg.IsAudioMessage, data, attach.GetMimeType(), attach.GetFileName(), extraContent)
 
 	uploadMime, uploadInfo := portal.encryptFile(data, mimeType)
 
@@ -1740,17 +2010,100 @@ func (portal *Portal) convertIMAttachment(msg *imessage.Message, attach *imessag
 		MimeType: mimeType,
 		Size:     len(data),
 	}
+	content.MsgType = msgTypeForMime(mimeType)
+	return &content, extraContent, nil
+}
+
+func msgTypeForMime(mimeType string) event.MessageType {
 	switch strings.Split(mimeType, "/")[0] {
 	case "image":
-		content.MsgType = event.MsgImage
+		return event.MsgImage
 	case "video":
-		content.MsgType = event.MsgVideo
+		return event.MsgVideo
 	case "audio":
-		content.MsgType = event.MsgAudio
+		return event.MsgAudio
 	default:
-		content.MsgType = event.MsgFile
+		return event.MsgFile
 	}
-	return &content, extraContent, nil
+}
+
+type attachmentConversion struct {
+	Description   string
+	MimeType      string
+	FileName      string
+	FileExtension string
+	Extra         map[string]interface{}
+	Convert       func(data []byte) ([]byte, error)
+}
+
+func (conv *attachmentConversion) convertFileName(fileName string) string {
+	if conv.FileName != "" {
+		return conv.FileName
+	}
+	return fileName + conv.FileExtension
+}
+
+// getAttachmentConversion returns the conversion that should be applied to an attachment before uploading,
+// or nil if the attachment should be uploaded as-is.
+func (portal *Portal) getAttachmentConversion(isAudioMessage bool, mimeType string) *attachmentConversion {
+	settings := portal.effectiveSettings()
+	switch {
+	case isAudioMessage:
+		return &attachmentConversion{
+			Description: "audio message to ogg/opus",
+			MimeType:    "audio/ogg",
+			FileName:    "Voice Message.ogg",
+			Extra: map[string]interface{}{
+				"org.matrix.msc1767.audio": map[string]interface{}{},
+				"org.matrix.msc3245.voice": map[string]interface{}{},
+			},
+			Convert: func(data []byte) ([]byte, error) {
+				return ffmpeg.ConvertBytes(context.TODO(), data, ".ogg", []string{}, []string{"-c:a", "libopus"}, "audio/x-caf")
+			},
+		}
+	case CanConvertHEIF && settings.ConvertHEIF && (mimeType == "image/heic" || mimeType == "image/heif"):
+		return &attachmentConversion{
+			Description:   "heif image to jpeg",
+			MimeType:      "image/jpeg",
+			FileExtension: ".jpg",
+			Convert:       ConvertHEIF,
+		}
+	case settings.ConvertTIFF && mimeType == "image/tiff":
+		return &attachmentConversion{
+			Description:   "tiff image to jpeg",
+			MimeType:      "image/jpeg",
+			FileExtension: ".jpg",
+			Convert:       ConvertTIFF,
+		}
+	case settings.ConvertVideo && mimeType == "video/quicktime":
+		conv := portal.bridge.Config.Bridge.ConvertVideo
+		return &attachmentConversion{
+			Description:   "quicktime video to webm",
+			MimeType:      conv.MimeType,
+			FileExtension: "." + conv.Extension,
+			Convert: func(data []byte) ([]byte, error) {
+				return ffmpeg.ConvertBytes(context.TODO(), data, "."+conv.Extension, []string{}, conv.FFMPEGArgs, "video/quicktime")
+			},
+		}
+	default:
+		return nil
+	}
+}
+
+func (portal *Portal) convertAttachmentData(isAudioMessage bool, data []byte, mimeType, fileName string, extraContent map[string]interface{}) ([]byte, string, string) {
+	conv := portal.getAttachmentConversion(isAudioMessage, mimeType)
+	if conv == nil {
+		return data, mimeType, fileName
+	}
+	convertedData, err := conv.Convert(data)
+	if err != nil {
+		portal.log.Errorf("Failed to convert %s: %v - sending without conversion", conv.Description, err)
+		return data, mimeType, fileName
+	}
+	for key, value := range conv.Extra {
+		extraContent[key] = value
+	}
+	return convertedData, conv.MimeType, conv.convertFileName(fileName)
 }
 
 type ConvertedMessage struct {
@@ -1759,11 +2112,24 @@ type ConvertedMessage struct {
 	Extra   map[string]any
 }
 
-func (portal *Portal) convertIMAttachments(msg *imessage.Message, intent *appservice.IntentAPI) []*ConvertedMessage {
+func (portal *Portal) convertIMAttachments(msg *imessage.Message, intent *appservice.IntentAPI, lazyMedia bool) []*ConvertedMessage {
 	converted := make([]*ConvertedMessage, len(msg.Attachments))
 	for index, attach := range msg.Attachments {
 		portal.log.Debugfln("Converting iMessage attachment %s.%d", msg.GUID, index)
-		content, extra, err := portal.convertIMAttachment(msg, attach, intent)
+		var content *event.MessageEventContent
+		var extra map[string]interface{}
+		var err error
+		// Attachments that need converting are uploaded immediately, as the converted type and size
+		// have to be known when the event is sent.
+		if lazyMedia && portal.getAttachmentConversion(msg.IsAudioMessage, attach.GetMimeType()) == nil {
+			content, extra, err = portal.convertIMAttachmentLazy(msg, attach, intent)
+			if err != nil {
+				portal.log.Warnfln("Failed to reserve media URL for %s.%d, uploading immediately: %v", msg.GUID, index, err)
+			}
+		}
+		if content == nil {
+			content, extra, err = portal.convertIMAttachment(msg, attach, intent)
+		}
 		if extra == nil {
 			extra = map[string]interface{}{}
 		}
@@ -1785,6 +2151,7 @@ func (portal *Portal) convertIMAttachments(msg *imessage.Message, intent *appser
 }
 
 func (portal *Portal) convertIMText(msg *imessage.Message) *ConvertedMessage {
+	formattedText, mentions := portal.convertIMFormatting(msg.Text, msg.Formatting)
 	msg.Text = strings.ReplaceAll(msg.Text, "\ufffc", "")
 	msg.Subject = strings.ReplaceAll(msg.Subject, "\ufffc", "")
 	if len(msg.Text) == 0 && len(msg.Subject) == 0 {
@@ -1794,13 +2161,23 @@ func (portal *Portal) convertIMText(msg *imessage.Message) *ConvertedMessage {
 		MsgType: event.MsgText,
 		Body:    msg.Text,
 	}
+	if len(formattedText) > 0 {
+		content.Format = event.FormatHTML
+		content.FormattedBody = formattedText
+	}
+	if len(mentions) > 0 {
+		content.Mentions = &event.Mentions{UserIDs: mentions}
+	}
 	if len(msg.Subject) > 0 {
+		if len(formattedText) == 0 {
+			formattedText = event.TextToHTML(content.Body)
+		}
 		content.Format = event.FormatHTML
-		content.FormattedBody = fmt.Sprintf("<strong>%s</strong><br>%s", event.TextToHTML(msg.Subject), event.TextToHTML(content.Body))
+		content.FormattedBody = fmt.Sprintf("<strong>%s</strong><br>%s", event.TextToHTML(msg.Subject), formattedText)
 		content.Body = fmt.Sprintf("**%s**\n%s", msg.Subject, msg.Text)
 	}
 	extraAttrs := map[string]any{}
-	if msg.RichLink != nil {
+	if msg.RichLink != nil && portal.effectiveSettings().LinkPreviews {
 		portal.log.Debugfln("Handling rich link in iMessage %s", msg.GUID)
 		linkPreview := portal.convertRichLinkToBeeper(msg.RichLink)
 		if linkPreview != nil {
@@ -1822,7 +2199,7 @@ func (portal *Portal) GetReplyEvent(msg *imessage.Message) (id.EventID, *event.E
 	if len(msg.ReplyToGUID) == 0 {
 		return "", nil
 	}
-	message := portal.bridge.DB.Message.GetByGUID(portal.GUID, msg.ReplyToGUID, msg.ReplyToPart)
+	message := portal.bridge.DB.Message.GetByGUID(portal.GUID, portal.Receiver, msg.ReplyToGUID, msg.ReplyToPart)
 	if message != nil {
 		evt, err := portal.MainIntent().GetEvent(portal.MXID, message.MXID)
 		if err != nil {
@@ -1849,17 +2226,39 @@ func (portal *Portal) GetReplyEvent(msg *imessage.Message) (id.EventID, *event.E
 	return "", nil
 }
 
+// GetThreadRelation returns the Matrix thread relation for an iMessage inline reply. The thread is rooted at the
+// originator message, and the reply fallback for clients without thread support points at the latest message in the thread.
+func (portal *Portal) GetThreadRelation(msg *imessage.Message) *event.RelatesTo {
+	var originatorMXID id.EventID
+	originator := portal.bridge.DB.Message.GetByGUID(portal.GUID, portal.Receiver, msg.ReplyToGUID, msg.ReplyToPart)
+	if originator != nil {
+		originatorMXID = originator.MXID
+	} else if portal.bridge.Config.Homeserver.Software == bridgeconfig.SoftwareHungry {
+		portal.log.Debugfln("Using deterministic event ID for unknown thread originator %s.%d", msg.ReplyToGUID, msg.ReplyToPart)
+		originatorMXID = portal.deterministicEventID(msg.ReplyToGUID, msg.ReplyToPart)
+	} else {
+		portal.log.Debugfln("Unknown thread originator %s.%d", msg.ReplyToGUID, msg.ReplyToPart)
+		return nil
+	}
+	fallbackMXID := originatorMXID
+	lastInThread := portal.bridge.DB.Message.GetLastInThread(portal.GUID, portal.Receiver, msg.ReplyToGUID)
+	if lastInThread != nil {
+		fallbackMXID = lastInThread.MXID
+	}
+	return (&event.RelatesTo{}).SetThread(originatorMXID, fallbackMXID)
+}
+
 func (portal *Portal) addSourceMetadata(msg *imessage.Message, to map[string]any) {
-	if portal.bridge.IM.Capabilities().ContactChatMerging {
+	if portal.capabilities().ContactChatMerging {
 		to[bridgeInfoService] = msg.Service
 		to[bridgeInfoHandle] = msg.ChatGUID
 	}
 }
 
-func (portal *Portal) convertiMessage(msg *imessage.Message, intent *appservice.IntentAPI) []*ConvertedMessage {
-	attachments := portal.convertIMAttachments(msg, intent)
+func (portal *Portal) convertiMessage(msg *imessage.Message, intent *appservice.IntentAPI, lazyMedia bool) []*ConvertedMessage {
+	attachments := portal.convertIMAttachments(msg, intent, lazyMedia)
 	text := portal.convertIMText(msg)
-	if text != nil && len(attachments) == 1 && portal.bridge.Config.Bridge.CaptionInMessage {
+	if text != nil && len(attachments) == 1 && portal.effectiveSettings().CaptionInMessage {
 		attach := attachments[0].Content
 		attach.FileName = attach.Body
 		attach.Body = text.Content.Body
@@ -1872,15 +2271,11 @@ func (portal *Portal) convertiMessage(msg *imessage.Message, intent *appservice.
 		portal.addSourceMetadata(msg, part.Extra)
 	}
 	if msg.ReplyToGUID != "" {
-		replyToMXID, replyToEvt := portal.GetReplyEvent(msg)
-		if replyToMXID != "" {
+		threadRelation := portal.GetThreadRelation(msg)
+		if threadRelation != nil {
 			msg.ReplyProcessed = true
 			for _, part := range attachments {
-				if replyToEvt != nil {
-					part.Content.SetReply(replyToEvt)
-				} else {
-					part.Content.RelatesTo = (&event.RelatesTo{}).SetReplyTo(replyToMXID)
-				}
+				part.Content.RelatesTo = threadRelation.Copy()
 			}
 		}
 	}
@@ -1892,7 +2287,7 @@ func (portal *Portal) handleNormaliMessage(msg *imessage.Message, dbMessage *dat
 		if portal.bridge.Config.HackyStartupTest.EchoMode {
 			_, ok := msg.Metadata[startupTestKey].(map[string]any)
 			if ok {
-				go portal.bridge.receiveStartupTestPing(msg)
+				go portal.bridge.receiveStartupTestPing(portal.user, msg)
 			}
 		} else if portal.Identifier.LocalID == portal.bridge.Config.HackyStartupTest.Identifier {
 			resp, ok := msg.Metadata[startupTestResponseKey].(map[string]any)
@@ -1902,7 +2297,7 @@ func (portal *Portal) handleNormaliMessage(msg *imessage.Message, dbMessage *dat
 		}
 	}
 
-	parts := portal.convertiMessage(msg, intent)
+	parts := portal.convertiMessage(msg, intent, false)
 	if len(parts) == 0 {
 		portal.log.Warnfln("iMessage %s doesn't contain any attachments nor text", msg.GUID)
 	}
@@ -1949,7 +2344,7 @@ func (portal *Portal) handleIMError(msg *imessage.Message, dbMessage *database.M
 
 func (portal *Portal) getIntentForMessage(msg *imessage.Message, dbMessage *database.Message) *appservice.IntentAPI {
 	if msg.IsFromMe {
-		intent := portal.bridge.user.DoublePuppetIntent
+		intent := portal.user.DoublePuppetIntent
 		if dbMessage != nil && portal.isDuplicate(dbMessage, msg) {
 			return nil
 		} else if intent == nil {
@@ -1963,7 +2358,7 @@ func (portal *Portal) getIntentForMessage(msg *imessage.Message, dbMessage *data
 			portal.log.Debugfln("Message received from %s, which is not the expected sender %s. Forcing the original puppet.", localID, portal.Identifier.LocalID)
 			localID = portal.Identifier.LocalID
 		}
-		puppet := portal.bridge.GetPuppetByLocalID(localID)
+		puppet := portal.user.GetPuppetByLocalID(localID)
 		if len(puppet.Displayname) == 0 {
 			portal.log.Debugfln("Displayname of %s is empty, syncing before handling %s", puppet.ID, msg.GUID)
 			puppet.Sync()
@@ -1985,7 +2380,7 @@ func (portal *Portal) HandleiMessage(msg *imessage.Message) id.EventID {
 		if hasMXID {
 			eventID = dbMessage.MXID
 		}
-		portal.bridge.IM.SendMessageBridgeResult(msg.ChatGUID, msg.GUID, eventID, overrideSuccess || hasMXID)
+		portal.user.IM.SendMessageBridgeResult(msg.ChatGUID, msg.GUID, eventID, overrideSuccess || hasMXID)
 	}()
 
 	if portal.IsPrivateChat() && msg.ChatGUID != portal.LastSeenHandle {
@@ -1997,8 +2392,9 @@ func (portal *Portal) HandleiMessage(msg *imessage.Message) id.EventID {
 	if msg.Tapback != nil {
 		portal.HandleiMessageTapback(msg)
 		return ""
-	} else if portal.bridge.DB.Message.GetLastByGUID(portal.GUID, msg.GUID) != nil {
+	} else if existing := portal.bridge.DB.Message.GetLastByGUID(portal.GUID, portal.Receiver, msg.GUID); existing != nil {
 		portal.log.Debugln("Ignoring duplicate message", msg.GUID)
+		portal.updateOutgoingMessageState(existing, msg)
 		// Send a success confirmation since it's a duplicate message
 		overrideSuccess = true
 		return ""
@@ -2007,10 +2403,13 @@ func (portal *Portal) HandleiMessage(msg *imessage.Message) id.EventID {
 	portal.log.Debugfln("Starting handling of iMessage %s (type: %d, attachments: %d, text: %d)", msg.GUID, msg.ItemType, len(msg.Attachments), len(msg.Text))
 	dbMessage = portal.bridge.DB.Message.New()
 	dbMessage.PortalGUID = portal.GUID
+	dbMessage.PortalReceiver = portal.Receiver
 	dbMessage.HandleGUID = msg.ChatGUID
 	dbMessage.SenderGUID = msg.Sender.String()
 	dbMessage.GUID = msg.GUID
 	dbMessage.Timestamp = msg.Time.UnixMilli()
+	dbMessage.ThreadOriginatorGUID = msg.ReplyToGUID
+	dbMessage.ThreadOriginatorPart = msg.ReplyToPart
 
 	intent := portal.getIntentForMessage(msg, dbMessage)
 	if intent == nil {
@@ -2046,7 +2445,7 @@ func (portal *Portal) HandleiMessage(msg *imessage.Message) id.EventID {
 	if len(dbMessage.MXID) > 0 {
 		portal.sendDeliveryReceipt(dbMessage.MXID, "", "", false)
 		if !msg.IsFromMe && msg.IsRead {
-			err := portal.markRead(portal.bridge.user.DoublePuppetIntent, dbMessage.MXID, time.Time{})
+			err := portal.markRead(portal.user.DoublePuppetIntent, dbMessage.MXID, time.Time{})
 			if err != nil {
 				portal.log.Warnln("Failed to mark %s as read after bridging: %v", dbMessage.MXID, err)
 			}
@@ -2059,7 +2458,7 @@ func (portal *Portal) HandleiMessage(msg *imessage.Message) id.EventID {
 
 func (portal *Portal) HandleiMessageTapback(msg *imessage.Message) {
 	portal.log.Debugln("Starting handling of iMessage tapback", msg.GUID, "to", msg.Tapback.TargetGUID)
-	target := portal.bridge.DB.Message.GetByGUID(portal.GUID, msg.Tapback.TargetGUID, msg.Tapback.TargetPart)
+	target := portal.bridge.DB.Message.GetByGUID(portal.GUID, portal.Receiver, msg.Tapback.TargetGUID, msg.Tapback.TargetPart)
 	if target == nil {
 		portal.log.Debugfln("Unknown tapback target %s.%d", msg.Tapback.TargetGUID, msg.Tapback.TargetPart)
 		return
@@ -2070,7 +2469,7 @@ func (portal *Portal) HandleiMessageTapback(msg *imessage.Message) {
 	}
 	senderGUID := msg.Sender.String()
 
-	existing := portal.bridge.DB.Tapback.GetByGUID(portal.GUID, target.GUID, target.Part, senderGUID)
+	existing := portal.bridge.DB.Tapback.GetByGUID(portal.GUID, portal.Receiver, target.GUID, target.Part, senderGUID)
 	if msg.Tapback.Remove {
 		if existing == nil {
 			return
@@ -2081,7 +2480,7 @@ func (portal *Portal) HandleiMessageTapback(msg *imessage.Message) {
 		}
 		existing.Delete()
 		return
-	} else if existing != nil && existing.Type == msg.Tapback.Type {
+	} else if existing != nil && existing.Type == msg.Tapback.Type && existing.Emoji == msg.Tapback.CustomEmoji {
 		portal.log.Debugfln("Ignoring tapback from %s to %s: type is same", msg.SenderText(), target.GUID)
 		return
 	}
@@ -2090,7 +2489,7 @@ func (portal *Portal) HandleiMessageTapback(msg *imessage.Message) {
 		RelatesTo: event.RelatesTo{
 			EventID: target.MXID,
 			Type:    event.RelAnnotation,
-			Key:     msg.Tapback.Type.Emoji(),
+			Key:     msg.Tapback.Emoji(),
 		},
 	}
 
@@ -2110,17 +2509,20 @@ func (portal *Portal) HandleiMessageTapback(msg *imessage.Message) {
 	if existing == nil {
 		tapback := portal.bridge.DB.Tapback.New()
 		tapback.PortalGUID = portal.GUID
+		tapback.PortalReceiver = portal.Receiver
 		tapback.MessageGUID = target.GUID
 		tapback.MessagePart = target.Part
 		tapback.SenderGUID = senderGUID
 		tapback.HandleGUID = msg.ChatGUID
 		tapback.GUID = msg.GUID
 		tapback.Type = msg.Tapback.Type
+		tapback.Emoji = msg.Tapback.CustomEmoji
 		tapback.MXID = resp.EventID
 		tapback.Insert(nil)
 	} else {
 		existing.GUID = msg.GUID
 		existing.Type = msg.Tapback.Type
+		existing.Emoji = msg.Tapback.CustomEmoji
 		existing.MXID = resp.EventID
 		existing.HandleGUID = msg.ChatGUID
 		existing.Update()
@@ -2128,12 +2530,13 @@ func (portal *Portal) HandleiMessageTapback(msg *imessage.Message) {
 }
 
 func (portal *Portal) Delete() {
+	portal.removeFromSpaces()
 	portal.Portal.Delete()
 	portal.bridge.portalsLock.Lock()
-	delete(portal.bridge.portalsByGUID, portal.GUID)
+	delete(portal.bridge.portalsByGUID, portal.key())
 	for _, guid := range portal.SecondaryGUIDs {
-		if storedPortal := portal.bridge.portalsByGUID[guid]; storedPortal == portal {
-			portal.bridge.portalsByGUID[guid] = nil
+		if storedPortal := portal.bridge.portalsByGUID[portalKey{guid, portal.Receiver}]; storedPortal == portal {
+			portal.bridge.portalsByGUID[portalKey{guid, portal.Receiver}] = nil
 		}
 	}
 	if len(portal.MXID) > 0 {
@@ -2149,7 +2552,7 @@ func (portal *Portal) GetMatrixUsers() ([]id.UserID, error) {
 	}
 	var users []id.UserID
 	for userID := range members.Joined {
-		_, isPuppet := portal.bridge.ParsePuppetMXID(userID)
+		_, _, isPuppet := portal.bridge.ParsePuppetMXID(userID)
 		if !isPuppet && userID != portal.bridge.Bot.UserID {
 			users = append(users, userID)
 		}
@@ -2200,9 +2603,9 @@ func (portal *Portal) Cleanup(puppetsOnly bool) {
 		portal.log.Errorln("Failed to get portal members for cleanup:", err)
 		return
 	}
-	if _, isJoined := members.Joined[portal.bridge.user.MXID]; !puppetsOnly && !isJoined {
+	if _, isJoined := members.Joined[portal.user.MXID]; !puppetsOnly && !isJoined {
 		// Kick the user even if they're not joined in case they're invited.
-		_, _ = intent.KickUser(portal.MXID, &mautrix.ReqKickUser{UserID: portal.bridge.user.MXID, Reason: "Deleting portal"})
+		_, _ = intent.KickUser(portal.MXID, &mautrix.ReqKickUser{UserID: portal.user.MXID, Reason: "Deleting portal"})
 	}
 	for member := range members.Joined {
 		if member == intent.UserID {
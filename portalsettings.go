@@ -0,0 +1,228 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-imessage/config"
+	"go.mau.fi/mautrix-imessage/database"
+)
+
+var PortalSettingsEventType = event.Type{Type: "fi.mau.imessage.portal_settings", Class: event.StateEventType}
+
+// portalSettings contains the effective values of the options that can be overridden per portal.
+type portalSettings struct {
+	CaptionInMessage      bool
+	PrivateChatPortalMeta string
+	ConvertHEIF           bool
+	ConvertTIFF           bool
+	ConvertVideo          bool
+	LinkPreviews          bool
+	RelayFormats          map[event.MessageType]string
+}
+
+// effectiveSettings returns the settings of the portal, falling back to the global config for options
+// that haven't been overridden.
+func (portal *Portal) effectiveSettings() portalSettings {
+	global := &portal.bridge.Config.Bridge
+	settings := portalSettings{
+		CaptionInMessage:      global.CaptionInMessage,
+		PrivateChatPortalMeta: global.PrivateChatPortalMeta,
+		ConvertHEIF:           global.ConvertHEIF,
+		ConvertTIFF:           global.ConvertTIFF,
+		ConvertVideo:          global.ConvertVideo.Enabled,
+		LinkPreviews:          true,
+		RelayFormats:          portal.Settings.RelayFormats,
+	}
+	overrides := &portal.Settings
+	if overrides.CaptionInMessage != nil {
+		settings.CaptionInMessage = *overrides.CaptionInMessage
+	}
+	if overrides.PrivateChatPortalMeta != nil {
+		settings.PrivateChatPortalMeta = *overrides.PrivateChatPortalMeta
+	}
+	if overrides.ConvertHEIF != nil {
+		settings.ConvertHEIF = *overrides.ConvertHEIF
+	}
+	if overrides.ConvertTIFF != nil {
+		settings.ConvertTIFF = *overrides.ConvertTIFF
+	}
+	if overrides.ConvertVideo != nil {
+		settings.ConvertVideo = *overrides.ConvertVideo
+	}
+	if overrides.LinkPreviews != nil {
+		settings.LinkPreviews = *overrides.LinkPreviews
+	}
+	return settings
+}
+
+var portalSettingBoolKeys = map[string]func(settings *database.PortalSettings) **bool{
+	"caption_in_message": func(settings *database.PortalSettings) **bool { return &settings.CaptionInMessage },
+	"convert_heif":       func(settings *database.PortalSettings) **bool { return &settings.ConvertHEIF },
+	"convert_tiff":       func(settings *database.PortalSettings) **bool { return &settings.ConvertTIFF },
+	"convert_video":      func(settings *database.PortalSettings) **bool { return &settings.ConvertVideo },
+	"link_previews":      func(settings *database.PortalSettings) **bool { return &settings.LinkPreviews },
+}
+
+func isValidPrivateChatPortalMeta(value string) bool {
+	return value == "default" || value == "always" || value == "never"
+}
+
+func validatePortalSettings(settings *database.PortalSettings) error {
+	if settings.PrivateChatPortalMeta != nil && !isValidPrivateChatPortalMeta(*settings.PrivateChatPortalMeta) {
+		return fmt.Errorf("invalid private_chat_portal_meta value %q", *settings.PrivateChatPortalMeta)
+	}
+	for msgType, format := range settings.RelayFormats {
+		if err := config.ValidateRelayFormat(format); err != nil {
+			return fmt.Errorf("invalid relay format for %s: %w", msgType, err)
+		}
+	}
+	for action, rules := range settings.Permissions {
+		if err := validatePermissionRules(action, rules); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setPortalSetting changes a single setting. An empty value removes the override.
+func setPortalSetting(settings *database.PortalSettings, key, value string) error {
+	if getter, ok := portalSettingBoolKeys[key]; ok {
+		if value == "" {
+			*getter(settings) = nil
+			return nil
+		}
+		boolValue, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s must be true or false", key)
+		}
+		*getter(settings) = &boolValue
+		return nil
+	} else if key == "private_chat_portal_meta" {
+		if value == "" {
+			settings.PrivateChatPortalMeta = nil
+		} else if !isValidPrivateChatPortalMeta(value) {
+			return fmt.Errorf("private_chat_portal_meta must be default, always or never")
+		} else {
+			settings.PrivateChatPortalMeta = &value
+		}
+		return nil
+	} else if strings.HasPrefix(key, "relay_format.") {
+		msgType := strings.TrimPrefix(key, "relay_format.")
+		if value == "" {
+			delete(settings.RelayFormats, event.MessageType(msgType))
+			return nil
+		} else if err := config.ValidateRelayFormat(value); err != nil {
+			return fmt.Errorf("invalid relay format: %w", err)
+		}
+		if settings.RelayFormats == nil {
+			settings.RelayFormats = make(map[event.MessageType]string)
+		}
+		settings.RelayFormats[event.MessageType(msgType)] = value
+		return nil
+	}
+	return fmt.Errorf("unknown setting %q", key)
+}
+
+// savePortalSettings stores the settings in the database and mirrors them to the room state.
+func (portal *Portal) savePortalSettings() {
+	portal.Update(nil)
+	if len(portal.MXID) == 0 {
+		return
+	}
+	_, err := portal.MainIntent().SendStateEvent(portal.MXID, PortalSettingsEventType, "", &portal.Settings)
+	if err != nil {
+		portal.log.Warnfln("Failed to update portal settings state event: %v", err)
+	}
+}
+
+func (br *IMBridge) HandlePortalSettingsEvent(evt *event.Event) {
+	if evt.Sender == br.Bot.UserID || br.IsGhost(evt.Sender) {
+		return
+	}
+	portal := br.GetPortalByMXID(evt.RoomID)
+	if portal == nil {
+		return
+	} else if evt.Sender != portal.user.MXID {
+		portal.log.Debugfln("Ignoring portal settings change from %s (not the bridge user)", evt.Sender)
+		return
+	}
+	// Fields missing from the event keep their current value, an explicit null removes the override.
+	// Relay formats are merged by message type, with an empty format removing the override.
+	// Round-tripping through JSON makes a deep copy, so the current settings aren't modified if the event is invalid.
+	var settings database.PortalSettings
+	current, err := json.Marshal(&portal.Settings)
+	if err == nil {
+		err = json.Unmarshal(current, &settings)
+	}
+	if err == nil {
+		err = json.Unmarshal(evt.Content.VeryRaw, &settings)
+	}
+	for msgType, format := range settings.RelayFormats {
+		if format == "" {
+			delete(settings.RelayFormats, msgType)
+		}
+	}
+	// Permissions can only be changed with the admin-only portal-permissions command,
+	// the copy in the room state is informational.
+	settings.Permissions = portal.Settings.Permissions
+	if err == nil {
+		err = validatePortalSettings(&settings)
+	}
+	if err != nil {
+		portal.log.Warnfln("Ignoring invalid portal settings event %s from %s: %v", evt.ID, evt.Sender, err)
+		return
+	}
+	portal.log.Debugfln("Updating portal settings from %s sent by %s", evt.ID, evt.Sender)
+	portal.Settings = settings
+	portal.Update(nil)
+}
+
+func formatPortalSettings(portal *Portal) string {
+	settings := portal.effectiveSettings()
+	overrides := &portal.Settings
+	isOverridden := func(overridden bool) string {
+		if overridden {
+			return ""
+		}
+		return " (default)"
+	}
+	lines := []string{
+		fmt.Sprintf("* caption_in_message: %t%s", settings.CaptionInMessage, isOverridden(overrides.CaptionInMessage != nil)),
+		fmt.Sprintf("* private_chat_portal_meta: %s%s", settings.PrivateChatPortalMeta, isOverridden(overrides.PrivateChatPortalMeta != nil)),
+		fmt.Sprintf("* convert_heif: %t%s", settings.ConvertHEIF, isOverridden(overrides.ConvertHEIF != nil)),
+		fmt.Sprintf("* convert_tiff: %t%s", settings.ConvertTIFF, isOverridden(overrides.ConvertTIFF != nil)),
+		fmt.Sprintf("* convert_video: %t%s", settings.ConvertVideo, isOverridden(overrides.ConvertVideo != nil)),
+		fmt.Sprintf("* link_previews: %t%s", settings.LinkPreviews, isOverridden(overrides.LinkPreviews != nil)),
+	}
+	msgTypes := make([]string, 0, len(settings.RelayFormats))
+	for msgType := range settings.RelayFormats {
+		msgTypes = append(msgTypes, string(msgType))
+	}
+	sort.Strings(msgTypes)
+	for _, msgType := range msgTypes {
+		lines = append(lines, fmt.Sprintf("* relay_format.%s: `%s`", msgType, settings.RelayFormats[event.MessageType(msgType)]))
+	}
+	return strings.Join(lines, "\n")
+}
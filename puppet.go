@@ -25,6 +25,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gabriel-vasile/mimetype"
@@ -41,62 +42,82 @@ import (
 
 var userIDRegex *regexp.Regexp
 
-func (br *IMBridge) ParsePuppetMXID(mxid id.UserID) (string, bool) {
+// ParsePuppetMXID parses the local ID and receiver from a ghost user ID.
+// The receiver is only set for ghosts of extra bridge users, where it's prefixed to the local ID with a slash.
+func (br *IMBridge) ParsePuppetMXID(mxid id.UserID) (string, string, bool) {
 	if userIDRegex == nil {
 		userIDRegex = br.Config.MakeUserIDRegex("(.+)")
 	}
 	match := userIDRegex.FindStringSubmatch(string(mxid))
 	if match == nil || len(match) != 2 {
-		return "", false
+		return "", "", false
 	}
 
 	localID := match[1]
+	var receiver string
+	if slashIdx := strings.IndexRune(localID, '/'); slashIdx > 0 {
+		receiver = localID[:slashIdx]
+		localID = localID[slashIdx+1:]
+	}
 	if number, err := strconv.Atoi(localID); err == nil {
-		return fmt.Sprintf("+%d", number), true
+		return fmt.Sprintf("+%d", number), receiver, true
 	} else if localpart, err := id.DecodeUserLocalpart(localID); err == nil {
-		return localpart, true
+		return localpart, receiver, true
 	} else {
 		br.Log.Debugfln("Failed to decode user localpart '%s': %v", localID, err)
-		return "", false
+		return "", "", false
 	}
 
 }
 
 func (br *IMBridge) GetPuppetByMXID(mxid id.UserID) *Puppet {
-	localID, ok := br.ParsePuppetMXID(mxid)
+	localID, receiver, ok := br.ParsePuppetMXID(mxid)
+	if !ok {
+		return nil
+	}
+	user, ok := br.usersByReceiver[receiver]
 	if !ok {
 		return nil
 	}
 
-	return br.GetPuppetByLocalID(localID)
+	return user.GetPuppetByLocalID(localID)
+}
+
+type puppetKey struct {
+	ID       string
+	Receiver string
 }
 
-func (br *IMBridge) GetPuppetByGUID(guid string) *Puppet {
-	return br.GetPuppetByLocalID(imessage.ParseIdentifier(guid).LocalID)
+func (user *User) GetPuppetByGUID(guid string) *Puppet {
+	return user.GetPuppetByLocalID(imessage.ParseIdentifier(guid).LocalID)
 }
 
-func (br *IMBridge) GetPuppetByLocalID(id string) *Puppet {
+func (user *User) GetPuppetByLocalID(id string) *Puppet {
+	br := user.bridge
+	id = br.NormalizeLocalID(id)
 	br.puppetsLock.Lock()
 	defer br.puppetsLock.Unlock()
-	puppet, ok := br.puppets[id]
+	puppet, ok := br.puppets[puppetKey{id, user.Receiver}]
 	if !ok {
-		dbPuppet := br.DB.Puppet.Get(id)
+		dbPuppet := br.DB.Puppet.Get(id, user.Receiver)
 		if dbPuppet == nil {
 			dbPuppet = br.DB.Puppet.New()
 			dbPuppet.ID = id
+			dbPuppet.Receiver = user.Receiver
 			dbPuppet.Insert()
 		}
-		puppet = br.NewPuppet(dbPuppet)
-		br.puppets[puppet.ID] = puppet
+		puppet = user.NewPuppet(dbPuppet)
+		br.puppets[puppet.key()] = puppet
 	}
 	return puppet
 }
 
-func (br *IMBridge) GetAllPuppets() []*Puppet {
-	return br.dbPuppetsToPuppets(br.DB.Puppet.GetAll())
+func (user *User) GetAllPuppets() []*Puppet {
+	return user.dbPuppetsToPuppets(user.bridge.DB.Puppet.GetAll(user.Receiver))
 }
 
-func (br *IMBridge) dbPuppetsToPuppets(dbPuppets []*database.Puppet) []*Puppet {
+func (user *User) dbPuppetsToPuppets(dbPuppets []*database.Puppet) []*Puppet {
+	br := user.bridge
 	br.puppetsLock.Lock()
 	defer br.puppetsLock.Unlock()
 	output := make([]*Puppet, len(dbPuppets))
@@ -104,28 +125,31 @@ func (br *IMBridge) dbPuppetsToPuppets(dbPuppets []*database.Puppet) []*Puppet {
 		if dbPuppet == nil {
 			continue
 		}
-		puppet, ok := br.puppets[dbPuppet.ID]
+		puppet, ok := br.puppets[puppetKey{dbPuppet.ID, dbPuppet.Receiver}]
 		if !ok {
-			puppet = br.NewPuppet(dbPuppet)
-			br.puppets[dbPuppet.ID] = puppet
+			puppet = user.NewPuppet(dbPuppet)
+			br.puppets[puppet.key()] = puppet
 		}
 		output[index] = puppet
 	}
 	return output
 }
 
-func (br *IMBridge) FormatPuppetMXID(guid string) id.UserID {
+func (br *IMBridge) FormatPuppetMXID(guid, receiver string) id.UserID {
 	return id.NewUserID(
-		br.Config.Bridge.FormatUsername(guid),
+		br.Config.Bridge.FormatReceiverUsername(receiver, guid),
 		br.Config.Homeserver.Domain)
 }
 
-func (br *IMBridge) NewPuppet(dbPuppet *database.Puppet) *Puppet {
-	mxid := br.FormatPuppetMXID(dbPuppet.ID)
+func (user *User) NewPuppet(dbPuppet *database.Puppet) *Puppet {
+	br := user.bridge
+	mxid := br.FormatPuppetMXID(dbPuppet.ID, dbPuppet.Receiver)
 	return &Puppet{
-		Puppet: dbPuppet,
-		bridge: br,
-		log:    br.Log.Sub(fmt.Sprintf("Puppet/%s", dbPuppet.ID)),
+		Puppet:   dbPuppet,
+		Override: br.DB.PuppetOverride.Get(dbPuppet.ID, dbPuppet.Receiver),
+		bridge:   br,
+		user:     user,
+		log:      br.Log.Sub(fmt.Sprintf("Puppet/%s", dbPuppet.ID)),
 
 		MXID:   mxid,
 		Intent: br.AS.Intent(mxid),
@@ -134,13 +158,18 @@ func (br *IMBridge) NewPuppet(dbPuppet *database.Puppet) *Puppet {
 
 type Puppet struct {
 	*database.Puppet
+	Override *database.PuppetOverride
 
 	bridge *IMBridge
+	user   *User
 	log    log.Logger
 
 	typingIn id.RoomID
 	typingAt int64
 
+	// syncLock prevents concurrent profile updates, as portals that share the ghost may be synced in parallel.
+	syncLock sync.Mutex
+
 	MXID   id.UserID
 	Intent *appservice.IntentAPI
 }
@@ -148,6 +177,10 @@ type Puppet struct {
 var _ bridge.Ghost = (*Puppet)(nil)
 var _ bridge.GhostWithProfile = (*Puppet)(nil)
 
+func (puppet *Puppet) key() puppetKey {
+	return puppetKey{puppet.ID, puppet.Receiver}
+}
+
 func (puppet *Puppet) GetDisplayname() string {
 	return puppet.Displayname
 }
@@ -173,18 +206,41 @@ func (puppet *Puppet) GetMXID() id.UserID {
 }
 
 func (puppet *Puppet) UpdateName(contact *imessage.Contact) bool {
-	if puppet.NameOverridden {
+	if puppet.Override != nil && len(puppet.Override.Displayname) > 0 {
+		return puppet.UpdateNameDirect(puppet.Override.Displayname)
+	} else if puppet.NameOverridden {
 		// Never replace custom names with contact list names
 		return false
-	} else if puppet.Displayname != "" && !contact.HasName() {
+	} else if puppet.Displayname != "" && !contact.HasName() && !puppet.hidesIdentifier() {
 		// Don't update displayname if there's no contact list name available
 		return false
 	}
 	return puppet.UpdateNameDirect(contact.Name())
 }
 
+// hidesIdentifier checks whether the phone number or email of the puppet should be hidden from the
+// displayname and contact info. The identifier is still part of the ghost's Matrix user ID.
+func (puppet *Puppet) hidesIdentifier() bool {
+	return puppet.Override != nil && puppet.Override.HideIdentifier
+}
+
+// maskedIdentifier returns the puppet ID with most of the phone number or email address hidden.
+func (puppet *Puppet) maskedIdentifier() string {
+	if localpart, domain, ok := strings.Cut(puppet.ID, "@"); ok {
+		if len(localpart) > 1 {
+			localpart = localpart[:1]
+		}
+		return fmt.Sprintf("%s•••@%s", localpart, domain)
+	} else if len(puppet.ID) > 4 {
+		return "•••" + puppet.ID[len(puppet.ID)-4:]
+	}
+	return "•••"
+}
+
 func (puppet *Puppet) UpdateNameDirect(name string) bool {
-	if len(name) == 0 {
+	if len(name) == 0 && puppet.hidesIdentifier() {
+		name = puppet.maskedIdentifier()
+	} else if len(name) == 0 {
 		// TODO format if phone numbers
 		name = puppet.ID
 	}
@@ -203,7 +259,14 @@ func (puppet *Puppet) UpdateNameDirect(name string) bool {
 }
 
 func (puppet *Puppet) UpdateAvatar(contact *imessage.Contact) bool {
-	if contact == nil {
+	if puppet.Override != nil && !puppet.Override.AvatarURL.IsEmpty() {
+		if puppet.AvatarURL == puppet.Override.AvatarURL {
+			return false
+		}
+		// Clear the hash so that the contact avatar is reuploaded if the override is removed
+		puppet.AvatarHash = nil
+		return puppet.UpdateAvatarFromMXC(puppet.Override.AvatarURL)
+	} else if contact == nil {
 		return false
 	}
 	return puppet.UpdateAvatarFromBytes(contact.Avatar)
@@ -251,9 +314,9 @@ func applyMeta(portal *Portal, meta func(portal *Portal)) {
 
 func (puppet *Puppet) updatePortalMeta(meta func(portal *Portal)) {
 	imID := imessage.Identifier{Service: "iMessage", LocalID: puppet.ID}.String()
-	applyMeta(puppet.bridge.GetPortalByGUID(imID), meta)
+	applyMeta(puppet.user.GetPortalByGUID(imID), meta)
 	smsID := imessage.Identifier{Service: "SMS", LocalID: puppet.ID}.String()
-	applyMeta(puppet.bridge.GetPortalByGUID(smsID), meta)
+	applyMeta(puppet.user.GetPortalByGUID(smsID), meta)
 }
 
 func (puppet *Puppet) updatePortalAvatar() {
@@ -291,7 +354,7 @@ func (puppet *Puppet) Sync() {
 		puppet.log.Errorln("Failed to ensure registered:", err)
 	}
 
-	contact, err := puppet.bridge.IM.GetContactInfo(puppet.ID)
+	contact, err := puppet.user.Contacts.GetContactInfo(puppet.ID)
 	if err != nil && !errors.Is(err, ipc.ErrUnknownCommand) {
 		puppet.log.Errorln("Failed to get contact info:", err)
 	} else if contact == nil {
@@ -342,6 +405,97 @@ func (puppet *Puppet) SyncWithProfileOverride(override ProfileOverride) {
 	}
 }
 
+// ResolveAvatarURL parses a mxc:// URL, or downloads the given http(s) URL and reuploads it to Matrix.
+func (puppet *Puppet) ResolveAvatarURL(rawURL string) (id.ContentURI, error) {
+	mxc, err := id.ParseContentURI(rawURL)
+	if err == nil {
+		return mxc, nil
+	}
+	resp, err := avatarDownloadClient.Get(rawURL)
+	if err != nil {
+		return id.ContentURI{}, fmt.Errorf("failed to download avatar: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return id.ContentURI{}, fmt.Errorf("unexpected status code %d while downloading avatar", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return id.ContentURI{}, fmt.Errorf("failed to read avatar: %w", err)
+	}
+	mimeTypeData := mimetype.Detect(body)
+	uploadResp, err := puppet.Intent.UploadBytesWithName(body, mimeTypeData.String(), "avatar"+mimeTypeData.Extension())
+	if err != nil {
+		return id.ContentURI{}, fmt.Errorf("failed to upload avatar: %w", err)
+	}
+	return uploadResp.ContentURI, nil
+}
+
+// EditOverride changes the persistent profile override of the puppet and resyncs the profile.
+// Empty fields in the override mean that the contact info is used.
+func (puppet *Puppet) EditOverride(edit func(override *database.PuppetOverride)) {
+	override := puppet.Override
+	if override == nil {
+		override = puppet.bridge.DB.PuppetOverride.New()
+		override.PuppetID = puppet.ID
+		override.Receiver = puppet.Receiver
+	}
+	oldName := override.Displayname
+	oldAvatarURL := override.AvatarURL
+	hadHideIdentifier := override.HideIdentifier
+	edit(override)
+	if oldName != override.Displayname {
+		// The override table supersedes the old name_overridden flag
+		puppet.NameOverridden = false
+	}
+	if override.IsEmpty() {
+		override.Delete()
+		puppet.Override = nil
+	} else {
+		override.Upsert()
+		puppet.Override = override
+	}
+	if (len(oldName) > 0 && len(override.Displayname) == 0) || (hadHideIdentifier && !override.HideIdentifier) {
+		// Make sure the old custom or masked name gets replaced even if there's no contact name
+		puppet.Displayname = ""
+	}
+	if hadHideIdentifier != override.HideIdentifier {
+		// Republish the contact info so that the identifiers are added or removed
+		puppet.ContactInfoSet = false
+	}
+	if !oldAvatarURL.IsEmpty() && override.AvatarURL.IsEmpty() {
+		puppet.clearOverrideAvatar(oldAvatarURL)
+	}
+	puppet.Sync()
+}
+
+// clearOverrideAvatar removes an avatar override from the ghost profile, so that it doesn't
+// stay in place when there's no contact avatar to replace it with.
+func (puppet *Puppet) clearOverrideAvatar(overrideURL id.ContentURI) {
+	if puppet.AvatarURL == overrideURL {
+		puppet.AvatarHash = nil
+		puppet.UpdateAvatarFromMXC(id.ContentURI{})
+	}
+}
+
+// ResetOverride removes all local profile overrides and resyncs the profile from contact info.
+func (puppet *Puppet) ResetOverride() {
+	puppet.NameOverridden = false
+	puppet.Displayname = ""
+	if puppet.Override != nil {
+		if puppet.Override.HideIdentifier {
+			puppet.ContactInfoSet = false
+		}
+		if !puppet.Override.AvatarURL.IsEmpty() {
+			puppet.clearOverrideAvatar(puppet.Override.AvatarURL)
+		}
+		puppet.Override.Delete()
+		puppet.Override = nil
+	}
+	puppet.Update()
+	puppet.Sync()
+}
+
 func (puppet *Puppet) UpdateContactInfo() bool {
 	if puppet.bridge.Config.Homeserver.Software != bridgeconfig.SoftwareHungry {
 		return false
@@ -350,12 +504,14 @@ func (puppet *Puppet) UpdateContactInfo() bool {
 		contactInfo := map[string]any{
 			"com.beeper.bridge.remote_id":     puppet.ID,
 		}
-		if strings.ContainsRune(puppet.ID, '@') {
+		if puppet.hidesIdentifier() {
+			contactInfo["com.beeper.bridge.identifiers"] = []string{}
+		} else if strings.ContainsRune(puppet.ID, '@') {
 			contactInfo["com.beeper.bridge.identifiers"] = []string{fmt.Sprintf("mailto:%s", puppet.ID)}
 		} else {
 			contactInfo["com.beeper.bridge.identifiers"] = []string{fmt.Sprintf("tel:%s", puppet.ID)}
 		}
-		if puppet.bridge.Config.IMessage.Platform == "android" {
+		if puppet.user.GetConnectorConfig().Platform == "android" {
 			contactInfo["com.beeper.bridge.service"] = "androidsms"
 			contactInfo["com.beeper.bridge.network"] = "androidsms"
 		} else {
@@ -375,6 +531,8 @@ func (puppet *Puppet) UpdateContactInfo() bool {
 }
 
 func (puppet *Puppet) SyncWithContact(contact *imessage.Contact) {
+	puppet.syncLock.Lock()
+	defer puppet.syncLock.Unlock()
 	update := false
 	update = puppet.UpdateName(contact) || update
 	update = puppet.UpdateAvatar(contact) || update
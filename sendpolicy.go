@@ -0,0 +1,172 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-imessage/imessage"
+)
+
+const (
+	SendPolicyAuto        = "auto"
+	SendPolicyIMessage    = "imessage"
+	SendPolicySMS         = "sms"
+	SendPolicySMSFallback = "sms_fallback"
+)
+
+var sendPolicies = []string{SendPolicyAuto, SendPolicyIMessage, SendPolicySMS, SendPolicySMSFallback}
+
+func isValidSendPolicy(policy string) bool {
+	for _, validPolicy := range sendPolicies {
+		if policy == validPolicy {
+			return true
+		}
+	}
+	return false
+}
+
+type pendingSMSFallback struct {
+	evt     *event.Event
+	content *event.MessageEventContent
+	target  string
+	timer   *time.Timer
+}
+
+func (portal *Portal) getSendPolicy() string {
+	if portal.SendPolicy != "" {
+		return portal.SendPolicy
+	}
+	return portal.bridge.Config.Bridge.SendPolicy.Default
+}
+
+func withService(guid, service string) string {
+	parsed := imessage.ParseIdentifier(guid)
+	if parsed.IsGroup || parsed.Service == service || (service == "SMS" && strings.ContainsRune(parsed.LocalID, '@')) {
+		// Groups can't change service, and emails can't receive SMS
+		return guid
+	}
+	parsed.Service = service
+	return parsed.String()
+}
+
+// getMessageTargetGUID returns the chat GUID that a new message should be sent to,
+// taking the send policy of the portal into account.
+func (portal *Portal) getMessageTargetGUID(eventID id.EventID) string {
+	target := portal.getTargetGUID("message", eventID, "")
+	if !portal.IsPrivateChat() {
+		return target
+	}
+	switch portal.getSendPolicy() {
+	case SendPolicyIMessage, SendPolicySMSFallback:
+		target = withService(target, "iMessage")
+	case SendPolicySMS:
+		target = withService(target, "SMS")
+	default:
+		return target
+	}
+	portal.log.Debugfln("Sending Matrix message %s to %s (send policy %s)", eventID, target, portal.getSendPolicy())
+	return target
+}
+
+func (portal *Portal) trackSMSFallback(evt *event.Event, content *event.MessageEventContent, resp *imessage.SendResponse) {
+	if !portal.IsPrivateChat() || portal.getSendPolicy() != SendPolicySMSFallback || resp.GUID == "" {
+		return
+	}
+	target := withService(resp.ChatGUID, "SMS")
+	if target == resp.ChatGUID {
+		return
+	}
+	pending := &pendingSMSFallback{
+		evt:     evt,
+		content: content,
+		target:  target,
+	}
+	portal.pendingSMSFallbackLock.Lock()
+	defer portal.pendingSMSFallbackLock.Unlock()
+	if portal.pendingSMSFallbacks == nil {
+		portal.pendingSMSFallbacks = make(map[string]*pendingSMSFallback)
+	}
+	portal.pendingSMSFallbacks[resp.GUID] = pending
+	timeout := time.Duration(portal.bridge.Config.Bridge.SendPolicy.FallbackTimeout) * time.Second
+	if timeout <= 0 {
+		return
+	}
+	guid := resp.GUID
+	if portal.capabilitiesFor(resp.ChatGUID).MessageStatusCheckpoints {
+		pending.timer = time.AfterFunc(timeout, func() {
+			portal.log.Debugfln("%s wasn't delivered in %s, falling back to SMS", guid, timeout)
+			portal.triggerSMSFallback(guid)
+		})
+	} else {
+		// The connector never reports delivery, so a missing delivered status doesn't mean anything.
+		// Only an explicit failed status triggers the fallback, and the pending entry is dropped after the timeout.
+		pending.timer = time.AfterFunc(timeout, func() {
+			portal.cancelSMSFallback(guid)
+		})
+	}
+}
+
+func (portal *Portal) popSMSFallback(guid string) *pendingSMSFallback {
+	portal.pendingSMSFallbackLock.Lock()
+	defer portal.pendingSMSFallbackLock.Unlock()
+	pending, ok := portal.pendingSMSFallbacks[guid]
+	if !ok {
+		return nil
+	}
+	delete(portal.pendingSMSFallbacks, guid)
+	if pending.timer != nil {
+		pending.timer.Stop()
+	}
+	return pending
+}
+
+func (portal *Portal) cancelSMSFallback(guid string) {
+	portal.popSMSFallback(guid)
+}
+
+// triggerSMSFallback re-sends the given message as SMS if it's waiting for a fallback.
+// It returns true if a fallback was triggered.
+func (portal *Portal) triggerSMSFallback(guid string) bool {
+	pending := portal.popSMSFallback(guid)
+	if pending == nil {
+		return false
+	}
+	portal.log.Infofln("Re-sending %s (%s) as SMS to %s", pending.evt.ID, guid, pending.target)
+	evtCopy := *pending.evt
+	contentCopy := *pending.content
+	evtCopy.Content.Parsed = &contentCopy
+	go func() {
+		portal.handleMatrixMessage(&evtCopy, pending.target)
+		if !portal.bridge.Config.Bridge.MessageStatusEvents {
+			// Without message status events, there's no other way to tell the user which service was used
+			_, err := portal.sendMainIntentMessage(&event.MessageEventContent{
+				MsgType:   event.MsgNotice,
+				Body:      "The message wasn't delivered via iMessage, so it was re-sent as SMS",
+				RelatesTo: (&event.RelatesTo{}).SetReplyTo(pending.evt.ID),
+			})
+			if err != nil {
+				portal.log.Warnfln("Failed to send SMS fallback notice for %s: %v", pending.evt.ID, err)
+			}
+		}
+	}()
+	return true
+}
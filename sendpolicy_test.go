@@ -0,0 +1,136 @@
+package main
+
+import (
+	"testing"
+
+	log "maunium.net/go/maulogger/v2"
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-imessage/imessage"
+)
+
+type fakeIMessageAPI struct {
+	imessage.API
+	caps imessage.ConnectorCapabilities
+}
+
+func (api *fakeIMessageAPI) Capabilities() imessage.ConnectorCapabilities {
+	return api.caps
+}
+
+func newTestSendPolicyPortal(guid, policy, defaultPolicy string) *Portal {
+	br := newTestBridge("US")
+	br.Config.Bridge.SendPolicy.Default = defaultPolicy
+	portal := newTestPortal(guid, "!room:example.com")
+	portal.Identifier = imessage.ParseIdentifier(guid)
+	portal.SendPolicy = policy
+	portal.bridge = br
+	portal.log = log.Sub("Portal")
+	portal.user = newTestUser(br, "@user:example.com", "", &br.Config.IMessage)
+	portal.user.IM = &fakeIMessageAPI{caps: imessage.ConnectorCapabilities{ContactChatMerging: true}}
+	return portal
+}
+
+func TestWithService(t *testing.T) {
+	tests := []struct {
+		guid     string
+		service  string
+		expected string
+	}{
+		{"iMessage;-;+12025550123", "SMS", "SMS;-;+12025550123"},
+		{"SMS;-;+12025550123", "iMessage", "iMessage;-;+12025550123"},
+		{"SMS;-;+12025550123", "SMS", "SMS;-;+12025550123"},
+		{"iMessage;-;user@example.com", "SMS", "iMessage;-;user@example.com"},
+		{"SMS;-;user@example.com", "iMessage", "iMessage;-;user@example.com"},
+		{"iMessage;+;chat123456", "SMS", "iMessage;+;chat123456"},
+	}
+	for _, test := range tests {
+		if output := withService(test.guid, test.service); output != test.expected {
+			t.Errorf("withService(%q, %q) returned %q, expected %q", test.guid, test.service, output, test.expected)
+		}
+	}
+}
+
+func TestPortal_GetMessageTargetGUID(t *testing.T) {
+	tests := []struct {
+		name          string
+		guid          string
+		policy        string
+		defaultPolicy string
+		expected      string
+	}{
+		{"auto", "SMS;-;+12025550123", "", SendPolicyAuto, "SMS;-;+12025550123"},
+		{"imessage", "SMS;-;+12025550123", SendPolicyIMessage, SendPolicyAuto, "iMessage;-;+12025550123"},
+		{"sms", "iMessage;-;+12025550123", SendPolicySMS, SendPolicyAuto, "SMS;-;+12025550123"},
+		{"sms fallback", "SMS;-;+12025550123", SendPolicySMSFallback, SendPolicyAuto, "iMessage;-;+12025550123"},
+		{"default policy", "iMessage;-;+12025550123", "", SendPolicySMS, "SMS;-;+12025550123"},
+		{"portal overrides default", "iMessage;-;+12025550123", SendPolicyAuto, SendPolicySMS, "iMessage;-;+12025550123"},
+		{"email can't use sms", "iMessage;-;user@example.com", SendPolicySMS, SendPolicyAuto, "iMessage;-;user@example.com"},
+		{"group", "iMessage;+;chat123456", SendPolicySMS, SendPolicyAuto, "iMessage;+;chat123456"},
+	}
+	for _, test := range tests {
+		portal := newTestSendPolicyPortal(test.guid, test.policy, test.defaultPolicy)
+		if output := portal.getMessageTargetGUID("$event"); output != test.expected {
+			t.Errorf("%s: expected message to be sent to %q, got %q", test.name, test.expected, output)
+		}
+	}
+}
+
+func TestPortal_TrackSMSFallback(t *testing.T) {
+	evt := &event.Event{ID: "$event"}
+	content := &event.MessageEventContent{MsgType: event.MsgText, Body: "hello"}
+	tests := []struct {
+		name     string
+		guid     string
+		policy   string
+		resp     *imessage.SendResponse
+		expected string
+	}{
+		{"fallback", "iMessage;-;+12025550123", SendPolicySMSFallback, &imessage.SendResponse{GUID: "msg", ChatGUID: "iMessage;-;+12025550123"}, "SMS;-;+12025550123"},
+		{"other policy", "iMessage;-;+12025550123", SendPolicyIMessage, &imessage.SendResponse{GUID: "msg", ChatGUID: "iMessage;-;+12025550123"}, ""},
+		{"no message guid", "iMessage;-;+12025550123", SendPolicySMSFallback, &imessage.SendResponse{ChatGUID: "iMessage;-;+12025550123"}, ""},
+		{"already sms", "SMS;-;+12025550123", SendPolicySMSFallback, &imessage.SendResponse{GUID: "msg", ChatGUID: "SMS;-;+12025550123"}, ""},
+		{"email", "iMessage;-;user@example.com", SendPolicySMSFallback, &imessage.SendResponse{GUID: "msg", ChatGUID: "iMessage;-;user@example.com"}, ""},
+		{"group", "iMessage;+;chat123456", SendPolicySMSFallback, &imessage.SendResponse{GUID: "msg", ChatGUID: "iMessage;+;chat123456"}, ""},
+	}
+	for _, test := range tests {
+		portal := newTestSendPolicyPortal(test.guid, test.policy, SendPolicyAuto)
+		portal.trackSMSFallback(evt, content, test.resp)
+		pending := portal.popSMSFallback("msg")
+		if test.expected == "" {
+			if pending != nil {
+				t.Errorf("%s: expected no fallback to be tracked, got one to %s", test.name, pending.target)
+			}
+			continue
+		} else if pending == nil {
+			t.Errorf("%s: expected fallback to be tracked", test.name)
+			continue
+		}
+		if pending.target != test.expected || pending.evt != evt || pending.content != content {
+			t.Errorf("%s: unexpected pending fallback %+v", test.name, pending)
+		}
+		if portal.popSMSFallback("msg") != nil {
+			t.Errorf("%s: expected fallback to only be returned once", test.name)
+		}
+	}
+}
+
+func TestPortal_CancelSMSFallback(t *testing.T) {
+	portal := newTestSendPolicyPortal("iMessage;-;+12025550123", SendPolicySMSFallback, SendPolicyAuto)
+	portal.bridge.Config.Bridge.SendPolicy.FallbackTimeout = 60
+	resp := &imessage.SendResponse{GUID: "msg", ChatGUID: "iMessage;-;+12025550123"}
+	portal.trackSMSFallback(&event.Event{ID: "$event"}, &event.MessageEventContent{}, resp)
+	portal.pendingSMSFallbackLock.Lock()
+	pending := portal.pendingSMSFallbacks["msg"]
+	portal.pendingSMSFallbackLock.Unlock()
+	if pending == nil || pending.timer == nil {
+		t.Fatal("Expected fallback with a timeout to be tracked")
+	}
+	portal.cancelSMSFallback("msg")
+	if pending.timer.Stop() {
+		t.Error("Expected fallback timer to be stopped when the fallback is cancelled")
+	}
+	if portal.triggerSMSFallback("msg") {
+		t.Error("Cancelled fallback shouldn't be triggered")
+	}
+}
@@ -0,0 +1,222 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	spaceKeyDirect    = "dm"
+	spaceKeyGroup     = "group"
+	spaceKeyIMessage  = "imessage"
+	spaceKeySMS       = "sms"
+	spaceKeyTagPrefix = "tag:"
+)
+
+func subSpaceName(key string) string {
+	switch key {
+	case spaceKeyDirect:
+		return "Direct chats"
+	case spaceKeyGroup:
+		return "Group chats"
+	case spaceKeyIMessage:
+		return "iMessage"
+	case spaceKeySMS:
+		return "SMS"
+	default:
+		return strings.TrimPrefix(key, spaceKeyTagPrefix)
+	}
+}
+
+// getSubSpace returns the room ID of the given sub-space of the personal filtering space,
+// creating the sub-space if it doesn't exist yet.
+func (user *User) getSubSpace(key string) id.RoomID {
+	return user.maybeGetSubSpace(key, true)
+}
+
+// getExistingSubSpace returns the room ID of the given sub-space, or an empty string if it hasn't been created.
+func (user *User) getExistingSubSpace(key string) id.RoomID {
+	return user.maybeGetSubSpace(key, false)
+}
+
+func (user *User) maybeGetSubSpace(key string, createIfNotExist bool) id.RoomID {
+	var parentID id.RoomID
+	if createIfNotExist {
+		parentID = user.GetSpaceRoom()
+		if len(parentID) == 0 {
+			return ""
+		}
+	}
+	user.subSpaceLock.Lock()
+	defer user.subSpaceLock.Unlock()
+	if user.subSpaces == nil {
+		user.subSpaces = user.bridge.DB.Space.GetUserSpaces(user.MXID)
+	}
+	if roomID, ok := user.subSpaces[key]; ok || !createIfNotExist {
+		return roomID
+	}
+
+	name := subSpaceName(key)
+	resp, err := user.bridge.Bot.CreateRoom(&mautrix.ReqCreateRoom{
+		Visibility: "private",
+		Name:       name,
+		InitialState: []*event.Event{{
+			Type:     event.StateSpaceParent,
+			StateKey: (*string)(&parentID),
+			Content: event.Content{
+				Parsed: &event.SpaceParentEventContent{
+					Via:       []string{user.bridge.Config.Homeserver.Domain},
+					Canonical: true,
+				},
+			},
+		}},
+		CreationContent: map[string]interface{}{
+			"type": event.RoomTypeSpace,
+		},
+		PowerLevelOverride: &event.PowerLevelsEventContent{
+			Users: map[id.UserID]int{
+				user.bridge.Bot.UserID: 9001,
+				user.MXID:              100,
+			},
+		},
+	})
+	if err != nil {
+		user.log.Errorfln("Failed to create %s sub-space: %v", key, err)
+		return ""
+	}
+	user.log.Debugfln("Created %s sub-space %s", key, resp.RoomID)
+	user.subSpaces[key] = resp.RoomID
+	user.bridge.DB.Space.SetUserSpace(user.MXID, key, resp.RoomID)
+	user.ensureInvited(user.bridge.Bot, resp.RoomID, false)
+	_, err = user.bridge.Bot.SendStateEvent(parentID, event.StateSpaceChild, resp.RoomID.String(), &event.SpaceChildEventContent{
+		Via: []string{user.bridge.Config.Homeserver.Domain},
+	})
+	if err != nil {
+		user.log.Warnfln("Failed to add %s sub-space to personal filtering space: %v", key, err)
+	}
+	return resp.RoomID
+}
+
+// desiredSubSpaces returns the keys of the sub-spaces the portal should be in.
+func (portal *Portal) desiredSubSpaces() []string {
+	var keys []string
+	conf := portal.bridge.Config.Bridge.SubSpaces
+	if conf.ChatType {
+		if portal.IsPrivateChat() {
+			keys = append(keys, spaceKeyDirect)
+		} else {
+			keys = append(keys, spaceKeyGroup)
+		}
+	}
+	if conf.Service {
+		if portal.Identifier.Service == "SMS" {
+			keys = append(keys, spaceKeySMS)
+		} else {
+			keys = append(keys, spaceKeyIMessage)
+		}
+	}
+	if len(portal.SpaceTag) > 0 {
+		keys = append(keys, spaceKeyTagPrefix+portal.SpaceTag)
+	}
+	return keys
+}
+
+func (portal *Portal) setSpaceChild(spaceID, roomID id.RoomID, add bool) error {
+	content := &event.SpaceChildEventContent{}
+	if add {
+		content.Via = []string{portal.bridge.Config.Homeserver.Domain}
+	}
+	_, err := portal.bridge.Bot.SendStateEvent(spaceID, event.StateSpaceChild, roomID.String(), content)
+	return err
+}
+
+// syncSubSpaces adds the portal to the sub-spaces it should be in and removes it from other sub-spaces.
+// Sub-space entries that point at an old room ID (e.g. after a merge or split) are replaced.
+func (portal *Portal) syncSubSpaces(user *User) {
+	if len(portal.MXID) == 0 {
+		return
+	}
+	current := portal.bridge.DB.Space.GetPortalSpaces(portal.GUID, portal.Receiver)
+	for _, key := range portal.desiredSubSpaces() {
+		oldRoomID, ok := current[key]
+		delete(current, key)
+		if ok && oldRoomID == portal.MXID {
+			continue
+		}
+		spaceID := user.getSubSpace(key)
+		if len(spaceID) == 0 {
+			continue
+		}
+		if ok {
+			if err := portal.setSpaceChild(spaceID, oldRoomID, false); err != nil {
+				portal.log.Warnfln("Failed to remove old room %s from %s sub-space: %v", oldRoomID, key, err)
+			}
+		}
+		if err := portal.setSpaceChild(spaceID, portal.MXID, true); err != nil {
+			portal.log.Errorfln("Failed to add room to %s sub-space (%s): %v", key, spaceID, err)
+		} else {
+			portal.log.Debugfln("Added room to %s sub-space (%s)", key, spaceID)
+			portal.bridge.DB.Space.AddPortalSpace(portal.GUID, portal.Receiver, key, portal.MXID)
+		}
+	}
+	for key, oldRoomID := range current {
+		portal.removeFromSubSpace(user, key, oldRoomID)
+	}
+}
+
+func (portal *Portal) removeFromSubSpace(user *User, key string, roomID id.RoomID) {
+	if spaceID := user.getExistingSubSpace(key); len(spaceID) > 0 {
+		if err := portal.setSpaceChild(spaceID, roomID, false); err != nil {
+			portal.log.Warnfln("Failed to remove room from %s sub-space: %v", key, err)
+		} else {
+			portal.log.Debugfln("Removed room from %s sub-space (%s)", key, spaceID)
+		}
+	}
+	portal.bridge.DB.Space.RemovePortalSpace(portal.GUID, portal.Receiver, key)
+}
+
+// removeFromSpaces removes the portal room from the personal filtering space and all sub-spaces.
+// It's used when the portal is deleted or merged into another portal.
+func (portal *Portal) removeFromSpaces() {
+	user := portal.user
+	for key, roomID := range portal.bridge.DB.Space.GetPortalSpaces(portal.GUID, portal.Receiver) {
+		portal.removeFromSubSpace(user, key, roomID)
+	}
+	if portal.InSpace && len(portal.MXID) > 0 && len(user.SpaceRoom) > 0 {
+		if err := portal.setSpaceChild(user.SpaceRoom, portal.MXID, false); err != nil {
+			portal.log.Warnfln("Failed to remove room from personal filtering space: %v", err)
+		}
+		portal.InSpace = false
+	}
+}
+
+// MoveToSpace changes the custom sub-space of the portal. An empty tag removes the portal from its custom sub-space.
+func (portal *Portal) MoveToSpace(tag string) error {
+	if len(portal.user.GetSpaceRoom()) == 0 {
+		return fmt.Errorf("personal filtering spaces are not enabled")
+	}
+	portal.SpaceTag = tag
+	portal.Update(nil)
+	portal.syncSubSpaces(portal.user)
+	return nil
+}
@@ -0,0 +1,206 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mau.fi/mautrix-imessage/database"
+	"go.mau.fi/mautrix-imessage/imessage"
+)
+
+// startupSyncCheckpointMaxAge is how long an interrupted startup sync can be resumed.
+// Older checkpoints are discarded and the sync starts over.
+const startupSyncCheckpointMaxAge = 24 * time.Hour
+
+const startupSyncProgressInterval = 5 * time.Second
+
+type startupSyncCheckpoint struct {
+	StartedAt int64    `json:"started_at"`
+	Synced    []string `json:"synced"`
+}
+
+type startupSyncTask struct {
+	portal       *Portal
+	lastActivity int64
+	existing     bool
+}
+
+type startupSync struct {
+	user *User
+
+	lock         sync.Mutex
+	checkpoint   startupSyncCheckpoint
+	synced       map[string]bool
+	total        int
+	done         int
+	lastSaved    int
+	lastProgress time.Time
+}
+
+func (user *User) checkpointKey() string {
+	return fmt.Sprintf("%s:%s", database.KVStartupSyncCheckpoint, user.Receiver)
+}
+
+func (user *User) newStartupSync() *startupSync {
+	ss := &startupSync{user: user, synced: make(map[string]bool)}
+	raw := user.bridge.DB.KV.Get(user.checkpointKey())
+	if len(raw) > 0 {
+		err := json.Unmarshal([]byte(raw), &ss.checkpoint)
+		if err != nil {
+			user.log.Warnfln("Failed to parse startup sync checkpoint: %v", err)
+		} else if time.Since(time.UnixMilli(ss.checkpoint.StartedAt)) > startupSyncCheckpointMaxAge {
+			user.log.Debugfln("Discarding startup sync checkpoint from %s", time.UnixMilli(ss.checkpoint.StartedAt))
+		} else {
+			for _, guid := range ss.checkpoint.Synced {
+				ss.synced[guid] = true
+			}
+			user.log.Infofln("Resuming startup sync from checkpoint with %d chats already synced", len(ss.synced))
+			return ss
+		}
+	}
+	ss.checkpoint = startupSyncCheckpoint{StartedAt: time.Now().UnixMilli()}
+	return ss
+}
+
+func (ss *startupSync) saveCheckpoint() {
+	data, err := json.Marshal(&ss.checkpoint)
+	if err != nil {
+		ss.user.log.Warnfln("Failed to marshal startup sync checkpoint: %v", err)
+		return
+	}
+	ss.user.bridge.DB.KV.Set(ss.user.checkpointKey(), string(data))
+	ss.lastSaved = ss.done
+}
+
+func (ss *startupSync) isSynced(guid string) bool {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	return ss.synced[guid]
+}
+
+func (ss *startupSync) markSynced(guid string) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	if !ss.synced[guid] {
+		ss.synced[guid] = true
+		ss.checkpoint.Synced = append(ss.checkpoint.Synced, guid)
+	}
+	ss.done++
+	if ss.done-ss.lastSaved >= 10 {
+		ss.saveCheckpoint()
+	}
+	if time.Since(ss.lastProgress) >= startupSyncProgressInterval {
+		ss.sendProgress()
+	}
+}
+
+func (ss *startupSync) sendProgress() {
+	ss.lastProgress = time.Now()
+	ss.user.log.Debugfln("Startup sync progress: %d/%d chats", ss.done, ss.total)
+	ss.user.sendSyncProgress(ss.done, ss.total)
+}
+
+func (ss *startupSync) finish() {
+	ss.user.bridge.DB.KV.Delete(ss.user.checkpointKey())
+	ss.user.sendSyncProgress(ss.total, ss.total)
+}
+
+// sendSyncProgress adds the startup sync progress to the info of the latest bridge status and resends it.
+// The progress is removed once done reaches total.
+func (user *User) sendSyncProgress(done, total int) {
+	state := imessage.BridgeStatus{
+		StateEvent: BridgeStatusConnected,
+		RemoteID:   "unknown",
+	}
+	if user.latestState != nil {
+		state = *user.latestState
+	}
+	info := make(map[string]interface{}, len(state.Info)+1)
+	for key, value := range state.Info {
+		info[key] = value
+	}
+	if done < total {
+		info["startup_sync"] = map[string]int{
+			"synced": done,
+			"total":  total,
+		}
+	} else if _, ok := info["startup_sync"]; ok {
+		delete(info, "startup_sync")
+	} else {
+		// Nothing to clear
+		return
+	}
+	state.Info = info
+	state.Timestamp = 0
+	user.SendBridgeStatus(state)
+}
+
+func (ss *startupSync) run(tasks []*startupSyncTask, forceUpdateBridgeInfo bool) {
+	sort.SliceStable(tasks, func(i, j int) bool {
+		return tasks[i].lastActivity > tasks[j].lastActivity
+	})
+	ss.lock.Lock()
+	ss.total = len(tasks)
+	ss.sendProgress()
+	ss.lock.Unlock()
+
+	concurrency := ss.user.bridge.Config.Bridge.StartupSyncConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	queue := make(chan *startupSyncTask)
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for task := range queue {
+				ss.syncPortal(task, forceUpdateBridgeInfo)
+			}
+		}()
+	}
+	for _, task := range tasks {
+		queue <- task
+	}
+	close(queue)
+	wg.Wait()
+	ss.finish()
+}
+
+func (ss *startupSync) syncPortal(task *startupSyncTask, forceUpdateBridgeInfo bool) {
+	portal := task.portal
+	if ss.isSynced(portal.GUID) && len(portal.MXID) > 0 {
+		// Messages may have arrived while the bridge was down, so only the info sync is skipped
+		portal.log.Debugln("Only backfilling portal in startup sync: info already synced before restart")
+		portal.syncBackfill()
+	} else if task.existing {
+		portal.log.Infoln("Syncing portal (startup sync, existing portal)")
+		portal.Sync(true)
+		if forceUpdateBridgeInfo {
+			portal.UpdateBridgeInfo()
+		}
+	} else {
+		portal.log.Infoln("Syncing portal (startup sync, new portal)")
+		portal.Sync(true)
+	}
+	ss.markSynced(portal.GUID)
+}
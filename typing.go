@@ -0,0 +1,176 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-imessage/imessage"
+)
+
+const (
+	// remoteTypingTimeout is how long a ghost is shown as typing without a new typing notification from iMessage.
+	remoteTypingTimeout = 60 * time.Second
+	// matrixTypingTimeout is how long the user is shown as typing on iMessage without a new typing event from Matrix.
+	matrixTypingTimeout = 60 * time.Second
+	// typingStopDebounce is how long stopping typing is delayed, so that rapid toggles don't cause flickering.
+	typingStopDebounce = 2 * time.Second
+)
+
+// typingState tracks whether someone is typing and sends debounced updates that expire automatically
+// if the stop notification is lost.
+type typingState struct {
+	lock       sync.Mutex
+	send       func(typing bool, timeout time.Duration)
+	onStop     func()
+	timeout    time.Duration
+	debounce   time.Duration
+	typing     bool
+	lastSent   time.Time
+	generation int
+	stopTimer  *time.Timer
+	expiry     *time.Timer
+}
+
+// newTypingState creates a typing state. onStop is optional and is called after a stop was sent.
+func newTypingState(timeout time.Duration, send func(typing bool, timeout time.Duration), onStop func()) *typingState {
+	return &typingState{timeout: timeout, debounce: typingStopDebounce, send: send, onStop: onStop}
+}
+
+func (ts *typingState) Set(typing bool) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	if typing {
+		ts.cancelTimersLocked()
+		generation := ts.generation
+		ts.expiry = time.AfterFunc(ts.timeout, func() { ts.stop(generation) })
+		// Already typing: only refresh if the previous notification is about to expire on the other side
+		if !ts.typing || time.Since(ts.lastSent) > ts.timeout/2 {
+			ts.typing = true
+			ts.lastSent = time.Now()
+			ts.send(true, ts.timeout)
+		}
+	} else if ts.typing && ts.stopTimer == nil {
+		generation := ts.generation
+		ts.stopTimer = time.AfterFunc(ts.debounce, func() { ts.stop(generation) })
+	}
+}
+
+// Reset marks the state as not typing without sending anything, e.g. after a message already cleared it.
+func (ts *typingState) Reset() {
+	ts.lock.Lock()
+	ts.cancelTimersLocked()
+	ts.typing = false
+	ts.lock.Unlock()
+}
+
+func (ts *typingState) stop(generation int) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	if generation != ts.generation || !ts.typing {
+		return
+	}
+	ts.cancelTimersLocked()
+	ts.typing = false
+	ts.send(false, 0)
+	if ts.onStop != nil {
+		ts.onStop()
+	}
+}
+
+func (ts *typingState) cancelTimersLocked() {
+	ts.generation++
+	if ts.stopTimer != nil {
+		ts.stopTimer.Stop()
+		ts.stopTimer = nil
+	}
+	if ts.expiry != nil {
+		ts.expiry.Stop()
+		ts.expiry = nil
+	}
+}
+
+func (portal *Portal) getRemoteTypingState(intent *appservice.IntentAPI) *typingState {
+	portal.remoteTypingLock.Lock()
+	defer portal.remoteTypingLock.Unlock()
+	state, ok := portal.remoteTyping[intent.UserID]
+	if !ok {
+		state = newTypingState(remoteTypingTimeout, func(typing bool, timeout time.Duration) {
+			_, err := intent.UserTyping(portal.MXID, typing, timeout)
+			if err != nil {
+				action := "typing"
+				if !typing {
+					action = "not typing"
+				}
+				portal.log.Warnfln("Failed to mark %s as %s in %s: %v", intent.UserID, action, portal.MXID, err)
+			}
+		}, func() {
+			portal.removeRemoteTyping(intent.UserID, state)
+		})
+		portal.remoteTyping[intent.UserID] = state
+	}
+	return state
+}
+
+// removeRemoteTyping evicts the typing state of a ghost that stopped typing, unless it was already replaced.
+func (portal *Portal) removeRemoteTyping(userID id.UserID, state *typingState) {
+	portal.remoteTypingLock.Lock()
+	if portal.remoteTyping[userID] == state {
+		delete(portal.remoteTyping, userID)
+	}
+	portal.remoteTypingLock.Unlock()
+}
+
+// clearRemoteTyping forgets the typing state of a ghost whose typing notification was cleared by sending a message.
+func (portal *Portal) clearRemoteTyping(userID id.UserID) {
+	portal.remoteTypingLock.Lock()
+	state, ok := portal.remoteTyping[userID]
+	delete(portal.remoteTyping, userID)
+	portal.remoteTypingLock.Unlock()
+	if ok {
+		state.Reset()
+	}
+}
+
+func (portal *Portal) getTypingIntent(notif *imessage.TypingNotification) *appservice.IntentAPI {
+	if len(notif.Sender) > 0 && !portal.IsPrivateChat() {
+		return portal.user.GetPuppetByLocalID(notif.Sender).Intent
+	}
+	return portal.MainIntent()
+}
+
+func (portal *Portal) HandleiMessageTyping(notif *imessage.TypingNotification) {
+	portal.getRemoteTypingState(portal.getTypingIntent(notif)).Set(notif.Typing)
+}
+
+func (portal *Portal) sendMatrixTyping(typing bool, _ time.Duration) {
+	if !typing {
+		portal.log.Debugfln("Sending typing stop notification")
+	} else {
+		portal.log.Debugfln("Sending typing start notification")
+	}
+	err := portal.user.IM.SendTypingNotification(portal.getTargetGUID("typing notification", "", ""), typing)
+	if err != nil {
+		portal.log.Warnfln("Failed to bridge typing status change: %v", err)
+	} else {
+		portal.log.Debugfln("Typing update sent")
+	}
+}
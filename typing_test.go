@@ -0,0 +1,125 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+const testTypingTimeout = 200 * time.Millisecond
+
+type typingRecorder struct {
+	lock    sync.Mutex
+	sent    []bool
+	stopped int
+}
+
+func (tr *typingRecorder) send(typing bool, _ time.Duration) {
+	tr.lock.Lock()
+	tr.sent = append(tr.sent, typing)
+	tr.lock.Unlock()
+}
+
+func (tr *typingRecorder) onStop() {
+	tr.lock.Lock()
+	tr.stopped++
+	tr.lock.Unlock()
+}
+
+func (tr *typingRecorder) check(t *testing.T, step string, expectedSent []bool, expectedStopped int) {
+	t.Helper()
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	if len(tr.sent) != len(expectedSent) {
+		t.Fatalf("%s: expected %v to be sent, got %v", step, expectedSent, tr.sent)
+	}
+	for i := range expectedSent {
+		if tr.sent[i] != expectedSent[i] {
+			t.Fatalf("%s: expected %v to be sent, got %v", step, expectedSent, tr.sent)
+		}
+	}
+	if tr.stopped != expectedStopped {
+		t.Fatalf("%s: expected %d stop callbacks, got %d", step, expectedStopped, tr.stopped)
+	}
+}
+
+func newTestTypingState() (*typingState, *typingRecorder) {
+	tr := &typingRecorder{}
+	ts := newTypingState(testTypingTimeout, tr.send, tr.onStop)
+	ts.debounce = 20 * time.Millisecond
+	return ts, tr
+}
+
+func TestTypingState_Debounce(t *testing.T) {
+	ts, tr := newTestTypingState()
+	ts.Set(true)
+	ts.Set(true)
+	tr.check(t, "start", []bool{true}, 0)
+
+	ts.Set(false)
+	tr.check(t, "stop before debounce", []bool{true}, 0)
+	ts.Set(true)
+	time.Sleep(2 * ts.debounce)
+	tr.check(t, "restart within debounce", []bool{true}, 0)
+
+	ts.Set(false)
+	ts.Set(false)
+	time.Sleep(2 * ts.debounce)
+	tr.check(t, "stop after debounce", []bool{true, false}, 1)
+
+	ts.Set(false)
+	time.Sleep(2 * ts.debounce)
+	tr.check(t, "stop when not typing", []bool{true, false}, 1)
+}
+
+func TestTypingState_Expiry(t *testing.T) {
+	ts, tr := newTestTypingState()
+	ts.Set(true)
+	time.Sleep(testTypingTimeout * 3 / 5)
+	tr.check(t, "before expiry", []bool{true}, 0)
+	// The other side is about to forget the previous notification, so it's sent again
+	ts.Set(true)
+	time.Sleep(testTypingTimeout * 3 / 5)
+	tr.check(t, "refreshed before expiry", []bool{true, true}, 0)
+	time.Sleep(testTypingTimeout)
+	tr.check(t, "expired", []bool{true, true, false}, 1)
+}
+
+func TestTypingState_Reset(t *testing.T) {
+	ts, tr := newTestTypingState()
+	ts.Set(true)
+	ts.Set(false)
+	ts.Reset()
+	time.Sleep(testTypingTimeout + ts.debounce)
+	tr.check(t, "reset", []bool{true}, 0)
+
+	ts.Set(true)
+	tr.check(t, "start after reset", []bool{true, true}, 0)
+	ts.Reset()
+}
+
+func TestPortal_RemoveRemoteTyping(t *testing.T) {
+	const userID id.UserID = "@imessage_user:example.com"
+	portal := newTestPortal("iMessage;-;+12025550123", "!room:example.com")
+	portal.remoteTyping = make(map[id.UserID]*typingState)
+	state := newTypingState(testTypingTimeout, func(bool, time.Duration) {}, nil)
+	replacement := newTypingState(testTypingTimeout, func(bool, time.Duration) {}, nil)
+
+	portal.remoteTyping[userID] = replacement
+	portal.removeRemoteTyping(userID, state)
+	if portal.remoteTyping[userID] != replacement {
+		t.Error("Replaced typing state shouldn't be evicted by the old state")
+	}
+	portal.removeRemoteTyping(userID, replacement)
+	if _, ok := portal.remoteTyping[userID]; ok {
+		t.Error("Expected stopped typing state to be evicted")
+	}
+
+	portal.remoteTyping[userID] = state
+	portal.clearRemoteTyping(userID)
+	if _, ok := portal.remoteTyping[userID]; ok {
+		t.Error("Expected cleared typing state to be evicted")
+	}
+}
@@ -20,8 +20,10 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"os"
 	"strings"
 	"sync"
+	"time"
 
 	log "maunium.net/go/maulogger/v2"
 
@@ -33,7 +35,10 @@ import (
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 
+	"go.mau.fi/mautrix-imessage/contacts"
 	"go.mau.fi/mautrix-imessage/database"
+	"go.mau.fi/mautrix-imessage/imessage"
+	"go.mau.fi/mautrix-imessage/ipc"
 )
 
 type User struct {
@@ -42,18 +47,38 @@ type User struct {
 	bridge *IMBridge
 	log    log.Logger
 
+	// Receiver is used to separate the portals and ghosts of different users.
+	// It's empty for the primary user and the configured ID for extra users.
+	Receiver        string
+	connectorConfig *imessage.PlatformConfig
+	IM              imessage.API
+	IMHandler       *iMessageHandler
+	Contacts        *contacts.Provider
+	connectLock     sync.Mutex
+	connected       bool
+	latestState     *imessage.BridgeStatus
+
 	DoublePuppetIntent *appservice.IntentAPI
 
 	mgmtCreateLock sync.Mutex
 
 	spaceMembershipChecked bool
+	subSpaces              map[string]id.RoomID
+	subSpaceLock           sync.Mutex
+
+	backfillQueueOnce sync.Once
+	backfillQueueWake chan struct{}
 }
 
 var _ bridge.User = (*User)(nil)
 
+// GetPermissionLevel returns the permission level of the user. Only the main bridge user is an admin,
+// extra users can only manage their own connector and portals.
 func (user *User) GetPermissionLevel() bridgeconfig.PermissionLevel {
 	if user == user.bridge.user {
 		return bridgeconfig.PermissionLevelAdmin
+	} else if user.connectorConfig != nil {
+		return bridgeconfig.PermissionLevelUser
 	} else if user.bridge.Config.Bridge.Relay.IsWhitelisted(user.MXID) {
 		return bridgeconfig.PermissionLevelRelay
 	}
@@ -61,7 +86,7 @@ func (user *User) GetPermissionLevel() bridgeconfig.PermissionLevel {
 }
 
 func (user *User) IsLoggedIn() bool {
-	return user == user.bridge.user
+	return user.connectorConfig != nil && !user.LoggedOut
 }
 
 func (user *User) GetManagementRoomID() id.RoomID {
@@ -82,7 +107,7 @@ func (user *User) GetCommandState() map[string]interface{} {
 }
 
 func (user *User) GetIDoublePuppet() bridge.DoublePuppet {
-	if user == user.bridge.user {
+	if user.connectorConfig != nil {
 		return user
 	}
 	return nil
@@ -92,14 +117,188 @@ func (user *User) GetIGhost() bridge.Ghost {
 	return nil
 }
 
-func (br *IMBridge) loadDBUser() *User {
-	dbUser := br.DB.User.GetByMXID(br.Config.Bridge.User)
+var _ imessage.Bridge = (*User)(nil)
+
+func (user *User) GetIPC() *ipc.Processor {
+	return user.bridge.IPC
+}
+
+func (user *User) GetLog() log.Logger {
+	return user.log
+}
+
+func (user *User) GetConnectorConfig() *imessage.PlatformConfig {
+	return user.connectorConfig
+}
+
+func (user *User) PingServer() (start, serverTs, end time.Time) {
+	return user.bridge.PingServer()
+}
+
+func (user *User) SetPushKey(req *imessage.PushKeyRequest) {
+	user.bridge.SetPushKey(req)
+}
+
+func (user *User) SendBridgeStatus(state imessage.BridgeStatus) {
+	state.UserID = user.MXID
+	if user.IM != nil && user.IM.Capabilities().BridgeState {
+		user.latestState = &state
+	}
+	user.bridge.SendBridgeStatus(state)
+}
+
+// isOwnHandle checks whether the given local ID is the handle the user is logged in with,
+// as reported in the remote_id field of the connector's bridge status.
+func (user *User) isOwnHandle(localID string) bool {
+	state := user.latestState
+	if state == nil || len(state.RemoteID) == 0 || len(localID) == 0 {
+		return false
+	}
+	br := user.bridge
+	return br.NormalizeLocalID(state.RemoteID) == br.NormalizeLocalID(localID)
+}
+
+func (user *User) resendBridgeStatus() {
+	if !user.IsLoggedIn() || user.IM == nil {
+		return
+	} else if user.latestState != nil {
+		go user.bridge.SendBridgeStatus(*user.latestState)
+	} else if !user.IM.Capabilities().BridgeState {
+		go user.bridge.SendBridgeStatus(imessage.BridgeStatus{
+			StateEvent: BridgeStatusConnected,
+			RemoteID:   "unknown",
+			UserID:     user.MXID,
+		})
+	}
+}
+
+func (user *User) initConnector() error {
+	var err error
+	user.IM, err = imessage.NewAPI(user)
+	if err != nil {
+		return err
+	}
+	user.IMHandler = NewiMessageHandler(user)
+	user.Contacts = &contacts.Provider{Connector: user.IM, Store: user.bridge.ContactStore}
+	return nil
+}
+
+// syncContactSources updates the ghosts that have contact info in the external contact sources,
+// then merges chats using the combined contact list.
+func (user *User) syncContactSources() {
+	for _, puppet := range user.GetAllPuppets() {
+		if puppet == nil || user.bridge.ContactStore.Get(puppet.ID) == nil {
+			continue
+		}
+		contact, err := user.Contacts.GetContactInfo(puppet.ID)
+		if err != nil {
+			puppet.log.Warnln("Failed to get contact info:", err)
+			continue
+		}
+		puppet.SyncWithContact(contact)
+	}
+	if user.IM.Capabilities().ContactChatMerging {
+		contactList, err := user.Contacts.GetContactList()
+		if err != nil {
+			user.log.Warnln("Failed to get contact list for merging chats:", err)
+		} else {
+			user.UpdateMerges(contactList, false)
+		}
+	}
+}
+
+// Connect starts the iMessage connector of the user. Depending on the connector,
+// this may block until the connection is closed. The ready callback is called
+// once the connector is ready to be used.
+func (user *User) Connect(readyCallback func()) error {
+	user.connectLock.Lock()
+	if user.connected {
+		user.connectLock.Unlock()
+		return errors.New("already connected")
+	}
+	user.connected = true
+	user.connectLock.Unlock()
+	go user.IMHandler.Start()
+	err := user.IM.Start(readyCallback)
+	if err != nil {
+		user.connectLock.Lock()
+		user.connected = false
+		user.connectLock.Unlock()
+		user.IMHandler.Stop()
+	}
+	return err
+}
+
+// connectOnStartup connects the user's connector and calls the ready callback once it's ready or has failed.
+// Only a failure of the main user's connector stops the bridge, extra users just get an error bridge state.
+func (user *User) connectOnStartup(readyCallback func()) {
+	var readyOnce sync.Once
+	ready := func() {
+		readyOnce.Do(readyCallback)
+	}
+	err := user.Connect(ready)
+	if err == nil {
+		return
+	} else if user == user.bridge.user {
+		user.log.Fatalln("Error in iMessage connection:", err)
+		os.Exit(40)
+	}
+	user.log.Errorln("Error in iMessage connection:", err)
+	user.SendBridgeStatus(imessage.BridgeStatus{
+		StateEvent: BridgeStatusUnknownError,
+		Error:      "im-connection-failed",
+		Message:    err.Error(),
+	})
+	ready()
+}
+
+func (user *User) Disconnect() {
+	user.connectLock.Lock()
+	defer user.connectLock.Unlock()
+	if !user.connected {
+		return
+	}
+	user.connected = false
+	user.IM.Stop()
+	user.IMHandler.Stop()
+}
+
+func (user *User) IsConnected() bool {
+	user.connectLock.Lock()
+	defer user.connectLock.Unlock()
+	return user.connected
+}
+
+func (br *IMBridge) loadUsers() {
+	br.user = br.loadDBUser(br.Config.Bridge.User, "", &br.Config.IMessage)
+	for i := range br.Config.Bridge.ExtraUsers {
+		extraUser := &br.Config.Bridge.ExtraUsers[i]
+		br.loadDBUser(extraUser.User, extraUser.ID, &extraUser.IMessage)
+	}
+}
+
+// getUserByReceiver finds the user for the receiver ID in an IPC or websocket request.
+// An empty receiver refers to the primary user.
+func (br *IMBridge) getUserByReceiver(receiver string) (*User, error) {
+	user, ok := br.usersByReceiver[receiver]
+	if !ok {
+		return nil, fmt.Errorf("unknown receiver %q", receiver)
+	}
+	return user, nil
+}
+
+func (br *IMBridge) loadDBUser(userID id.UserID, receiver string, connectorConfig *imessage.PlatformConfig) *User {
+	dbUser := br.DB.User.GetByMXID(userID)
 	if dbUser == nil {
 		dbUser = br.DB.User.New()
-		dbUser.MXID = br.Config.Bridge.User
+		dbUser.MXID = userID
 		dbUser.Insert()
 	}
 	user := br.NewUser(dbUser)
+	user.Receiver = receiver
+	user.connectorConfig = connectorConfig
+	br.users[user.MXID] = user
+	br.usersByReceiver[user.Receiver] = user
 	return user
 }
 
@@ -108,6 +307,8 @@ func (br *IMBridge) NewUser(dbUser *database.User) *User {
 		User:   dbUser,
 		bridge: br,
 		log:    br.Log.Sub("User").Sub(string(dbUser.MXID)),
+
+		backfillQueueWake: make(chan struct{}, 1),
 	}
 
 	return user
@@ -115,11 +316,11 @@ func (br *IMBridge) NewUser(dbUser *database.User) *User {
 
 func (user *User) getDirectChats() map[id.UserID][]id.RoomID {
 	res := make(map[id.UserID][]id.RoomID)
-	privateChats := user.bridge.DB.Portal.FindPrivateChats()
+	privateChats := user.bridge.DB.Portal.FindPrivateChats(user.Receiver)
 	for _, portal := range privateChats {
 		if len(portal.MXID) > 0 {
 			// TODO Make FormatPuppetMXID work with chat GUIDs or add a field with the sender ID to portals
-			res[user.bridge.FormatPuppetMXID(portal.GUID)] = []id.RoomID{portal.MXID}
+			res[user.bridge.FormatPuppetMXID(portal.GUID, user.Receiver)] = []id.RoomID{portal.MXID}
 		}
 	}
 	return res
@@ -152,7 +353,7 @@ func (user *User) UpdateDirectChats(chats map[id.UserID][]id.RoomID) {
 			return
 		}
 		for userID, rooms := range existingChats {
-			if _, ok := user.bridge.ParsePuppetMXID(userID); !ok {
+			if _, _, ok := user.bridge.ParsePuppetMXID(userID); !ok {
 				// This is not a ghost user, include it in the new list
 				chats[userID] = rooms
 			} else if _, ok := chats[userID]; !ok && method == http.MethodPatch {
@@ -203,7 +404,7 @@ func (user *User) GetSpaceRoom() id.RoomID {
 
 	if len(user.SpaceRoom) == 0 {
 		name := "iMessage"
-		if user.bridge.Config.IMessage.Platform == "android" {
+		if user.GetConnectorConfig().Platform == "android" {
 			name = "Android SMS"
 		}
 		resp, err := user.bridge.Bot.CreateRoom(&mautrix.ReqCreateRoom{
@@ -243,3 +444,83 @@ func (user *User) GetSpaceRoom() id.RoomID {
 
 	return user.SpaceRoom
 }
+
+func (user *User) StartupSync() {
+	// Queued backfills are started after the startup sync so they don't compete with it
+	defer user.startBackfillQueue()
+	user.normalizeExistingIdentifiers()
+
+	resp, err := user.IM.PreStartupSyncHook()
+	if err != nil {
+		user.log.Errorln("iMessage connector returned error in startup sync hook:", err)
+	} else if resp.SkipSync {
+		user.log.Debugln("Skipping startup sync")
+		return
+	}
+
+	forceUpdateBridgeInfo := user.bridge.sendStatusUpdateInfo ||
+		user.bridge.DB.KV.Get(database.KVBridgeInfoVersion) != database.ExpectedBridgeInfoVersion
+	var tasks []*startupSyncTask
+	tasksByGUID := make(map[string]*startupSyncTask)
+	for _, portal := range user.GetAllPortals() {
+		removed := portal.CleanupIfEmpty(true)
+		if !removed && len(portal.MXID) > 0 {
+			if user.bridge.Config.Bridge.DisableSMSPortals && portal.Identifier.Service == "SMS" && !portal.Identifier.IsGroup {
+				imIdentifier := portal.Identifier
+				imIdentifier.Service = "iMessage"
+				if !portal.reIDInto(imIdentifier.String(), true, true) {
+					// Portal was dropped/merged, don't sync it
+					continue
+				} // else: portal was re-id'd, sync it as usual
+			} else if !user.bridge.Config.Bridge.DisableSMSPortals && portal.Identifier.Service == "iMessage" && !portal.Identifier.IsGroup && portal.LastSeenHandle != "" {
+				lastSeenHandle := imessage.ParseIdentifier(portal.LastSeenHandle)
+				if lastSeenHandle.Service == "SMS" && lastSeenHandle.LocalID == portal.Identifier.LocalID {
+					if !portal.reIDInto(portal.LastSeenHandle, true, true) {
+						continue
+					}
+				}
+			}
+			task := &startupSyncTask{portal: portal, existing: true}
+			if lastMessage := user.bridge.DB.Message.GetLastInChat(portal.GUID, portal.Receiver); lastMessage != nil {
+				task.lastActivity = lastMessage.Timestamp
+			}
+			tasks = append(tasks, task)
+			tasksByGUID[portal.GUID] = task
+		}
+	}
+	syncChatMaxAge := time.Duration(user.bridge.Config.Bridge.Backfill.InitialSyncMaxAge*24*60) * time.Minute
+	chats, err := user.IM.GetChatsWithMessagesAfter(time.Now().Add(-syncChatMaxAge))
+	if err != nil {
+		user.log.Errorln("Failed to get chat list to backfill:", err)
+		chats = nil
+	}
+	for _, chat := range chats {
+		guid := user.bridge.NormalizeGUID(chat.ChatGUID)
+		if task, isSynced := tasksByGUID[guid]; isSynced {
+			if chat.LastMessageTime > task.lastActivity {
+				task.lastActivity = chat.LastMessageTime
+			}
+			continue
+		}
+		portal := user.GetPortalByGUID(chat.ChatGUID)
+		if portal.ThreadID == "" {
+			portal.ThreadID = chat.ThreadID
+		}
+		task := &startupSyncTask{portal: portal, lastActivity: chat.LastMessageTime}
+		if task.lastActivity == 0 {
+			// The chat has recent messages that haven't been bridged, so it should be synced before older chats
+			task.lastActivity = time.Now().UnixMilli()
+		}
+		tasks = append(tasks, task)
+		tasksByGUID[guid] = task
+	}
+	user.newStartupSync().run(tasks, forceUpdateBridgeInfo)
+	if forceUpdateBridgeInfo {
+		user.bridge.DB.KV.Set(database.KVBridgeInfoVersion, database.ExpectedBridgeInfoVersion)
+	}
+	if err != nil {
+		return
+	}
+	user.log.Infoln("Startup sync complete")
+	user.IM.PostStartupSyncHook()
+}
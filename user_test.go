@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-imessage/database"
+	"go.mau.fi/mautrix-imessage/imessage"
+)
+
+func newTestUser(br *IMBridge, userID id.UserID, receiver string, connectorConfig *imessage.PlatformConfig) *User {
+	return &User{
+		User:            &database.User{MXID: userID},
+		bridge:          br,
+		Receiver:        receiver,
+		connectorConfig: connectorConfig,
+	}
+}
+
+func TestUser_GetPermissionLevel(t *testing.T) {
+	br := newTestBridge("")
+	br.user = newTestUser(br, "@main:example.com", "", &br.Config.IMessage)
+	extra := newTestUser(br, "@extra:example.com", "extra", &imessage.PlatformConfig{Platform: "mac-nosip"})
+	stranger := newTestUser(br, "@stranger:example.com", "", nil)
+
+	tests := []struct {
+		name     string
+		user     *User
+		expected bridgeconfig.PermissionLevel
+	}{
+		{"main user", br.user, bridgeconfig.PermissionLevelAdmin},
+		{"extra user", extra, bridgeconfig.PermissionLevelUser},
+		{"user without connector", stranger, bridgeconfig.PermissionLevelBlock},
+	}
+	for _, test := range tests {
+		if level := test.user.GetPermissionLevel(); level != test.expected {
+			t.Errorf("%s: expected permission level %d, got %d", test.name, test.expected, level)
+		}
+	}
+}